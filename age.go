@@ -38,12 +38,18 @@
 package age
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/hmac"
 	"crypto/rand"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"sort"
+	"time"
 
+	"filippo.io/age/armor"
 	"filippo.io/age/internal/format"
 	"filippo.io/age/internal/stream"
 )
@@ -65,10 +71,43 @@ type Identity interface {
 
 var ErrIncorrectIdentity = errors.New("incorrect identity for recipient block")
 
+// HardwareBackedIdentity can be optionally implemented by an Identity whose
+// secret keys are held by hardware, like a security key or a smart card, and
+// never exist in software, in which case HardwareBacked must return true. See
+// Decryptor.RequireHardwareBacked.
+//
+// Software keys like X25519Identity and ScryptIdentity don't implement it, and
+// neither does tpm.Identity, which unseals its keys into memory.
+type HardwareBackedIdentity interface {
+	Identity
+	HardwareBacked() bool
+}
+
+// AuditableIdentity can be optionally implemented by an Identity that needs to
+// record its use, for example in an audit log. When the Identity unwraps the
+// file key, Decrypt calls Audit with the header information of the file,
+// after the header was checked and before any plaintext is returned. If Audit
+// returns an error, Decrypt fails, so that decryptions can't go unrecorded.
+// The other functions that recover the file key, like DecryptReaderAt and
+// AddRecipient, call Audit in the same way.
+//
+// None of the identities in this module implement it.
+type AuditableIdentity interface {
+	Identity
+	Audit(info *HeaderInfo) error
+}
+
 // A Recipient is passed to Encrypt to wrap an opaque file key to one or more
 // recipient stanza(s). It can be for example a public key like X25519Recipient,
 // a plugin, or a custom implementation.
 //
+// Each Recipient produces its own stanzas, with an algorithm of its choice, so
+// recipients of different types, like X25519Recipient and a custom
+// post-quantum KEM, can be mixed in the same file, unless their labels differ,
+// see RecipientWithLabels. Decrypt tries each Identity against all stanzas,
+// and identities must reject the stanza types they don't implement with
+// ErrIncorrectIdentity.
+//
 // Most age API users won't need to interact with this directly, and should
 // instead pass Recipient implementations to Encrypt and Identity
 // implementations to Decrypt.
@@ -76,6 +115,47 @@ type Recipient interface {
 	Wrap(fileKey []byte) ([]*Stanza, error)
 }
 
+// RecipientWithLabels can be optionally implemented by a Recipient, in which
+// case Encrypt will use WrapWithLabels instead of Wrap.
+//
+// Encrypt will succeed only if the labels returned by all the recipients
+// (assuming the empty set for those that don't implement RecipientWithLabels)
+// are the same, regardless of order.
+//
+// This can be used to ensure a recipient is only used with other recipients
+// with equivalent properties (for example by setting a "postquantum" label) or
+// to ensure a recipient is always used alone (by returning a random label, like
+// ScryptRecipient does).
+//
+// Labels are a property of recipients at encryption time, and are not written
+// to the file, so files encrypted to recipients with labels can be decrypted by
+// any age implementation, including ones that don't know about labels.
+type RecipientWithLabels interface {
+	WrapWithLabels(fileKey []byte) (s []*Stanza, labels []string, err error)
+}
+
+func wrapWithLabels(r Recipient, fileKey []byte) (s []*Stanza, labels []string, err error) {
+	if r, ok := r.(RecipientWithLabels); ok {
+		s, labels, err = r.WrapWithLabels(fileKey)
+		// Copy the labels, since they get sorted.
+		return s, append([]string{}, labels...), err
+	}
+	s, err = r.Wrap(fileKey)
+	return s, []string{}, err
+}
+
+func slicesEqual(s1, s2 []string) bool {
+	if len(s1) != len(s2) {
+		return false
+	}
+	for i := range s1 {
+		if s1[i] != s2[i] {
+			return false
+		}
+	}
+	return true
+}
+
 // A Stanza is a section of the age header that encapsulates the file key as
 // encrypted to a specific recipient.
 //
@@ -96,51 +176,427 @@ const streamNonceSize = 16
 // Writes to the returned WriteCloser are encrypted and written to dst as an age
 // file. Every recipient will be able to decrypt the file.
 //
+// The header lists the stanzas of each recipient in the order recipients are
+// passed, so that with a fixed Encryptor.Rand the output is fully determined
+// by the inputs.
+//
 // The caller must call Close on the WriteCloser when done for the last chunk to
 // be encrypted and flushed to dst.
+//
+// The payload is encrypted in chunks of 64 KiB, and all chunks except the last
+// must be full, so data is written to dst only when a chunk fills up or on
+// Close. There is no way to flush a partial chunk. Applications that need to
+// bound the latency of small messages should encrypt each message, or each
+// batch of messages, as a separate file.
 func Encrypt(dst io.Writer, recipients ...Recipient) (io.WriteCloser, error) {
+	return (&Encryptor{}).Encrypt(dst, recipients...)
+}
+
+// An Encryptor encrypts files like Encrypt, with optional settings. The zero
+// value is ready to use and behaves exactly like Encrypt.
+type Encryptor struct {
+	// HeaderWriter, if not nil, receives a copy of the serialized binary
+	// header, that is, all the bytes of the binary file before the payload.
+	// Without Armor, that's what is written to dst before the payload. With
+	// Armor, it's a prefix of the armor-decoded output instead, since the
+	// armored output encodes the header together with the start of the
+	// payload. It is meant for diagnosing interoperability issues, and does
+	// not affect dst.
+	HeaderWriter io.Writer
+
+	// NotBefore, if not zero, is recorded in a non-standard "ext-not-before"
+	// stanza, and makes Decrypt refuse to decrypt the file with a
+	// NotYetValidError until that time, according to the local clock, unless
+	// Decryptor.IgnoreNotBefore is set. Other age implementations ignore the
+	// stanza, so it is a safeguard rather than a security boundary. It can't be
+	// used with ScryptRecipient.
+	NotBefore time.Time
+
+	// GroupName, if not empty, is a human-readable name for the set of
+	// recipients, such as "ops-2024", recorded in a non-standard "ext-group"
+	// stanza for auditing purposes. It is not secret, and it is returned by
+	// Inspect. It has no effect on decryption, and other age implementations
+	// ignore it. It can't be used with ScryptRecipient.
+	GroupName string
+
+	// Timestamp, if not zero, is recorded with second precision, in UTC, in a
+	// non-standard "ext-timestamp" stanza, as the time of encryption. It is
+	// covered by the header MAC, so it can't be modified without Decrypt
+	// failing, and it is returned by Inspect, but it is only as accurate as
+	// the clock of whoever encrypted the file. It has no effect on
+	// decryption, and other age implementations ignore it. It can't be used
+	// with ScryptRecipient.
+	Timestamp time.Time
+
+	// Metadata, if not nil, is an application-defined blob of at most 4096
+	// bytes, such as a JSON object with the content type and original name of
+	// the file, recorded in a non-standard "ext-metadata" stanza. Like the
+	// rest of the header, it is not secret, and it is covered by the header
+	// MAC, so it can't be modified without Decrypt failing. It is returned by
+	// Inspect, and it can be trusted once the file is decrypted successfully.
+	// Other age implementations ignore it. It can't be used with
+	// ScryptRecipient.
+	Metadata []byte
+
+	// Padding, if not nil, is called by Close with the length of the
+	// plaintext, and must return a larger padded length. The plaintext is then
+	// padded to that length, to hide its exact length. See PadToPowerOfTwo and
+	// PadToMultipleOf. Padded files carry a non-standard "ext-padding" stanza,
+	// and Decrypt strips the padding. Other age implementations decrypt padded
+	// files but don't remove the padding. It can't be used with
+	// ScryptRecipient.
+	Padding func(length int64) int64
+
+	// Armor, if true, makes the output ASCII armored, as if dst had been
+	// wrapped with armor.NewWriter. Close then also writes the armor footer.
+	Armor bool
+
+	// Rand, if not nil, is the source of randomness for the file key, the
+	// payload nonce, and the ephemeral keys of X25519Recipient. Other
+	// recipients use crypto/rand.Reader. Rand must be a cryptographically
+	// secure random number generator, such as an approved DRBG: any other
+	// source, or reusing a seed, completely breaks the security of the files.
+	Rand io.Reader
+
+	// Compat, if not empty, is the oldest upstream age version, such as
+	// "v1.0.0", that must be able to decrypt the files correctly. Encrypt then
+	// fails if the header would have stanzas that version doesn't support,
+	// such as those of non-standard recipients, or extension stanzas it would
+	// ignore while they change the result of decryption, like the ones of
+	// Padding and NotBefore. Extension stanzas that are safe to ignore, like
+	// those of GroupName, Timestamp, Metadata, and NewHintedRecipient, are
+	// allowed.
+	//
+	// Recipient labels, see RecipientWithLabels, don't appear in the file, so
+	// they don't affect compatibility.
+	Compat string
+
+	// WriteOnlyIdentities, if not empty, are the identities available to the
+	// encrypting process, and makes Encrypt fail with ErrRecipientNotWriteOnly
+	// if any of the recipients corresponds to one of them. This enforces
+	// setups where whoever encrypts a file must not be able to read it back.
+	// Recipients are matched by the result of their String method, so
+	// recipients that don't implement fmt.Stringer, and identities whose
+	// recipient can't be derived, like ScryptIdentity, can't be checked and
+	// make Encrypt fail.
+	WriteOnlyIdentities []Identity
+
+	// StanzaTransformer, if not nil, is called with all the stanzas of the
+	// header, including extension stanzas, after the file key is wrapped and
+	// before the header MAC is computed, and its result replaces them. It can
+	// add, remove, or reorder stanzas, for example to add a custom extension
+	// stanza. The result is still subject to the checks of Encrypt, such as
+	// the scrypt and Compat rules, and is authenticated by the header MAC.
+	StanzaTransformer func([]*Stanza) ([]*Stanza, error)
+
+	// RecipientFingerprints, if not nil, is called once the header of each
+	// file is written, with the RecipientFingerprint of each of its
+	// recipients, in order, for example to build a manifest of which keys can
+	// open which files. If a recipient has no fingerprint, Encrypt fails
+	// before writing anything.
+	RecipientFingerprints func(fingerprints []string)
+}
+
+// ErrRecipientNotWriteOnly is returned by Encryptor.Encrypt when
+// WriteOnlyIdentities is set and one of the recipients corresponds to one of
+// those identities.
+var ErrRecipientNotWriteOnly = errors.New("recipient corresponds to an available identity")
+
+// checkWriteOnly returns ErrRecipientNotWriteOnly if any of recipients
+// corresponds to one of identities, or an error if that can't be determined.
+func checkWriteOnly(recipients []Recipient, identities []Identity) error {
+	if len(identities) == 0 {
+		return nil
+	}
+	readable := make(map[string]bool, len(identities))
+	for i, id := range identities {
+		r, err := identityToRecipient(id)
+		if err != nil {
+			return fmt.Errorf("failed to check write-only identity #%d: %v", i, err)
+		}
+		s, ok := r.(fmt.Stringer)
+		if !ok {
+			return fmt.Errorf("failed to check write-only identity #%d: recipient of type %T is not a fmt.Stringer", i, r)
+		}
+		readable[s.String()] = true
+	}
+	for i, r := range recipients {
+		s, ok := r.(fmt.Stringer)
+		if !ok {
+			return fmt.Errorf("failed to check recipient #%d: type %T is not a fmt.Stringer", i, r)
+		}
+		if readable[s.String()] {
+			return ErrRecipientNotWriteOnly
+		}
+	}
+	return nil
+}
+
+// randomizedRecipient is implemented by recipients that can use the random
+// source of Encryptor.Rand.
+type randomizedRecipient interface {
+	wrapWithRand(fileKey []byte, rand io.Reader) ([]*Stanza, error)
+}
+
+func (e *Encryptor) rand() io.Reader {
+	if e.Rand != nil {
+		return e.Rand
+	}
+	return rand.Reader
+}
+
+// Encrypt encrypts a file to one or more recipients. See the package-level
+// Encrypt function for details.
+func (e *Encryptor) Encrypt(dst io.Writer, recipients ...Recipient) (io.WriteCloser, error) {
+	extensions, err := e.extensionStanzas()
+	if err != nil {
+		return nil, err
+	}
+	return e.encrypt(dst, recipients, extensions)
+}
+
+func (e *Encryptor) encrypt(dst io.Writer, recipients []Recipient, extensions []*format.Stanza) (io.WriteCloser, error) {
+	var armorWriter io.WriteCloser
+	if e.Armor {
+		armorWriter = armor.NewWriter(dst)
+		dst = armorWriter
+	}
+
+	key, err := e.writeHeader(dst, recipients, extensions)
+	if err != nil {
+		return nil, err
+	}
+
+	var w io.WriteCloser
+	w, err = stream.NewWriter(key, dst)
+	if err != nil {
+		return nil, err
+	}
+	if e.Padding != nil {
+		w = &padWriter{w: w, padding: e.Padding}
+	}
+	if armorWriter != nil {
+		w = &armoredWriteCloser{WriteCloser: w, a: armorWriter}
+	}
+	return w, nil
+}
+
+// EncryptBytes encrypts plaintext to one or more recipients, and returns the
+// whole age file. See the package-level Encrypt function for details.
+//
+// The output is the same that Encrypt would produce, but plaintexts that fit
+// in a single chunk are encrypted with fewer allocations, without the
+// buffering of the streaming Writer. It's meant for services encrypting many
+// small secrets.
+func (e *Encryptor) EncryptBytes(plaintext []byte, recipients ...Recipient) ([]byte, error) {
+	extensions, err := e.extensionStanzas()
+	if err != nil {
+		return nil, err
+	}
+	return e.encryptBytes(plaintext, recipients, extensions)
+}
+
+func (e *Encryptor) encryptBytes(plaintext []byte, recipients []Recipient, extensions []*format.Stanza) ([]byte, error) {
+	if e.Padding != nil || e.Armor || len(plaintext) > stream.ChunkSize {
+		buf := &bytes.Buffer{}
+		w, err := e.encrypt(buf, recipients, extensions)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(plaintext); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	// Most headers are smaller than 512 bytes.
+	buf := bytes.NewBuffer(make([]byte, 0, 512+len(plaintext)+stream.Overhead))
+	key, err := e.writeHeader(buf, recipients, extensions)
+	if err != nil {
+		return nil, err
+	}
+	return stream.SealSingleChunk(key, buf.Bytes(), plaintext)
+}
+
+// EncryptBytes encrypts plaintext to one or more recipients, and returns the
+// whole age file. It is like Encrypt, but faster for small plaintexts. See
+// Encryptor.EncryptBytes.
+func EncryptBytes(plaintext []byte, recipients ...Recipient) ([]byte, error) {
+	return (&Encryptor{}).EncryptBytes(plaintext, recipients...)
+}
+
+// extensionStanzas returns the non-standard stanzas that record the settings
+// of e, which follow the recipient stanzas in the header.
+func (e *Encryptor) extensionStanzas() ([]*format.Stanza, error) {
+	var stanzas []*format.Stanza
+	if !e.NotBefore.IsZero() {
+		stanzas = append(stanzas, notBeforeStanza(e.NotBefore))
+	}
+	if e.Padding != nil {
+		stanzas = append(stanzas, &format.Stanza{Type: paddingStanzaType})
+	}
+	if e.GroupName != "" {
+		s, err := groupStanza(e.GroupName)
+		if err != nil {
+			return nil, err
+		}
+		stanzas = append(stanzas, s)
+	}
+	if !e.Timestamp.IsZero() {
+		stanzas = append(stanzas, timestampStanza(e.Timestamp))
+	}
+	if e.Metadata != nil {
+		s, err := metadataStanza(e.Metadata)
+		if err != nil {
+			return nil, err
+		}
+		stanzas = append(stanzas, s)
+	}
+	return stanzas, nil
+}
+
+// writeHeader generates a file key, wraps it to recipients, and writes the
+// header, followed by the extension stanzas, and the payload nonce to dst. It
+// returns the payload key.
+func (e *Encryptor) writeHeader(dst io.Writer, recipients []Recipient, extensions []*format.Stanza) ([]byte, error) {
 	if len(recipients) == 0 {
-		return nil, errors.New("no recipients specified")
+		return nil, &NoRecipientsError{}
+	}
+	if err := checkWriteOnly(recipients, e.WriteOnlyIdentities); err != nil {
+		return nil, err
+	}
+	var fingerprints []string
+	if e.RecipientFingerprints != nil {
+		var err error
+		fingerprints, err = recipientFingerprints(recipients)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	fileKey := make([]byte, fileKeySize)
-	if _, err := rand.Read(fileKey); err != nil {
+	if _, err := io.ReadFull(e.rand(), fileKey); err != nil {
 		return nil, err
 	}
 
 	hdr := &format.Header{}
+	var labels []string
 	for i, r := range recipients {
-		stanzas, err := r.Wrap(fileKey)
+		var stanzas []*Stanza
+		var l []string
+		var err error
+		if rr, ok := r.(randomizedRecipient); ok && e.Rand != nil {
+			stanzas, err = rr.wrapWithRand(fileKey, e.Rand)
+			l = []string{}
+		} else {
+			stanzas, l, err = wrapWithLabels(r, fileKey)
+		}
 		if err != nil {
 			return nil, fmt.Errorf("failed to wrap key for recipient #%d: %v", i, err)
 		}
+		sort.Strings(l)
+		if i == 0 {
+			labels = l
+		} else if !slicesEqual(labels, l) {
+			labels = nil
+		}
 		for _, s := range stanzas {
 			hdr.Recipients = append(hdr.Recipients, (*format.Stanza)(s))
 		}
 	}
-	for _, s := range hdr.Recipients {
-		if s.Type == "scrypt" && len(hdr.Recipients) != 1 {
-			return nil, errors.New("an scrypt recipient must be the only one")
+	if len(hdr.Recipients) == 0 {
+		return nil, &NoRecipientsError{EmptyStanzas: true}
+	}
+	hdr.Recipients = append(hdr.Recipients, extensions...)
+	if e.StanzaTransformer != nil {
+		stanzas := make([]*Stanza, 0, len(hdr.Recipients))
+		for _, s := range hdr.Recipients {
+			stanzas = append(stanzas, (*Stanza)(s))
+		}
+		stanzas, err := e.StanzaTransformer(stanzas)
+		if err != nil {
+			return nil, fmt.Errorf("failed to transform stanzas: %v", err)
+		}
+		if len(stanzas) == 0 {
+			return nil, &NoRecipientsError{EmptyStanzas: true}
+		}
+		hdr.Recipients = make([]*format.Stanza, 0, len(stanzas))
+		for _, s := range stanzas {
+			hdr.Recipients = append(hdr.Recipients, (*format.Stanza)(s))
 		}
 	}
+	if err := checkScryptStanzas(hdr.Recipients); err != nil {
+		return nil, err
+	}
+	if e.Compat != "" {
+		if err := checkCompat(e.Compat, hdr.Recipients); err != nil {
+			return nil, err
+		}
+	}
+	if labels == nil {
+		return nil, errors.New("incompatible recipients: they have different labels")
+	}
 	if mac, err := headerMAC(fileKey, hdr); err != nil {
 		return nil, fmt.Errorf("failed to compute header MAC: %v", err)
 	} else {
 		hdr.MAC = mac
 	}
+	if e.HeaderWriter != nil {
+		buf := &bytes.Buffer{}
+		if err := hdr.Marshal(buf); err != nil {
+			return nil, fmt.Errorf("failed to serialize header: %v", err)
+		}
+		if _, err := e.HeaderWriter.Write(buf.Bytes()); err != nil {
+			return nil, fmt.Errorf("failed to write header copy: %v", err)
+		}
+	}
 	if err := hdr.Marshal(dst); err != nil {
 		return nil, fmt.Errorf("failed to write header: %v", err)
 	}
 
 	nonce := make([]byte, streamNonceSize)
-	if _, err := rand.Read(nonce); err != nil {
+	if _, err := io.ReadFull(e.rand(), nonce); err != nil {
 		return nil, err
 	}
 	if _, err := dst.Write(nonce); err != nil {
 		return nil, fmt.Errorf("failed to write nonce: %v", err)
 	}
+	if e.RecipientFingerprints != nil {
+		e.RecipientFingerprints(fingerprints)
+	}
+	return streamKey(fileKey, nonce), nil
+}
 
-	return stream.NewWriter(streamKey(fileKey, nonce), dst)
+// armoredWriteCloser closes the armor writer after the payload writer.
+type armoredWriteCloser struct {
+	io.WriteCloser
+	a io.WriteCloser
+}
+
+func (w *armoredWriteCloser) Close() error {
+	if err := w.WriteCloser.Close(); err != nil {
+		return err
+	}
+	return w.a.Close()
+}
+
+// NoRecipientsError is returned by Encrypt when no recipients are specified,
+// or when the recipients didn't produce any stanza, since nobody would be able
+// to decrypt the resulting file.
+type NoRecipientsError struct {
+	// EmptyStanzas is true if recipients were specified but returned no
+	// stanzas from Wrap.
+	EmptyStanzas bool
+}
+
+func (e *NoRecipientsError) Error() string {
+	if e.EmptyStanzas {
+		return "no recipients specified: the recipients didn't produce any stanzas"
+	}
+	return "no recipients specified"
 }
 
 // NoIdentityMatchError is returned by Decrypt when none of the supplied
@@ -159,56 +615,437 @@ func (*NoIdentityMatchError) Error() string {
 //
 // It returns a Reader reading the decrypted plaintext of the age file read
 // from src. All identities will be tried until one successfully decrypts the file.
+//
+// The payload is decrypted in chunks of 64 KiB, and each chunk is
+// authenticated before any of its plaintext is returned by Read. However, if
+// the file is corrupted or truncated, Read returns an error only after the
+// preceding chunks were returned. In that case, the plaintext read so far
+// must be discarded. See DecryptAtomic for an alternative.
 func Decrypt(src io.Reader, identities ...Identity) (io.Reader, error) {
+	r, _, err := DecryptWithIdentity(src, identities...)
+	return r, err
+}
+
+// DecryptWithIdentity is like Decrypt, but it also returns the identity,
+// among the supplied ones, that unwrapped the file key.
+func DecryptWithIdentity(src io.Reader, identities ...Identity) (io.Reader, Identity, error) {
+	return (&Decryptor{}).DecryptWithIdentity(src, identities...)
+}
+
+// DecryptAtomic decrypts a file like Decrypt, and writes the plaintext to dst.
+//
+// Unlike Decrypt, the whole plaintext is buffered in memory, and it is written
+// to dst with a single Write only after all chunks were successfully
+// authenticated. If any chunk fails to decrypt, DecryptAtomic returns an error
+// and nothing is written to dst. This is meant for cases in which partial
+// output is worse than no output, and for files that fit comfortably in memory.
+func DecryptAtomic(src io.Reader, dst io.Writer, identities ...Identity) error {
+	return (&Decryptor{}).DecryptAtomic(src, dst, identities...)
+}
+
+// A Decryptor decrypts files like Decrypt, with optional settings. The zero
+// value is ready to use and behaves exactly like Decrypt.
+type Decryptor struct {
+	// IgnoreNotBefore disables the check of the time set with
+	// Encryptor.NotBefore, allowing files to be decrypted before it.
+	IgnoreNotBefore bool
+
+	// RequireArmor, if true, makes Decrypt accept only ASCII armored files,
+	// which it decodes as if src had been wrapped with armor.NewReader. Binary
+	// files are rejected with ErrNotArmored.
+	RequireArmor bool
+
+	// UnsafeIgnoreErrors, if true, enables a DANGEROUS data recovery mode for
+	// partially corrupted files. The header MAC is not checked, so the header
+	// might have been tampered with, and a failure to decrypt a chunk of the
+	// payload makes Read return a *CorruptedPayloadError, after which reading
+	// can continue with the following chunks. Padding is not removed.
+	//
+	// Only the plaintext returned before the first error is as trustworthy as
+	// with a regular Decrypt. Everything after it, and the very fact that the
+	// file ended where it did, is unauthenticated. Never use this mode outside
+	// of manual recovery of damaged files.
+	UnsafeIgnoreErrors bool
+
+	// ExpectedRecipient, if not nil, makes Decrypt fail with
+	// ErrUnexpectedRecipient unless the file was encrypted to it, even if one
+	// of the identities, for example a shared one, can decrypt it.
+	//
+	// Stanzas don't reveal their recipient, so the file is accepted only if
+	// one of the identities corresponds to ExpectedRecipient and unwraps the
+	// same file key from one of the recipient stanzas. This shows that
+	// whoever encrypted the file included ExpectedRecipient, since the header
+	// is authenticated. Hints, see NewHintedRecipient, are not enough, since
+	// anyone can add them. ExpectedRecipient must implement fmt.Stringer,
+	// like X25519Recipient.
+	ExpectedRecipient Recipient
+
+	// RequireHardwareBacked, if true, makes Decrypt use only the identities
+	// that implement HardwareBackedIdentity and report being hardware-backed,
+	// ignoring the others. If there are none, Decrypt fails with
+	// ErrNoHardwareBackedIdentity.
+	RequireHardwareBacked bool
+
+	// MaxPayloadBytes, if positive, is the maximum size of the plaintext. The
+	// Reader returned by Decrypt returns up to MaxPayloadBytes bytes, and then
+	// ErrPayloadTooLarge instead of reading any further, if the plaintext is
+	// larger. This bounds the memory used when reading the whole plaintext,
+	// for example with ioutil.ReadAll. Padding doesn't count towards it.
+	MaxPayloadBytes int64
+
+	// AcceptNewerMinorVersion, if true, makes Decrypt accept files whose
+	// version line has a newer minor version than the "age-encryption.org/v1"
+	// one this package writes, like "age-encryption.org/v1.1", on the
+	// assumption that minor versions are backwards compatible. The version
+	// line is still covered by the header MAC. Files with a different major
+	// version are always rejected.
+	AcceptNewerMinorVersion bool
+
+	// checkHeader, if not nil, is called with the header after its MAC is
+	// verified, and before the payload is decrypted. It's used by
+	// RecordReader to verify chained logs.
+	checkHeader func(hdr *format.Header) error
+}
+
+// ErrPayloadTooLarge is returned by the Reader returned by Decryptor.Decrypt
+// when MaxPayloadBytes is set and the plaintext is larger.
+var ErrPayloadTooLarge = errors.New("plaintext exceeds the maximum payload size")
+
+// ErrNoHardwareBackedIdentity is returned by Decryptor.Decrypt when
+// RequireHardwareBacked is set and none of the identities is hardware-backed.
+var ErrNoHardwareBackedIdentity = errors.New("no hardware-backed identities specified")
+
+// ErrUnexpectedRecipient is returned by Decryptor.Decrypt when
+// ExpectedRecipient is set and the file was not encrypted to it.
+var ErrUnexpectedRecipient = errors.New("file was not encrypted to the expected recipient")
+
+// CorruptedPayloadError is returned by Read in the mode enabled by
+// Decryptor.UnsafeIgnoreErrors when a chunk of the payload fails to decrypt.
+type CorruptedPayloadError struct {
+	// Offset is the position in the plaintext where the corrupted chunk
+	// starts. The next Read returns the plaintext starting at the next chunk,
+	// ChunkSize bytes after Offset, which is NOT authenticated as part of the
+	// same file.
+	Offset int64
+}
+
+func (e *CorruptedPayloadError) Error() string {
+	return fmt.Sprintf("payload corrupted at plaintext offset %d", e.Offset)
+}
+
+// recoveryReader translates the errors of a stream.Reader in the mode enabled
+// by SkipCorruptedChunks.
+type recoveryReader struct {
+	r *stream.Reader
+}
+
+func (r recoveryReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err, ok := err.(*stream.CorruptedChunkError); ok {
+		return n, &CorruptedPayloadError{Offset: int64(err.Chunk) * stream.ChunkSize}
+	}
+	return n, err
+}
+
+// ErrNotArmored is returned by Decryptor.Decrypt when RequireArmor is set and
+// the input is not an ASCII armored age file.
+var ErrNotArmored = errors.New("input is not an ASCII armored age file")
+
+// Decrypt decrypts a file encrypted to one or more identities. See the
+// package-level Decrypt function for details.
+func (d *Decryptor) Decrypt(src io.Reader, identities ...Identity) (io.Reader, error) {
+	r, _, err := d.DecryptWithIdentity(src, identities...)
+	return r, err
+}
+
+// DecryptAtomic decrypts a file into dst, writing nothing unless the whole
+// file is valid. See the package-level DecryptAtomic function for details.
+//
+// It can't be used with UnsafeIgnoreErrors.
+func (d *Decryptor) DecryptAtomic(src io.Reader, dst io.Writer, identities ...Identity) error {
+	if d.UnsafeIgnoreErrors {
+		return errors.New("DecryptAtomic can't be used with UnsafeIgnoreErrors")
+	}
+	r, err := d.Decrypt(src, identities...)
+	if err != nil {
+		return err
+	}
+	plaintext, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if _, err := dst.Write(plaintext); err != nil {
+		return err
+	}
+	return nil
+}
+
+// DecryptWithIdentity is like Decrypt, but it also returns the identity,
+// among the supplied ones, that unwrapped the file key.
+func (d *Decryptor) DecryptWithIdentity(src io.Reader, identities ...Identity) (io.Reader, Identity, error) {
+	return d.decrypt(src, identities, false)
+}
+
+// decrypt implements DecryptWithIdentity. If delimited is true, src must be a
+// *bufio.Reader large enough for stream.NewDelimitedReader, and the file might
+// be followed by another one, which is not read.
+func (d *Decryptor) decrypt(src io.Reader, identities []Identity, delimited bool) (io.Reader, Identity, error) {
+	identities, err := d.selectIdentities(identities)
+	if err != nil {
+		return nil, nil, err
+	}
+	return d.decryptWithTags(src, identities, nil, delimited)
+}
+
+// selectIdentities returns the identities that decrypt may use, according to
+// the settings of d.
+func (d *Decryptor) selectIdentities(identities []Identity) ([]Identity, error) {
 	if len(identities) == 0 {
 		return nil, errors.New("no identities specified")
 	}
+	if d.RequireHardwareBacked {
+		var hw []Identity
+		for _, i := range identities {
+			if i, ok := i.(HardwareBackedIdentity); ok && i.HardwareBacked() {
+				hw = append(hw, i)
+			}
+		}
+		if len(hw) == 0 {
+			return nil, ErrNoHardwareBackedIdentity
+		}
+		identities = hw
+	}
+	return identities, nil
+}
 
-	hdr, payload, err := format.Parse(src)
+// decryptWithTags implements decrypt for identities already returned by
+// selectIdentities. If tags is not nil, it holds their hint tags, see
+// unwrapHeaderWithTags.
+func (d *Decryptor) decryptWithTags(src io.Reader, identities []Identity, tags []string, delimited bool) (io.Reader, Identity, error) {
+	if d.RequireArmor {
+		in, armored, err := detectArmor(src)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !armored {
+			return nil, nil, ErrNotArmored
+		}
+		src = in
+	}
+
+	parse := format.Parse
+	if d.AcceptNewerMinorVersion {
+		parse = format.ParseCompat
+	}
+	hdr, payload, err := parse(src)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read header: %v", err)
+		return nil, nil, fmt.Errorf("failed to read header: %v", err)
 	}
 
-	for _, r := range hdr.Recipients {
-		if r.Type == "scrypt" && len(hdr.Recipients) != 1 {
-			return nil, errors.New("an scrypt recipient must be the only one")
+	fileKey, matched, err := d.openHeader(hdr, identities, tags)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nonce := make([]byte, streamNonceSize)
+	if _, err := io.ReadFull(payload, nonce); err != nil {
+		return nil, nil, fmt.Errorf("failed to read nonce: %v", err)
+	}
+
+	var r *stream.Reader
+	if delimited {
+		// format.Parse returns the bufio.Reader itself as the payload.
+		r, err = stream.NewDelimitedReader(streamKey(fileKey, nonce), payload.(*bufio.Reader), []byte(format.Intro))
+	} else {
+		r, err = stream.NewReader(streamKey(fileKey, nonce), payload)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var out io.Reader = r
+	switch {
+	case d.UnsafeIgnoreErrors && !delimited:
+		r.SkipCorruptedChunks()
+		out = recoveryReader{r}
+	case hasPaddingStanza(hdr):
+		out = &unpadReader{r: r}
+	}
+	if d.MaxPayloadBytes > 0 {
+		out = &maxPayloadReader{r: out, n: d.MaxPayloadBytes}
+	}
+	return out, matched, nil
+}
+
+// openHeader unwraps the file key from hdr with identities, and then runs the
+// checks enabled by the settings of d, and the Audit of the matched identity,
+// which must all pass before any plaintext is returned. If tags is not nil, it
+// holds the hint tags of identities, see unwrapHeaderWithTags.
+func (d *Decryptor) openHeader(hdr *format.Header, identities []Identity, tags []string) ([]byte, Identity, error) {
+	fileKey, matched, err := unwrapHeaderWithTags(hdr, identities, tags)
+	if err == errBadHeaderMAC && d.UnsafeIgnoreErrors {
+		err = nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if d.ExpectedRecipient != nil {
+		if err := checkExpectedRecipient(hdr, fileKey, d.ExpectedRecipient, identities); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if !d.IgnoreNotBefore {
+		if err := checkNotBefore(hdr, time.Now()); err != nil {
+			return nil, nil, err
 		}
 	}
 
+	if d.checkHeader != nil {
+		if err := d.checkHeader(hdr); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := audit(matched, hdr); err != nil {
+		return nil, nil, err
+	}
+	return fileKey, matched, nil
+}
+
+// audit calls Audit if i is an AuditableIdentity. It must be called whenever
+// i was used to recover a file key, before the file key or any plaintext is
+// used.
+func audit(i Identity, hdr *format.Header) error {
+	if a, ok := i.(AuditableIdentity); ok {
+		if err := a.Audit(headerInfo(hdr)); err != nil {
+			return fmt.Errorf("failed to audit decryption: %v", err)
+		}
+	}
+	return nil
+}
+
+// maxPayloadReader returns ErrPayloadTooLarge instead of reading past n bytes
+// from r, as documented by Decryptor.MaxPayloadBytes.
+type maxPayloadReader struct {
+	r io.Reader
+	n int64
+}
+
+func (m *maxPayloadReader) Read(p []byte) (int, error) {
+	if m.n <= 0 {
+		// Check whether the plaintext ends exactly at the limit.
+		var b [1]byte
+		n, err := m.r.Read(b[:])
+		if n > 0 {
+			return 0, ErrPayloadTooLarge
+		}
+		return 0, err
+	}
+	if int64(len(p)) > m.n {
+		p = p[:m.n]
+	}
+	n, err := m.r.Read(p)
+	m.n -= int64(n)
+	return n, err
+}
+
+// checkExpectedRecipient verifies that the file with header hdr and file key
+// fileKey was encrypted to expected, as documented by
+// Decryptor.ExpectedRecipient.
+func checkExpectedRecipient(hdr *format.Header, fileKey []byte, expected Recipient, identities []Identity) error {
+	str, ok := expected.(fmt.Stringer)
+	if !ok {
+		return fmt.Errorf("expected recipient of type %T has no string encoding", expected)
+	}
+	want := str.String()
+
+	// Hints and other extension stanzas can be added by anyone without
+	// knowing the file key, so only the recipient stanzas are considered.
+	stanzas := make([]*Stanza, 0, len(hdr.Recipients))
+	for _, s := range hdr.Recipients {
+		if isExtensionStanza(s) {
+			continue
+		}
+		stanzas = append(stanzas, (*Stanza)(s))
+	}
+
+	for _, i := range identities {
+		r, err := identityToRecipient(i)
+		if err != nil {
+			continue
+		}
+		if str, ok := r.(fmt.Stringer); !ok || str.String() != want {
+			continue
+		}
+		if k, err := i.Unwrap(stanzas); err == nil && hmac.Equal(k, fileKey) {
+			return nil
+		}
+	}
+	return ErrUnexpectedRecipient
+}
+
+var errBadHeaderMAC = errors.New("bad header MAC")
+
+// unwrapHeader tries identities against the stanzas of hdr until one of them
+// returns the file key, and then verifies the header MAC with it. If only the
+// MAC is wrong, it returns the file key along with errBadHeaderMAC.
+func unwrapHeader(hdr *format.Header, identities []Identity) ([]byte, Identity, error) {
+	return unwrapHeaderWithTags(hdr, identities, nil)
+}
+
+// unwrapHeaderWithTags is like unwrapHeader, but if tags is not nil it holds
+// the hint tags of the identities, precomputed with identityHintTag.
+func unwrapHeaderWithTags(hdr *format.Header, identities []Identity, tags []string) ([]byte, Identity, error) {
+	if err := checkScryptStanzas(hdr.Recipients); err != nil {
+		return nil, nil, err
+	}
+
 	stanzas := make([]*Stanza, 0, len(hdr.Recipients))
 	for _, s := range hdr.Recipients {
 		stanzas = append(stanzas, (*Stanza)(s))
 	}
 	errNoMatch := &NoIdentityMatchError{}
 	var fileKey []byte
-	for _, id := range identities {
+	var matched Identity
+	var err error
+	for n, id := range identities {
+		var hinted []*Stanza
+		if tags != nil {
+			hinted = stanzasWithHint(tags[n], stanzas)
+		} else {
+			hinted = hintedStanzas(id, stanzas)
+		}
+		if len(hinted) > 0 {
+			fileKey, err = id.Unwrap(hinted)
+			if err == nil {
+				matched = id
+				break
+			}
+			// On a tag collision, fall back to trying all stanzas.
+		}
 		fileKey, err = id.Unwrap(stanzas)
 		if errors.Is(err, ErrIncorrectIdentity) {
 			errNoMatch.Errors = append(errNoMatch.Errors, err)
 			continue
 		}
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
+		matched = id
 		break
 	}
 	if fileKey == nil {
-		return nil, errNoMatch
+		return nil, nil, errNoMatch
 	}
 
 	if mac, err := headerMAC(fileKey, hdr); err != nil {
-		return nil, fmt.Errorf("failed to compute header MAC: %v", err)
+		return nil, nil, fmt.Errorf("failed to compute header MAC: %v", err)
 	} else if !hmac.Equal(mac, hdr.MAC) {
-		return nil, errors.New("bad header MAC")
-	}
-
-	nonce := make([]byte, streamNonceSize)
-	if _, err := io.ReadFull(payload, nonce); err != nil {
-		return nil, fmt.Errorf("failed to read nonce: %v", err)
+		return fileKey, matched, errBadHeaderMAC
 	}
-
-	return stream.NewReader(streamKey(fileKey, nonce), payload)
+	return fileKey, matched, nil
 }
 
 // multiUnwrap is a helper that implements Identity.Unwrap in terms of a
@@ -8,15 +8,26 @@ package age_test
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
 	"strings"
 	"testing"
+	"time"
 
 	"filippo.io/age"
+	"filippo.io/age/armor"
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
 func ExampleEncrypt() {
@@ -192,6 +203,440 @@ func TestEncryptDecryptScrypt(t *testing.T) {
 	}
 }
 
+func TestScryptIdentityFromReader(t *testing.T) {
+	password := "twitch.tv/filosottile"
+	r, err := age.NewScryptRecipient(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetWorkFactor(10)
+	file, err := age.EncryptBytes([]byte(helloWorld), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, in := range []string{password, password + "\n", password + "\r\n"} {
+		i, err := age.NewScryptIdentityFromReader(strings.NewReader(in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := age.Decrypt(bytes.NewReader(file), i); err != nil {
+			t.Errorf("%q: %v", in, err)
+		}
+	}
+
+	src := strings.NewReader(password + "\nrest")
+	if _, err := age.NewScryptIdentityFromReader(src); err != nil {
+		t.Fatal(err)
+	}
+	if rest, _ := ioutil.ReadAll(src); string(rest) != "rest" {
+		t.Errorf("read past the first line, left %q", rest)
+	}
+
+	if _, err := age.NewScryptIdentityFromReader(strings.NewReader("\n")); err == nil {
+		t.Error("expected an error for an empty passphrase")
+	}
+}
+
+type countingLimiter struct {
+	left int
+	logN []int
+}
+
+func (l *countingLimiter) AllowScrypt(logN int) error {
+	l.logN = append(l.logN, logN)
+	if l.left == 0 {
+		return errors.New("too many attempts")
+	}
+	l.left--
+	return nil
+}
+
+func TestScryptLimiter(t *testing.T) {
+	r, err := age.NewScryptRecipient("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetWorkFactor(10)
+	file, err := age.EncryptBytes([]byte(helloWorld), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := &countingLimiter{left: 1}
+	i, err := age.NewScryptIdentity("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.SetLimiter(l)
+	if _, err := age.Decrypt(bytes.NewReader(file), i); err != nil {
+		t.Fatal(err)
+	}
+	_, err = age.Decrypt(bytes.NewReader(file), i)
+	var limitErr *age.ScryptLimitError
+	if !errors.As(err, &limitErr) {
+		t.Errorf("expected a ScryptLimitError, got %v", err)
+	}
+	if len(l.logN) != 2 || l.logN[0] != 10 {
+		t.Errorf("limiter was called with %v", l.logN)
+	}
+}
+
+func TestOpenWithPassphrase(t *testing.T) {
+	r, err := age.NewScryptRecipient("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetWorkFactor(10)
+	file, err := age.EncryptBytes([]byte(helloWorld), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := age.OpenWithPassphrase(bytes.NewReader(file), "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadAll(out); err != nil || string(got) != helloWorld {
+		t.Errorf("got %q, %v", got, err)
+	}
+
+	if _, err := age.OpenWithPassphrase(bytes.NewReader(file), "wrong"); err != age.ErrIncorrectPassphrase {
+		t.Errorf("got %v, want ErrIncorrectPassphrase", err)
+	}
+
+	// Damage the payload: the passphrase is still accepted, and the error is
+	// returned by Read.
+	damaged := append([]byte{}, file...)
+	damaged[len(damaged)-1] ^= 1
+	out, err = age.OpenWithPassphrase(bytes.NewReader(damaged), "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(out); err == nil {
+		t.Error("expected an error reading a damaged payload")
+	}
+
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err = age.EncryptBytes([]byte(helloWorld), i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := age.OpenWithPassphrase(bytes.NewReader(file), "password"); err == nil || err == age.ErrIncorrectPassphrase {
+		t.Errorf("got %v for a file without a passphrase", err)
+	}
+}
+
+func TestScryptRecipientWithSalt(t *testing.T) {
+	var salt [16]byte
+	copy(salt[:], "0123456789abcdef")
+	fileKey := bytes.Repeat([]byte{42}, 16)
+
+	var bodies [][]byte
+	for n := 0; n < 2; n++ {
+		r, err := age.NewScryptRecipientWithSalt("password", 10, salt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stanzas, err := r.Wrap(fileKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stanzas) != 1 {
+			t.Fatalf("got %d stanzas, want 1", len(stanzas))
+		}
+		s := stanzas[0]
+		if s.Type != "scrypt" || len(s.Args) != 2 ||
+			s.Args[0] != "MDEyMzQ1Njc4OWFiY2RlZg" || s.Args[1] != "10" {
+			t.Errorf("unexpected stanza: %v %q", s.Type, s.Args)
+		}
+		bodies = append(bodies, s.Body)
+
+		if _, err := r.Wrap(fileKey); err == nil {
+			t.Error("recipient with a fixed salt was used twice")
+		}
+
+		i, err := age.NewScryptIdentity("password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := i.Unwrap(stanzas)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, fileKey) {
+			t.Errorf("unwrapped %x, want %x", out, fileKey)
+		}
+	}
+	if !bytes.Equal(bodies[0], bodies[1]) {
+		t.Errorf("stanzas with the same salt are different")
+	}
+
+	if _, err := age.NewScryptRecipientWithSalt("password", 0, salt); err == nil {
+		t.Error("expected an error for an invalid work factor")
+	}
+}
+
+func TestMultiPassphrase(t *testing.T) {
+	passwords := []string{"correct horse", "battery staple", "hunter2"}
+	r, err := age.NewMultiPassphraseRecipient(passwords...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetWorkFactor(10)
+	file, err := age.EncryptBytes([]byte(helloWorld), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := age.Inspect(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(info.StanzaTypes, " "), "ext-scrypt ext-scrypt ext-scrypt"; got != want {
+		t.Errorf("got stanza types %q, want %q", got, want)
+	}
+
+	for _, password := range passwords {
+		i, err := age.NewScryptIdentity(password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := age.Decrypt(bytes.NewReader(file), i)
+		if err != nil {
+			t.Fatalf("%q: %v", password, err)
+		}
+		outBytes, err := ioutil.ReadAll(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(outBytes) != helloWorld {
+			t.Errorf("wrong data: %q, excepted %q", outBytes, helloWorld)
+		}
+	}
+
+	wrong, err := age.NewScryptIdentity("wrong")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := age.Decrypt(bytes.NewReader(file), wrong); err == nil {
+		t.Error("decrypted with the wrong passphrase")
+	}
+
+	x, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := age.EncryptBytes([]byte(helloWorld), r, x.Recipient()); err == nil {
+		t.Error("expected an error mixing a multi-passphrase recipient with others")
+	}
+	if err := age.AddRecipient(bytes.NewReader(file), []age.Identity{wrong}, x.Recipient(), ioutil.Discard); err == nil {
+		t.Error("expected an error adding a recipient to a multi-passphrase file")
+	}
+}
+
+func TestMultiPassphraseLimit(t *testing.T) {
+	passwords := make([]string, age.MaxPassphrases+1)
+	for n := range passwords {
+		passwords[n] = fmt.Sprintf("password %d", n)
+	}
+	if _, err := age.NewMultiPassphraseRecipient(passwords...); err == nil {
+		t.Errorf("expected an error for %d passphrases", len(passwords))
+	}
+	if _, err := age.NewMultiPassphraseRecipient(passwords[:age.MaxPassphrases]...); err != nil {
+		t.Errorf("unexpected error for %d passphrases: %v", age.MaxPassphrases, err)
+	}
+
+	// A header with too many stanzas, at the maximum work factor, must be
+	// rejected before running scrypt even once.
+	hdr := "age-encryption.org/v1\n"
+	var stanzas []*age.Stanza
+	for n := 0; n < age.MaxPassphrases+1; n++ {
+		s := &age.Stanza{Type: "ext-scrypt", Args: []string{"AAAAAAAAAAAAAAAAAAAAAA", "22"}, Body: make([]byte, 32)}
+		stanzas = append(stanzas, s)
+		hdr += "-> ext-scrypt AAAAAAAAAAAAAAAAAAAAAA 22\n" + base64.RawStdEncoding.EncodeToString(s.Body) + "\n"
+	}
+	hdr += "--- " + base64.RawStdEncoding.EncodeToString(make([]byte, 32)) + "\n"
+
+	i, err := age.NewScryptIdentity(passwords[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &countingLimiter{left: 100}
+	i.SetLimiter(l)
+	if _, err := age.Decrypt(strings.NewReader(hdr), i); err == nil || !strings.Contains(err.Error(), "too many") {
+		t.Errorf("expected an error for too many ext-scrypt stanzas, got %v", err)
+	}
+	if _, err := i.Unwrap(stanzas); err == nil || !strings.Contains(err.Error(), "too many") {
+		t.Errorf("Unwrap: expected an error for too many ext-scrypt stanzas, got %v", err)
+	}
+	if len(l.logN) != 0 {
+		t.Errorf("scrypt was attempted %d times", len(l.logN))
+	}
+}
+
+func TestVerifyHeader(t *testing.T) {
+	r, err := age.NewScryptRecipient("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetWorkFactor(10)
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, helloWorld); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file := buf.Bytes()
+
+	good, err := age.NewScryptIdentity("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Truncate the payload, to show it's not read.
+	if id, err := age.VerifyHeader(bytes.NewReader(file[:len(file)-10]), good); err != nil {
+		t.Errorf("unexpected error for correct passphrase: %v", err)
+	} else if id != good {
+		t.Errorf("wrong identity returned: %v", id)
+	}
+
+	bad, err := age.NewScryptIdentity("battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := age.VerifyHeader(bytes.NewReader(file), bad); err == nil {
+		t.Error("expected error for wrong passphrase")
+	}
+
+	good.SetMaxWorkFactor(9)
+	if _, err := age.VerifyHeader(bytes.NewReader(file), good); err == nil {
+		t.Error("expected error for work factor above the maximum")
+	}
+}
+
+func TestCanDecrypt(t *testing.T) {
+	a, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := age.EncryptBytes([]byte(helloWorld), a.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	armored, err := (&age.Encryptor{Armor: true}).EncryptBytes([]byte(helloWorld), a.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range [][]byte{file, armored} {
+		if ok, err := age.CanDecrypt(bytes.NewReader(f), int64(len(f)), a); err != nil || !ok {
+			t.Errorf("CanDecrypt with the right identity = %v, %v", ok, err)
+		}
+		if ok, err := age.CanDecrypt(bytes.NewReader(f), int64(len(f)), b); err != nil || ok {
+			t.Errorf("CanDecrypt with the wrong identity = %v, %v", ok, err)
+		}
+	}
+
+	corrupted := append([]byte{}, file...)
+	corrupted[bytes.Index(corrupted, []byte("\n---"))+5] ^= 1
+	if ok, err := age.CanDecrypt(bytes.NewReader(corrupted), int64(len(corrupted)), a); err == nil || ok {
+		t.Errorf("CanDecrypt with a bad header MAC = %v, %v", ok, err)
+	}
+}
+
+func TestDecryptionCost(t *testing.T) {
+	r, err := age.NewScryptRecipient("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetWorkFactor(12)
+	file, err := age.EncryptBytes(make([]byte, 1000), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := age.DecryptionCost(bytes.NewReader(file), int64(len(file)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The payload is the 16 bytes nonce and a chunk with a 16 bytes tag.
+	if c.ScryptWorkFactor != 12 || c.ScryptStanzas != 1 || c.Stanzas != 1 || c.PayloadSize != 16+1000+16 {
+		t.Errorf("unexpected cost: %+v", c)
+	}
+
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err = age.EncryptBytes(nil, i.Recipient(), i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = age.DecryptionCost(bytes.NewReader(file), int64(len(file)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ScryptWorkFactor != 0 || c.ScryptStanzas != 0 || c.Stanzas != 2 || c.PayloadSize != 16+16 {
+		t.Errorf("unexpected cost: %+v", c)
+	}
+
+	// Hint and padding stanzas are not tried by identities.
+	hinted, err := age.NewHintedRecipient(i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &age.Encryptor{Padding: age.PadToPowerOfTwo}
+	file, err = e.EncryptBytes(nil, hinted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = age.DecryptionCost(bytes.NewReader(file), int64(len(file)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Stanzas != 1 {
+		t.Errorf("got %d stanzas with extensions, want 1", c.Stanzas)
+	}
+
+	// Work factors are reported as declared, even above any identity's cap.
+	hdr := "age-encryption.org/v1\n-> scrypt AAAAAAAAAAAAAAAAAAAAAA 40\n" +
+		base64.RawStdEncoding.EncodeToString(make([]byte, 32)) + "\n--- " +
+		base64.RawStdEncoding.EncodeToString(make([]byte, 32)) + "\n"
+	c, err = age.DecryptionCost(strings.NewReader(hdr), int64(len(hdr)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ScryptWorkFactor != 40 {
+		t.Errorf("got work factor %d, want 40 as declared", c.ScryptWorkFactor)
+	}
+}
+
+func TestCalibrateScryptWorkFactor(t *testing.T) {
+	if logN := age.CalibrateScryptWorkFactor(time.Nanosecond); logN != 1 {
+		t.Errorf("got work factor %d for a 1ns target, want 1", logN)
+	}
+	fast := age.CalibrateScryptWorkFactor(time.Millisecond)
+	slow := age.CalibrateScryptWorkFactor(time.Hour)
+	if fast > slow || slow > 22 {
+		t.Errorf("unexpected work factors: %d for 1ms, %d for 1h", fast, slow)
+	}
+	// Whatever the machine, the result must be accepted by a default
+	// ScryptIdentity.
+	if logN := age.CalibrateScryptWorkFactor(1000 * time.Hour); logN > 22 {
+		t.Errorf("got work factor %d for a 1000h target, want at most 22", logN)
+	}
+}
+
 func TestParseIdentities(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -223,3 +668,3683 @@ AGE-SECRET-KEY--1D6K0SGAX3NU66R4GYFZY0UQWCLM3UUSF3CXLW4KXZM342WQSJ82QKU59Q`},
 		})
 	}
 }
+
+func TestParseIdentitiesAll(t *testing.T) {
+	file := `# comment
+AGE-SECRET-KEY-1D6K0SGAX3NU66R4GYFZY0UQWCLM3UUSF3CXLW4KXZM342WQSJ82QKU59QJ
+AGE-SECRET-KEY--1D6K0SGAX3NU66R4GYFZY0UQWCLM3UUSF3CXLW4KXZM342WQSJ82QKU59Q
+AGE-SECRET-KEY-19WUMFE89H3928FRJ5U3JYRNHM6CERQGKSQ584AQ8QY7T7R09D32SWE4DYH
+not a key`
+	ids, errs := age.ParseIdentitiesAll(strings.NewReader(file))
+	if len(ids) != 2 {
+		t.Errorf("got %d identities, want 2", len(ids))
+	}
+	if len(errs) != 2 {
+		t.Fatalf("got errors %v, want 2", errs)
+	}
+	if errs[0].Line != 3 || errs[1].Line != 5 || errs[1].Content != "not a key" {
+		t.Errorf("unexpected errors: %+v", errs)
+	}
+	if strings.Contains(errs[0].Error(), "1D6K0SG") {
+		t.Errorf("error message includes the line content: %v", errs[0])
+	}
+
+	if _, errs := age.ParseIdentitiesAll(strings.NewReader("# empty\n")); len(errs) != 1 || errs[0].Line != 0 {
+		t.Errorf("expected a single file error for an empty file, got %v", errs)
+	}
+}
+
+type testRecipient struct{ s string }
+
+func (r *testRecipient) Wrap(fileKey []byte) ([]*age.Stanza, error) {
+	return []*age.Stanza{{Type: "test", Args: []string{r.s}, Body: fileKey}}, nil
+}
+
+func TestRegisterRecipientParser(t *testing.T) {
+	age.RegisterRecipientParser("test1", func(s string) (age.Recipient, error) {
+		if s == "test1bad" {
+			return nil, errors.New("bad test recipient")
+		}
+		return &testRecipient{s}, nil
+	})
+
+	recs, err := age.ParseRecipients(strings.NewReader(`
+# a custom recipient next to a built-in one
+test1foo
+age1cy0su9fwf3gf9mw868g5yut09p6nytfmmnktexz2ya5uqg9vl9sss4euqm`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 2 {
+		t.Fatalf("got %d recipients, want 2", len(recs))
+	}
+	if r, ok := recs[0].(*testRecipient); !ok || r.s != "test1foo" {
+		t.Errorf("first recipient is %#v, want a test recipient", recs[0])
+	}
+	if _, ok := recs[1].(*age.X25519Recipient); !ok {
+		t.Errorf("second recipient is %T, want *age.X25519Recipient", recs[1])
+	}
+
+	if _, err := age.ParseRecipients(strings.NewReader("test1bad")); err == nil {
+		t.Error("expected error for recipient rejected by custom parser")
+	}
+	if _, err := age.ParseRecipients(strings.NewReader("test2foo")); err == nil {
+		t.Error("expected error for unregistered recipient type")
+	}
+}
+
+func TestCountRecipients(t *testing.T) {
+	a, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, a.Recipient(), b.Recipient(), a.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(make([]byte, 1<<20)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := age.CountRecipients(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("got %d recipients, want 3", n)
+	}
+
+	if _, err := age.CountRecipients(strings.NewReader("not an age file\n")); err == nil {
+		t.Error("expected error for malformed header")
+	}
+
+	// Hints, padding, and groups add stanzas that aren't recipients.
+	hinted, err := age.NewHintedRecipient(b.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &age.Encryptor{Padding: age.PadToPowerOfTwo, GroupName: "ops"}
+	file, err := e.EncryptBytes([]byte(helloWorld), a.Recipient(), hinted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err = age.CountRecipients(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("got %d recipients with extensions, want 2", n)
+	}
+}
+
+type lenientRecipient struct{ s string }
+
+func (r *lenientRecipient) Wrap(fileKey []byte) ([]*age.Stanza, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (r *lenientRecipient) String() string { return strings.ToLower(r.s) }
+
+func TestParseRecipientsStrict(t *testing.T) {
+	age.RegisterRecipientParser("lenient1", func(s string) (age.Recipient, error) {
+		return &lenientRecipient{s}, nil
+	})
+	age.RegisterRecipientParser("LENIENT1", func(s string) (age.Recipient, error) {
+		return &lenientRecipient{s}, nil
+	})
+
+	for _, s := range []string{
+		"age1cy0su9fwf3gf9mw868g5yut09p6nytfmmnktexz2ya5uqg9vl9sss4euqm",
+		"lenient1foo",
+	} {
+		if _, err := age.ParseRecipientsStrict(strings.NewReader(s)); err != nil {
+			t.Errorf("%q: unexpected error: %v", s, err)
+		}
+	}
+	for _, s := range []string{
+		"AGE1CY0SU9FWF3GF9MW868G5YUT09P6NYTFMMNKTEXZ2YA5UQG9VL9SSS4EUQM",
+		"age1cy0su9fwf3gf9mw868g5yut09p6nytfmmnktexz2ya5uqg9vl9sss4EUQM",
+		"LENIENT1FOO",
+		"test1foo", // registered by TestRegisterRecipientParser, not a Stringer
+	} {
+		if _, err := age.ParseRecipientsStrict(strings.NewReader(s)); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+	if _, err := age.ParseRecipients(strings.NewReader("LENIENT1FOO")); err != nil {
+		t.Errorf("lenient parsing failed: %v", err)
+	}
+}
+
+func TestParseKeyFile(t *testing.T) {
+	mine, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	theirs, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := "# mine\r\n" + mine.String() + "\r\n\n# theirs\n" + theirs.Recipient().String() + "\n"
+	ids, recs, err := age.ParseKeyFile(strings.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0].(*age.X25519Identity).String() != mine.String() {
+		t.Errorf("unexpected identities: %v", ids)
+	}
+	if len(recs) != 1 || recs[0].(*age.X25519Recipient).String() != theirs.Recipient().String() {
+		t.Errorf("unexpected recipients: %v", recs)
+	}
+
+	// A prefix claimed by both a recipient and an identity parser is parsed as
+	// a recipient, like in RecipientsFrom.
+	age.RegisterRecipientParser("keyfile1", func(s string) (age.Recipient, error) {
+		return &testRecipient{s}, nil
+	})
+	age.RegisterIdentityParser("keyfile1", func(s string) (age.Identity, error) {
+		return mine, nil
+	})
+	ids, recs, err = age.ParseKeyFile(strings.NewReader("\ufeffkeyfile1foo\r\n" + mine.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 {
+		t.Errorf("got %d identities, want 1", len(ids))
+	}
+	if len(recs) != 1 {
+		t.Fatalf("got %d recipients, want 1", len(recs))
+	}
+	if r, ok := recs[0].(*testRecipient); !ok || r.s != "keyfile1foo" {
+		t.Errorf("recipient is %#v, want a test recipient", recs[0])
+	}
+
+	for _, file := range []string{
+		"# empty\n",
+		mine.String() + "\nunknown\n",
+		mine.String() + "\nage1invalid\n",
+	} {
+		if _, _, err := age.ParseKeyFile(strings.NewReader(file)); err == nil {
+			t.Errorf("expected an error for %q", file)
+		} else if strings.Contains(err.Error(), mine.String()) {
+			t.Errorf("error leaks the secret key: %v", err)
+		}
+	}
+}
+
+func TestRecipientsFrom(t *testing.T) {
+	dir, err := ioutil.TempDir("", "age-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	idsFile := filepath.Join(dir, "key.txt")
+	if err := ioutil.WriteFile(idsFile, []byte("# created: now\n"+a.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	recsFile := filepath.Join(dir, "recipients.txt")
+	recs := a.Recipient().String() + "\n" + b.Recipient().String() + "\n"
+	if err := ioutil.WriteFile(recsFile, []byte(recs), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := age.RecipientsFrom(idsFile, recsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %d recipients, want 2", len(got))
+	}
+	if s := got[0].(*age.X25519Recipient).String(); s != a.Recipient().String() {
+		t.Errorf("first recipient is %q, want %q", s, a.Recipient())
+	}
+	if s := got[1].(*age.X25519Recipient).String(); s != b.Recipient().String() {
+		t.Errorf("second recipient is %q, want %q", s, b.Recipient())
+	}
+
+	if _, err := age.RecipientsFrom(filepath.Join(dir, "missing.txt")); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
+
+func TestParseRecipientsJSON(t *testing.T) {
+	const a = "age1cy0su9fwf3gf9mw868g5yut09p6nytfmmnktexz2ya5uqg9vl9sss4euqm"
+	recs, err := age.ParseRecipientsJSON(strings.NewReader(`["` + a + `", "` + a + `"]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 2 || recs[0].(*age.X25519Recipient).String() != a {
+		t.Errorf("unexpected recipients: %v", recs)
+	}
+	for _, in := range []string{`[]`, `{}`, `["` + a + `", 42]`, `[`} {
+		if _, err := age.ParseRecipientsJSON(strings.NewReader(in)); err == nil {
+			t.Errorf("expected error for %s", in)
+		}
+	}
+	_, err = age.ParseRecipientsJSON(strings.NewReader(`["` + a + `", "age1nope"]`))
+	if err == nil || !strings.Contains(err.Error(), "index 1") {
+		t.Errorf("expected error mentioning index 1, got %v", err)
+	}
+
+	groups, err := age.ParseRecipientGroupsJSON(strings.NewReader(`{"ops": ["` + a + `"], "empty": []}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 2 || len(groups["ops"]) != 1 || len(groups["empty"]) != 0 {
+		t.Errorf("unexpected groups: %v", groups)
+	}
+	_, err = age.ParseRecipientGroupsJSON(strings.NewReader(`{"ops": ["` + a + `", "nope"]}`))
+	if err == nil || !strings.Contains(err.Error(), `"ops"`) || !strings.Contains(err.Error(), "index 1") {
+		t.Errorf("expected error mentioning the group and index, got %v", err)
+	}
+}
+
+func TestResolveRecipients(t *testing.T) {
+	dir, err := ioutil.TempDir("", "age-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	idsFile := filepath.Join(dir, "key.txt")
+	if err := ioutil.WriteFile(idsFile, []byte(a.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	recsFile := filepath.Join(dir, "recipients.txt")
+	if err := ioutil.WriteFile(recsFile, []byte(b.Recipient().String()+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, errs := age.ResolveRecipients(age.RecipientSpec{
+		Recipients:     []string{a.Recipient().String(), "age1nope", "nope"},
+		RecipientFiles: []string{recsFile, filepath.Join(dir, "missing.txt")},
+		IdentityFiles:  []string{idsFile},
+	})
+	if len(got) != 2 {
+		t.Errorf("got %d recipients, want 2", len(got))
+	}
+	if len(errs) != 3 {
+		t.Errorf("got errors %v, want 3", errs)
+	}
+	for _, err := range errs {
+		if !strings.Contains(err.Error(), "nope") && !strings.Contains(err.Error(), "missing.txt") {
+			t.Errorf("error doesn't mention its source: %v", err)
+		}
+	}
+
+	if got, errs := age.ResolveRecipients(age.RecipientSpec{}); len(got) != 0 || len(errs) != 1 {
+		t.Errorf("expected a single error for an empty spec, got %v, %v", got, errs)
+	}
+}
+
+func TestRecipientAliases(t *testing.T) {
+	a, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliases, err := age.ParseRecipientAliases(strings.NewReader(
+		"# team\nalice = " + a.Recipient().String() + "\r\n\nbob=" + b.Recipient().String() + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, err := aliases.ResolveRecipient("alice"); err != nil {
+		t.Fatal(err)
+	} else if r.(*age.X25519Recipient).String() != a.Recipient().String() {
+		t.Errorf("alice resolved to %v", r)
+	}
+	if _, err := aliases.ResolveRecipient("carol"); err == nil {
+		t.Error("expected an error for an unknown alias")
+	}
+
+	for _, bad := range []string{
+		"alice " + a.Recipient().String(),
+		"= " + a.Recipient().String(),
+		"@alice = " + a.Recipient().String(),
+		"alice = nope",
+		"alice = " + a.Recipient().String() + "\nalice = " + b.Recipient().String(),
+	} {
+		if _, err := age.ParseRecipientAliases(strings.NewReader(bad)); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "age-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	recsFile := filepath.Join(dir, "recipients.txt")
+	if err := ioutil.WriteFile(recsFile, []byte("@bob\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, errs := age.ResolveRecipients(age.RecipientSpec{
+		Recipients:     []string{"@alice", "@carol"},
+		RecipientFiles: []string{recsFile},
+		Resolver:       aliases,
+	})
+	if len(got) != 2 {
+		t.Errorf("got %d recipients, want 2", len(got))
+	}
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "carol") {
+		t.Errorf("got errors %v, want one about carol", errs)
+	}
+	if _, errs := age.ResolveRecipients(age.RecipientSpec{Recipients: []string{"@alice"}}); len(errs) != 1 {
+		t.Errorf("expected an error for an alias without a resolver, got %v", errs)
+	}
+}
+
+type countingIdentity struct {
+	i       *age.X25519Identity
+	stanzas int
+}
+
+func (c *countingIdentity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	c.stanzas += len(stanzas)
+	return c.i.Unwrap(stanzas)
+}
+
+func (c *countingIdentity) Recipient() age.Recipient { return c.i.Recipient() }
+
+func TestValidateRecipientCount(t *testing.T) {
+	a, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	aa, err := age.ParseX25519Recipient(a.Recipient().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := age.ValidateRecipientCount([]age.Recipient{a.Recipient(), b.Recipient()}, 2); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := age.ValidateRecipientCount([]age.Recipient{a.Recipient(), aa}, 2); err == nil {
+		t.Error("duplicate recipients were counted as distinct")
+	}
+	if err := age.ValidateRecipientCount(nil, 1); err == nil {
+		t.Error("expected an error for no recipients")
+	}
+	if err := age.ValidateRecipientCount(nil, 0); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// testKEM is a toy symmetric stand-in for a custom KEM, with its own stanza
+// type, used as both Recipient and Identity.
+type testKEM [chacha20poly1305.KeySize]byte
+
+func (k *testKEM) Wrap(fileKey []byte) ([]*age.Stanza, error) {
+	aead, err := chacha20poly1305.New(k[:])
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return []*age.Stanza{{
+		Type: "test-kem",
+		Args: []string{base64.RawStdEncoding.EncodeToString(nonce)},
+		Body: aead.Seal(nil, nonce, fileKey, nil),
+	}}, nil
+}
+
+func (k *testKEM) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	aead, err := chacha20poly1305.New(k[:])
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range stanzas {
+		if s.Type != "test-kem" || len(s.Args) != 1 {
+			continue
+		}
+		nonce, err := base64.RawStdEncoding.DecodeString(s.Args[0])
+		if err != nil || len(nonce) != chacha20poly1305.NonceSize {
+			return nil, errors.New("invalid test-kem stanza")
+		}
+		if fileKey, err := aead.Open(nil, nonce, s.Body, nil); err == nil {
+			return fileKey, nil
+		}
+	}
+	return nil, age.ErrIncorrectIdentity
+}
+
+func TestMixedRecipients(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kem := &testKEM{}
+	if _, err := rand.Read(kem[:]); err != nil {
+		t.Fatal(err)
+	}
+	file, err := age.EncryptBytes([]byte(helloWorld), i.Recipient(), kem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := age.Inspect(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(info.StanzaTypes, " "); got != "X25519 test-kem" {
+		t.Errorf("got stanza types %q", got)
+	}
+	for _, id := range []age.Identity{i, kem} {
+		r, err := age.Decrypt(bytes.NewReader(file), id)
+		if err != nil {
+			t.Fatalf("%T: %v", id, err)
+		}
+		if out, err := ioutil.ReadAll(r); err != nil {
+			t.Fatal(err)
+		} else if string(out) != helloWorld {
+			t.Errorf("%T: wrong data: %q, excepted %q", id, out, helloWorld)
+		}
+	}
+
+	file, err = age.EncryptBytes([]byte(helloWorld), i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var noMatch *age.NoIdentityMatchError
+	if _, err := age.Decrypt(bytes.NewReader(file), kem); !errors.As(err, &noMatch) {
+		t.Errorf("expected NoIdentityMatchError, got %v", err)
+	}
+}
+
+func TestHintedRecipient(t *testing.T) {
+	var recipients []age.Recipient
+	var target *age.X25519Identity
+	for n := 0; n < 50; n++ {
+		i, err := age.GenerateX25519Identity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := age.NewHintedRecipient(i.Recipient())
+		if err != nil {
+			t.Fatal(err)
+		}
+		recipients = append(recipients, r)
+		if n == 42 {
+			target = i
+		}
+	}
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, recipients...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, helloWorld); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := age.CountRecipients(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	} else if n != 50 {
+		t.Errorf("got %d recipients, want 50", n)
+	}
+
+	// Decrypting without using hints must still work.
+	out, err := age.Decrypt(bytes.NewReader(buf.Bytes()), target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outBytes, err := ioutil.ReadAll(out); err != nil {
+		t.Fatal(err)
+	} else if string(outBytes) != helloWorld {
+		t.Errorf("wrong data: %q, excepted %q", outBytes, helloWorld)
+	}
+
+	c := &countingIdentity{i: target}
+	out, err = age.Decrypt(bytes.NewReader(buf.Bytes()), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outBytes, err := ioutil.ReadAll(out); err != nil {
+		t.Fatal(err)
+	} else if string(outBytes) != helloWorld {
+		t.Errorf("wrong data: %q, excepted %q", outBytes, helloWorld)
+	}
+	if c.stanzas != 1 {
+		t.Errorf("identity was offered %d stanzas, want 1", c.stanzas)
+	}
+
+	if _, err := age.NewHintedRecipient(&testRecipient{}); err == nil {
+		t.Error("expected error for recipient without a string encoding")
+	}
+}
+
+func TestLazyIdentity(t *testing.T) {
+	a, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := age.NewScryptRecipient("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetWorkFactor(10)
+
+	encrypt := func(r age.Recipient) []byte {
+		buf := &bytes.Buffer{}
+		w, err := age.Encrypt(buf, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, helloWorld); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	var calls int
+	lazy := age.NewLazyIdentity("scrypt", func() (age.Identity, error) {
+		calls++
+		return age.NewScryptIdentity("password")
+	})
+
+	if _, err := age.Decrypt(bytes.NewReader(encrypt(a.Recipient())), lazy, a); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 0 {
+		t.Errorf("lazy identity was constructed for a non-matching file")
+	}
+
+	for n := 0; n < 2; n++ {
+		out, err := age.Decrypt(bytes.NewReader(encrypt(r)), a, lazy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if outBytes, err := ioutil.ReadAll(out); err != nil {
+			t.Fatal(err)
+		} else if string(outBytes) != helloWorld {
+			t.Errorf("wrong data: %q, excepted %q", outBytes, helloWorld)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("lazy identity was constructed %d times, want 1", calls)
+	}
+
+	var seen int
+	f := age.IdentityFunc(func(stanzas []*age.Stanza) ([]byte, error) {
+		seen += len(stanzas)
+		return a.Unwrap(stanzas)
+	})
+	if _, err := age.Decrypt(bytes.NewReader(encrypt(a.Recipient())), f); err != nil {
+		t.Fatal(err)
+	}
+	if seen != 1 {
+		t.Errorf("IdentityFunc saw %d stanzas, want 1", seen)
+	}
+}
+
+func TestTeeEncryptor(t *testing.T) {
+	a, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bufA, bufB := &bytes.Buffer{}, &bytes.Buffer{}
+	w, err := age.NewTeeEncryptor([]io.Writer{bufA, bufB},
+		[][]age.Recipient{{a.Recipient()}, {b.Recipient(), a.Recipient()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := bytes.Repeat([]byte(helloWorld), 10000)
+	if _, err := w.Write(plaintext); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		file []byte
+		id   age.Identity
+		ok   bool
+	}{
+		{bufA.Bytes(), a, true},
+		{bufA.Bytes(), b, false},
+		{bufB.Bytes(), a, true},
+		{bufB.Bytes(), b, true},
+	} {
+		out, err := age.Decrypt(bytes.NewReader(tt.file), tt.id)
+		if !tt.ok {
+			if err == nil {
+				t.Error("expected decryption failure")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if outBytes, err := ioutil.ReadAll(out); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(outBytes, plaintext) {
+			t.Error("wrong decrypted data")
+		}
+	}
+
+	if _, err := age.NewTeeEncryptor([]io.Writer{bufA}, nil); err == nil {
+		t.Error("expected error for mismatched arguments")
+	}
+
+	// A failing recipient set must not leave a header on other destinations.
+	bufA.Reset()
+	if _, err := age.NewTeeEncryptor([]io.Writer{bufA, bufB},
+		[][]age.Recipient{{a.Recipient()}, {}}); err == nil {
+		t.Error("expected error for an empty recipient set")
+	}
+	if bufA.Len() != 0 {
+		t.Errorf("%d bytes written to the first destination after a failure", bufA.Len())
+	}
+
+	// A failing destination leaves truncated files, which must not decrypt.
+	for _, n := range []int{0, 1000} {
+		bufA.Reset()
+		w, err := age.NewTeeEncryptor([]io.Writer{bufA, &failingWriter{n: n}},
+			[][]age.Recipient{{a.Recipient()}, {b.Recipient()}})
+		if err == nil {
+			_, err = w.Write(plaintext)
+		}
+		if err == nil {
+			err = w.Close()
+		}
+		if err == nil {
+			t.Fatalf("expected error for a destination failing after %d bytes", n)
+		}
+		if r, err := age.Decrypt(bytes.NewReader(bufA.Bytes()), a); err == nil {
+			if _, err := ioutil.ReadAll(r); err == nil {
+				t.Errorf("truncated file decrypted successfully after %d bytes", n)
+			}
+		}
+	}
+}
+
+// failingWriter accepts n bytes, and then fails.
+type failingWriter struct{ n int }
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		return 0, errors.New("write failed")
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+func TestParseCRLF(t *testing.T) {
+	ids := "# created: 2021-01-02T15:30:45+01:00\r\n" +
+		"# public key: age1lvyvwawkr0mcnnnncaghunadrqkmuf9e6507x9y920xxpp866cnql7dp2z\r\n" +
+		"AGE-SECRET-KEY-1N9JEPW6DWJ0ZQUDX63F5A03GX8QUW7PXDE39N8UYF82VZ9PC8UFS3M7XA9\r\n" +
+		"\r\n" +
+		"AGE-SECRET-KEY-184JMZMVQH3E6U0PSL869004Y3U2NYV7R30EU99CSEDNPH02YUVFSZW44VU\r"
+	got, err := age.ParseIdentities(strings.NewReader(ids))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Errorf("got %d identities, want 2", len(got))
+	}
+
+	recs := "# Alice\r\n" +
+		"age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p\r\n" +
+		"age1lggyhqrw2nlhcxprm67z43rta597azn8gknawjehu9d9dl0jq3yqqvfafg\r\n"
+	rr, err := age.ParseRecipients(strings.NewReader(recs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rr) != 2 {
+		t.Errorf("got %d recipients, want 2", len(rr))
+	}
+}
+
+func TestParseBOM(t *testing.T) {
+	recs := "\ufeffage1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p\n" +
+		"age1lggyhqrw2nlhcxprm67z43rta597azn8gknawjehu9d9dl0jq3yqqvfafg\n"
+	rr, err := age.ParseRecipients(strings.NewReader(recs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rr) != 2 {
+		t.Errorf("got %d recipients, want 2", len(rr))
+	}
+	if _, err := age.ParseRecipients(strings.NewReader("\ufeff# comment\n" + recs[len("\ufeff"):])); err != nil {
+		t.Errorf("BOM before a comment: %v", err)
+	}
+	// A BOM is only expected at the start of the file.
+	if _, err := age.ParseRecipients(strings.NewReader("# comment\n" + recs)); err == nil {
+		t.Error("expected error for BOM in the middle of the file")
+	}
+
+	ids := "\ufeffAGE-SECRET-KEY-184JMZMVQH3E6U0PSL869004Y3U2NYV7R30EU99CSEDNPH02YUVFSZW44VU\r\n"
+	if _, err := age.ParseIdentities(strings.NewReader(ids)); err != nil {
+		t.Errorf("BOM before an identity: %v", err)
+	}
+}
+
+func TestDecryptWithIdentity(t *testing.T) {
+	a, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, b.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, helloWorld); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	out, id, err := age.DecryptWithIdentity(buf, a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != age.Identity(b) {
+		t.Errorf("got identity %v, want %v", id, b)
+	}
+	if outBytes, err := ioutil.ReadAll(out); err != nil {
+		t.Fatal(err)
+	} else if string(outBytes) != helloWorld {
+		t.Errorf("wrong data: %q, excepted %q", outBytes, helloWorld)
+	}
+}
+
+func TestEncryptorHeaderWriter(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf, hdr := &bytes.Buffer{}, &bytes.Buffer{}
+	e := &age.Encryptor{HeaderWriter: hdr}
+	w, err := e.Encrypt(buf, i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, helloWorld); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.HasPrefix(buf.Bytes(), hdr.Bytes()) {
+		t.Fatalf("header copy is not a prefix of the output: %q", hdr)
+	}
+	if !bytes.HasPrefix(hdr.Bytes(), []byte("age-encryption.org/v1\n")) ||
+		!bytes.Contains(hdr.Bytes(), []byte("\n--- ")) || !bytes.HasSuffix(hdr.Bytes(), []byte("\n")) {
+		t.Errorf("unexpected header copy: %q", hdr)
+	}
+
+	out, err := age.Decrypt(buf, i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outBytes, err := ioutil.ReadAll(out); err != nil {
+		t.Fatal(err)
+	} else if string(outBytes) != helloWorld {
+		t.Errorf("wrong data: %q, excepted %q", outBytes, helloWorld)
+	}
+
+	// With Armor, the copy is of the binary header, before armoring.
+	buf.Reset()
+	hdr.Reset()
+	e = &age.Encryptor{HeaderWriter: hdr, Armor: true}
+	w, err = e.Encrypt(buf, i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, helloWorld); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(buf.Bytes(), []byte(armor.Header)) {
+		t.Fatalf("output is not armored: %q", buf)
+	}
+	binary, err := ioutil.ReadAll(armor.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(hdr.Bytes(), []byte("age-encryption.org/v1\n")) || !bytes.HasPrefix(binary, hdr.Bytes()) {
+		t.Errorf("header copy is not a prefix of the decoded output: %q", hdr)
+	}
+}
+
+func TestEncryptDecryptSymmetric(t *testing.T) {
+	var key, otherKey [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		t.Fatal(err)
+	}
+	otherKey[0] = 1
+
+	buf := &bytes.Buffer{}
+	w, err := age.EncryptSymmetric(buf, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, helloWorld); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := age.DecryptSymmetric(bytes.NewReader(buf.Bytes()), otherKey); err == nil {
+		t.Error("expected decryption with the wrong key to fail")
+	}
+
+	out, err := age.DecryptSymmetric(buf, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outBytes, err := ioutil.ReadAll(out); err != nil {
+		t.Fatal(err)
+	} else if string(outBytes) != helloWorld {
+		t.Errorf("wrong data: %q, excepted %q", outBytes, helloWorld)
+	}
+}
+
+func TestConvertIdentitiesToRecipients(t *testing.T) {
+	in := "# test key\n" + privateKey + "\n\n" + privateKey
+	out := &bytes.Buffer{}
+	n, err := age.ConvertIdentitiesToRecipients(strings.NewReader(in), out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const recipient = "age1cy0su9fwf3gf9mw868g5yut09p6nytfmmnktexz2ya5uqg9vl9sss4euqm"
+	if n != 2 || out.String() != recipient+"\n"+recipient+"\n" {
+		t.Errorf("got %d recipients %q", n, out)
+	}
+
+	if _, err := age.ConvertIdentitiesToRecipients(strings.NewReader("# empty\n"), ioutil.Discard); err == nil {
+		t.Error("expected an error for a file with no identities")
+	}
+}
+
+func TestNotBefore(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypt := func(notBefore time.Time) []byte {
+		buf := &bytes.Buffer{}
+		e := &age.Encryptor{NotBefore: notBefore}
+		w, err := e.Encrypt(buf, i.Recipient())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, helloWorld); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	if _, err := age.Decrypt(bytes.NewReader(encrypt(time.Now().Add(-time.Hour))), i); err != nil {
+		t.Errorf("failed to decrypt file past its not-before time: %v", err)
+	}
+
+	future := encrypt(time.Now().Add(time.Hour))
+	_, err = age.Decrypt(bytes.NewReader(future), i)
+	var e *age.NotYetValidError
+	if !errors.As(err, &e) {
+		t.Errorf("expected NotYetValidError, got %v", err)
+	}
+
+	out, err := (&age.Decryptor{IgnoreNotBefore: true}).Decrypt(bytes.NewReader(future), i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outBytes, err := ioutil.ReadAll(out); err != nil {
+		t.Fatal(err)
+	} else if string(outBytes) != helloWorld {
+		t.Errorf("wrong data: %q, excepted %q", outBytes, helloWorld)
+	}
+
+	r, err := age.NewScryptRecipient("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetWorkFactor(10)
+	if _, err := (&age.Encryptor{NotBefore: time.Now()}).Encrypt(ioutil.Discard, r); err == nil {
+		t.Error("expected NotBefore to be rejected with an scrypt recipient")
+	}
+}
+
+func TestGroupName(t *testing.T) {
+	a, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	e := &age.Encryptor{GroupName: "ops team, 2021"}
+	w, err := e.Encrypt(buf, a.Recipient(), b.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := age.Inspect(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.GroupName != "ops team, 2021" {
+		t.Errorf("got group name %q", info.GroupName)
+	}
+	if want := []string{"X25519", "X25519", "ext-group"}; strings.Join(info.StanzaTypes, " ") != strings.Join(want, " ") {
+		t.Errorf("got stanza types %q, want %q", info.StanzaTypes, want)
+	}
+
+	if _, err := age.Decrypt(buf, b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata := []byte(`{"type":"text/plain"}`)
+	e := &age.Encryptor{Metadata: metadata}
+	file, err := e.EncryptBytes([]byte(helloWorld), i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := age.Inspect(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(info.Metadata, metadata) {
+		t.Errorf("got metadata %q, want %q", info.Metadata, metadata)
+	}
+	if _, err := age.Decrypt(bytes.NewReader(file), i); err != nil {
+		t.Fatal(err)
+	}
+
+	body := "\n-> ext-metadata\ne"
+	if !bytes.Contains(file, []byte(body)) {
+		t.Fatal("metadata stanza not found")
+	}
+	tampered := bytes.Replace(file, []byte(body), []byte("\n-> ext-metadata\nf"), 1)
+	if _, err := age.Decrypt(bytes.NewReader(tampered), i); err == nil {
+		t.Error("tampered metadata was not detected")
+	}
+
+	e = &age.Encryptor{Metadata: make([]byte, 4097)}
+	if _, err := e.EncryptBytes([]byte(helloWorld), i.Recipient()); err == nil {
+		t.Error("expected an error for oversized metadata")
+	}
+}
+
+func TestTimestamp(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Date(2021, time.March, 14, 15, 9, 26, 535, time.FixedZone("", 3600))
+	e := &age.Encryptor{Timestamp: ts}
+	file, err := e.EncryptBytes([]byte(helloWorld), i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := age.Inspect(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := ts.Truncate(time.Second); !info.Timestamp.Equal(want) {
+		t.Errorf("got timestamp %v, want %v", info.Timestamp, want)
+	}
+	if _, err := age.Decrypt(bytes.NewReader(file), i); err != nil {
+		t.Fatal(err)
+	}
+
+	stanza := "\n-> ext-timestamp 2021-03-14T14:09:26Z\n"
+	if !bytes.Contains(file, []byte(stanza)) {
+		t.Fatal("timestamp stanza not found")
+	}
+	tampered := bytes.Replace(file, []byte(stanza), []byte("\n-> ext-timestamp 2021-03-14T14:09:27Z\n"), 1)
+	if _, err := age.Decrypt(bytes.NewReader(tampered), i); err == nil {
+		t.Error("tampered timestamp was not detected")
+	}
+
+	file, err = age.EncryptBytes([]byte(helloWorld), i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err = age.Inspect(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Timestamp.IsZero() {
+		t.Errorf("unexpected timestamp %v", info.Timestamp)
+	}
+}
+
+func TestEncryptDecryptEmpty(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, armored := range []bool{false, true} {
+		t.Run(fmt.Sprintf("armor=%v", armored), func(t *testing.T) {
+			buf, hdr := &bytes.Buffer{}, &bytes.Buffer{}
+			var dst io.Writer = buf
+			var aw io.WriteCloser
+			if armored {
+				aw = armor.NewWriter(buf)
+				dst = aw
+			}
+			w, err := (&age.Encryptor{HeaderWriter: hdr}).Encrypt(dst, i.Recipient())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			var src io.Reader = buf
+			if armored {
+				if err := aw.Close(); err != nil {
+					t.Fatal(err)
+				}
+				b, err := ioutil.ReadAll(armor.NewReader(buf))
+				if err != nil {
+					t.Fatal(err)
+				}
+				src = bytes.NewReader(b)
+			} else {
+				// The payload is the nonce and a single empty final chunk,
+				// made only of the authentication tag.
+				if got, want := buf.Len(), hdr.Len()+16+16; got != want {
+					t.Errorf("got %d bytes of output, want %d", got, want)
+				}
+			}
+
+			out, err := age.Decrypt(src, i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := make([]byte, 10)
+			if n, err := out.Read(p); n != 0 || err != io.EOF {
+				t.Errorf("got Read() = %d, %v; want 0, EOF", n, err)
+			}
+		})
+	}
+}
+
+func TestEncryptDecryptStream(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	n, err := age.EncryptStream(buf, strings.NewReader(helloWorld), i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(helloWorld)) {
+		t.Errorf("EncryptStream returned %d, want %d", n, len(helloWorld))
+	}
+
+	out := &bytes.Buffer{}
+	n, err = age.DecryptStream(out, buf, i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(helloWorld)) || out.String() != helloWorld {
+		t.Errorf("wrong data: %q (%d bytes), excepted %q", out, n, helloWorld)
+	}
+}
+
+func TestDecryptChunks(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := make([]byte, 2*64*1024+100)
+	if _, err := rand.Read(plaintext); err != nil {
+		t.Fatal(err)
+	}
+	file, err := age.EncryptBytes(plaintext, i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sizes []string
+	out := &bytes.Buffer{}
+	err = age.DecryptChunks(bytes.NewReader(file), []age.Identity{i}, func(chunk []byte) error {
+		sizes = append(sizes, fmt.Sprint(len(chunk)))
+		out.Write(chunk)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), plaintext) {
+		t.Error("wrong plaintext")
+	}
+	if got := strings.Join(sizes, ","); got != "65536,65536,100" {
+		t.Errorf("got chunks of %s bytes", got)
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	err = age.DecryptChunks(bytes.NewReader(file), []age.Identity{i}, func(chunk []byte) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Errorf("got %v after %d calls, want the callback error after one", err, calls)
+	}
+
+	truncated := file[:len(file)-200]
+	if err := age.DecryptChunks(bytes.NewReader(truncated), []age.Identity{i}, func([]byte) error { return nil }); err == nil {
+		t.Error("expected an error for a truncated file")
+	}
+}
+
+func TestDecryptStreamAuto(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, armored := range []bool{false, true} {
+		e := &age.Encryptor{Armor: armored}
+		file, err := e.EncryptBytes([]byte(helloWorld), i.Recipient())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		out := &bytes.Buffer{}
+		n, err := age.DecryptStreamAuto(out, bytes.NewReader(file), i)
+		if err != nil {
+			t.Fatalf("armored=%v: %v", armored, err)
+		}
+		if n != int64(len(helloWorld)) || out.String() != helloWorld {
+			t.Errorf("armored=%v: wrong data: %q (%d bytes), expected %q", armored, out, n, helloWorld)
+		}
+
+		truncated := file[:len(file)-10]
+		if _, err := age.DecryptStreamAuto(ioutil.Discard, bytes.NewReader(truncated), i); err == nil {
+			t.Errorf("armored=%v: expected an error for a truncated file", armored)
+		}
+	}
+}
+
+type emptyRecipient struct{}
+
+func (emptyRecipient) Wrap([]byte) ([]*age.Stanza, error) { return nil, nil }
+
+func TestDecryptReaderAt(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{0, 1000, 64 * 1024, 3*64*1024 + 100} {
+		plaintext := make([]byte, size)
+		if _, err := rand.Read(plaintext); err != nil {
+			t.Fatal(err)
+		}
+		file, err := age.EncryptBytes(plaintext, i.Recipient())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r, n, err := age.DecryptReaderAt(bytes.NewReader(file), int64(len(file)), i)
+		if err != nil {
+			t.Fatalf("%d: %v", size, err)
+		}
+		if n != int64(size) {
+			t.Errorf("%d: got plaintext size %d", size, n)
+		}
+		for _, off := range []int{0, 1, 64*1024 - 1, 64 * 1024, 2*64*1024 + 50} {
+			if off > size {
+				continue
+			}
+			buf := make([]byte, 64*1024+10)
+			nn, err := r.ReadAt(buf, int64(off))
+			if want := size - off; want < len(buf) {
+				if err != io.EOF || nn != want {
+					t.Errorf("%d: ReadAt(%d) = %d, %v, want %d, EOF", size, off, nn, err, want)
+				}
+			} else if err != nil || nn != len(buf) {
+				t.Errorf("%d: ReadAt(%d) = %d, %v", size, off, nn, err)
+			}
+			if !bytes.Equal(buf[:nn], plaintext[off:off+nn]) {
+				t.Errorf("%d: ReadAt(%d) returned the wrong plaintext", size, off)
+			}
+		}
+		if _, err := r.ReadAt(make([]byte, 1), int64(size)+1); err == nil || err == io.EOF {
+			t.Errorf("%d: expected an error past the end, got %v", size, err)
+		}
+		if _, err := r.ReadAt(make([]byte, 1), -1); err == nil {
+			t.Errorf("%d: expected an error for a negative offset", size)
+		}
+	}
+
+	file, err := age.EncryptBytes(make([]byte, 3*64*1024), i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := age.DecryptReaderAt(bytes.NewReader(file), int64(len(file))-10, i); err == nil {
+		t.Error("truncated file was not detected")
+	}
+	file[len(file)-64*1024-100] ^= 1
+	r, _, err := age.DecryptReaderAt(bytes.NewReader(file), int64(len(file)), i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.ReadAt(make([]byte, 10), 0); err != nil {
+		t.Errorf("first chunk: %v", err)
+	}
+	if _, err := r.ReadAt(make([]byte, 10), 2*64*1024-100); err == nil {
+		t.Error("corrupted chunk was not detected")
+	}
+}
+
+func TestNoRecipients(t *testing.T) {
+	var e *age.NoRecipientsError
+	if _, err := age.Encrypt(ioutil.Discard); !errors.As(err, &e) || e.EmptyStanzas {
+		t.Errorf("expected NoRecipientsError, got %v", err)
+	}
+	if _, err := age.Encrypt(ioutil.Discard, emptyRecipient{}); !errors.As(err, &e) || !e.EmptyStanzas {
+		t.Errorf("expected NoRecipientsError with EmptyStanzas, got %v", err)
+	}
+}
+
+func TestPadding(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypt := func(plaintext []byte, padding func(int64) int64) []byte {
+		buf := &bytes.Buffer{}
+		w, err := (&age.Encryptor{Padding: padding}).Encrypt(buf, i.Recipient())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(plaintext); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	for _, plaintext := range []string{
+		"", helloWorld, "\x80", "\x80\x00\x00", "a\x80\x00\x80\x00b\x80\x00\x00",
+		strings.Repeat("\x00\x80", 5000) + "\x80\x00",
+	} {
+		for _, padding := range []func(int64) int64{age.PadToPowerOfTwo, age.PadToMultipleOf(1000)} {
+			out, err := age.Decrypt(bytes.NewReader(encrypt([]byte(plaintext), padding)), i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			outBytes, err := ioutil.ReadAll(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(outBytes) != plaintext {
+				t.Errorf("wrong data: %q, expected %q", outBytes, plaintext)
+			}
+		}
+	}
+
+	// Files with plaintexts of different lengths in the same bucket must have
+	// the same size.
+	a := encrypt([]byte("short"), age.PadToMultipleOf(1000))
+	b := encrypt(bytes.Repeat([]byte("a"), 999), age.PadToMultipleOf(1000))
+	if len(a) != len(b) {
+		t.Errorf("padded files have different sizes: %d and %d", len(a), len(b))
+	}
+}
+
+func TestProgress(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const size = 3*64*1024 + 100
+	want := []int64{64 * 1024, 2 * 64 * 1024, 3 * 64 * 1024, size}
+
+	var reports []int64
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pw := age.NewProgressWriter(w, 0, func(n int64) { reports = append(reports, n) })
+	for left := size; left > 0; left -= 4096 {
+		n := 4096
+		if left < n {
+			n = left
+		}
+		if _, err := pw.Write(make([]byte, n)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(reports) != fmt.Sprint(want) {
+		t.Errorf("got writer reports %v, want %v", reports, want)
+	}
+
+	reports = nil
+	r, err := age.Decrypt(buf, i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr := age.NewProgressReader(r, 0, func(n int64) { reports = append(reports, n) })
+	if _, err := io.Copy(ioutil.Discard, pr); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(reports) != fmt.Sprint(want) {
+		t.Errorf("got reader reports %v, want %v", reports, want)
+	}
+}
+
+func TestRequireArmor(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypt := func(e *age.Encryptor) []byte {
+		buf := &bytes.Buffer{}
+		w, err := e.Encrypt(buf, i.Recipient())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, helloWorld); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	armored := encrypt(&age.Encryptor{Armor: true})
+	if !bytes.HasPrefix(armored, []byte(armor.Header+"\n")) || !bytes.HasSuffix(armored, []byte(armor.Footer+"\n")) {
+		t.Fatalf("output is not armored: %q", armored)
+	}
+	d := &age.Decryptor{RequireArmor: true}
+	out, err := d.Decrypt(bytes.NewReader(armored), i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outBytes, err := ioutil.ReadAll(out); err != nil {
+		t.Fatal(err)
+	} else if string(outBytes) != helloWorld {
+		t.Errorf("wrong data: %q, excepted %q", outBytes, helloWorld)
+	}
+
+	binary := encrypt(&age.Encryptor{})
+	if _, err := d.Decrypt(bytes.NewReader(binary), i); !errors.Is(err, age.ErrNotArmored) {
+		t.Errorf("expected ErrNotArmored for binary input, got %v", err)
+	}
+}
+
+func TestAddRecipient(t *testing.T) {
+	a, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, a.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, helloWorld); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	original := buf.Bytes()
+
+	if err := age.AddRecipient(bytes.NewReader(original), []age.Identity{b}, a.Recipient(), ioutil.Discard); err == nil {
+		t.Error("expected error with an identity that can't decrypt the file")
+	}
+
+	out := &bytes.Buffer{}
+	if err := age.AddRecipient(bytes.NewReader(original), []age.Identity{a}, b.Recipient(), out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(out.Bytes(), original[len(original)-40:]) {
+		t.Error("payload was modified")
+	}
+	for _, i := range []age.Identity{a, b} {
+		r, err := age.Decrypt(bytes.NewReader(out.Bytes()), i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if outBytes, err := ioutil.ReadAll(r); err != nil {
+			t.Fatal(err)
+		} else if string(outBytes) != helloWorld {
+			t.Errorf("wrong data: %q, excepted %q", outBytes, helloWorld)
+		}
+	}
+
+	// Recipients with labels can't be checked against the existing ones.
+	labeled := &labeledRecipient{b.Recipient(), []string{"postquantum"}}
+	if err := age.AddRecipient(bytes.NewReader(original), []age.Identity{a}, labeled, ioutil.Discard); err == nil {
+		t.Error("expected an error adding a recipient with labels")
+	}
+	scrypt, err := age.NewScryptRecipient("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	scrypt.SetWorkFactor(1)
+	if err := age.AddRecipient(bytes.NewReader(original), []age.Identity{a}, scrypt, ioutil.Discard); err == nil {
+		t.Error("expected an error adding an scrypt recipient")
+	}
+}
+
+func TestRemoveRecipient(t *testing.T) {
+	a, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, a.Recipient(), b.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, helloWorld); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	original := buf.Bytes()
+
+	decrypt := func(file []byte, i age.Identity) error {
+		r, err := age.Decrypt(bytes.NewReader(file), i)
+		if err != nil {
+			return err
+		}
+		outBytes, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		if string(outBytes) != helloWorld {
+			t.Errorf("wrong data: %q, excepted %q", outBytes, helloWorld)
+		}
+		return nil
+	}
+
+	out := &bytes.Buffer{}
+	if err := age.RemoveRecipient(bytes.NewReader(original), []age.Identity{a}, []age.Recipient{a.Recipient()}, out); err != nil {
+		t.Fatal(err)
+	}
+	if err := decrypt(out.Bytes(), a); err != nil {
+		t.Error(err)
+	}
+	if err := decrypt(out.Bytes(), b); err == nil {
+		t.Error("removed recipient can still decrypt the file")
+	}
+	if bytes.HasSuffix(out.Bytes(), original[len(original)-40:]) {
+		t.Error("payload was not re-encrypted")
+	}
+
+	// Drop b's stanza, which is the second one, without re-keying.
+	n := 0
+	out.Reset()
+	if err := age.UnsafeRemoveStanzas(bytes.NewReader(original), []age.Identity{a}, func(s *age.Stanza) bool {
+		n++
+		return n == 2
+	}, out); err != nil {
+		t.Fatal(err)
+	}
+	if err := decrypt(out.Bytes(), a); err != nil {
+		t.Error(err)
+	}
+	if err := decrypt(out.Bytes(), b); err == nil {
+		t.Error("removed stanza can still be used")
+	}
+	if !bytes.HasSuffix(out.Bytes(), original[len(original)-40:]) {
+		t.Error("payload was modified")
+	}
+}
+
+func TestDecryptConcatenated(t *testing.T) {
+	a, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sizes := []int{0, 100, 64 * 1024, 64*1024 + 1, 3 * 64 * 1024}
+	var plaintexts [][]byte
+	buf := &bytes.Buffer{}
+	for n, size := range sizes {
+		r := a.Recipient()
+		if n%2 == 1 {
+			r = b.Recipient()
+		}
+		w, err := age.Encrypt(buf, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := make([]byte, size)
+		if _, err := rand.Read(p); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(p); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		plaintexts = append(plaintexts, p)
+	}
+
+	d := age.DecryptConcatenated(bytes.NewReader(buf.Bytes()), a, b)
+	for n, want := range plaintexts {
+		r, err := d.Next()
+		if err != nil {
+			t.Fatalf("file #%d: %v", n, err)
+		}
+		if n == 2 {
+			// Leave the file unread, to check that Next skips it.
+			continue
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("file #%d: %v", n, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("file #%d: wrong plaintext", n)
+		}
+	}
+	if _, err := d.Next(); err != io.EOF {
+		t.Errorf("expected io.EOF after the last file, got %v", err)
+	}
+
+	d = age.DecryptConcatenated(io.MultiReader(bytes.NewReader(buf.Bytes()), strings.NewReader("garbage")), a, b)
+	for {
+		if _, err := d.Next(); err == io.EOF {
+			t.Fatal("trailing garbage was not rejected")
+		} else if err != nil {
+			break
+		}
+	}
+}
+
+func TestEncryptBytes(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{0, 32, 64 * 1024, 64*1024 + 1} {
+		plaintext := make([]byte, size)
+		if _, err := rand.Read(plaintext); err != nil {
+			t.Fatal(err)
+		}
+		file, err := age.EncryptBytes(plaintext, i.Recipient())
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := age.Decrypt(bytes.NewReader(file), i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, plaintext) {
+			t.Errorf("size %d: wrong plaintext", size)
+		}
+	}
+	if _, err := age.EncryptBytes([]byte(helloWorld)); err == nil {
+		t.Error("expected error with no recipients")
+	}
+}
+
+func TestUnsafeIgnoreErrors(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := make([]byte, 3*64*1024+100)
+	if _, err := rand.Read(plaintext); err != nil {
+		t.Fatal(err)
+	}
+	file, err := age.EncryptBytes(plaintext, i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Flip a bit in the third chunk, before the last short one.
+	file[len(file)-100-16-1000] ^= 1
+
+	if r, err := age.Decrypt(bytes.NewReader(file), i); err != nil {
+		t.Fatal(err)
+	} else if _, err := ioutil.ReadAll(r); err == nil {
+		t.Fatal("corruption was not detected")
+	}
+
+	d := &age.Decryptor{UnsafeIgnoreErrors: true}
+	r, err := d.Decrypt(bytes.NewReader(file), i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []byte
+	var corrupted []int64
+	buf := make([]byte, 4096)
+	for {
+		n, err := r.Read(buf)
+		out = append(out, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err, ok := err.(*age.CorruptedPayloadError); ok {
+			corrupted = append(corrupted, err.Offset)
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(corrupted) != 1 || corrupted[0] != 2*64*1024 {
+		t.Fatalf("got corruption at %v, want [%d]", corrupted, 2*64*1024)
+	}
+	if !bytes.Equal(out[:2*64*1024], plaintext[:2*64*1024]) {
+		t.Error("wrong plaintext before the corruption")
+	}
+	if !bytes.Equal(out[2*64*1024:], plaintext[3*64*1024:]) {
+		t.Error("wrong plaintext after the corruption")
+	}
+}
+
+func TestDecryptAtomic(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := make([]byte, 3*64*1024+100)
+	if _, err := rand.Read(plaintext); err != nil {
+		t.Fatal(err)
+	}
+	file, err := age.EncryptBytes(plaintext, i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := &bytes.Buffer{}
+	if err := age.DecryptAtomic(bytes.NewReader(file), out, i); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), plaintext) {
+		t.Error("wrong plaintext")
+	}
+
+	// Corrupt the last chunk: nothing must be written, not even the valid
+	// chunks before it.
+	file[len(file)-1] ^= 1
+	out.Reset()
+	if err := age.DecryptAtomic(bytes.NewReader(file), out, i); err == nil {
+		t.Fatal("corruption was not detected")
+	}
+	if out.Len() != 0 {
+		t.Errorf("%d bytes were written despite the error", out.Len())
+	}
+
+	d := &age.Decryptor{UnsafeIgnoreErrors: true}
+	if err := d.DecryptAtomic(bytes.NewReader(file), out, i); err == nil {
+		t.Error("expected an error with UnsafeIgnoreErrors")
+	}
+}
+
+type fixedReader byte
+
+func (r fixedReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(r)
+	}
+	return len(p), nil
+}
+
+func TestEncryptorRand(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A constant source is horribly insecure, but makes the output repeatable.
+	e := &age.Encryptor{Rand: fixedReader(42)}
+	a, err := e.EncryptBytes([]byte(helloWorld), i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := e.EncryptBytes([]byte(helloWorld), i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(a, b) {
+		t.Error("output is not determined by the random source")
+	}
+	r, err := age.Decrypt(bytes.NewReader(a), i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := ioutil.ReadAll(r); err != nil {
+		t.Fatal(err)
+	} else if string(out) != helloWorld {
+		t.Errorf("wrong data: %q, excepted %q", out, helloWorld)
+	}
+
+	c, err := (&age.Encryptor{}).EncryptBytes([]byte(helloWorld), i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(a, c) {
+		t.Error("the default random source was not used")
+	}
+}
+
+func TestDeterministicHeader(t *testing.T) {
+	var recipients []age.Recipient
+	for n := 0; n < 10; n++ {
+		i, err := age.GenerateX25519Identity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		recipients = append(recipients, i.Recipient())
+	}
+	header := func(recipients []age.Recipient) string {
+		buf := &bytes.Buffer{}
+		e := &age.Encryptor{Rand: fixedReader(42), HeaderWriter: buf, GroupName: "test", NotBefore: time.Unix(0, 0)}
+		if _, err := e.EncryptBytes([]byte(helloWorld), recipients...); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+
+	a := header(recipients)
+	for n := 0; n < 10; n++ {
+		if b := header(recipients); b != a {
+			t.Fatalf("header changed between runs:\n%s\n%s", a, b)
+		}
+	}
+
+	// The stanzas follow the order of the recipients.
+	reversed := make([]age.Recipient, len(recipients))
+	for n, r := range recipients {
+		reversed[len(recipients)-1-n] = r
+	}
+	lines := func(h string) []string {
+		// With a fixed Rand, all stanzas have the same ephemeral share, so
+		// compare their bodies, which depend on the recipient.
+		var stanzas []string
+		ll := strings.Split(h, "\n")
+		for n, l := range ll {
+			if strings.HasPrefix(l, "-> X25519 ") {
+				stanzas = append(stanzas, ll[n+1])
+			}
+		}
+		return stanzas
+	}
+	fwd, rev := lines(a), lines(header(reversed))
+	if len(fwd) != len(recipients) || len(rev) != len(recipients) {
+		t.Fatalf("unexpected number of stanzas: %d, %d", len(fwd), len(rev))
+	}
+	for n := range fwd {
+		if fwd[n] != rev[len(rev)-1-n] {
+			t.Errorf("stanza %d is not in recipient order", n)
+		}
+	}
+}
+
+func TestRekeyTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "age-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldID, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newID, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(name string, r age.Recipient) {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		file, err := age.EncryptBytes([]byte(helloWorld), r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, file, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a.age", oldID.Recipient())
+	write("sub/b.age", oldID.Recipient())
+	write("sub/other.age", other.Recipient())
+	write("sub/ignored.txt", oldID.Recipient())
+	if err := ioutil.WriteFile(filepath.Join(dir, "sub/a-corrupted.age"), []byte("nope"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := age.RekeyTree(dir, []age.Identity{oldID}, []age.Recipient{newID.Recipient()}, age.RekeyOptions{}); err == nil {
+		t.Error("expected error for corrupted file")
+	}
+
+	results, err := age.RekeyTree(dir, []age.Identity{oldID}, []age.Recipient{newID.Recipient()}, age.RekeyOptions{ContinueOnError: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	for _, res := range results {
+		rel, _ := filepath.Rel(dir, res.Path)
+		switch {
+		case res.Err != nil:
+			got[filepath.ToSlash(rel)] = "error"
+		case res.Skipped:
+			got[filepath.ToSlash(rel)] = "skipped"
+		default:
+			got[filepath.ToSlash(rel)] = "ok"
+		}
+	}
+	// a.age was already rekeyed by the first, interrupted run.
+	want := map[string]string{"a.age": "skipped", "sub/b.age": "ok",
+		"sub/a-corrupted.age": "error", "sub/other.age": "skipped"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got results %v, want %v", got, want)
+	}
+
+	for _, name := range []string{"a.age", "sub/b.age"} {
+		f, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if fi, err := f.Stat(); err != nil {
+			t.Fatal(err)
+		} else if runtime.GOOS != "windows" && fi.Mode().Perm() != 0600 {
+			t.Errorf("%s: mode is %v, want 0600", name, fi.Mode())
+		}
+		r, err := age.Decrypt(f, newID)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if out, err := ioutil.ReadAll(r); err != nil {
+			t.Fatal(err)
+		} else if string(out) != helloWorld {
+			t.Errorf("%s: wrong data: %q, excepted %q", name, out, helloWorld)
+		}
+	}
+}
+
+func TestConvertArmor(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary, err := age.EncryptBytes([]byte(helloWorld), i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	armored := &bytes.Buffer{}
+	if toArmor, err := age.ConvertArmor(bytes.NewReader(binary), armored); err != nil {
+		t.Fatal(err)
+	} else if !toArmor {
+		t.Error("binary file was not converted to armor")
+	}
+	if !strings.HasPrefix(armored.String(), armor.Header) {
+		t.Errorf("output is not armored: %q", armored)
+	}
+	r, err := age.Decrypt(armor.NewReader(bytes.NewReader(armored.Bytes())), i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := ioutil.ReadAll(r); err != nil {
+		t.Fatal(err)
+	} else if string(out) != helloWorld {
+		t.Errorf("wrong data: %q, excepted %q", out, helloWorld)
+	}
+
+	back := &bytes.Buffer{}
+	if toArmor, err := age.ConvertArmor(bytes.NewReader(armored.Bytes()), back); err != nil {
+		t.Fatal(err)
+	} else if toArmor {
+		t.Error("armored file was not converted to binary")
+	}
+	if !bytes.Equal(back.Bytes(), binary) {
+		t.Error("binary to armored to binary round-trip changed the file")
+	}
+
+	corrupted := bytes.Replace(armored.Bytes(), []byte(armor.Footer), []byte("-----END AGE ENCRYPTED FILE----"), 1)
+	if _, err := age.ConvertArmor(bytes.NewReader(corrupted), ioutil.Discard); err == nil {
+		t.Error("invalid armor was not detected")
+	}
+	if _, err := age.ConvertArmor(strings.NewReader("not an age file\n"), ioutil.Discard); err == nil {
+		t.Error("invalid header was not detected")
+	}
+}
+
+func TestSplitHeaderBody(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{0, 100, 3*64*1024 + 100} {
+		rs := []age.Recipient{i.Recipient()}
+		for n := 0; n < size/1000; n++ {
+			// Make the header larger than bufio's default buffer.
+			other, err := age.GenerateX25519Identity()
+			if err != nil {
+				t.Fatal(err)
+			}
+			rs = append(rs, other.Recipient())
+		}
+		file, err := age.EncryptBytes(make([]byte, size), rs...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		header, body, err := age.SplitHeaderBody(bytes.NewReader(file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(file, header) || !bytes.HasSuffix(header, []byte("\n")) {
+			t.Fatalf("%d: header is not a prefix of the file", size)
+		}
+		rest, err := ioutil.ReadAll(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(rest, file[len(header):]) {
+			t.Errorf("%d: body doesn't start after the header", size)
+		}
+	}
+
+	if _, _, err := age.SplitHeaderBody(strings.NewReader("age-encryption.org/v1\n")); err == nil {
+		t.Error("expected an error for a truncated header")
+	}
+}
+
+func TestJoinHeaderBody(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := age.EncryptBytes([]byte(helloWorld), i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, body, err := age.SplitHeaderBody(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	macStart := bytes.Index(header, []byte("\n--- ")) + len("\n--- ")
+	shortMAC := append(append([]byte{}, header[:macStart]...), "AAAA\n"...)
+
+	out := &bytes.Buffer{}
+	if err := age.JoinHeaderBody(header, body, out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), file) {
+		t.Error("joined file is different from the original")
+	}
+
+	for name, h := range map[string][]byte{
+		"truncated":     header[:len(header)-10],
+		"no newline":    header[:len(header)-1],
+		"trailing":      append(append([]byte{}, header...), 'x'),
+		"short MAC":     shortMAC,
+		"no intro":      header[len("age-encryption.org/v1\n"):],
+		"not canonical": bytes.Replace(header, []byte("\n--- "), []byte("\n---  "), 1),
+	} {
+		out.Reset()
+		if err := age.JoinHeaderBody(h, strings.NewReader("payload"), out); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+		if out.Len() != 0 {
+			t.Errorf("%s: data was written despite the error", name)
+		}
+	}
+}
+
+func TestIsEncrypted(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary, err := age.EncryptBytes([]byte(helloWorld), i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	armored, err := (&age.Encryptor{Armor: true}).EncryptBytes([]byte(helloWorld), i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{"binary", binary, true},
+		{"armored", armored, true},
+		{"plaintext", []byte(helloWorld), false},
+		{"empty", nil, false},
+		{"intro only", []byte("age-encryption.org/v1\n"), true},
+		{"armored after whitespace", append([]byte(" \t\r\n\n"), armored...), true},
+		{"armored after too much whitespace", append(bytes.Repeat([]byte("\n"), armor.MaxLeadingWhitespace+1), armored...), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Hide the bytes.Reader methods, to check it works on any stream.
+			src := struct{ io.Reader }{bytes.NewReader(tt.data)}
+			got, r, err := age.IsEncrypted(src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("IsEncrypted() = %v, want %v", got, tt.want)
+			}
+			rest, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(rest, tt.data) {
+				t.Error("the returned Reader doesn't yield the original content")
+			}
+		})
+	}
+}
+
+// TestArmorWhitespace checks that all the functions that accept both binary
+// and armored files agree on the whitespace allowed before the armor.
+func TestArmorWhitespace(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary, err := age.EncryptBytes([]byte(helloWorld), i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	armored := &bytes.Buffer{}
+	if _, err := age.ConvertArmor(bytes.NewReader(binary), armored); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, prefix string
+		ok           bool
+	}{
+		{"none", "", true},
+		{"spaces", "  \t", true},
+		{"blank line", "\n", true},
+		{"blank lines and CRLF", "\r\n \n\t", true},
+		{"too much", strings.Repeat("\n", armor.MaxLeadingWhitespace+1), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := append([]byte(tt.prefix), armored.Bytes()...)
+
+			r, err := (&age.Decryptor{RequireArmor: true}).Decrypt(bytes.NewReader(file), i)
+			if err == nil {
+				var out []byte
+				out, err = ioutil.ReadAll(r)
+				if err == nil && string(out) != helloWorld {
+					t.Errorf("Decrypt: wrong data %q", out)
+				}
+			}
+			if (err == nil) != tt.ok {
+				t.Errorf("Decrypt: got error %v, want success %v", err, tt.ok)
+			}
+
+			pt := &bytes.Buffer{}
+			err = age.Process(pt, bytes.NewReader(file), age.ProcessOptions{
+				Decrypt: true, Identities: []age.Identity{i}, RequireArmor: true,
+			})
+			if (err == nil) != tt.ok {
+				t.Errorf("Process: got error %v, want success %v", err, tt.ok)
+			} else if err == nil && pt.String() != helloWorld {
+				t.Errorf("Process: wrong data %q", pt)
+			}
+
+			if ok, err := age.CanDecrypt(bytes.NewReader(file), int64(len(file)), i); ok != tt.ok {
+				t.Errorf("CanDecrypt: got %v, %v; want %v", ok, err, tt.ok)
+			}
+
+			if ok, _, err := age.IsEncrypted(bytes.NewReader(file)); err != nil || ok != tt.ok {
+				t.Errorf("IsEncrypted: got %v, %v; want %v", ok, err, tt.ok)
+			}
+
+			back := &bytes.Buffer{}
+			toArmor, err := age.ConvertArmor(bytes.NewReader(file), back)
+			if (err == nil && !toArmor) != tt.ok {
+				t.Errorf("ConvertArmor: got armored output %v, error %v", toArmor, err)
+			} else if tt.ok && !bytes.Equal(back.Bytes(), binary) {
+				t.Error("ConvertArmor: wrong binary output")
+			}
+
+			if tt.ok {
+				if _, err := ioutil.ReadAll(armor.NewReader(bytes.NewReader(file))); err != nil {
+					t.Errorf("armor.NewReader: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestRecords(t *testing.T) {
+	a, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	w, err := age.NewRecordWriter(buf, a.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := []string{"first", "", strings.Repeat("x", 100000)}
+	for _, rec := range records {
+		if err := w.WriteRecord([]byte(rec)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	log := buf.Bytes()
+
+	r := age.NewRecordReader(bytes.NewReader(log), a)
+	for n, want := range records {
+		got, err := r.Next()
+		if err != nil {
+			t.Fatalf("record #%d: %v", n, err)
+		}
+		if string(got) != want {
+			t.Errorf("record #%d: wrong plaintext", n)
+		}
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("expected io.EOF after the last record, got %v", err)
+	}
+
+	r = age.NewRecordReader(bytes.NewReader(log[:len(log)-10]), a)
+	r.Next()
+	r.Next()
+	if _, err := r.Next(); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF for a truncated record, got %v", err)
+	}
+
+	b, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := age.NewRecordReader(bytes.NewReader(log), b).Next(); err == nil || err == io.EOF {
+		t.Errorf("expected error with the wrong identity, got %v", err)
+	}
+}
+
+func TestChainedRecords(t *testing.T) {
+	a, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	w, err := age.NewChainedRecordWriter(buf, nil, a.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range []string{"0", "1", "2"} {
+		if err := w.WriteRecord([]byte(rec)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Resume the log, starting from the head returned by a reader.
+	r := age.NewChainedRecordReader(bytes.NewReader(buf.Bytes()), a)
+	for {
+		if _, err := r.Next(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(r.ChainHead(), w.ChainHead()) {
+		t.Errorf("reader and writer chain heads differ")
+	}
+	w, err = age.NewChainedRecordWriter(buf, r.ChainHead(), a.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteRecord([]byte("3")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Split the log into its length-prefixed records.
+	var records [][]byte
+	for log := buf.Bytes(); len(log) > 0; {
+		n := 4 + int(binary.BigEndian.Uint32(log))
+		records = append(records, log[:n])
+		log = log[n:]
+	}
+	if len(records) != 4 {
+		t.Fatalf("got %d records, want 4", len(records))
+	}
+	readAll := func(rr *age.RecordReader) (string, error) {
+		var got string
+		for {
+			p, err := rr.Next()
+			if err == io.EOF {
+				return got, nil
+			}
+			if err != nil {
+				return got, err
+			}
+			got += string(p)
+		}
+	}
+	for _, r := range []*age.RecordReader{
+		age.NewChainedRecordReader(bytes.NewReader(buf.Bytes()), a),
+		age.NewRecordReader(bytes.NewReader(buf.Bytes()), a),
+	} {
+		if got, err := readAll(r); err != nil || got != "0123" {
+			t.Errorf("got %q, %v; want %q", got, err, "0123")
+		}
+	}
+
+	for name, order := range map[string][]int{
+		"removed":   {0, 2, 3},
+		"reordered": {0, 2, 1, 3},
+		"first":     {1, 2, 3},
+	} {
+		var log []byte
+		for _, n := range order {
+			log = append(log, records[n]...)
+		}
+		_, err := readAll(age.NewChainedRecordReader(bytes.NewReader(log), a))
+		if err != age.ErrBrokenChain {
+			t.Errorf("%s: got error %v, want ErrBrokenChain", name, err)
+		}
+	}
+
+	unchained := &bytes.Buffer{}
+	uw, err := age.NewRecordWriter(unchained, a.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := uw.WriteRecord([]byte("0")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := age.NewChainedRecordReader(unchained, a).Next(); err == nil {
+		t.Error("expected an error reading an unchained log")
+	}
+
+	s, err := age.NewScryptRecipient("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := age.NewChainedRecordWriter(buf, nil, s); err == nil {
+		t.Error("expected an error with an scrypt recipient")
+	}
+}
+
+func TestSameRecipients(t *testing.T) {
+	var hinted []age.Recipient
+	for i := 0; i < 2; i++ {
+		id, err := age.GenerateX25519Identity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := age.NewHintedRecipient(id.Recipient())
+		if err != nil {
+			t.Fatal(err)
+		}
+		hinted = append(hinted, r)
+	}
+	encrypt := func(e *age.Encryptor, recipients ...age.Recipient) []byte {
+		t.Helper()
+		file, err := e.EncryptBytes([]byte(helloWorld), recipients...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	ab := encrypt(&age.Encryptor{GroupName: "test"}, hinted[0], hinted[1])
+	ba := encrypt(&age.Encryptor{Padding: age.PadToPowerOfTwo, Armor: true}, hinted[1], hinted[0])
+	a := encrypt(&age.Encryptor{}, hinted[0])
+
+	for _, tc := range []struct {
+		a, b []byte
+		want bool
+	}{
+		{ab, ba, true},
+		{ab, ab, true},
+		{ab, a, false},
+		{a, ba, false},
+	} {
+		got, err := age.SameRecipients(bytes.NewReader(tc.a), bytes.NewReader(tc.b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("got %v, want %v", got, tc.want)
+		}
+	}
+
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unhinted := encrypt(&age.Encryptor{}, id.Recipient())
+	if _, err := age.SameRecipients(bytes.NewReader(unhinted), bytes.NewReader(unhinted)); err != age.ErrRecipientsNotComparable {
+		t.Errorf("got error %v, want ErrRecipientsNotComparable", err)
+	}
+}
+
+func TestEncryptWithLength(t *testing.T) {
+	a, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// With a constant random source, the output is the same as Encrypt's.
+	for _, e := range []*age.Encryptor{
+		{Rand: fixedReader(42)},
+		{Rand: fixedReader(42), Armor: true},
+		{Rand: fixedReader(42), Padding: age.PadToMultipleOf(1000)},
+		{Rand: fixedReader(42), Armor: true, Padding: age.PadToPowerOfTwo, GroupName: "test"},
+	} {
+		for _, size := range []int{0, 1, 47, 48, 100, 64 * 1024, 64*1024 + 1, 3 * 64 * 1024} {
+			plaintext := bytes.Repeat([]byte{'x'}, size)
+			want := &bytes.Buffer{}
+			w, err := e.Encrypt(want, a.Recipient(), b.Recipient())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.Write(plaintext); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			buf := &bytes.Buffer{}
+			length, w, err := e.EncryptWithLength(buf, int64(size), a.Recipient(), b.Recipient())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if buf.Len() != 0 {
+				t.Errorf("%d bytes written before the first Write", buf.Len())
+			}
+			if _, err := w.Write(plaintext); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("armor %v, size %d: %v", e.Armor, size, err)
+			}
+			if int64(buf.Len()) != length {
+				t.Errorf("armor %v, size %d: got %d bytes, declared %d", e.Armor, size, buf.Len(), length)
+			}
+			if !bytes.Equal(buf.Bytes(), want.Bytes()) {
+				t.Errorf("armor %v, size %d: output differs from Encrypt", e.Armor, size)
+			}
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	_, w, err := age.EncryptWithLength(buf, int64(len(helloWorld)), a.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, helloWorld); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	out, err := age.Decrypt(buf, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadAll(out); err != nil || string(got) != helloWorld {
+		t.Errorf("got %q, %v", got, err)
+	}
+
+	_, w, err = age.EncryptWithLength(ioutil.Discard, 5, a.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte(helloWorld)); err != age.ErrLengthMismatch {
+		t.Errorf("got %v for a longer plaintext, want ErrLengthMismatch", err)
+	}
+	if _, err := w.Write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != age.ErrLengthMismatch {
+		t.Errorf("got %v for a shorter plaintext, want ErrLengthMismatch", err)
+	}
+}
+
+func TestHeaderMAC(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// With a constant random source, the file key is known.
+	e := &age.Encryptor{Rand: fixedReader(42)}
+	file, err := e.EncryptBytes([]byte(helloWorld), i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileKey := bytes.Repeat([]byte{42}, 16)
+
+	end := bytes.Index(file, []byte("\n---")) + len("\n---")
+	macLine := file[end+1:]
+	macLine = macLine[:bytes.IndexByte(macLine, '\n')]
+	want, err := base64.RawStdEncoding.DecodeString(string(macLine))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := age.HeaderMAC(fileKey, file[:end]); !bytes.Equal(got, want) {
+		t.Errorf("got MAC %x, want %x", got, want)
+	}
+}
+
+func TestParseEncryptedIdentities(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := age.NewScryptRecipient("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetWorkFactor(10)
+	passphrase, err := age.NewScryptIdentity("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypt := func(layers int) []byte {
+		file := []byte(i.String() + "\n")
+		for n := 0; n < layers; n++ {
+			e := &age.Encryptor{Armor: n%2 == 1}
+			file, err = e.EncryptBytes(file, r)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return file
+	}
+
+	for layers := 0; layers <= 5; layers++ {
+		calls := 0
+		unlock := func() ([]age.Identity, error) {
+			calls++
+			return []age.Identity{passphrase}, nil
+		}
+		ids, err := age.ParseEncryptedIdentities(bytes.NewReader(encrypt(layers)), unlock)
+		if layers > 4 {
+			if err == nil {
+				t.Errorf("%d layers: expected an error", layers)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%d layers: %v", layers, err)
+		}
+		if len(ids) != 1 || ids[0].(*age.X25519Identity).String() != i.String() {
+			t.Errorf("%d layers: wrong identities", layers)
+		}
+		if calls != layers {
+			t.Errorf("%d layers: unlock called %d times", layers, calls)
+		}
+	}
+
+	if _, err := age.ParseEncryptedIdentities(bytes.NewReader(encrypt(1)), nil); err == nil {
+		t.Error("expected an error without unlock")
+	}
+	wrong, err := age.NewScryptIdentity("wrong")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := age.ParseEncryptedIdentities(bytes.NewReader(encrypt(1)), func() ([]age.Identity, error) {
+		return []age.Identity{wrong}, nil
+	}); err == nil {
+		t.Error("expected an error with the wrong passphrase")
+	}
+}
+
+type mapResolver map[string]string
+
+func (m mapResolver) ResolveSecretRef(ref string) (string, error) {
+	s, ok := m[ref]
+	if !ok {
+		return "", fmt.Errorf("unknown reference %q", ref)
+	}
+	return s, nil
+}
+
+func TestParseIdentitiesWithResolver(t *testing.T) {
+	a, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver := mapResolver{
+		"op://vault/item/field":        a.String(),
+		"vault:secret/data/path#key":   "# comment\n" + b.String() + "\n",
+		"op://vault/item/nested":       "op://vault/item/field",
+		"op://vault/item/not-a-secret": "hello",
+	}
+
+	ids, err := age.ParseIdentitiesWithResolver(strings.NewReader(
+		"# keys\nop://vault/item/field\n"+b.String()+"\nvault:secret/data/path#key\n"), resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, i := range ids {
+		got = append(got, i.(*age.X25519Identity).String())
+	}
+	if want := []string{a.String(), b.String(), b.String()}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got identities %q, want %q", got, want)
+	}
+
+	for _, bad := range []string{
+		"op://vault/item/missing",
+		"op://vault/item/nested",
+		"op://vault/item/not-a-secret",
+		"1op://vault/item/field",
+	} {
+		_, err := age.ParseIdentitiesWithResolver(strings.NewReader(bad), resolver)
+		if err == nil {
+			t.Errorf("%q: expected an error", bad)
+			continue
+		}
+		if strings.Contains(err.Error(), "AGE-SECRET-KEY-") || strings.Contains(err.Error(), "hello") {
+			t.Errorf("%q: error leaks the secret: %v", bad, err)
+		}
+	}
+	if _, err := age.ParseIdentities(strings.NewReader("op://vault/item/field")); err == nil {
+		t.Error("ParseIdentities resolved a reference")
+	}
+}
+
+func TestSetLogger(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permission bits are not meaningful on Windows")
+	}
+	dir, err := ioutil.TempDir("", "age-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	idsFile := filepath.Join(dir, "key.txt")
+	if err := ioutil.WriteFile(idsFile, []byte(i.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var warnings []string
+	previous := age.SetLogger(func(level, msg string, kv ...interface{}) {
+		warnings = append(warnings, fmt.Sprint(level, ": ", msg, kv))
+	})
+	defer age.SetLogger(previous)
+
+	c := &age.Config{IdentityFiles: []string{idsFile}}
+	if _, _, err := c.BuildDecryptor(); err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 0 {
+		t.Errorf("unexpected warnings: %q", warnings)
+	}
+
+	if err := os.Chmod(idsFile, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.BuildDecryptor(); err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 || !strings.HasPrefix(warnings[0], "warning: ") || !strings.Contains(warnings[0], idsFile) {
+		t.Errorf("got warnings %q, want one about %q", warnings, idsFile)
+	}
+
+	age.SetLogger(nil)
+	if _, _, err := c.BuildDecryptor(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetStrict(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permission bits are not meaningful on Windows")
+	}
+	dir, err := ioutil.TempDir("", "age-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	idsFile := filepath.Join(dir, "key.txt")
+	if err := ioutil.WriteFile(idsFile, []byte(i.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(idsFile, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var warnings []string
+	previous := age.SetLogger(func(level, msg string, kv ...interface{}) {
+		warnings = append(warnings, msg)
+	})
+	defer age.SetLogger(previous)
+	defer age.SetStrict(age.SetStrict(true))
+
+	c := &age.Config{IdentityFiles: []string{idsFile}}
+	if _, _, err := c.BuildDecryptor(); err == nil || !strings.Contains(err.Error(), "readable by other users") {
+		t.Errorf("BuildDecryptor: got %v, want a world-readable error", err)
+	}
+	if _, errs := age.ResolveRecipients(age.RecipientSpec{IdentityFiles: []string{idsFile}}); len(errs) != 1 {
+		t.Errorf("ResolveRecipients: got errors %v, want one", errs)
+	}
+	f, err := os.Open(idsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var warning *age.WarningError
+	if err := age.CheckIdentityFile(f); !errors.As(err, &warning) {
+		t.Errorf("CheckIdentityFile: got %v, want a *WarningError", err)
+	} else if warning.Msg == "" || !strings.Contains(err.Error(), idsFile) {
+		t.Errorf("unexpected warning %q", err)
+	}
+	if len(warnings) != 0 {
+		t.Errorf("unexpected warnings in strict mode: %q", warnings)
+	}
+
+	age.SetStrict(false)
+	if err := age.CheckIdentityFile(f); err != nil {
+		t.Errorf("CheckIdentityFile: unexpected error outside strict mode: %v", err)
+	}
+	if len(warnings) != 1 {
+		t.Errorf("got warnings %q, want one", warnings)
+	}
+}
+
+func TestAcceptNewerMinorVersion(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// With a constant random source, the file key is known, so the header
+	// MAC can be recomputed after changing the version line.
+	e := &age.Encryptor{Rand: fixedReader(42)}
+	file, err := e.EncryptBytes([]byte(helloWorld), i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileKey := bytes.Repeat([]byte{42}, 16)
+	withIntro := func(intro string) []byte {
+		f := append([]byte(intro), file[len("age-encryption.org/v1\n"):]...)
+		end := bytes.Index(f, []byte("\n---")) + len("\n---")
+		payload := f[end+1:]
+		payload = payload[bytes.IndexByte(payload, '\n')+1:]
+		mac := base64.RawStdEncoding.EncodeToString(age.HeaderMAC(fileKey, f[:end]))
+		out := append([]byte{}, f[:end]...)
+		out = append(out, " "+mac+"\n"...)
+		return append(out, payload...)
+	}
+
+	d := &age.Decryptor{AcceptNewerMinorVersion: true}
+	for _, intro := range []string{"age-encryption.org/v1\n", "age-encryption.org/v1.1\n", "age-encryption.org/v1.23\n"} {
+		f := withIntro(intro)
+		r, err := d.Decrypt(bytes.NewReader(f), i)
+		if err != nil {
+			t.Errorf("%q: %v", intro, err)
+			continue
+		}
+		if out, err := ioutil.ReadAll(r); err != nil || string(out) != helloWorld {
+			t.Errorf("%q: got %q, %v", intro, out, err)
+		}
+		if intro != "age-encryption.org/v1\n" {
+			if _, err := age.Decrypt(bytes.NewReader(f), i); err == nil {
+				t.Errorf("%q: accepted without AcceptNewerMinorVersion", intro)
+			}
+		}
+	}
+	for _, intro := range []string{"age-encryption.org/v2\n", "age-encryption.org/v2.1\n", "age-encryption.org/v1.01\n", "age-encryption.org/v1.\n", "age-encryption.org/v1.x\n"} {
+		if _, err := d.Decrypt(bytes.NewReader(withIntro(intro)), i); err == nil {
+			t.Errorf("%q: expected an error", intro)
+		}
+	}
+
+	// The version line is covered by the header MAC.
+	tampered := bytes.Replace(withIntro("age-encryption.org/v1.1\n"), []byte("v1.1"), []byte("v1.2"), 1)
+	if _, err := d.Decrypt(bytes.NewReader(tampered), i); err == nil {
+		t.Error("tampered version line was not detected")
+	}
+}
+
+func TestConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "age-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	idsFile := filepath.Join(dir, "key.txt")
+	if err := ioutil.WriteFile(idsFile, []byte(i.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []*age.Config{
+		{Recipients: []string{i.Recipient().String()}, Armor: true},
+		{IdentityFiles: []string{idsFile}},
+	} {
+		p, err := c.BuildEncryptor()
+		if err != nil {
+			t.Fatal(err)
+		}
+		file, err := p.EncryptBytes([]byte(helloWorld))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Armor {
+			file, err = ioutil.ReadAll(armor.NewReader(bytes.NewReader(file)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		d, ids, err := (&age.Config{IdentityFiles: []string{idsFile}}).BuildDecryptor()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.Decrypt(bytes.NewReader(file), ids...); err != nil {
+			t.Error(err)
+		}
+	}
+
+	c := &age.Config{Passphrase: "password", ScryptWorkFactor: 10}
+	p, err := c.BuildEncryptor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := p.EncryptBytes([]byte(helloWorld))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, ids, err := (&age.Config{Passphrase: "password"}).BuildDecryptor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Decrypt(bytes.NewReader(file), ids...); err != nil {
+		t.Error(err)
+	}
+
+	for name, c := range map[string]*age.Config{
+		"passphrase and recipients": {Passphrase: "password", Recipients: []string{i.Recipient().String()}},
+		"nothing":                   {},
+		"work factor alone":         {Recipients: []string{i.Recipient().String()}, ScryptWorkFactor: 10},
+		"bad work factor":           {Passphrase: "password", ScryptWorkFactor: 31},
+		"bad recipient":             {Recipients: []string{"age1nope"}},
+	} {
+		if _, err := c.BuildEncryptor(); err == nil {
+			t.Errorf("BuildEncryptor: %s: expected an error", name)
+		}
+	}
+	for name, c := range map[string]*age.Config{
+		"recipients":                    {IdentityFiles: []string{idsFile}, Recipients: []string{i.Recipient().String()}},
+		"armor":                         {IdentityFiles: []string{idsFile}, Armor: true},
+		"passphrase and identity files": {IdentityFiles: []string{idsFile}, Passphrase: "password"},
+		"nothing":                       {},
+		"missing file":                  {IdentityFiles: []string{filepath.Join(dir, "missing.txt")}},
+	} {
+		if _, _, err := c.BuildDecryptor(); err == nil {
+			t.Errorf("BuildDecryptor: %s: expected an error", name)
+		}
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	c := age.Capabilities()
+	if c.Version != age.CapabilitiesVersion || c.Format != "age-encryption.org/v1" {
+		t.Errorf("unexpected version or format: %+v", c)
+	}
+	// Other tests register more prefixes.
+	if !strings.Contains(" "+strings.Join(c.RecipientPrefixes, " ")+" ", " age1 ") {
+		t.Errorf("missing age1 in recipient prefixes: %q", c.RecipientPrefixes)
+	}
+	j, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"version", "format", "recipient_prefixes",
+		"identity_prefixes", "plugins", "extensions", "experimental"} {
+		if !strings.Contains(string(j), `"`+key+`":`) {
+			t.Errorf("missing %q in %s", key, j)
+		}
+	}
+}
+
+func TestProcess(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipients := []age.Recipient{i.Recipient()}
+	identities := []age.Identity{i}
+
+	for _, armored := range []bool{false, true} {
+		ct := &bytes.Buffer{}
+		if err := age.Process(ct, strings.NewReader(helloWorld), age.ProcessOptions{
+			Recipients: recipients, Armor: armored,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if got := bytes.HasPrefix(ct.Bytes(), []byte(armor.Header)); got != armored {
+			t.Errorf("armored output = %v, want %v", got, armored)
+		}
+
+		pt := &bytes.Buffer{}
+		if err := age.Process(pt, bytes.NewReader(ct.Bytes()), age.ProcessOptions{
+			Decrypt: true, Identities: identities,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if pt.String() != helloWorld {
+			t.Errorf("wrong data: %q, excepted %q", pt, helloWorld)
+		}
+
+		err := age.Process(ioutil.Discard, bytes.NewReader(ct.Bytes()), age.ProcessOptions{
+			Decrypt: true, Identities: identities, RequireArmor: !armored, RequireBinary: armored,
+		})
+		if err == nil {
+			t.Errorf("armored = %v: expected error for the wrong input format", armored)
+		}
+	}
+
+	for _, opts := range []age.ProcessOptions{
+		{Recipients: recipients, Identities: identities},
+		{Recipients: recipients, RequireArmor: true},
+		{Decrypt: true, Identities: identities, Recipients: recipients},
+		{Decrypt: true, Identities: identities, Armor: true},
+		{Decrypt: true, Identities: identities, RequireArmor: true, RequireBinary: true},
+	} {
+		if err := age.Process(ioutil.Discard, strings.NewReader(""), opts); err == nil {
+			t.Errorf("expected error for options %+v", opts)
+		}
+	}
+}
+
+func TestPreparedEncryptor(t *testing.T) {
+	a, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &age.Encryptor{GroupName: "test"}
+	p, err := e.Prepare(a.Recipient(), b.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Later changes to the Encryptor must not affect p.
+	e.GroupName = "changed"
+
+	var files [][]byte
+	for i := 0; i < 2; i++ {
+		file, err := p.EncryptBytes([]byte(helloWorld))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+
+		buf := &bytes.Buffer{}
+		w, err := p.Encrypt(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, helloWorld); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, buf.Bytes())
+	}
+	if bytes.Equal(files[0], files[2]) {
+		t.Error("files encrypted with the same PreparedEncryptor are identical")
+	}
+	for _, file := range files {
+		for _, i := range []age.Identity{a, b} {
+			out, err := age.Decrypt(bytes.NewReader(file), i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			outBytes, err := ioutil.ReadAll(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(outBytes) != helloWorld {
+				t.Errorf("wrong data: %q, excepted %q", outBytes, helloWorld)
+			}
+		}
+		info, err := age.Inspect(bytes.NewReader(file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.GroupName != "test" {
+			t.Errorf("got group name %q, want %q", info.GroupName, "test")
+		}
+	}
+
+	s, err := age.NewScryptRecipient("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&age.Encryptor{}).Prepare(s, a.Recipient()); err == nil {
+		t.Error("expected an error preparing an scrypt recipient with others")
+	}
+	if _, err := (&age.Encryptor{}).Prepare(); err == nil {
+		t.Error("expected an error preparing no recipients")
+	}
+}
+
+func TestBatchDecryptor(t *testing.T) {
+	a, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hinted, err := age.NewHintedRecipient(b.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := age.EncryptBytes([]byte(helloWorld), b.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	withHint, err := age.EncryptBytes([]byte(helloWorld), hinted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &age.Decryptor{MaxPayloadBytes: 5}
+	bd, err := d.Batch(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Later changes to the Decryptor must not affect bd.
+	d.MaxPayloadBytes = 0
+
+	for _, file := range [][]byte{plain, withHint, plain} {
+		out, matched, err := bd.DecryptWithIdentity(bytes.NewReader(file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if matched != b {
+			t.Errorf("matched identity %v, want %v", matched, b)
+		}
+		if _, err := ioutil.ReadAll(out); err != age.ErrPayloadTooLarge {
+			t.Errorf("got error %v, want ErrPayloadTooLarge", err)
+		}
+	}
+
+	bd, err = age.NewBatchDecryptor(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = bd.Decrypt(bytes.NewReader(withHint))
+	if e := new(age.NoIdentityMatchError); !errors.As(err, &e) {
+		t.Errorf("got error %v, want NoIdentityMatchError", err)
+	}
+
+	if _, err := age.NewBatchDecryptor(); err == nil {
+		t.Error("expected an error with no identities")
+	}
+	if _, err := (&age.Decryptor{RequireHardwareBacked: true}).Batch(a); err != age.ErrNoHardwareBackedIdentity {
+		t.Errorf("got error %v, want ErrNoHardwareBackedIdentity", err)
+	}
+}
+
+func TestRecipientFingerprints(t *testing.T) {
+	a, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hinted, err := age.NewHintedRecipient(b.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fa, err := age.RecipientFingerprint(a.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fb, err := age.RecipientFingerprint(b.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(fa, "SHA256:") || fa == fb {
+		t.Errorf("unexpected fingerprints %q and %q", fa, fb)
+	}
+
+	var got [][]string
+	e := &age.Encryptor{RecipientFingerprints: func(f []string) {
+		got = append(got, f)
+	}}
+	if _, err := e.EncryptBytes([]byte(helloWorld), a.Recipient(), hinted); err != nil {
+		t.Fatal(err)
+	}
+	p, err := e.Prepare(hinted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Encrypt(ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{{fa, fb}, {fb}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got fingerprints %v, want %v", got, want)
+	}
+
+	buf := &bytes.Buffer{}
+	if _, err := e.Encrypt(buf, a.Recipient(), stringlessRecipient{}); err == nil {
+		t.Error("expected an error for a recipient without a fingerprint")
+	}
+	if buf.Len() != 0 || len(got) != 2 {
+		t.Error("output was written for a recipient without a fingerprint")
+	}
+}
+
+type stringlessRecipient struct{}
+
+func (stringlessRecipient) Wrap(fileKey []byte) ([]*age.Stanza, error) {
+	return []*age.Stanza{{Type: "test", Body: fileKey}}, nil
+}
+
+func TestWriteIdentityFile(t *testing.T) {
+	i, err := age.ParseX25519Identity("AGE-SECRET-KEY-1N9JEPW6DWJ0ZQUDX63F5A03GX8QUW7PXDE39N8UYF82VZ9PC8UFS3M7XA9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if err := age.WriteIdentityFile(buf, i, map[string]string{
+		"created": "2021-01-02T15:30:45+01:00",
+		"version": "3",
+		"owner":   "ops",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// This format is relied upon by tools that parse age-keygen output, so it
+	// must not change.
+	const want = `# created: 2021-01-02T15:30:45+01:00
+# public key: age1lvyvwawkr0mcnnnncaghunadrqkmuf9e6507x9y920xxpp866cnql7dp2z
+# owner: ops
+# version: 3
+AGE-SECRET-KEY-1N9JEPW6DWJ0ZQUDX63F5A03GX8QUW7PXDE39N8UYF82VZ9PC8UFS3M7XA9
+`
+	if buf.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", buf, want)
+	}
+	ids, err := age.ParseIdentities(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0].(*age.X25519Identity).String() != i.String() {
+		t.Errorf("identity file doesn't parse back to the identity")
+	}
+
+	for _, comments := range []map[string]string{
+		{"public key": "age1"},
+		{"a:b": "c"},
+		{"": "c"},
+		{"a": "b\nAGE-SECRET-KEY-1"},
+	} {
+		if err := age.WriteIdentityFile(ioutil.Discard, i, comments); err == nil {
+			t.Errorf("expected error for comments %q", comments)
+		}
+	}
+}
+
+func TestWrapBytes(t *testing.T) {
+	a, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		t.Fatal(err)
+	}
+	blob, err := age.WrapBytes(secret, a.Recipient(), b.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []age.Identity{a, b} {
+		got, err := age.UnwrapBytes(blob, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, secret) {
+			t.Errorf("got %x, want %x", got, secret)
+		}
+	}
+
+	if _, err := age.WrapBytes(nil, a.Recipient()); err == nil {
+		t.Error("expected an error for an empty secret")
+	}
+	if _, err := age.WrapBytes(make([]byte, age.MaxWrappedSecretSize+1), a.Recipient()); err == nil {
+		t.Error("expected an error for an oversized secret")
+	}
+	large, err := age.EncryptBytes(make([]byte, age.MaxWrappedSecretSize+1), a.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := age.UnwrapBytes(large, a); err == nil {
+		t.Error("expected an error for an oversized file")
+	}
+}
+
+func TestShredFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "age-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := []byte(strings.Repeat(i.String()+"\n", 1000))
+	path := filepath.Join(dir, "key.txt")
+	if err := ioutil.WriteFile(path, contents, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// A hard link keeps the inode reachable after ShredFile removes path.
+	link := filepath.Join(dir, "link.txt")
+	if err := os.Link(path, link); err != nil {
+		t.Skipf("hard links not supported: %v", err)
+	}
+
+	if err := age.ShredFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("file was not removed: %v", err)
+	}
+	got, err := ioutil.ReadFile(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(contents) {
+		t.Errorf("got %d bytes, want %d", len(got), len(contents))
+	}
+	if bytes.Contains(got, []byte(i.String())) {
+		t.Error("secret key was not overwritten")
+	}
+
+	if err := age.ShredFile(dir); err == nil {
+		t.Error("expected an error for a directory")
+	}
+}
+
+func TestMaxPayloadBytes(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := make([]byte, 100*1024)
+	for _, padded := range []bool{false, true} {
+		e := &age.Encryptor{}
+		if padded {
+			e.Padding = age.PadToPowerOfTwo
+		}
+		file, err := e.EncryptBytes(plaintext, i.Recipient())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		d := &age.Decryptor{MaxPayloadBytes: int64(len(plaintext))}
+		r, err := d.Decrypt(bytes.NewReader(file), i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out, err := ioutil.ReadAll(r); err != nil {
+			t.Errorf("padded=%v: unexpected error at the limit: %v", padded, err)
+		} else if len(out) != len(plaintext) {
+			t.Errorf("padded=%v: got %d bytes, want %d", padded, len(out), len(plaintext))
+		}
+
+		d = &age.Decryptor{MaxPayloadBytes: int64(len(plaintext)) - 1}
+		r, err = d.Decrypt(bytes.NewReader(file), i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadAll(r)
+		if err != age.ErrPayloadTooLarge {
+			t.Errorf("padded=%v: got %v, want ErrPayloadTooLarge", padded, err)
+		}
+		if int64(len(out)) > d.MaxPayloadBytes {
+			t.Errorf("padded=%v: got %d bytes, more than the limit", padded, len(out))
+		}
+	}
+}
+
+func TestWriteOnlyIdentities(t *testing.T) {
+	local, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &age.Encryptor{WriteOnlyIdentities: []age.Identity{local}}
+
+	if _, err := e.EncryptBytes([]byte(helloWorld), remote.Recipient()); err != nil {
+		t.Errorf("unexpected error for a remote recipient: %v", err)
+	}
+	if _, err := e.EncryptBytes([]byte(helloWorld), remote.Recipient(), local.Recipient()); err != age.ErrRecipientNotWriteOnly {
+		t.Errorf("got %v, want ErrRecipientNotWriteOnly", err)
+	}
+	if _, err := e.Prepare(local.Recipient()); err != age.ErrRecipientNotWriteOnly {
+		t.Errorf("Prepare: got %v, want ErrRecipientNotWriteOnly", err)
+	}
+
+	scrypt, err := age.NewScryptIdentity("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e = &age.Encryptor{WriteOnlyIdentities: []age.Identity{scrypt}}
+	if _, err := e.EncryptBytes([]byte(helloWorld), remote.Recipient()); err == nil {
+		t.Error("expected an error for an identity that can't be checked")
+	}
+}
+
+func TestExpectedRecipient(t *testing.T) {
+	mine, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hinted, err := age.NewHintedRecipient(mine.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		recipients []age.Recipient
+		identities []age.Identity
+		ok         bool
+	}{
+		{"matching identity", []age.Recipient{mine.Recipient()}, []age.Identity{mine}, true},
+		{"shared identity", []age.Recipient{shared.Recipient(), mine.Recipient()}, []age.Identity{shared, mine}, true},
+		{"hint", []age.Recipient{shared.Recipient(), hinted}, []age.Identity{shared, mine}, true},
+		{"hint only", []age.Recipient{shared.Recipient(), hinted}, []age.Identity{shared}, false},
+		{"not encrypted to it", []age.Recipient{shared.Recipient(), other.Recipient()}, []age.Identity{shared, mine}, false},
+		{"forged hint", []age.Recipient{hinted, shared.Recipient()}, []age.Identity{shared, mine}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &age.Encryptor{}
+			if tt.name == "forged hint" {
+				// Keep the hint for mine, but drop the stanza after it, so
+				// the file is not actually encrypted to mine.
+				e.StanzaTransformer = func(stanzas []*age.Stanza) ([]*age.Stanza, error) {
+					return append(stanzas[:1:1], stanzas[2:]...), nil
+				}
+			}
+			file, err := e.EncryptBytes([]byte(helloWorld), tt.recipients...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d := &age.Decryptor{ExpectedRecipient: mine.Recipient()}
+			_, err = d.Decrypt(bytes.NewReader(file), tt.identities...)
+			if tt.ok && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if !tt.ok && err != age.ErrUnexpectedRecipient {
+				t.Errorf("got error %v, want ErrUnexpectedRecipient", err)
+			}
+		})
+	}
+}
+
+type hardwareIdentity struct {
+	*age.X25519Identity
+}
+
+func (hardwareIdentity) HardwareBacked() bool { return true }
+
+func TestRequireHardwareBacked(t *testing.T) {
+	software, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hardware := hardwareIdentity{id}
+	file, err := age.EncryptBytes([]byte(helloWorld), software.Recipient(), id.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &age.Decryptor{RequireHardwareBacked: true}
+	if _, err := d.Decrypt(bytes.NewReader(file), software); err != age.ErrNoHardwareBackedIdentity {
+		t.Errorf("software identity: got %v, want ErrNoHardwareBackedIdentity", err)
+	}
+	_, matched, err := d.DecryptWithIdentity(bytes.NewReader(file), software, hardware)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := matched.(hardwareIdentity); !ok {
+		t.Errorf("file was decrypted with %T, not the hardware-backed identity", matched)
+	}
+	if _, _, err := d.DecryptReaderAt(bytes.NewReader(file), int64(len(file)), software); err != age.ErrNoHardwareBackedIdentity {
+		t.Errorf("DecryptReaderAt: got %v, want ErrNoHardwareBackedIdentity", err)
+	}
+	if _, _, err := d.DecryptReaderAt(bytes.NewReader(file), int64(len(file)), software, hardware); err != nil {
+		t.Errorf("DecryptReaderAt: %v", err)
+	}
+}
+
+type auditedIdentity struct {
+	*age.X25519Identity
+	log []*age.HeaderInfo
+	err error
+}
+
+func (i *auditedIdentity) Audit(info *age.HeaderInfo) error {
+	i.log = append(i.log, info)
+	return i.err
+}
+
+func TestAuditableIdentity(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &age.Encryptor{GroupName: "backups"}
+	file, err := e.EncryptBytes([]byte(helloWorld), id.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	audited := &auditedIdentity{X25519Identity: id}
+	if _, err := age.Decrypt(bytes.NewReader(file), audited); err != nil {
+		t.Fatal(err)
+	}
+	if len(audited.log) != 1 || audited.log[0].GroupName != "backups" {
+		t.Errorf("unexpected audit log: %v", audited.log)
+	}
+
+	if _, _, err := age.DecryptReaderAt(bytes.NewReader(file), int64(len(file)), audited); err != nil {
+		t.Fatal(err)
+	}
+	other, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := age.AddRecipient(bytes.NewReader(file), []age.Identity{audited}, other.Recipient(), ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if len(audited.log) != 3 {
+		t.Errorf("got %d audit log entries, want 3", len(audited.log))
+	}
+
+	audited.err = errors.New("audit log unavailable")
+	if _, err := age.Decrypt(bytes.NewReader(file), audited); err == nil {
+		t.Error("decryption succeeded despite the audit failure")
+	}
+	if _, _, err := age.DecryptReaderAt(bytes.NewReader(file), int64(len(file)), audited); err == nil {
+		t.Error("DecryptReaderAt succeeded despite the audit failure")
+	}
+	buf := &bytes.Buffer{}
+	if err := age.AddRecipient(bytes.NewReader(file), []age.Identity{audited}, other.Recipient(), buf); err == nil || buf.Len() != 0 {
+		t.Error("AddRecipient succeeded despite the audit failure")
+	}
+}
+
+func TestCompat(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hinted, err := age.NewHintedRecipient(i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	multi, err := age.NewMultiPassphraseRecipient("a", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	multi.SetWorkFactor(1)
+
+	tests := []struct {
+		name      string
+		e         *age.Encryptor
+		recipient age.Recipient
+		ok        bool
+	}{
+		{"X25519", &age.Encryptor{Compat: "v1.0.0"}, i.Recipient(), true},
+		{"short version", &age.Encryptor{Compat: "1.1"}, i.Recipient(), true},
+		{"group", &age.Encryptor{Compat: "v1.0.0", GroupName: "ops"}, i.Recipient(), true},
+		{"hint", &age.Encryptor{Compat: "v1.0.0"}, hinted, true},
+		{"padding", &age.Encryptor{Compat: "v1.0.0", Padding: age.PadToPowerOfTwo}, i.Recipient(), false},
+		{"not before", &age.Encryptor{Compat: "v1.0.0", NotBefore: time.Now()}, i.Recipient(), false},
+		{"multi-passphrase", &age.Encryptor{Compat: "v1.0.0"}, multi, false},
+		{"unsupported version", &age.Encryptor{Compat: "v2.0.0"}, i.Recipient(), false},
+		{"malformed version", &age.Encryptor{Compat: "latest"}, i.Recipient(), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.e.EncryptBytes([]byte(helloWorld), tt.recipient)
+			if tt.ok && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestStanzaTransformer(t *testing.T) {
+	a, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &age.Encryptor{
+		GroupName: "ops",
+		StanzaTransformer: func(stanzas []*age.Stanza) ([]*age.Stanza, error) {
+			// Reverse the stanzas and add a custom extension stanza.
+			var res []*age.Stanza
+			for i := len(stanzas) - 1; i >= 0; i-- {
+				res = append(res, stanzas[i])
+			}
+			return append(res, &age.Stanza{Type: "ext-custom", Args: []string{"test"}}), nil
+		},
+	}
+	file, err := e.EncryptBytes([]byte(helloWorld), a.Recipient(), b.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := age.Inspect(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(info.StanzaTypes, " "), "ext-group X25519 X25519 ext-custom"; got != want {
+		t.Errorf("got stanza types %q, want %q", got, want)
+	}
+	for _, i := range []age.Identity{a, b} {
+		out, err := age.Decrypt(bytes.NewReader(file), i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outBytes, err := ioutil.ReadAll(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(outBytes) != helloWorld {
+			t.Errorf("wrong data: %q, excepted %q", outBytes, helloWorld)
+		}
+	}
+
+	s, err := age.NewScryptRecipient("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetWorkFactor(1)
+	e = &age.Encryptor{StanzaTransformer: func(stanzas []*age.Stanza) ([]*age.Stanza, error) {
+		return append(stanzas, &age.Stanza{Type: "ext-custom"}), nil
+	}}
+	if _, err := e.EncryptBytes([]byte(helloWorld), s); err == nil {
+		t.Error("transformer was allowed to add a stanza to an scrypt file")
+	}
+	e = &age.Encryptor{StanzaTransformer: func(stanzas []*age.Stanza) ([]*age.Stanza, error) {
+		return nil, errors.New("test error")
+	}}
+	if _, err := e.EncryptBytes([]byte(helloWorld), a.Recipient()); err == nil {
+		t.Error("transformer error was ignored")
+	}
+}
+
+func TestLibraryVersion(t *testing.T) {
+	// Tests are built from within the module, which has build info.
+	if v := age.LibraryVersion(); v == "" || v == "(unknown)" {
+		t.Errorf("unexpected library version %q", v)
+	}
+}
@@ -0,0 +1,324 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+// Package agent implements age.Recipient and age.Identity types that delegate
+// wrapping and unwrapping of file keys to a local daemon over a Unix socket, in
+// the style of ssh-agent. Key material stays in the daemon, which can be shared
+// by multiple processes.
+//
+// The protocol is loosely modeled on the age plugin protocol, and is made of
+// messages encoded as age header stanzas. Each connection carries a single
+// request from the client, followed by the response of the daemon.
+//
+// A wrap request is a single stanza.
+//
+//	-> wrap RECIPIENT
+//	BASE64(FILE KEY)
+//
+// An unwrap request is a sequence of recipient-stanza messages, one for each
+// stanza in the file header, terminated by an unwrap message with an empty body.
+//
+//	-> recipient-stanza TYPE [ARGS...]
+//	BASE64(BODY)
+//	-> unwrap
+//
+// The daemon replies to a wrap request with a sequence of recipient-stanza
+// messages followed by a done message with an empty body, and to an unwrap
+// request with either a file-key message carrying the file key in its body, or
+// an empty no-match message if none of its identities match the stanzas. Either
+// request can also fail with an error message carrying a human-readable
+// description of the error in its body.
+package agent
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/internal/format"
+)
+
+const (
+	wrapMessage            = "wrap"
+	unwrapMessage          = "unwrap"
+	recipientStanzaMessage = "recipient-stanza"
+	doneMessage            = "done"
+	fileKeyMessage         = "file-key"
+	noMatchMessage         = "no-match"
+	errorMessage           = "error"
+)
+
+// DialOptions configure how a Recipient or Identity connects to the daemon,
+// which might be slow to start, for example if it's socket activated or it
+// needs to wake up a hardware token.
+type DialOptions struct {
+	// Timeout, if not zero, bounds each connection attempt, and then the
+	// whole exchange of a request and its response.
+	Timeout time.Duration
+
+	// Retries is the number of times a failed connection attempt is retried.
+	// Only connecting is retried: once a request was sent, errors are returned
+	// immediately, to avoid performing the same operation twice.
+	Retries int
+
+	// Backoff is the delay before the first retry, which is doubled for each
+	// following one. If zero, 100ms is used.
+	Backoff time.Duration
+}
+
+// dial connects to the daemon listening at socket, according to opts.
+func dial(socket string, opts DialOptions) (net.Conn, error) {
+	backoff := opts.Backoff
+	if backoff == 0 {
+		backoff = 100 * time.Millisecond
+	}
+	for attempt := 0; ; attempt++ {
+		conn, err := net.DialTimeout("unix", socket, opts.Timeout)
+		if err == nil {
+			if opts.Timeout != 0 {
+				conn.SetDeadline(time.Now().Add(opts.Timeout))
+			}
+			return conn, nil
+		}
+		if attempt == opts.Retries {
+			return nil, fmt.Errorf("failed to connect to agent: %v", err)
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// Recipient is an age.Recipient that asks the daemon listening on a Unix
+// socket to wrap the file key to one of its recipients.
+type Recipient struct {
+	socket    string
+	recipient string
+	opts      DialOptions
+}
+
+var _ age.Recipient = &Recipient{}
+
+// NewRecipient returns a Recipient that connects to the daemon listening at
+// the socket path, and wraps file keys to the recipient the daemon knows by
+// that name. The name must be a valid stanza argument: a non-empty string of
+// printable ASCII characters, excluding spaces.
+func NewRecipient(socket, recipient string) *Recipient {
+	return &Recipient{socket: socket, recipient: recipient}
+}
+
+// SetDialOptions sets how r connects to the daemon. It must be called before
+// Wrap.
+func (r *Recipient) SetDialOptions(opts DialOptions) {
+	r.opts = opts
+}
+
+func (r *Recipient) Wrap(fileKey []byte) ([]*age.Stanza, error) {
+	conn, err := dial(r.socket, r.opts)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	req := &format.Stanza{Type: wrapMessage, Args: []string{r.recipient}, Body: fileKey}
+	if err := req.Marshal(conn); err != nil {
+		return nil, fmt.Errorf("failed to send request to agent: %v", err)
+	}
+
+	sr := format.NewStanzaReader(bufio.NewReader(conn))
+	var stanzas []*age.Stanza
+	for {
+		s, err := sr.ReadStanza()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read response from agent: %v", err)
+		}
+		switch s.Type {
+		case recipientStanzaMessage:
+			if len(s.Args) < 1 {
+				return nil, errors.New("malformed recipient-stanza message from agent")
+			}
+			stanzas = append(stanzas, &age.Stanza{
+				Type: s.Args[0], Args: s.Args[1:], Body: s.Body,
+			})
+		case doneMessage:
+			return stanzas, nil
+		case errorMessage:
+			return nil, fmt.Errorf("agent error: %s", s.Body)
+		default:
+			return nil, fmt.Errorf("unexpected message from agent: %q", s.Type)
+		}
+	}
+}
+
+// Identity is an age.Identity that asks the daemon listening on a Unix socket
+// to unwrap the file key with any of its identities.
+type Identity struct {
+	socket string
+	opts   DialOptions
+}
+
+var _ age.Identity = &Identity{}
+
+// NewIdentity returns an Identity that connects to the daemon listening at the
+// socket path.
+func NewIdentity(socket string) *Identity {
+	return &Identity{socket: socket}
+}
+
+// SetDialOptions sets how i connects to the daemon. It must be called before
+// Unwrap.
+func (i *Identity) SetDialOptions(opts DialOptions) {
+	i.opts = opts
+}
+
+func (i *Identity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	conn, err := dial(i.socket, i.opts)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	w := bufio.NewWriter(conn)
+	for _, s := range stanzas {
+		msg := &format.Stanza{
+			Type: recipientStanzaMessage,
+			Args: append([]string{s.Type}, s.Args...),
+			Body: s.Body,
+		}
+		if err := msg.Marshal(w); err != nil {
+			return nil, fmt.Errorf("failed to send request to agent: %v", err)
+		}
+	}
+	if err := (&format.Stanza{Type: unwrapMessage}).Marshal(w); err != nil {
+		return nil, fmt.Errorf("failed to send request to agent: %v", err)
+	}
+	if err := w.Flush(); err != nil {
+		return nil, fmt.Errorf("failed to send request to agent: %v", err)
+	}
+
+	s, err := format.NewStanzaReader(bufio.NewReader(conn)).ReadStanza()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response from agent: %v", err)
+	}
+	switch s.Type {
+	case fileKeyMessage:
+		return s.Body, nil
+	case noMatchMessage:
+		return nil, age.ErrIncorrectIdentity
+	case errorMessage:
+		return nil, fmt.Errorf("agent error: %s", s.Body)
+	default:
+		return nil, fmt.Errorf("unexpected message from agent: %q", s.Type)
+	}
+}
+
+// Server is a reference implementation of the daemon side of the protocol,
+// which wraps and unwraps file keys with the recipients and identities it
+// holds.
+type Server struct {
+	// Recipients maps the names clients use in wrap requests to recipients.
+	Recipients map[string]age.Recipient
+
+	// Identities are tried in order on unwrap requests.
+	Identities []age.Identity
+}
+
+// Serve accepts connections on l and serves a request on each of them, until
+// l.Accept returns an error.
+func (srv *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			srv.ServeConn(conn)
+		}()
+	}
+}
+
+// ServeConn reads a single request from rw and writes the response to it.
+//
+// Errors returned by the recipients and identities are sent to the client,
+// while a non-nil error is returned only if the connection failed or the
+// client sent a malformed request. Requests with lines longer than 16 KiB are
+// malformed, so a client can't make the server buffer unbounded input.
+func (srv *Server) ServeConn(rw io.ReadWriter) error {
+	sr := format.NewStanzaReader(bufio.NewReader(rw))
+	var stanzas []*age.Stanza
+	for {
+		s, err := sr.ReadStanza()
+		if err != nil {
+			return err
+		}
+		switch s.Type {
+		case wrapMessage:
+			if len(s.Args) != 1 {
+				return errors.New("malformed wrap request")
+			}
+			return srv.wrap(rw, s.Args[0], s.Body)
+		case recipientStanzaMessage:
+			if len(s.Args) < 1 {
+				return errors.New("malformed recipient-stanza message")
+			}
+			stanzas = append(stanzas, &age.Stanza{
+				Type: s.Args[0], Args: s.Args[1:], Body: s.Body,
+			})
+		case unwrapMessage:
+			return srv.unwrap(rw, stanzas)
+		default:
+			return fmt.Errorf("unexpected message: %q", s.Type)
+		}
+	}
+}
+
+func (srv *Server) wrap(w io.Writer, name string, fileKey []byte) error {
+	r, ok := srv.Recipients[name]
+	if !ok {
+		return writeError(w, fmt.Errorf("unknown recipient %q", name))
+	}
+	stanzas, err := r.Wrap(fileKey)
+	if err != nil {
+		return writeError(w, err)
+	}
+	bw := bufio.NewWriter(w)
+	for _, s := range stanzas {
+		msg := &format.Stanza{
+			Type: recipientStanzaMessage,
+			Args: append([]string{s.Type}, s.Args...),
+			Body: s.Body,
+		}
+		if err := msg.Marshal(bw); err != nil {
+			return err
+		}
+	}
+	if err := (&format.Stanza{Type: doneMessage}).Marshal(bw); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func (srv *Server) unwrap(w io.Writer, stanzas []*age.Stanza) error {
+	for _, id := range srv.Identities {
+		fileKey, err := id.Unwrap(stanzas)
+		if errors.Is(err, age.ErrIncorrectIdentity) {
+			continue
+		}
+		if err != nil {
+			return writeError(w, err)
+		}
+		return (&format.Stanza{Type: fileKeyMessage, Body: fileKey}).Marshal(w)
+	}
+	return (&format.Stanza{Type: noMatchMessage}).Marshal(w)
+}
+
+func writeError(w io.Writer, err error) error {
+	return (&format.Stanza{Type: errorMessage, Body: []byte(err.Error())}).Marshal(w)
+}
@@ -0,0 +1,213 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package agent_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/agent"
+)
+
+func startServer(t *testing.T, srv *agent.Server) (socket string, stop func()) {
+	dir, err := ioutil.TempDir("", "age-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket = filepath.Join(dir, "agent.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	return socket, func() {
+		l.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestAgentRoundTrip(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket, stop := startServer(t, &agent.Server{
+		Recipients: map[string]age.Recipient{"alice": i.Recipient()},
+		Identities: []age.Identity{i},
+	})
+	defer stop()
+
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, agent.NewRecipient(socket, "alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, helloWorld); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	encrypted := buf.Bytes()
+
+	// The file must be decryptable without the agent, too.
+	for _, id := range []age.Identity{agent.NewIdentity(socket), i} {
+		out, err := age.Decrypt(bytes.NewReader(encrypted), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outBytes, err := ioutil.ReadAll(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(outBytes) != helloWorld {
+			t.Errorf("wrong data: %q, excepted %q", outBytes, helloWorld)
+		}
+	}
+}
+
+func TestAgentErrors(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket, stop := startServer(t, &agent.Server{
+		Identities: []age.Identity{other},
+	})
+	defer stop()
+
+	_, err = age.Encrypt(ioutil.Discard, agent.NewRecipient(socket, "alice"))
+	if err == nil || !strings.Contains(err.Error(), "unknown recipient") {
+		t.Errorf("expected unknown recipient error, got %v", err)
+	}
+
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = age.Decrypt(buf, agent.NewIdentity(socket))
+	var e *age.NoIdentityMatchError
+	if !errors.As(err, &e) {
+		t.Errorf("expected NoIdentityMatchError, got %v", err)
+	}
+}
+
+const helloWorld = "Hello, Twitch!"
+
+type infiniteReader byte
+
+func (r infiniteReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(r)
+	}
+	return len(p), nil
+}
+
+func TestServerLineLimit(t *testing.T) {
+	srv := &agent.Server{}
+	for _, prefix := range []string{"-> wrap ", "-> unwrap\n"} {
+		rw := struct {
+			io.Reader
+			io.Writer
+		}{io.MultiReader(strings.NewReader(prefix), infiniteReader('A')), ioutil.Discard}
+		if err := srv.ServeConn(rw); err == nil || !strings.Contains(err.Error(), "too long") {
+			t.Errorf("%q: expected a line too long error, got %v", prefix, err)
+		}
+	}
+}
+
+func TestAgentDialOptions(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "age-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "agent.sock")
+
+	r := agent.NewRecipient(socket, "alice")
+	if _, err := r.Wrap(make([]byte, 16)); err == nil {
+		t.Fatal("expected an error without retries")
+	}
+
+	// Start the daemon late, after the first attempts failed.
+	started := make(chan net.Listener, 1)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		l, err := net.Listen("unix", socket)
+		if err != nil {
+			started <- nil
+			return
+		}
+		go (&agent.Server{Recipients: map[string]age.Recipient{"alice": i.Recipient()}}).Serve(l)
+		started <- l
+	}()
+	r.SetDialOptions(agent.DialOptions{Retries: 10, Backoff: 20 * time.Millisecond})
+	if _, err := r.Wrap(make([]byte, 16)); err != nil {
+		t.Errorf("unexpected error with retries: %v", err)
+	}
+	l := <-started
+	if l == nil {
+		t.Fatal("failed to start daemon")
+	}
+	l.Close()
+	os.Remove(socket)
+
+	// A daemon that accepts connections but never replies must time out, and
+	// the request must not be retried.
+	l, err = net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conns := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				close(conns)
+				return
+			}
+			conns <- conn
+		}
+	}()
+	id := agent.NewIdentity(socket)
+	id.SetDialOptions(agent.DialOptions{Timeout: 100 * time.Millisecond, Retries: 3})
+	if _, err := id.Unwrap([]*age.Stanza{{Type: "X25519"}}); err == nil {
+		t.Error("expected a timeout error")
+	}
+	l.Close()
+	var n int
+	for conn := range conns {
+		conn.Close()
+		n++
+	}
+	if n != 1 {
+		t.Errorf("got %d connections, want 1", n)
+	}
+}
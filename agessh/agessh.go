@@ -13,6 +13,11 @@
 //
 // Note that these recipient types are not anonymous: the encrypted message will
 // include a short 32-bit ID of the public key.
+//
+// Keys held by ssh-agent can't be used as identities. The agent protocol only
+// allows producing signatures, while unwrapping an ssh-ed25519 stanza requires
+// an X25519 key exchange with the private key, and unwrapping an ssh-rsa stanza
+// requires an RSA-OAEP decryption, neither of which a signature can replace.
 package agessh
 
 import (
@@ -24,6 +29,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"time"
 
 	"filippo.io/age"
 	"filippo.io/age/internal/format"
@@ -39,14 +45,39 @@ func sshFingerprint(pk ssh.PublicKey) string {
 	return format.EncodeToString(h[:4])
 }
 
+// Fingerprint returns the OpenSSH SHA-256 fingerprint of the public key of an
+// ssh-ed25519 or ssh-rsa recipient, in the "SHA256:" format printed by
+// ssh-keygen -l. It returns an error for any other recipient type.
+func Fingerprint(r age.Recipient) (string, error) {
+	switch r := r.(type) {
+	case *Ed25519Recipient:
+		return ssh.FingerprintSHA256(r.sshKey), nil
+	case *RSARecipient:
+		return ssh.FingerprintSHA256(r.sshKey), nil
+	default:
+		return "", fmt.Errorf("recipient of type %T is not an SSH recipient", r)
+	}
+}
+
+func init() {
+	// Make SSH public keys available to age.ParseRecipients. SSH private keys
+	// are multi-line PEM files, so they can't be registered as line-delimited
+	// identities, and must be parsed with ParseIdentity instead.
+	age.RegisterRecipientParser("ssh-ed25519 ", ParseRecipient)
+	age.RegisterRecipientParser("ssh-rsa ", ParseRecipient)
+	age.RegisterRecipientParser(ssh.CertAlgoED25519v01+" ", ParseRecipient)
+	age.RegisterRecipientParser(ssh.CertAlgoRSAv01+" ", ParseRecipient)
+}
+
 const oaepLabel = "age-encryption.org/v1/ssh-rsa"
 
 type RSARecipient struct {
 	sshKey ssh.PublicKey
 	pubKey *rsa.PublicKey
+	label  string
 }
 
-var _ age.Recipient = &RSARecipient{}
+var _ age.FingerprintedRecipient = &RSARecipient{}
 
 func NewRSARecipient(pk ssh.PublicKey) (*RSARecipient, error) {
 	if pk.Type() != "ssh-rsa" {
@@ -75,7 +106,7 @@ func (r *RSARecipient) Wrap(fileKey []byte) ([]*age.Stanza, error) {
 	}
 
 	wrappedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader,
-		r.pubKey, fileKey, []byte(oaepLabel))
+		r.pubKey, fileKey, rsaOAEPLabel(r.label))
 	if err != nil {
 		return nil, err
 	}
@@ -84,9 +115,35 @@ func (r *RSARecipient) Wrap(fileKey []byte) ([]*age.Stanza, error) {
 	return []*age.Stanza{l}, nil
 }
 
+// Fingerprint returns the OpenSSH SHA-256 fingerprint of r's public key, like
+// the package-level Fingerprint function.
+func (r *RSARecipient) Fingerprint() string {
+	return ssh.FingerprintSHA256(r.sshKey)
+}
+
+// SetLabel binds file keys wrapped by r to a context string, by mixing it into
+// the RSA-OAEP label. Files encrypted with a label can only be decrypted by an
+// RSAIdentity with the same label set with SetLabel.
+//
+// This is a non-standard extension: files encrypted with a non-empty label
+// can't be decrypted by other age implementations. The default empty label
+// produces spec-conformant files.
+func (r *RSARecipient) SetLabel(label string) {
+	r.label = label
+}
+
+// rsaOAEPLabel returns the RSA-OAEP label for a SetLabel context string.
+func rsaOAEPLabel(label string) []byte {
+	if label == "" {
+		return []byte(oaepLabel)
+	}
+	return []byte(oaepLabel + "/" + label)
+}
+
 type RSAIdentity struct {
 	k      *rsa.PrivateKey
 	sshKey ssh.PublicKey
+	label  string
 }
 
 var _ age.Identity = &RSAIdentity{}
@@ -102,10 +159,17 @@ func NewRSAIdentity(key *rsa.PrivateKey) (*RSAIdentity, error) {
 	return i, nil
 }
 
+// SetLabel sets the context string mixed into the RSA-OAEP label, which must
+// match the one set with RSARecipient.SetLabel at encryption time.
+func (i *RSAIdentity) SetLabel(label string) {
+	i.label = label
+}
+
 func (i *RSAIdentity) Recipient() age.Recipient {
 	return &RSARecipient{
 		sshKey: i.sshKey,
 		pubKey: &i.k.PublicKey,
+		label:  i.label,
 	}
 }
 
@@ -126,9 +190,11 @@ func (i *RSAIdentity) unwrap(block *age.Stanza) ([]byte, error) {
 	}
 
 	fileKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, i.k,
-		block.Body, []byte(oaepLabel))
-	if err != nil {
-		return nil, fmt.Errorf("failed to decrypt file key: %v", err)
+		block.Body, rsaOAEPLabel(i.label))
+	if err != nil && i.label != "" {
+		return nil, fmt.Errorf("failed to decrypt file key with OAEP label %q (was the file encrypted with the same label?): %v", i.label, err)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to decrypt file key (was the file encrypted with an OAEP label?): %v", err)
 	}
 	return fileKey, nil
 }
@@ -138,7 +204,7 @@ type Ed25519Recipient struct {
 	theirPublicKey []byte
 }
 
-var _ age.Recipient = &Ed25519Recipient{}
+var _ age.FingerprintedRecipient = &Ed25519Recipient{}
 
 func NewEd25519Recipient(pk ssh.PublicKey) (*Ed25519Recipient, error) {
 	if pk.Type() != "ssh-ed25519" {
@@ -164,26 +230,78 @@ func NewEd25519Recipient(pk ssh.PublicKey) (*Ed25519Recipient, error) {
 	}, nil
 }
 
+// ParseRecipient parses an SSH public key in authorized_keys format.
+//
+// An SSH certificate is also accepted, in which case the recipient is the
+// public key it signs. Its validity period and signature are not checked; use
+// ParseCertificateRecipient to reject expired certificates.
 func ParseRecipient(s string) (age.Recipient, error) {
 	pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(s))
 	if err != nil {
 		return nil, fmt.Errorf("malformed SSH recipient: %q: %v", s, err)
 	}
+	if cert, ok := pubKey.(*ssh.Certificate); ok {
+		pubKey = cert.Key
+	}
+
+	r, err := newRecipient(pubKey)
+	if err != nil {
+		return nil, fmt.Errorf("malformed SSH recipient: %q: %v", s, err)
+	}
+	return r, nil
+}
 
-	var r age.Recipient
+// ParseCertificateRecipient parses an SSH certificate in authorized_keys
+// format, and returns a recipient for the ssh-ed25519 or ssh-rsa public key it
+// signs.
+//
+// If checkValidity is true, the certificate is rejected unless the current
+// time is within its validity period. The CA signature is not verified, as the
+// certificate is only used to carry the public key.
+func ParseCertificateRecipient(s string, checkValidity bool) (age.Recipient, error) {
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(s))
+	if err != nil {
+		return nil, fmt.Errorf("malformed SSH certificate: %q: %v", s, err)
+	}
+	cert, ok := pubKey.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("malformed SSH certificate: %q: not a certificate", s)
+	}
+	if checkValidity {
+		if err := checkCertValidity(cert, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+
+	r, err := newRecipient(cert.Key)
+	if err != nil {
+		return nil, fmt.Errorf("malformed SSH certificate: %q: %v", s, err)
+	}
+	return r, nil
+}
+
+func checkCertValidity(cert *ssh.Certificate, now time.Time) error {
+	// ValidBefore is ssh.CertTimeInfinity for certificates that don't expire,
+	// so comparing it as an unsigned value is enough.
+	unix := uint64(now.Unix())
+	if unix < cert.ValidAfter {
+		return fmt.Errorf("SSH certificate %q is not valid yet", cert.KeyId)
+	}
+	if unix >= cert.ValidBefore {
+		return fmt.Errorf("SSH certificate %q has expired", cert.KeyId)
+	}
+	return nil
+}
+
+func newRecipient(pubKey ssh.PublicKey) (age.Recipient, error) {
 	switch t := pubKey.Type(); t {
 	case "ssh-rsa":
-		r, err = NewRSARecipient(pubKey)
+		return NewRSARecipient(pubKey)
 	case "ssh-ed25519":
-		r, err = NewEd25519Recipient(pubKey)
+		return NewEd25519Recipient(pubKey)
 	default:
 		return nil, fmt.Errorf("unknown SSH recipient type: %q", t)
 	}
-	if err != nil {
-		return nil, fmt.Errorf("malformed SSH recipient: %q: %v", s, err)
-	}
-
-	return r, nil
 }
 
 func ed25519PublicKeyToCurve25519(pk ed25519.PublicKey) ([]byte, error) {
@@ -198,6 +316,12 @@ func ed25519PublicKeyToCurve25519(pk ed25519.PublicKey) ([]byte, error) {
 
 const ed25519Label = "age-encryption.org/v1/ssh-ed25519"
 
+// Fingerprint returns the OpenSSH SHA-256 fingerprint of r's public key, like
+// the package-level Fingerprint function.
+func (r *Ed25519Recipient) Fingerprint() string {
+	return ssh.FingerprintSHA256(r.sshKey)
+}
+
 func (r *Ed25519Recipient) Wrap(fileKey []byte) ([]*age.Stanza, error) {
 	ephemeral := make([]byte, curve25519.ScalarSize)
 	if _, err := rand.Read(ephemeral); err != nil {
@@ -247,6 +371,7 @@ func (r *Ed25519Recipient) Wrap(fileKey []byte) ([]*age.Stanza, error) {
 type Ed25519Identity struct {
 	secretKey, ourPublicKey []byte
 	sshKey                  ssh.PublicKey
+	signer                  ssh.Signer
 }
 
 var _ age.Identity = &Ed25519Identity{}
@@ -259,6 +384,7 @@ func NewEd25519Identity(key ed25519.PrivateKey) (*Ed25519Identity, error) {
 	i := &Ed25519Identity{
 		sshKey:    s.PublicKey(),
 		secretKey: ed25519PrivateKeyToCurve25519(key),
+		signer:    s,
 	}
 	i.ourPublicKey, _ = curve25519.X25519(i.secretKey, curve25519.Basepoint)
 	return i, nil
@@ -11,9 +11,14 @@ import (
 	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
+	"errors"
+	"io/ioutil"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"filippo.io/age"
 	"filippo.io/age/agessh"
 	"golang.org/x/crypto/ssh"
 )
@@ -103,3 +108,390 @@ func TestSSHEd25519RoundTrip(t *testing.T) {
 		t.Errorf("invalid output: %x, expected %x", out, fileKey)
 	}
 }
+
+func TestParseRecipientsRegistered(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshPubKey, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recs, err := age.ParseRecipients(bytes.NewReader(ssh.MarshalAuthorizedKey(sshPubKey)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 1 {
+		t.Fatalf("got %d recipients, want 1", len(recs))
+	}
+	if _, ok := recs[0].(*agessh.Ed25519Recipient); !ok {
+		t.Errorf("got recipient of type %T, want *agessh.Ed25519Recipient", recs[0])
+	}
+}
+
+func TestParseCertificateRecipient(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshPubKey, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := ssh.NewSignerFromKey(caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := agessh.NewEd25519Identity(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newCert := func(validAfter, validBefore uint64) string {
+		cert := &ssh.Certificate{
+			Key:         sshPubKey,
+			KeyId:       "test",
+			CertType:    ssh.UserCert,
+			ValidAfter:  validAfter,
+			ValidBefore: validBefore,
+		}
+		if err := cert.SignCert(rand.Reader, ca); err != nil {
+			t.Fatal(err)
+		}
+		return string(ssh.MarshalAuthorizedKey(cert))
+	}
+	now := uint64(time.Now().Unix())
+	valid := newCert(now-3600, ssh.CertTimeInfinity)
+	expired := newCert(now-7200, now-3600)
+
+	r, err := agessh.ParseCertificateRecipient(valid, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(r, i.Recipient()) {
+		t.Errorf("certificate recipient is different from the identity's")
+	}
+	fileKey := make([]byte, 16)
+	if _, err := rand.Read(fileKey); err != nil {
+		t.Fatal(err)
+	}
+	stanzas, err := r.Wrap(fileKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := i.Unwrap(stanzas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fileKey, out) {
+		t.Errorf("invalid output: %x, expected %x", out, fileKey)
+	}
+
+	if _, err := agessh.ParseCertificateRecipient(expired, true); err == nil {
+		t.Error("expired certificate was accepted with checkValidity")
+	}
+	if _, err := agessh.ParseCertificateRecipient(expired, false); err != nil {
+		t.Errorf("expired certificate was rejected without checkValidity: %v", err)
+	}
+	if _, err := agessh.ParseCertificateRecipient(string(ssh.MarshalAuthorizedKey(sshPubKey)), false); err == nil {
+		t.Error("plain public key was accepted as a certificate")
+	}
+
+	recs, err := age.ParseRecipients(strings.NewReader(expired))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 1 || !reflect.DeepEqual(recs[0], i.Recipient()) {
+		t.Errorf("age.ParseRecipients returned %v, want the certificate key", recs)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	// Fingerprints as printed by ssh-keygen -lf.
+	for name, want := range map[string]string{
+		"testdata/ed25519_key.pub":           "SHA256:o3G9t5RWnO1ySg5yg5QeFJ3//8hdJhDRZ9YlQLpeLZE",
+		"testdata/rsa_encrypted_pem_key.pub": "SHA256:D5DOSrrJgmOIhiYrN6yG7BFfQfnvrsglU5gIYXZP7gI",
+	} {
+		pubKey, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := agessh.ParseRecipient(string(pubKey))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := agessh.Fingerprint(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("%s: got fingerprint %q, want %q", name, got, want)
+		}
+	}
+
+	x, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := agessh.Fingerprint(x.Recipient()); err == nil {
+		t.Error("expected an error for an X25519 recipient")
+	}
+}
+
+func TestRecipientFromPrivateKeyFile(t *testing.T) {
+	tests := []struct {
+		name       string
+		passphrase []byte
+		wantErr    bool
+	}{
+		{"ed25519_key", nil, false},
+		{"ed25519_encrypted_key", nil, false}, // public key is unencrypted
+		{"rsa_encrypted_pem_key", []byte("correct horse"), false},
+		{"rsa_encrypted_pem_key", nil, true},
+		{"rsa_encrypted_pem_key", []byte("battery staple"), true},
+	}
+	for _, tt := range tests {
+		r, err := agessh.RecipientFromPrivateKeyFile("testdata/"+tt.name, tt.passphrase)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		pemBytes, err := ioutil.ReadFile("testdata/" + tt.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var i age.Identity
+		if tt.passphrase == nil {
+			i, err = agessh.ParseIdentity(pemBytes)
+			if _, ok := err.(*ssh.PassphraseMissingError); ok {
+				continue
+			}
+		} else {
+			var k interface{}
+			k, err = ssh.ParseRawPrivateKeyWithPassphrase(pemBytes, tt.passphrase)
+			if err == nil {
+				i, err = agessh.NewRSAIdentity(k.(*rsa.PrivateKey))
+			}
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fileKey := make([]byte, 16)
+		if _, err := rand.Read(fileKey); err != nil {
+			t.Fatal(err)
+		}
+		stanzas, err := r.Wrap(fileKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := i.Unwrap(stanzas)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !bytes.Equal(fileKey, out) {
+			t.Errorf("%s: invalid output: %x, expected %x", tt.name, out, fileKey)
+		}
+	}
+}
+
+func TestSSHRSALabel(t *testing.T) {
+	pk, err := rsa.GenerateKey(rand.Reader, 768)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := agessh.NewRSAIdentity(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fileKey := make([]byte, 16)
+	if _, err := rand.Read(fileKey); err != nil {
+		t.Fatal(err)
+	}
+	wrap := func(label string) []*age.Stanza {
+		r := i.Recipient().(*agessh.RSARecipient)
+		r.SetLabel(label)
+		stanzas, err := r.Wrap(fileKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stanzas
+	}
+
+	for _, tt := range []struct {
+		wrapLabel, unwrapLabel string
+		wantErr                bool
+	}{
+		{"", "", false},
+		{"A", "A", false},
+		{"A", "B", true},
+		{"A", "", true},
+		{"", "A", true},
+	} {
+		i.SetLabel(tt.unwrapLabel)
+		out, err := i.Unwrap(wrap(tt.wrapLabel))
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("wrap label %q, unwrap label %q: expected error", tt.wrapLabel, tt.unwrapLabel)
+			} else if errors.Is(err, age.ErrIncorrectIdentity) {
+				t.Errorf("wrap label %q, unwrap label %q: got ErrIncorrectIdentity, expected a more specific error", tt.wrapLabel, tt.unwrapLabel)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(fileKey, out) {
+			t.Errorf("invalid output: %x, expected %x", out, fileKey)
+		}
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshPubKey, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := agessh.NewEd25519Identity(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := i.Recipient().(*agessh.Ed25519Recipient)
+
+	file := &bytes.Buffer{}
+	w, err := age.Encrypt(file, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sig, err := i.Sign(bytes.NewReader(file.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(sig, []byte("-----BEGIN SSH SIGNATURE-----\n")) {
+		t.Errorf("unexpected signature encoding: %q", sig)
+	}
+	if err := r.Verify(bytes.NewReader(file.Bytes()), sig); err != nil {
+		t.Fatal(err)
+	}
+	if err := agessh.Verify(bytes.NewReader(file.Bytes()), sig, sshPubKey); err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := append([]byte{}, file.Bytes()...)
+	tampered[len(tampered)-1] ^= 1
+	if err := r.Verify(bytes.NewReader(tampered), sig); err == nil {
+		t.Error("tampered file was accepted")
+	}
+
+	otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ssh.NewPublicKey(otherPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := agessh.Verify(bytes.NewReader(file.Bytes()), sig, otherKey); err == nil {
+		t.Error("signature was accepted with a different key")
+	}
+	if err := r.Verify(bytes.NewReader(file.Bytes()), sig[:len(sig)/2]); err == nil {
+		t.Error("truncated signature was accepted")
+	}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaSigner, err := ssh.NewSignerFromKey(rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := agessh.Sign(bytes.NewReader(file.Bytes()), rsaSigner); err == nil {
+		t.Error("expected an error for an RSA key")
+	}
+}
+
+func TestSameRecipients(t *testing.T) {
+	var recipients []age.Recipient
+	for i := 0; i < 2; i++ {
+		pub, _, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sshPubKey, err := ssh.NewPublicKey(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := agessh.NewEd25519Recipient(sshPubKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recipients = append(recipients, r)
+	}
+
+	a, err := age.EncryptBytes([]byte("test"), recipients...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := age.EncryptBytes([]byte("test"), recipients[1], recipients[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := age.EncryptBytes([]byte("test"), recipients[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if same, err := age.SameRecipients(bytes.NewReader(a), bytes.NewReader(b)); err != nil || !same {
+		t.Errorf("got %v, %v; want true", same, err)
+	}
+	if same, err := age.SameRecipients(bytes.NewReader(a), bytes.NewReader(c)); err != nil || same {
+		t.Errorf("got %v, %v; want false", same, err)
+	}
+}
+
+func TestRecipientFingerprint(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshPubKey, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := agessh.NewEd25519Recipient(sshPubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := age.RecipientFingerprint(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := ssh.FingerprintSHA256(sshPubKey); got != want {
+		t.Errorf("got fingerprint %q, want %q", got, want)
+	}
+}
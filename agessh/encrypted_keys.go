@@ -10,6 +10,7 @@ import (
 	"crypto/ed25519"
 	"crypto/rsa"
 	"fmt"
+	"io/ioutil"
 
 	"filippo.io/age"
 	"golang.org/x/crypto/ssh"
@@ -116,3 +117,47 @@ func (i *EncryptedSSHIdentity) Unwrap(stanzas []*age.Stanza) (fileKey []byte, er
 
 	return i.decrypted.Unwrap(stanzas)
 }
+
+// RecipientFromPrivateKeyFile reads the SSH private key at path and returns
+// the age.Recipient corresponding to its public key, for example to encrypt a
+// file to oneself. The file can then be decrypted with the Identity returned
+// by ParseIdentity for the same key.
+//
+// If the private key is encrypted, passphrase is used to decrypt it, unless
+// the public key is available in the unencrypted part of the file. passphrase
+// may be nil for unencrypted keys.
+func RecipientFromPrivateKeyFile(path string, passphrase []byte) (age.Recipient, error) {
+	pemBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read SSH key file: %v", err)
+	}
+	k, err := ssh.ParseRawPrivateKey(pemBytes)
+	if sshErr, ok := err.(*ssh.PassphraseMissingError); ok {
+		if sshErr.PublicKey != nil {
+			return ParseRecipient(string(ssh.MarshalAuthorizedKey(sshErr.PublicKey)))
+		}
+		if passphrase == nil {
+			return nil, fmt.Errorf("SSH key file is encrypted and no passphrase was provided")
+		}
+		k, err = ssh.ParseRawPrivateKeyWithPassphrase(pemBytes, passphrase)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SSH key file: %v", err)
+	}
+
+	var id interface{ Recipient() age.Recipient }
+	switch k := k.(type) {
+	case *ed25519.PrivateKey:
+		id, err = NewEd25519Identity(*k)
+	case ed25519.PrivateKey:
+		id, err = NewEd25519Identity(k)
+	case *rsa.PrivateKey:
+		id, err = NewRSAIdentity(k)
+	default:
+		return nil, fmt.Errorf("unsupported SSH key type: %T", k)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid SSH key: %v", err)
+	}
+	return id.Recipient(), nil
+}
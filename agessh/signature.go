@@ -0,0 +1,150 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package agessh
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SignatureNamespace is the namespace of the signatures produced by Sign. A
+// signature made for a different namespace, or with a different tool for a
+// different purpose, is not accepted by Verify.
+const SignatureNamespace = "age-encryption.org"
+
+// Signatures use the SSHSIG format of OpenSSH, so they can also be checked
+// with "ssh-keygen -Y verify -n age-encryption.org". See
+// https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.sshsig.
+const (
+	sshsigMagic   = "SSHSIG"
+	sshsigVersion = 1
+	sshsigHash    = "sha512"
+	sshsigPEMType = "SSH SIGNATURE"
+)
+
+type sshsigSignedData struct {
+	Namespace     string
+	Reserved      string
+	HashAlgorithm string
+	Hash          []byte
+}
+
+type sshsigBlob struct {
+	Version       uint32
+	PublicKey     []byte
+	Namespace     string
+	Reserved      string
+	HashAlgorithm string
+	Signature     []byte
+}
+
+// Sign produces a detached signature of the contents of src, such as an age
+// file, with signer, which must be an ssh-ed25519 key. The signature is
+// PEM-encoded in the OpenSSH SSHSIG format.
+//
+// A signature authenticates the file to anyone with the public key, without
+// the need to decrypt it, for example when files are stored by a party that
+// can't be trusted not to replace them. It is unrelated to the authentication
+// provided by age encryption, which only proves that the file was encrypted
+// by someone who knew the recipient.
+func Sign(src io.Reader, signer ssh.Signer) ([]byte, error) {
+	if signer.PublicKey().Type() != ssh.KeyAlgoED25519 {
+		return nil, fmt.Errorf("unsupported signing key type %q", signer.PublicKey().Type())
+	}
+	h := sha512.New()
+	if _, err := io.Copy(h, src); err != nil {
+		return nil, err
+	}
+	sig, err := signer.Sign(rand.Reader, sshsigMessage(h.Sum(nil)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign: %v", err)
+	}
+	blob := ssh.Marshal(&sshsigBlob{
+		Version:       sshsigVersion,
+		PublicKey:     signer.PublicKey().Marshal(),
+		Namespace:     SignatureNamespace,
+		HashAlgorithm: sshsigHash,
+		Signature:     ssh.Marshal(sig),
+	})
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  sshsigPEMType,
+		Bytes: append([]byte(sshsigMagic), blob...),
+	}), nil
+}
+
+// Verify checks that sig is a signature of the contents of src produced by
+// Sign with the private key corresponding to pk, which must be an ssh-ed25519
+// key.
+func Verify(src io.Reader, sig []byte, pk ssh.PublicKey) error {
+	if pk.Type() != ssh.KeyAlgoED25519 {
+		return fmt.Errorf("unsupported signing key type %q", pk.Type())
+	}
+	block, rest := pem.Decode(sig)
+	if block == nil || block.Type != sshsigPEMType || len(bytes.TrimSpace(rest)) != 0 {
+		return errors.New("malformed signature: invalid PEM encoding")
+	}
+	if !bytes.HasPrefix(block.Bytes, []byte(sshsigMagic)) {
+		return errors.New("malformed signature: invalid preamble")
+	}
+	var b sshsigBlob
+	if err := ssh.Unmarshal(block.Bytes[len(sshsigMagic):], &b); err != nil {
+		return fmt.Errorf("malformed signature: %v", err)
+	}
+	switch {
+	case b.Version != sshsigVersion:
+		return fmt.Errorf("unsupported signature version %d", b.Version)
+	case b.Namespace != SignatureNamespace:
+		return fmt.Errorf("signature is for namespace %q, not %q", b.Namespace, SignatureNamespace)
+	case b.HashAlgorithm != sshsigHash:
+		return fmt.Errorf("unsupported signature hash algorithm %q", b.HashAlgorithm)
+	case !bytes.Equal(b.PublicKey, pk.Marshal()):
+		return errors.New("signature was made with a different key")
+	}
+	s := &ssh.Signature{}
+	if err := ssh.Unmarshal(b.Signature, s); err != nil {
+		return fmt.Errorf("malformed signature: %v", err)
+	}
+	if s.Format != ssh.KeyAlgoED25519 {
+		return fmt.Errorf("unsupported signature type %q", s.Format)
+	}
+
+	h := sha512.New()
+	if _, err := io.Copy(h, src); err != nil {
+		return err
+	}
+	if err := pk.Verify(sshsigMessage(h.Sum(nil)), s); err != nil {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+func sshsigMessage(hash []byte) []byte {
+	return append([]byte(sshsigMagic), ssh.Marshal(&sshsigSignedData{
+		Namespace:     SignatureNamespace,
+		HashAlgorithm: sshsigHash,
+		Hash:          hash,
+	})...)
+}
+
+// Sign produces a detached signature of the contents of src with the
+// Ed25519 key of i. See the package-level Sign function.
+func (i *Ed25519Identity) Sign(src io.Reader) ([]byte, error) {
+	return Sign(src, i.signer)
+}
+
+// Verify checks a signature produced by Ed25519Identity.Sign with the
+// identity corresponding to r. See the package-level Verify function.
+func (r *Ed25519Recipient) Verify(src io.Reader, sig []byte) error {
+	return Verify(src, sig, r.sshKey)
+}
@@ -0,0 +1,101 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+// Package agetest provides helpers to produce unusual but valid age files, to
+// test the interoperability of age implementations.
+//
+// It is not meant for use outside of tests.
+package agetest
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+
+	"filippo.io/age"
+)
+
+// stanzaRecipient is a Recipient that ignores the file key and always returns
+// the same stanza.
+type stanzaRecipient struct {
+	s *age.Stanza
+}
+
+func (r stanzaRecipient) Wrap(fileKey []byte) ([]*age.Stanza, error) {
+	return []*age.Stanza{r.s}, nil
+}
+
+// EncryptWithExtraStanza is like age.Encrypt, but it adds stanza to the header
+// before the stanzas of recipients. stanza is not checked for validity, and
+// its contents are unrelated to the file key.
+//
+// A conforming implementation must ignore stanzas of unknown types, so the
+// file should still decrypt with an identity for any of recipients. See
+// GreaseStanza for generating such a stanza.
+func EncryptWithExtraStanza(dst io.Writer, stanza *age.Stanza, recipients ...age.Recipient) (io.WriteCloser, error) {
+	if len(recipients) == 0 {
+		return nil, errors.New("no recipients specified")
+	}
+	rr := append([]age.Recipient{stanzaRecipient{stanza}}, recipients...)
+	return age.Encrypt(dst, rr...)
+}
+
+// GreaseStanza returns a random stanza of a type that no implementation
+// recognizes, with up to three random arguments and a random body of up to 100
+// bytes. The type ends in "-grease", following the convention of other
+// implementations.
+func GreaseStanza() (*age.Stanza, error) {
+	name, err := randomString(8)
+	if err != nil {
+		return nil, err
+	}
+	s := &age.Stanza{Type: name + "-grease"}
+	nArgs, err := randomInt(4)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < nArgs; i++ {
+		a, err := randomString(10)
+		if err != nil {
+			return nil, err
+		}
+		s.Args = append(s.Args, a)
+	}
+	bodyLen, err := randomInt(101)
+	if err != nil {
+		return nil, err
+	}
+	s.Body = make([]byte, bodyLen)
+	if _, err := rand.Read(s.Body); err != nil {
+		return nil, fmt.Errorf("failed to generate random body: %v", err)
+	}
+	return s, nil
+}
+
+func randomInt(max int) (int, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(max)))
+	if err != nil {
+		return 0, err
+	}
+	return int(n.Int64()), nil
+}
+
+// randomString returns a random string of lowercase letters and digits, which
+// are valid in stanza types and arguments.
+func randomString(n int) (string, error) {
+	const alphabet = "abcdefghijklmnopqrstuvwxyz0123456789"
+	b := make([]byte, n)
+	for i := range b {
+		c, err := randomInt(len(alphabet))
+		if err != nil {
+			return "", err
+		}
+		b[i] = alphabet[c]
+	}
+	return string(b), nil
+}
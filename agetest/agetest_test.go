@@ -0,0 +1,63 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package agetest_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/agetest"
+)
+
+const helloWorld = "Hello, Twitch!"
+
+func TestEncryptWithExtraStanza(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < 20; n++ {
+		s, err := agetest.GreaseStanza()
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := &bytes.Buffer{}
+		w, err := agetest.EncryptWithExtraStanza(buf, s, i.Recipient())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, helloWorld); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		info, err := age.Inspect(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(info.StanzaTypes) != 2 || info.StanzaTypes[0] != s.Type {
+			t.Errorf("unexpected stanzas: %v", info.StanzaTypes)
+		}
+
+		out, err := age.Decrypt(buf, i)
+		if err != nil {
+			t.Fatalf("stanza %v: %v", s, err)
+		}
+		outBytes, err := ioutil.ReadAll(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(outBytes) != helloWorld {
+			t.Errorf("wrong data: %q, excepted %q", outBytes, helloWorld)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package age
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// A RecipientResolver maps names to recipients, so that users can refer to
+// recipients as "@name" in RecipientSpec instead of spelling them out.
+type RecipientResolver interface {
+	// ResolveRecipient returns the recipient called name, without the "@"
+	// prefix, or an error if there is none.
+	ResolveRecipient(name string) (Recipient, error)
+}
+
+// RecipientAliases is a RecipientResolver backed by an alias file, see
+// ParseRecipientAliases.
+type RecipientAliases struct {
+	aliases map[string]Recipient
+}
+
+var _ RecipientResolver = &RecipientAliases{}
+
+// ParseRecipientAliases parses a file of recipient aliases, one per line, in
+// the form
+//
+//	alice = age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p
+//
+// Empty lines and lines starting with "#" are ignored. Lines can end in LF or
+// CRLF. Names can't contain whitespace, "=", or "@", and can't be repeated.
+// Recipients are parsed like in ParseRecipients.
+func ParseRecipientAliases(f io.Reader) (*RecipientAliases, error) {
+	const aliasFileSizeLimit = 1 << 24 // 16 MiB
+	a := &RecipientAliases{aliases: make(map[string]Recipient)}
+	scanner := newKeyFileScanner(f, aliasFileSizeLimit)
+	for scanner.Scan() {
+		n, line := scanner.Line()
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "#") || line == "" {
+			continue
+		}
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("missing \"=\" at line %d", n)
+		}
+		name := strings.TrimSpace(line[:eq])
+		value := strings.TrimSpace(line[eq+1:])
+		if name == "" || strings.ContainsAny(name, " \t@") {
+			return nil, fmt.Errorf("invalid alias name %q at line %d", name, n)
+		}
+		if _, ok := a.aliases[name]; ok {
+			return nil, fmt.Errorf("duplicate alias %q at line %d", name, n)
+		}
+		parse := lookupRecipientParser(value)
+		if parse == nil {
+			return nil, fmt.Errorf("unknown recipient type at line %d", n)
+		}
+		r, err := parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("malformed recipient at line %d: %v", n, err)
+		}
+		a.aliases[name] = r
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read aliases file: %v", err)
+	}
+	return a, nil
+}
+
+// ResolveRecipient returns the recipient aliased to name.
+func (a *RecipientAliases) ResolveRecipient(name string) (Recipient, error) {
+	r, ok := a.aliases[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown recipient alias %q", name)
+	}
+	return r, nil
+}
+
+// resolveAlias resolves a "@name" reference with resolver, or returns an error
+// if resolver is nil.
+func resolveAlias(resolver RecipientResolver, ref string) (Recipient, error) {
+	if resolver == nil {
+		return nil, fmt.Errorf("recipient alias %q used without a resolver", ref)
+	}
+	return resolver.ResolveRecipient(strings.TrimPrefix(ref, "@"))
+}
@@ -7,8 +7,14 @@
 // Package armor provides a strict, streaming implementation of the ASCII
 // armoring format for age files.
 //
-// It's PEM with type "AGE ENCRYPTED FILE", 64 character columns, no headers,
-// and strict base64 decoding.
+// It's PEM with type "AGE ENCRYPTED FILE", 64 character columns, and strict
+// base64 decoding. PEM headers are only written if requested with WithHeader,
+// and are ignored by the Reader.
+//
+// Unlike OpenPGP armor, there is no CRC checksum line. Transport corruption,
+// like mangled line wrapping or altered characters, is reported by the Reader
+// as an "invalid armor" error if it breaks the strict encoding, and otherwise
+// by the age header MAC and payload authentication when decrypting.
 package armor
 
 import (
@@ -17,6 +23,8 @@ import (
 	"encoding/base64"
 	"errors"
 	"io"
+	"strings"
+	"unicode"
 
 	"filippo.io/age/internal/format"
 )
@@ -26,15 +34,40 @@ const (
 	Footer = "-----END AGE ENCRYPTED FILE-----"
 )
 
+// MaxLeadingWhitespace is the most whitespace, including empty lines, that the
+// Reader returned by NewReader skips before the Header line.
+const MaxLeadingWhitespace = 1024
+
+// IsArmored reports whether the data read from b starts with Header, possibly
+// after whitespace that the Reader returned by NewReader would skip. It only
+// peeks at b, which should have a buffer of at least the default size, and it
+// returns an error only if reading from b fails.
+func IsArmored(b *bufio.Reader) (bool, error) {
+	peeked, err := b.Peek(len(Header) + MaxLeadingWhitespace)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return false, err
+	}
+	trimmed := bytes.TrimLeftFunc(peeked, unicode.IsSpace)
+	if len(peeked)-len(trimmed) > MaxLeadingWhitespace {
+		return false, nil
+	}
+	return bytes.HasPrefix(trimmed, []byte(Header)), nil
+}
+
 type armoredWriter struct {
 	started, closed bool
 	encoder         io.WriteCloser
 	dst             io.Writer
+	headers         []string
 }
 
 func (a *armoredWriter) Write(p []byte) (int, error) {
 	if !a.started {
-		if _, err := io.WriteString(a.dst, Header+"\n"); err != nil {
+		first := Header + "\n"
+		if len(a.headers) > 0 {
+			first += strings.Join(a.headers, "\n") + "\n\n"
+		}
+		if _, err := io.WriteString(a.dst, first); err != nil {
 			return 0, err
 		}
 	}
@@ -54,11 +87,31 @@ func (a *armoredWriter) Close() error {
 	return err
 }
 
-func NewWriter(dst io.Writer) io.WriteCloser {
+// A WriterOption changes the behavior of the Writer returned by NewWriter.
+type WriterOption func(*armoredWriter)
+
+// WithHeader adds a PEM header line "key: value" after the first line of the
+// armored file, for example to tag it with routing metadata. Headers are
+// written in the order the options are passed, followed by an empty line.
+//
+// Headers are not authenticated, and are ignored by the Reader. key must be
+// non-empty, and neither key nor value can contain a colon or a newline.
+func WithHeader(key, value string) WriterOption {
+	if key == "" || strings.ContainsAny(key, ":\r\n") || strings.ContainsAny(value, ":\r\n") {
+		panic("armor: WithHeader called with invalid key or value")
+	}
+	return func(a *armoredWriter) { a.headers = append(a.headers, key+": "+value) }
+}
+
+func NewWriter(dst io.Writer, opts ...WriterOption) io.WriteCloser {
 	// TODO: write a test with aligned and misaligned sizes, and 8 and 10 steps.
-	return &armoredWriter{dst: dst,
+	a := &armoredWriter{dst: dst,
 		encoder: base64.NewEncoder(base64.StdEncoding.Strict(),
 			format.NewlineWriter(dst))}
+	for _, o := range opts {
+		o(a)
+	}
+	return a
 }
 
 type armoredReader struct {
@@ -69,8 +122,74 @@ type armoredReader struct {
 	err     error
 }
 
-func NewReader(r io.Reader) io.Reader {
-	return &armoredReader{r: bufio.NewReader(r)}
+// DefaultMaxLineLength is the default limit on the length of any line read by
+// the Reader returned by NewReader, including the header and footer. Valid
+// lines are at most format.ColumnsPerLine long, plus optional whitespace.
+const DefaultMaxLineLength = 1024
+
+// A ReaderOption changes the behavior of the Reader returned by NewReader.
+type ReaderOption func(*readerConfig)
+
+type readerConfig struct {
+	maxLineLength int
+	maxInputSize  int64
+}
+
+// WithMaxLineLength limits the length of each line read, including the header
+// and footer, to n bytes including the line terminator. Longer lines cause an
+// error without being buffered. The default is DefaultMaxLineLength, and n
+// can't be smaller than 80.
+func WithMaxLineLength(n int) ReaderOption {
+	if n < 80 {
+		panic("armor: WithMaxLineLength called with too small value")
+	}
+	return func(c *readerConfig) { c.maxLineLength = n }
+}
+
+// WithMaxInputSize causes the Reader to return an error if the armored input
+// is longer than n bytes. By default there is no limit.
+func WithMaxInputSize(n int64) ReaderOption {
+	return func(c *readerConfig) { c.maxInputSize = n }
+}
+
+// NewReader returns a Reader that decodes the armored age file read from r.
+//
+// The Reader allocates memory proportional to the maximum line length, not to
+// the input, so it's suitable for untrusted input. Services processing
+// untrusted files might also want to use WithMaxInputSize.
+func NewReader(r io.Reader, opts ...ReaderOption) io.Reader {
+	c := &readerConfig{maxLineLength: DefaultMaxLineLength}
+	for _, o := range opts {
+		o(c)
+	}
+	if c.maxInputSize > 0 {
+		r = &sizeLimitedReader{r: r, n: c.maxInputSize}
+	}
+	return &armoredReader{r: bufio.NewReaderSize(r, c.maxLineLength)}
+}
+
+// sizeLimitedReader is like io.LimitedReader, but it returns an error instead
+// of io.EOF if the underlying Reader has more than n bytes.
+type sizeLimitedReader struct {
+	r io.Reader
+	n int64 // remaining bytes
+}
+
+func (l *sizeLimitedReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		var b [1]byte
+		n, err := l.r.Read(b[:])
+		if n > 0 {
+			return 0, errors.New("invalid armor: input size limit exceeded")
+		}
+		return 0, err
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
 }
 
 func (r *armoredReader) Read(p []byte) (int, error) {
@@ -83,8 +202,13 @@ func (r *armoredReader) Read(p []byte) (int, error) {
 		return 0, r.err
 	}
 
+	var raw []byte // the last line returned by getLine, before trimming
 	getLine := func() ([]byte, error) {
-		line, err := r.r.ReadBytes('\n')
+		line, err := r.r.ReadSlice('\n')
+		raw = line
+		if err == bufio.ErrBufferFull {
+			return nil, errors.New("invalid armor: line too long")
+		}
 		if err != nil && len(line) == 0 {
 			if err == io.EOF {
 				err = errors.New("invalid armor: unexpected EOF")
@@ -94,19 +218,51 @@ func (r *armoredReader) Read(p []byte) (int, error) {
 		return bytes.TrimSpace(line), nil
 	}
 
+	var line []byte
+	var err error
+	haveLine := false
 	if !r.started {
-		line, err := getLine()
+		// Skip leading whitespace, including empty lines, like IsArmored.
+		first, err := getLine()
+		skipped := len(raw) - len(bytes.TrimLeftFunc(raw, unicode.IsSpace))
+		for err == nil && len(first) == 0 && skipped <= MaxLeadingWhitespace {
+			first, err = getLine()
+			skipped += len(raw) - len(bytes.TrimLeftFunc(raw, unicode.IsSpace))
+		}
 		if err != nil {
 			return 0, r.setErr(err)
 		}
-		if string(line) != Header {
-			return 0, r.setErr(errors.New("invalid armor first line: " + string(line)))
+		if skipped > MaxLeadingWhitespace {
+			return 0, r.setErr(errors.New("invalid armor: too much leading whitespace"))
+		}
+		if string(first) != Header {
+			return 0, r.setErr(errors.New("invalid armor first line: " + string(first)))
 		}
 		r.started = true
+
+		// Skip the PEM headers, if any. They can't be mistaken for base64,
+		// which doesn't use colons, and they must be followed by an empty line.
+		line, err = getLine()
+		if err != nil {
+			return 0, r.setErr(err)
+		}
+		if bytes.IndexByte(line, ':') >= 0 {
+			for bytes.IndexByte(line, ':') >= 0 {
+				if line, err = getLine(); err != nil {
+					return 0, r.setErr(err)
+				}
+			}
+			if len(line) != 0 {
+				return 0, r.setErr(errors.New("invalid armor: missing empty line after headers"))
+			}
+		} else {
+			haveLine = true
+		}
 	}
-	line, err := getLine()
-	if err != nil {
-		return 0, r.setErr(err)
+	if !haveLine {
+		if line, err = getLine(); err != nil {
+			return 0, r.setErr(err)
+		}
 	}
 	if string(line) == Footer {
 		return 0, r.setErr(io.EOF)
@@ -7,6 +7,7 @@
 package armor_test
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/pem"
 	"fmt"
@@ -114,3 +115,133 @@ func TestArmor(t *testing.T) {
 		t.Error("decoded value doesn't match")
 	}
 }
+
+type infiniteReader byte
+
+func (r infiniteReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(r)
+	}
+	return len(p), nil
+}
+
+func TestArmorLimits(t *testing.T) {
+	// A giant header line must be rejected without reading all of it.
+	r := armor.NewReader(io.MultiReader(strings.NewReader("-----BEGIN"), infiniteReader('-')))
+	if _, err := ioutil.ReadAll(r); err == nil {
+		t.Error("expected error for giant header line")
+	}
+	r = armor.NewReader(io.MultiReader(strings.NewReader(armor.Header+"\n"), infiniteReader('A')))
+	if _, err := ioutil.ReadAll(r); err == nil {
+		t.Error("expected error for giant body line")
+	}
+
+	buf := &bytes.Buffer{}
+	w := armor.NewWriter(buf)
+	plain := make([]byte, 611)
+	if _, err := w.Write(plain); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	armored := buf.Bytes()
+
+	r = armor.NewReader(bytes.NewReader(armored), armor.WithMaxInputSize(int64(len(armored))))
+	if out, err := ioutil.ReadAll(r); err != nil {
+		t.Errorf("unexpected error at exact size limit: %v", err)
+	} else if !bytes.Equal(out, plain) {
+		t.Error("decoded value doesn't match")
+	}
+	r = armor.NewReader(bytes.NewReader(armored), armor.WithMaxInputSize(int64(len(armored)-10)))
+	if _, err := ioutil.ReadAll(r); err == nil {
+		t.Error("expected error for input over the size limit")
+	}
+	r = armor.NewReader(io.MultiReader(bytes.NewReader(armored), infiniteReader('\n')), armor.WithMaxInputSize(1<<20))
+	if _, err := ioutil.ReadAll(r); err != nil {
+		t.Errorf("trailing data after the footer should not be read: %v", err)
+	}
+
+	long := bytes.Replace(armored, []byte(armor.Header), []byte(armor.Header+strings.Repeat(" ", 200)), 1)
+	if _, err := ioutil.ReadAll(armor.NewReader(bytes.NewReader(long))); err != nil {
+		t.Errorf("unexpected error for header with trailing whitespace: %v", err)
+	}
+	if _, err := ioutil.ReadAll(armor.NewReader(bytes.NewReader(long), armor.WithMaxLineLength(100))); err == nil {
+		t.Error("expected error for header longer than the line limit")
+	}
+}
+
+func TestArmorLeadingWhitespace(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := armor.NewWriter(buf)
+	plain := make([]byte, 611)
+	if _, err := w.Write(plain); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, n := range []int{0, 1, armor.MaxLeadingWhitespace, armor.MaxLeadingWhitespace + 1} {
+		// Mix empty lines and spaces before the header line.
+		prefix := strings.Repeat("\n", n/2) + strings.Repeat(" ", n-n/2)
+		in := prefix + buf.String()
+		want := n <= armor.MaxLeadingWhitespace
+
+		armored, err := armor.IsArmored(bufio.NewReader(strings.NewReader(in)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if armored != want {
+			t.Errorf("%d bytes of whitespace: IsArmored = %v, want %v", n, armored, want)
+		}
+		out, err := ioutil.ReadAll(armor.NewReader(strings.NewReader(in)))
+		if (err == nil) != want {
+			t.Errorf("%d bytes of whitespace: got error %v, want success %v", n, err, want)
+		} else if want && !bytes.Equal(out, plain) {
+			t.Error("decoded value doesn't match")
+		}
+	}
+
+	r := armor.NewReader(infiniteReader('\n'))
+	if _, err := ioutil.ReadAll(r); err == nil {
+		t.Error("expected error for endless empty lines")
+	}
+}
+
+func TestArmorHeaders(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := armor.NewWriter(buf, armor.WithHeader("Route", "queue-7"), armor.WithHeader("Owner", "ops"))
+	plain := make([]byte, 611)
+	if _, err := w.Write(plain); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	block, _ := pem.Decode(buf.Bytes())
+	if block == nil {
+		t.Fatal("PEM decoding failed")
+	}
+	if block.Headers["Route"] != "queue-7" || block.Headers["Owner"] != "ops" {
+		t.Errorf("unexpected PEM headers: %v", block.Headers)
+	}
+	if !bytes.Equal(block.Bytes, plain) {
+		t.Error("PEM decoded value doesn't match")
+	}
+
+	armored := buf.String()
+	out, err := ioutil.ReadAll(armor.NewReader(strings.NewReader(armored)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, plain) {
+		t.Error("decoded value doesn't match")
+	}
+
+	noEmptyLine := strings.Replace(armored, "Owner: ops\n\n", "Owner: ops\n", 1)
+	if _, err := ioutil.ReadAll(armor.NewReader(strings.NewReader(noEmptyLine))); err == nil {
+		t.Error("expected error for headers not followed by an empty line")
+	}
+}
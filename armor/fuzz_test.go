@@ -0,0 +1,59 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+//go:build go1.18
+// +build go1.18
+
+package armor_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"filippo.io/age/armor"
+)
+
+func FuzzArmorReader(f *testing.F) {
+	for _, n := range []int{0, 1, 47, 48, 49, 611} {
+		buf := &bytes.Buffer{}
+		w := armor.NewWriter(buf)
+		if _, err := w.Write(bytes.Repeat([]byte{0x42}, n)); err != nil {
+			f.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			f.Fatal(err)
+		}
+		f.Add(buf.Bytes())
+	}
+	f.Add([]byte(armor.Header + "\n" + armor.Footer + "\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := armor.NewReader(bytes.NewReader(data))
+		// Base64 can only shrink the data, so the output must be shorter than
+		// the input, or the reader is making things up.
+		out, err := ioutil.ReadAll(io.LimitReader(r, int64(len(data))+1))
+		if len(out) > len(data) {
+			t.Fatalf("armor reader returned %d bytes from a %d bytes input", len(out), len(data))
+		}
+		if err != nil {
+			return
+		}
+		buf := &bytes.Buffer{}
+		w := armor.NewWriter(buf)
+		if _, err := w.Write(out); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if again, err := ioutil.ReadAll(armor.NewReader(buf)); err != nil {
+			t.Fatalf("re-armored output failed to decode: %v", err)
+		} else if !bytes.Equal(again, out) {
+			t.Error("re-armored output decoded to different bytes")
+		}
+	})
+}
@@ -0,0 +1,67 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package age
+
+import (
+	"errors"
+	"io"
+)
+
+// A BatchDecryptor decrypts files with a fixed set of identities, with the
+// settings of the Decryptor that created it. It's meant for programs that
+// decrypt many files with the same identities, like backup restorers: they
+// are checked once by Batch, and what can be derived from them without
+// secrets, like the tags matched against NewHintedRecipient hints, is
+// computed once, so that each file only pays for unwrapping its own file key.
+//
+// A BatchDecryptor is safe for concurrent use if its identities are.
+type BatchDecryptor struct {
+	d          Decryptor
+	identities []Identity
+	tags       []string
+}
+
+// NewBatchDecryptor returns a BatchDecryptor that decrypts files like
+// Decrypt, with the given identities.
+func NewBatchDecryptor(identities ...Identity) (*BatchDecryptor, error) {
+	return (&Decryptor{}).Batch(identities...)
+}
+
+// Batch returns a BatchDecryptor that decrypts files with identities. Later
+// changes to d don't affect it.
+func (d *Decryptor) Batch(identities ...Identity) (*BatchDecryptor, error) {
+	for _, i := range identities {
+		if i == nil {
+			return nil, errors.New("nil identity")
+		}
+	}
+	identities, err := d.selectIdentities(identities)
+	if err != nil {
+		return nil, err
+	}
+	tags := make([]string, len(identities))
+	for n, i := range identities {
+		tags[n] = identityHintTag(i)
+	}
+	return &BatchDecryptor{
+		d:          *d,
+		identities: append([]Identity{}, identities...),
+		tags:       tags,
+	}, nil
+}
+
+// Decrypt decrypts a file with the identities of b. See Decryptor.Decrypt.
+func (b *BatchDecryptor) Decrypt(src io.Reader) (io.Reader, error) {
+	r, _, err := b.DecryptWithIdentity(src)
+	return r, err
+}
+
+// DecryptWithIdentity is like Decrypt, but it also returns the identity that
+// unwrapped the file key. See Decryptor.DecryptWithIdentity.
+func (b *BatchDecryptor) DecryptWithIdentity(src io.Reader) (io.Reader, Identity, error) {
+	return b.d.decryptWithTags(src, b.identities, b.tags, false)
+}
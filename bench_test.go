@@ -0,0 +1,196 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package age_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+)
+
+func BenchmarkDecryptManyStanzas(b *testing.B) {
+	const stanzas = 500
+	var recipients []age.Recipient
+	var last *age.X25519Identity
+	for n := 0; n < stanzas; n++ {
+		i, err := age.GenerateX25519Identity()
+		if err != nil {
+			b.Fatal(err)
+		}
+		recipients = append(recipients, i.Recipient())
+		last = i
+	}
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, recipients...)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if _, err := io.WriteString(w, helloWorld); err != nil {
+		b.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		b.Fatal(err)
+	}
+	file := buf.Bytes()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		// The matching stanza is the last one, so all of them are tried.
+		r, err := age.Decrypt(bytes.NewReader(file), last)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.Copy(ioutil.Discard, r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncryptSmall(b *testing.B) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		b.Fatal(err)
+	}
+	r := i.Recipient()
+	for _, size := range []int{32, 256} {
+		plaintext := make([]byte, size)
+		b.Run(fmt.Sprintf("Encrypt/%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			for n := 0; n < b.N; n++ {
+				buf := &bytes.Buffer{}
+				w, err := age.Encrypt(buf, r)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := w.Write(plaintext); err != nil {
+					b.Fatal(err)
+				}
+				if err := w.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("EncryptBytes/%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			for n := 0; n < b.N; n++ {
+				if _, err := age.EncryptBytes(plaintext, r); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkEncryptPrepared(b *testing.B) {
+	var recipients string
+	for n := 0; n < 3; n++ {
+		i, err := age.GenerateX25519Identity()
+		if err != nil {
+			b.Fatal(err)
+		}
+		recipients += i.Recipient().String() + "\n"
+	}
+	plaintext := []byte(helloWorld)
+
+	b.Run("Parse", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			rr, err := age.ParseRecipients(strings.NewReader(recipients))
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := (&age.Encryptor{GroupName: "bench"}).EncryptBytes(plaintext, rr...); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Prepared", func(b *testing.B) {
+		rr, err := age.ParseRecipients(strings.NewReader(recipients))
+		if err != nil {
+			b.Fatal(err)
+		}
+		p, err := (&age.Encryptor{GroupName: "bench"}).Prepare(rr...)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.ReportAllocs()
+		b.ResetTimer()
+		for n := 0; n < b.N; n++ {
+			if _, err := p.EncryptBytes(plaintext); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkDecryptBatch(b *testing.B) {
+	const files = 10000
+	var identities []age.Identity
+	var last age.Recipient
+	for n := 0; n < 4; n++ {
+		i, err := age.GenerateX25519Identity()
+		if err != nil {
+			b.Fatal(err)
+		}
+		identities = append(identities, i)
+		last = i.Recipient()
+	}
+	// The files are encrypted to the last identity, with a hint, so the
+	// identities are matched against it before trying any stanza.
+	hinted, err := age.NewHintedRecipient(last)
+	if err != nil {
+		b.Fatal(err)
+	}
+	p, err := (&age.Encryptor{}).Prepare(hinted)
+	if err != nil {
+		b.Fatal(err)
+	}
+	var encrypted [][]byte
+	for n := 0; n < files; n++ {
+		file, err := p.EncryptBytes([]byte(helloWorld))
+		if err != nil {
+			b.Fatal(err)
+		}
+		encrypted = append(encrypted, file)
+	}
+
+	b.Run("Decrypt", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			r, err := age.Decrypt(bytes.NewReader(encrypted[n%files]), identities...)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := io.Copy(ioutil.Discard, r); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("BatchDecryptor", func(b *testing.B) {
+		d, err := age.NewBatchDecryptor(identities...)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.ReportAllocs()
+		b.ResetTimer()
+		for n := 0; n < b.N; n++ {
+			r, err := d.Decrypt(bytes.NewReader(encrypted[n%files]))
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := io.Copy(ioutil.Discard, r); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
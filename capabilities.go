@@ -0,0 +1,80 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package age
+
+import (
+	"sort"
+	"strings"
+
+	"filippo.io/age/internal/format"
+)
+
+// CapabilitiesVersion is the version of the CapabilityInfo schema. It is
+// incremented only if fields are removed or their meaning changes.
+const CapabilitiesVersion = 1
+
+// CapabilityInfo describes what this build of the package supports, as
+// returned by Capabilities. It encodes to JSON with a stable schema, versioned
+// by CapabilitiesVersion.
+type CapabilityInfo struct {
+	// Version is CapabilitiesVersion.
+	Version int `json:"version"`
+
+	// Format is the age format version, "age-encryption.org/v1".
+	Format string `json:"format"`
+
+	// RecipientPrefixes and IdentityPrefixes are the prefixes of the
+	// encodings accepted by ParseRecipients and ParseIdentities, including
+	// those registered by imported packages, like filippo.io/age/agessh.
+	RecipientPrefixes []string `json:"recipient_prefixes"`
+	IdentityPrefixes  []string `json:"identity_prefixes"`
+
+	// Plugins reports whether age-plugin-NAME binaries can be used. It's
+	// always false, as this package has no plugin support.
+	Plugins bool `json:"plugins"`
+
+	// Extensions are the non-standard "ext-" stanza types implemented by
+	// this package.
+	Extensions []string `json:"extensions"`
+
+	// Experimental are the experimental recipient stanza types available in
+	// this build, which other age implementations don't support.
+	Experimental []string `json:"experimental"`
+}
+
+// experimentalStanzaTypes are the experimental stanza types compiled in, which
+// are added by the files implementing them, depending on build constraints.
+var experimentalStanzaTypes []string
+
+// Capabilities returns what this build of the package supports, for tools that
+// need to adapt to different builds, for example of this module and upstream.
+func Capabilities() *CapabilityInfo {
+	c := &CapabilityInfo{
+		Version: CapabilitiesVersion,
+		Format:  strings.TrimSuffix(format.Intro, "\n"),
+		Extensions: []string{
+			chainStanzaType, groupStanzaType, hintStanzaType, kmsStanzaType,
+			metadataStanzaType, notBeforeStanzaType, paddingStanzaType,
+			multiScryptStanzaType, symmetricStanzaType, timestampStanzaType,
+			totpStanzaType, totpWrapStanzaType,
+		},
+		Experimental: append([]string{}, experimentalStanzaTypes...),
+	}
+	parsersMu.RLock()
+	for prefix := range recipientParsers {
+		c.RecipientPrefixes = append(c.RecipientPrefixes, prefix)
+	}
+	for prefix := range identityParsers {
+		c.IdentityPrefixes = append(c.IdentityPrefixes, prefix)
+	}
+	parsersMu.RUnlock()
+	sort.Strings(c.RecipientPrefixes)
+	sort.Strings(c.IdentityPrefixes)
+	sort.Strings(c.Extensions)
+	sort.Strings(c.Experimental)
+	return c
+}
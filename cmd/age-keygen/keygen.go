@@ -7,35 +7,90 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"filippo.io/age"
+	"filippo.io/age/agessh"
 	"golang.org/x/term"
 )
 
 const usage = `Usage:
-    age-keygen [-o OUTPUT]
-    age-keygen -y [-o OUTPUT] [INPUT]
+    age-keygen [--strict] [--version-file PATH] [-r RECIPIENT]... [--mkdir]
+               [--utc] [--time-format LAYOUT] [-o OUTPUT]
+    age-keygen -y [--format FORMAT] [-o OUTPUT] [INPUT]
+    age-keygen --capabilities
 
 Options:
     -o, --output OUTPUT       Write the result to the file at path OUTPUT.
+    --mkdir                   Create the directory of OUTPUT if missing.
     -y                        Convert an identity file to a recipients file.
+    --format FORMAT           Format the -y output as plain, ssh-authorized, or env.
+    -r, --recipient RECIPIENT Encrypt the new key to RECIPIENT. Can be repeated.
+    --version-file PATH       Increment the key generation counter at PATH.
+    --utc                     Record the creation time in UTC.
+    --time-format LAYOUT      Record the creation time with a Go time LAYOUT.
+    --strict                  Treat warnings as errors.
+    --capabilities            Print the features of this build as JSON.
 
 age-keygen generates a new standard X25519 key pair, and outputs it to
 standard output or to the OUTPUT file.
 
 If an OUTPUT file is specified, the public key is printed to standard error.
-If OUTPUT already exists, it is not overwritten.
+If OUTPUT already exists, it is not overwritten. With --mkdir, the missing
+parent directories of OUTPUT are created, readable only by the current user.
+OUTPUT is first written to a temporary file in the same directory, which is
+renamed to OUTPUT once complete, or removed if age-keygen fails or is
+interrupted, so that no partial secret key is left behind.
+
+With -r, the new key is written as an age file encrypted to the given
+recipients, which can be age or SSH public keys, and the public key is always
+printed to standard error. This allows generating a key that can only be used
+after decrypting it with another, long-term key.
 
 In -y mode, age-keygen reads an identity file from INPUT or from standard
 input and writes the corresponding recipient(s) to OUTPUT or to standard
-output, one per line, with no comments.
+output, one per line, with no comments. "-" may be used as INPUT to read
+the identities from standard input explicitly.
+
+With --format, the recipients written in -y mode are formatted for other
+tools: "plain" is the default, "ssh-authorized" prefixes each recipient with
+"# " so it's a comment in SSH authorized_keys files, and "env" writes a single
+recipient as an AGE_RECIPIENT=... environment variable assignment.
+
+With --strict, age-keygen fails instead of printing a warning when writing
+the secret key to a world-readable file, or when reading identities with -y
+from a file that other users can read.
+
+The "# created:" comment holds the creation time in the local time zone, in
+RFC 3339 format. With --utc, it's in UTC instead, which keeps key files
+committed from different machines consistent. --time-format replaces RFC 3339
+with a custom layout, as accepted by https://pkg.go.dev/time#Time.Format.
+
+With --capabilities, age-keygen prints a JSON object describing this build:
+the schema "version", the age "format", the supported "recipient_prefixes"
+and "identity_prefixes", whether "plugins" are supported, and the
+"extensions" and "experimental" stanza types it implements.
+
+With --version-file, age-keygen reads the integer stored at PATH (or zero
+if PATH doesn't exist), increments it, adds it to the output as a
+"# version:" comment, and atomically writes it back once the key is written.
+This can be used to track the generations of a rotating key.
 
 Examples:
 
@@ -47,7 +102,13 @@ Examples:
     $ age-keygen -o key.txt
     Public key: age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p
 
+    $ age-keygen -r age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p -o key.age
+    Public key: age1lvyvwawkr0mcnnnncaghunadrqkmuf9e6507x9y920xxpp866cnql7dp2z
+
     $ age-keygen -y key.txt
+    age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p
+
+    $ echo "$SECRET_KEY" | age-keygen -y -
     age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p`
 
 // Version can be set at link time to override debug.BuildInfo.Main.Version,
@@ -55,26 +116,77 @@ Examples:
 // golang.org/issue/29814 and golang.org/issue/29228.
 var Version string
 
+type multiFlag []string
+
+func (f *multiFlag) String() string { return fmt.Sprint(*f) }
+
+func (f *multiFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
 func main() {
 	log.SetFlags(0)
 	flag.Usage = func() { fmt.Fprintf(os.Stderr, "%s\n", usage) }
 
 	var (
 		versionFlag, convertFlag bool
-		outFlag                  string
+		capabilitiesFlag         bool
+		strictFlag, mkdirFlag    bool
+		outFlag, versionFileFlag string
+		utcFlag                  bool
+		timeFormatFlag           string
+		formatFlag               string
+		recipientFlags           multiFlag
 	)
 
 	flag.BoolVar(&versionFlag, "version", false, "print the version")
 	flag.BoolVar(&convertFlag, "y", false, "convert identities to recipients")
+	flag.BoolVar(&capabilitiesFlag, "capabilities", false, "print the supported features as JSON")
 	flag.StringVar(&outFlag, "o", "", "output to `FILE` (default stdout)")
 	flag.StringVar(&outFlag, "output", "", "output to `FILE` (default stdout)")
+	flag.StringVar(&versionFileFlag, "version-file", "", "key generation counter `FILE`")
+	flag.BoolVar(&strictFlag, "strict", false, "treat warnings as errors")
+	flag.BoolVar(&mkdirFlag, "mkdir", false, "create the output directory")
+	flag.BoolVar(&utcFlag, "utc", false, "record the creation time in UTC")
+	flag.StringVar(&timeFormatFlag, "time-format", time.RFC3339, "creation time `LAYOUT`")
+	flag.StringVar(&formatFlag, "format", "plain", "-y output `FORMAT`")
+	flag.Var(&recipientFlags, "r", "encrypt the key to `RECIPIENT` (can be repeated)")
+	flag.Var(&recipientFlags, "recipient", "encrypt the key to `RECIPIENT` (can be repeated)")
 	flag.Parse()
+	age.SetStrict(strictFlag)
 	if len(flag.Args()) != 0 && !convertFlag {
 		log.Fatalf("age-keygen takes no arguments")
 	}
 	if len(flag.Args()) > 1 && convertFlag {
 		log.Fatalf("Too many arguments")
 	}
+	if versionFileFlag != "" && convertFlag {
+		log.Fatalf("--version-file can't be used with -y")
+	}
+	if len(recipientFlags) > 0 && convertFlag {
+		log.Fatalf("-r/--recipient can't be used with -y")
+	}
+	if (utcFlag || timeFormatFlag != time.RFC3339) && convertFlag {
+		log.Fatalf("--utc and --time-format can't be used with -y")
+	}
+	if formatFlag != "plain" && !convertFlag {
+		log.Fatalf("--format can only be used with -y")
+	}
+	if _, ok := recipientFormats[formatFlag]; !ok {
+		log.Fatalf("Unknown --format %q: must be plain, ssh-authorized, or env", formatFlag)
+	}
+	if strings.ContainsAny(timeFormatFlag, "\r\n") {
+		log.Fatalf("--time-format can't contain newlines")
+	}
+	var recipients []age.Recipient
+	for _, arg := range recipientFlags {
+		r, err := parseRecipient(arg)
+		if err != nil {
+			log.Fatalf("Invalid recipient %q: %v", arg, err)
+		}
+		recipients = append(recipients, r)
+	}
 	if versionFlag {
 		if Version != "" {
 			fmt.Println(Version)
@@ -87,23 +199,57 @@ func main() {
 		fmt.Println("(unknown)")
 		return
 	}
+	if capabilitiesFlag {
+		if convertFlag || outFlag != "" || len(recipientFlags) > 0 {
+			log.Fatalf("--capabilities can't be used with other options")
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "    ")
+		if err := enc.Encode(age.Capabilities()); err != nil {
+			log.Fatalf("Failed to encode capabilities: %v", err)
+		}
+		return
+	}
 
 	out := os.Stdout
+	commit := func() {}
+	if mkdirFlag && outFlag == "" {
+		log.Fatalf("--mkdir can only be used with -o/--output")
+	}
 	if outFlag != "" {
-		f, err := os.OpenFile(outFlag, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		dir := filepath.Dir(outFlag)
+		if mkdirFlag {
+			if err := os.MkdirAll(dir, 0700); err != nil {
+				log.Fatalf("Failed to create output directory %q: %v", dir, err)
+			}
+		}
+		if _, err := os.Lstat(outFlag); err == nil {
+			log.Fatalf("Failed to open output file %q: file already exists", outFlag)
+		}
+		f, err := createOutput(outFlag)
 		if err != nil {
+			if _, statErr := os.Stat(dir); os.IsNotExist(statErr) {
+				log.Fatalf("Failed to open output file %q: directory %q does not exist (use --mkdir to create it)", outFlag, dir)
+			}
 			log.Fatalf("Failed to open output file %q: %v", outFlag, err)
 		}
-		defer func() {
-			if err := f.Close(); err != nil {
-				log.Fatalf("Failed to close output file %q: %v", outFlag, err)
+		commit = func() {
+			if err := commitOutput(f, outFlag); err != nil {
+				fatalf("Failed to write output file %q: %v", outFlag, err)
 			}
-		}()
+		}
 		out = f
 	}
 
-	if fi, err := out.Stat(); err == nil {
+	if len(recipients) > 0 && term.IsTerminal(int(out.Fd())) {
+		fatalf("Refusing to write the encrypted key to the terminal. Use -o to write it to a file.")
+	}
+
+	if fi, err := out.Stat(); err == nil && len(recipients) == 0 {
 		if fi.Mode().IsRegular() && fi.Mode().Perm()&0004 != 0 {
+			if strictFlag {
+				fatalf("Refusing to write secret key to a world-readable file because of --strict")
+			}
 			fmt.Fprintf(os.Stderr, "Warning: writing secret key to a world-readable file.\n")
 		}
 	}
@@ -112,47 +258,279 @@ func main() {
 	if inFile := flag.Arg(0); inFile != "" && inFile != "-" {
 		f, err := os.Open(inFile)
 		if err != nil {
-			log.Fatalf("Failed to open input file %q: %v", inFile, err)
+			fatalf("Failed to open input file %q: %v", inFile, err)
 		}
 		defer f.Close()
+		if err := age.CheckIdentityFile(f); err != nil {
+			fatalf("Refusing to read input file %q because of --strict: %v", inFile, err)
+		}
 		in = f
 	}
 
 	if convertFlag {
-		convert(in, out)
+		convert(in, out, formatFlag)
+		commit()
 	} else {
-		generate(out)
+		var version int
+		if versionFileFlag != "" {
+			v, err := nextVersion(versionFileFlag)
+			if err != nil {
+				fatalf("Failed to read version file %q: %v", versionFileFlag, err)
+			}
+			version = v
+		}
+		created := time.Now()
+		if utcFlag {
+			created = created.UTC()
+		}
+		generate(out, created.Format(timeFormatFlag), version, recipients)
+		commit()
+		if versionFileFlag != "" {
+			if err := saveVersion(versionFileFlag, version); err != nil {
+				log.Fatalf("Key generated, but failed to update version file %q: %v", versionFileFlag, err)
+			}
+		}
+	}
+}
+
+// tempOutput is the temporary file the output is written to, if any, before
+// being renamed to its final name. It's removed by fatalf and on interrupt.
+// It's guarded by its mutex, since the signal handler goroutine uses it, and
+// stop, if not nil, unregisters that goroutine.
+var tempOutput struct {
+	sync.Mutex
+	name string
+	stop func()
+}
+
+// fatalf is log.Fatalf, but first removes tempOutput, so that no partial
+// output, like a truncated secret key, is left on disk.
+func fatalf(format string, v ...interface{}) {
+	discardOutput()
+	log.Fatalf(format, v...)
+}
+
+// pendingOutput returns the name of tempOutput, or "" if there is none.
+func pendingOutput() string {
+	tempOutput.Lock()
+	defer tempOutput.Unlock()
+	return tempOutput.name
+}
+
+// releaseOutput forgets tempOutput, without removing it, and stops handling
+// signals for it.
+func releaseOutput() (name string) {
+	tempOutput.Lock()
+	defer tempOutput.Unlock()
+	if tempOutput.stop != nil {
+		tempOutput.stop()
+	}
+	name = tempOutput.name
+	tempOutput.name, tempOutput.stop = "", nil
+	return name
+}
+
+// discardOutput removes tempOutput, if any, and stops handling signals for it.
+func discardOutput() {
+	if name := releaseOutput(); name != "" {
+		os.Remove(name)
+	}
+}
+
+// createOutput creates a temporary file, readable only by the current user,
+// in the same directory as name, and records it as tempOutput. If the process
+// is interrupted or terminated before commitOutput, the file is removed.
+func createOutput(name string) (*os.File, error) {
+	f, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name)+".tmp")
+	if err != nil {
+		return nil, err
+	}
+	c := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-c:
+			fatalf("Interrupted, not writing output file %q", name)
+		case <-done:
+		}
+	}()
+	tempOutput.Lock()
+	tempOutput.name = f.Name()
+	tempOutput.stop = func() {
+		signal.Stop(c)
+		close(done)
+	}
+	tempOutput.Unlock()
+	return f, nil
+}
+
+// commitOutput syncs and closes f, and moves it to name. It uses a hard link,
+// which unlike a rename fails if name was created in the meantime, falling
+// back to copying f to a file created exclusively if the file system doesn't
+// support hard links. On error, f is removed.
+func commitOutput(f *os.File, name string) error {
+	if err := f.Sync(); err != nil {
+		f.Close()
+		discardOutput()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		discardOutput()
+		return err
+	}
+	err := os.Link(f.Name(), name)
+	switch {
+	case os.IsExist(err):
+		discardOutput()
+		return errors.New("file already exists")
+	case err != nil:
+		if err := copyExclusive(f.Name(), name); err != nil {
+			discardOutput()
+			return err
+		}
+	}
+	discardOutput()
+	return nil
+}
+
+// copyExclusive copies the file at src to a new file at name, failing if name
+// already exists. If the copy fails, the new file is removed.
+func copyExclusive(src, name string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		return errors.New("file already exists")
+	} else if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(name)
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		os.Remove(name)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(name)
+		return err
+	}
+	return nil
+}
+
+func parseRecipient(arg string) (age.Recipient, error) {
+	if strings.HasPrefix(arg, "ssh-") {
+		return agessh.ParseRecipient(arg)
 	}
+	return age.ParseX25519Recipient(arg)
 }
 
-func generate(out *os.File) {
+// generate writes a new identity to out, encrypted to recipients if any.
+// created is the formatted creation time.
+func generate(out *os.File, created string, version int, recipients []age.Recipient) {
 	k, err := age.GenerateX25519Identity()
 	if err != nil {
-		log.Fatalf("Internal error: %v", err)
+		fatalf("Internal error: %v", err)
 	}
 
-	if !term.IsTerminal(int(out.Fd())) {
+	if len(recipients) > 0 || !term.IsTerminal(int(out.Fd())) {
 		fmt.Fprintf(os.Stderr, "Public key: %s\n", k.Recipient())
 	}
 
-	fmt.Fprintf(out, "# created: %s\n", time.Now().Format(time.RFC3339))
-	fmt.Fprintf(out, "# public key: %s\n", k.Recipient())
-	fmt.Fprintf(out, "%s\n", k)
+	var w io.Writer = out
+	var encrypted io.WriteCloser
+	if len(recipients) > 0 {
+		encrypted, err = age.Encrypt(out, recipients...)
+		if err != nil {
+			fatalf("Failed to encrypt the key: %v", err)
+		}
+		w = encrypted
+	}
+
+	comments := map[string]string{"created": created}
+	if version != 0 {
+		comments["version"] = strconv.Itoa(version)
+	}
+	if err := age.WriteIdentityFile(w, k, comments); err != nil {
+		fatalf("Failed to write the key: %v", err)
+	}
+
+	if encrypted != nil {
+		if err := encrypted.Close(); err != nil {
+			fatalf("Failed to encrypt the key: %v", err)
+		}
+	}
 }
 
-func convert(in io.Reader, out io.Writer) {
-	ids, err := age.ParseIdentities(in)
+// nextVersion reads the counter stored at name and returns it incremented. A
+// missing file is treated as holding zero. The file is not modified, see
+// saveVersion.
+func nextVersion(name string) (int, error) {
+	var version int
+	contents, err := ioutil.ReadFile(name)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return 0, err
+	default:
+		version, err = strconv.Atoi(strings.TrimSpace(string(contents)))
+		if err != nil {
+			return 0, fmt.Errorf("malformed version: %v", err)
+		}
+		if version < 0 {
+			return 0, fmt.Errorf("malformed version: %d", version)
+		}
+	}
+	return version + 1, nil
+}
+
+// saveVersion writes version to the counter stored at name, atomically by
+// renaming a temporary file over it. It's called only once the key was
+// written, so that a failed run doesn't use up a version.
+func saveVersion(name string, version int) error {
+	f, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name)+".tmp")
 	if err != nil {
-		log.Fatalf("Failed to parse input: %v", err)
+		return err
 	}
-	if len(ids) == 0 {
-		log.Fatalf("No identities found in the input")
+	defer os.Remove(f.Name())
+	if _, err := fmt.Fprintf(f, "%d\n", version); err != nil {
+		f.Close()
+		return err
 	}
-	for _, id := range ids {
-		id, ok := id.(*age.X25519Identity)
-		if !ok {
-			log.Fatalf("Internal error: unexpected identity type: %T", id)
-		}
-		fmt.Fprintf(out, "%s\n", id.Recipient())
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+// recipientFormats are the layouts of the -y output lines for --format.
+var recipientFormats = map[string]string{
+	"plain":          "%s\n",
+	"ssh-authorized": "# %s\n",
+	"env":            "AGE_RECIPIENT=%s\n",
+}
+
+func convert(in io.Reader, out io.Writer, format string) {
+	buf := &bytes.Buffer{}
+	n, err := age.ConvertIdentitiesToRecipients(in, buf)
+	if err != nil {
+		fatalf("Failed to convert identities: %v", err)
+	}
+	if format == "env" && n != 1 {
+		fatalf("--format env requires exactly one identity, got %d", n)
+	}
+	for _, r := range strings.Fields(buf.String()) {
+		fmt.Fprintf(out, recipientFormats[format], r)
 	}
 }
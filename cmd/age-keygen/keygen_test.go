@@ -0,0 +1,205 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	testIdentityA  = "AGE-SECRET-KEY-184JMZMVQH3E6U0PSL869004Y3U2NYV7R30EU99CSEDNPH02YUVFSZW44VU"
+	testRecipientA = "age1cy0su9fwf3gf9mw868g5yut09p6nytfmmnktexz2ya5uqg9vl9sss4euqm"
+	testIdentityB  = "AGE-SECRET-KEY-1N9JEPW6DWJ0ZQUDX63F5A03GX8QUW7PXDE39N8UYF82VZ9PC8UFS3M7XA9"
+	testRecipientB = "age1lvyvwawkr0mcnnnncaghunadrqkmuf9e6507x9y920xxpp866cnql7dp2z"
+)
+
+func TestConvert(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"trailing newline", testIdentityA + "\n", testRecipientA + "\n"},
+		{"no trailing newline", testIdentityA, testRecipientA + "\n"},
+		{"CRLF", testIdentityA + "\r\n", testRecipientA + "\n"},
+		{"multiple", "# comment\n" + testIdentityA + "\n\n" + testIdentityB,
+			testRecipientA + "\n" + testRecipientB + "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			convert(strings.NewReader(tt.in), out, "plain")
+			if out.String() != tt.want {
+				t.Errorf("got %q, want %q", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestConvertFormat(t *testing.T) {
+	tests := []struct {
+		format, in, want string
+	}{
+		{"plain", testIdentityA, testRecipientA + "\n"},
+		{"ssh-authorized", testIdentityA + "\n" + testIdentityB,
+			"# " + testRecipientA + "\n# " + testRecipientB + "\n"},
+		{"env", testIdentityA, "AGE_RECIPIENT=" + testRecipientA + "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			convert(strings.NewReader(tt.in), out, tt.format)
+			if out.String() != tt.want {
+				t.Errorf("got %q, want %q", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestCommitOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "age-keygen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "key.txt")
+
+	f, err := createOutput(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("output exists before commit: %v", err)
+	}
+	if _, err := f.WriteString(testIdentityA + "\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commitOutput(f, name); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadFile(name); err != nil {
+		t.Fatal(err)
+	} else if string(got) != testIdentityA+"\n" {
+		t.Errorf("got %q, want %q", got, testIdentityA+"\n")
+	}
+	if tmp := pendingOutput(); tmp != "" {
+		t.Errorf("tempOutput not cleared: %q", tmp)
+	}
+
+	f, err = createOutput(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp := f.Name()
+	if err := commitOutput(f, name); err == nil {
+		t.Error("expected an error for an existing output file")
+	}
+	if pending := pendingOutput(); pending != "" {
+		t.Errorf("tempOutput not cleared after a failed commit: %q", pending)
+	}
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Errorf("temporary file left after a failed commit: %v", err)
+	}
+	if got, err := ioutil.ReadFile(name); err != nil {
+		t.Fatal(err)
+	} else if string(got) != testIdentityA+"\n" {
+		t.Errorf("existing output was overwritten: %q", got)
+	}
+	if entries, err := ioutil.ReadDir(dir); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 1 {
+		t.Errorf("got %d files, want only the output", len(entries))
+	}
+}
+
+func TestCopyExclusive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "age-keygen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	if err := ioutil.WriteFile(src, []byte(testIdentityA+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	name := filepath.Join(dir, "key.txt")
+	if err := copyExclusive(src, name); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadFile(name); err != nil {
+		t.Fatal(err)
+	} else if string(got) != testIdentityA+"\n" {
+		t.Errorf("got %q, want %q", got, testIdentityA+"\n")
+	}
+
+	// An existing file, for example created since main checked, is kept.
+	if err := ioutil.WriteFile(src, []byte(testIdentityB+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyExclusive(src, name); err == nil {
+		t.Error("expected an error for an existing output file")
+	}
+	if got, err := ioutil.ReadFile(name); err != nil {
+		t.Fatal(err)
+	} else if string(got) != testIdentityA+"\n" {
+		t.Errorf("existing output was overwritten: %q", got)
+	}
+}
+
+func TestNextVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "age-keygen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "version")
+
+	if v, err := nextVersion(name); err != nil || v != 1 {
+		t.Errorf("missing file: got %d, %v; want 1, nil", v, err)
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("nextVersion created the version file: %v", err)
+	}
+
+	if err := saveVersion(name, 1); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := nextVersion(name); err != nil || v != 2 {
+		t.Errorf("existing file: got %d, %v; want 2, nil", v, err)
+	}
+	// Without saveVersion, for example after a failed run, the version
+	// is not used up.
+	if v, err := nextVersion(name); err != nil || v != 2 {
+		t.Errorf("existing file, read again: got %d, %v; want 2, nil", v, err)
+	}
+
+	if err := ioutil.WriteFile(name, []byte(" 41\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := nextVersion(name); err != nil || v != 42 {
+		t.Errorf("file with whitespace: got %d, %v; want 42, nil", v, err)
+	}
+
+	for _, corrupt := range []string{"", "abc\n", "-1\n", "1 2\n"} {
+		if err := ioutil.WriteFile(name, []byte(corrupt), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := nextVersion(name); err == nil {
+			t.Errorf("expected an error for version file %q", corrupt)
+		}
+	}
+
+	if entries, err := ioutil.ReadDir(dir); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 1 {
+		t.Errorf("got %d files, want only the version file", len(entries))
+	}
+}
@@ -33,8 +33,8 @@ func (f *multiFlag) Set(value string) error {
 }
 
 const usage = `Usage:
-    age [--encrypt] (-r RECIPIENT | -R PATH)... [--armor] [-o OUTPUT] [INPUT]
-    age [--encrypt] --passphrase [--armor] [-o OUTPUT] [INPUT]
+    age [--encrypt] (-r RECIPIENT | -R PATH)... [--armor] [--compat VERSION] [-o OUTPUT] [INPUT]
+    age [--encrypt] --passphrase [--armor] [--compat VERSION] [-o OUTPUT] [INPUT]
     age --decrypt [-i PATH]... [-o OUTPUT] [INPUT]
 
 Options:
@@ -46,6 +46,8 @@ Options:
     -r, --recipient RECIPIENT   Encrypt to the specified RECIPIENT. Can be repeated.
     -R, --recipients-file PATH  Encrypt to recipients listed at PATH. Can be repeated.
     -i, --identity PATH         Use the identity file at PATH. Can be repeated.
+    --strict                    Treat warnings as errors.
+    --compat VERSION            Fail unless age VERSION can decrypt the output.
 
 INPUT defaults to standard input, and OUTPUT defaults to standard output.
 If OUTPUT exists, it will be overwritten.
@@ -61,6 +63,17 @@ Identity files contain one or more secret keys ("AGE-SECRET-KEY-1..."),
 one per line, or an SSH key. Empty lines and lines starting with "#" are
 ignored as comments. Multiple key files can be provided, and any unused ones
 will be ignored. "-" may be used to read identities from standard input.
+To read identities from a pipe while the input is on standard input, pass
+them on another file descriptor, for example with "-i /dev/fd/3 3<key.txt".
+
+With --strict, conditions that would otherwise only print a warning cause
+age to fail instead. Currently this applies to unsupported SSH keys in
+recipients files, which are otherwise skipped, and to identity files that
+other users can read.
+
+With --compat, age checks that the output can be decrypted by the upstream
+age VERSION, such as v1.0.0, and fails instead if a recipient would need a
+non-standard extension.
 
 When --encrypt is specified explicitly, -i can also be used to encrypt to an
 identity file symmetrically, instead or in addition to normal recipients.
@@ -86,7 +99,7 @@ func main() {
 	}
 
 	var (
-		outFlag                          string
+		outFlag, compatFlag              string
 		decryptFlag, encryptFlag         bool
 		passFlag, versionFlag, armorFlag bool
 		recipientFlags, identityFlags    multiFlag
@@ -110,7 +123,10 @@ func main() {
 	flag.Var(&recipientsFileFlags, "recipients-file", "recipients file (can be repeated)")
 	flag.Var(&identityFlags, "i", "identity (can be repeated)")
 	flag.Var(&identityFlags, "identity", "identity (can be repeated)")
+	flag.BoolVar(&strictMode, "strict", false, "treat warnings as errors")
+	flag.StringVar(&compatFlag, "compat", "", "check compatibility with age `VERSION`")
 	flag.Parse()
+	age.SetStrict(strictMode)
 
 	if versionFlag {
 		if Version != "" {
@@ -150,6 +166,9 @@ func main() {
 			logFatalf("Error: -R/--recipients-file can't be used with -d/--decrypt.\n" +
 				"Did you mean to use -i/--identity to specify a private key?")
 		}
+		if compatFlag != "" {
+			logFatalf("Error: --compat can't be used with -d/--decrypt.")
+		}
 	default: // encrypt
 		if len(identityFlags) > 0 && !encryptFlag {
 			logFatalf("Error: -i/--identity can't be used in encryption mode unless symmetric encryption is explicitly selected with -e/--encrypt.\n" +
@@ -218,9 +237,9 @@ func main() {
 		if err != nil {
 			logFatalf("Error: %v", err)
 		}
-		encryptPass(pass, in, out, armorFlag)
+		encryptPass(pass, in, out, armorFlag, compatFlag)
 	default:
-		encryptKeys(recipientFlags, recipientsFileFlags, identityFlags, in, out, armorFlag)
+		encryptKeys(recipientFlags, recipientsFileFlags, identityFlags, in, out, armorFlag, compatFlag)
 	}
 }
 
@@ -251,7 +270,7 @@ func passphrasePromptForEncryption() (string, error) {
 	return p, nil
 }
 
-func encryptKeys(keys, files, identities []string, in io.Reader, out io.Writer, armor bool) {
+func encryptKeys(keys, files, identities []string, in io.Reader, out io.Writer, armor bool, compat string) {
 	var recipients []age.Recipient
 	for _, arg := range keys {
 		r, err := parseRecipient(arg)
@@ -280,18 +299,18 @@ func encryptKeys(keys, files, identities []string, in io.Reader, out io.Writer,
 			recipients = append(recipients, r)
 		}
 	}
-	encrypt(recipients, in, out, armor)
+	encrypt(recipients, in, out, armor, compat)
 }
 
-func encryptPass(pass string, in io.Reader, out io.Writer, armor bool) {
+func encryptPass(pass string, in io.Reader, out io.Writer, armor bool, compat string) {
 	r, err := age.NewScryptRecipient(pass)
 	if err != nil {
 		logFatalf("Error: %v", err)
 	}
-	encrypt([]age.Recipient{r}, in, out, armor)
+	encrypt([]age.Recipient{r}, in, out, armor, compat)
 }
 
-func encrypt(recipients []age.Recipient, in io.Reader, out io.Writer, withArmor bool) {
+func encrypt(recipients []age.Recipient, in io.Reader, out io.Writer, withArmor bool, compat string) {
 	if withArmor {
 		a := armor.NewWriter(out)
 		defer func() {
@@ -301,7 +320,7 @@ func encrypt(recipients []age.Recipient, in io.Reader, out io.Writer, withArmor
 		}()
 		out = a
 	}
-	w, err := age.Encrypt(out, recipients...)
+	w, err := (&age.Encryptor{Compat: compat}).Encrypt(out, recipients...)
 	if err != nil {
 		logFatalf("Error: %v", err)
 	}
@@ -329,7 +348,9 @@ func decrypt(keys []string, in io.Reader, out io.Writer) {
 	}
 
 	rr := bufio.NewReader(in)
-	if start, _ := rr.Peek(len(armor.Header)); string(start) == armor.Header {
+	if armored, err := armor.IsArmored(rr); err != nil {
+		logFatalf("Error: failed to read input: %v", err)
+	} else if armored {
 		in = armor.NewReader(rr)
 	} else {
 		in = rr
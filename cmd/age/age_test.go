@@ -7,10 +7,12 @@
 package main
 
 import (
+	"encoding/base64"
 	"errors"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"testing"
 
@@ -86,3 +88,86 @@ func TestVectors(t *testing.T) {
 		})
 	}
 }
+
+func TestStrictRecipientsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "age-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// An SSH key type not supported as a recipient, which is skipped unless
+	// --strict is set.
+	blob := append([]byte{0, 0, 0, 7}, "ssh-dss"...)
+	unsupported := "ssh-dss " + base64.StdEncoding.EncodeToString(blob)
+	name := filepath.Join(dir, "recipients.txt")
+	contents := unsupported + "\nage1cy0su9fwf3gf9mw868g5yut09p6nytfmmnktexz2ya5uqg9vl9sss4euqm\n"
+	if err := ioutil.WriteFile(name, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() { strictMode = false }()
+	if recs, err := parseRecipientsFile(name); err != nil || len(recs) != 1 {
+		t.Errorf("got %d recipients, %v; want 1, nil", len(recs), err)
+	}
+	strictMode = true
+	if _, err := parseRecipientsFile(name); err == nil {
+		t.Error("expected an error in strict mode")
+	}
+}
+
+func TestStrictIdentityFile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permission bits are not meaningful on Windows")
+	}
+	dir, err := ioutil.TempDir("", "age-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "key.txt")
+	const key = "AGE-SECRET-KEY-184JMZMVQH3E6U0PSL869004Y3U2NYV7R30EU99CSEDNPH02YUVFSZW44VU"
+	if err := ioutil.WriteFile(name, []byte(key+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(name, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	defer age.SetLogger(age.SetLogger(nil))
+	defer age.SetStrict(age.SetStrict(false))
+	if ids, err := parseIdentitiesFile(name); err != nil || len(ids) != 1 {
+		t.Errorf("got %d identities, %v; want 1, nil", len(ids), err)
+	}
+	age.SetStrict(true)
+	if _, err := parseIdentitiesFile(name); err == nil {
+		t.Error("expected an error in strict mode")
+	}
+}
+
+func TestIsPassphraseFile(t *testing.T) {
+	stanzas := func(n int, typ string) []*age.Stanza {
+		var ss []*age.Stanza
+		for i := 0; i < n; i++ {
+			ss = append(ss, &age.Stanza{Type: typ})
+		}
+		return ss
+	}
+	for _, tt := range []struct {
+		name    string
+		stanzas []*age.Stanza
+		want    bool
+	}{
+		{"scrypt", stanzas(1, "scrypt"), true},
+		{"two scrypt", stanzas(2, "scrypt"), false},
+		{"ext-scrypt", stanzas(age.MaxPassphrases, "ext-scrypt"), true},
+		{"too many ext-scrypt", stanzas(age.MaxPassphrases+1, "ext-scrypt"), false},
+		{"X25519", stanzas(1, "X25519"), false},
+		{"none", nil, false},
+	} {
+		if got := isPassphraseFile(tt.stanzas); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -7,9 +7,11 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
+	"os/signal"
 
 	"filippo.io/age"
 	"golang.org/x/term"
@@ -21,8 +23,23 @@ type LazyScryptIdentity struct {
 
 var _ age.Identity = &LazyScryptIdentity{}
 
+// isPassphraseFile reports whether stanzas are a single "scrypt" stanza, or the
+// "ext-scrypt" stanzas of age.MultiPassphraseRecipient, of which there can be
+// at most age.MaxPassphrases.
+func isPassphraseFile(stanzas []*age.Stanza) bool {
+	if len(stanzas) == 1 && stanzas[0].Type == "scrypt" {
+		return true
+	}
+	for _, s := range stanzas {
+		if s.Type != "ext-scrypt" {
+			return false
+		}
+	}
+	return len(stanzas) > 0 && len(stanzas) <= age.MaxPassphrases
+}
+
 func (i *LazyScryptIdentity) Unwrap(stanzas []*age.Stanza) (fileKey []byte, err error) {
-	if len(stanzas) != 1 || stanzas[0].Type != "scrypt" {
+	if !isPassphraseFile(stanzas) {
 		return nil, age.ErrIncorrectIdentity
 	}
 	pass, err := i.Passphrase()
@@ -45,23 +62,76 @@ func (i *LazyScryptIdentity) Unwrap(stanzas []*age.Stanza) (fileKey []byte, err
 	return fileKey, err
 }
 
-// readPassphrase reads a passphrase from the terminal. If stdin is not
+// readPassphrase reads a passphrase from the terminal with
+// readPassphraseContext, returning early if the process receives an interrupt
+// signal, so that the terminal echo is restored before exiting.
+func readPassphrase() ([]byte, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	defer signal.Stop(c)
+	go func() {
+		select {
+		case <-c:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return readPassphraseContext(ctx)
+}
+
+// readPassphraseContext reads a passphrase from the terminal. If stdin is not
 // connected to a terminal, it tries /dev/tty and fails if that's not available.
 // It does not read from a non-terminal stdin, so it does not check stdinInUse.
-func readPassphrase() ([]byte, error) {
+//
+// If ctx is canceled before a passphrase is entered, readPassphraseContext
+// restores the terminal state and returns ctx.Err() promptly. The underlying
+// read can't be interrupted portably, so it is left to complete in the
+// background, and the goroutine performing it exits as soon as the user
+// presses enter or the terminal is closed. Its result is discarded.
+func readPassphraseContext(ctx context.Context) ([]byte, error) {
 	fd := int(os.Stdin.Fd())
+	var tty *os.File
 	if !term.IsTerminal(fd) {
-		tty, err := os.Open("/dev/tty")
+		var err error
+		tty, err = os.Open("/dev/tty")
 		if err != nil {
 			return nil, fmt.Errorf("standard input is not a terminal, and opening /dev/tty failed: %v", err)
 		}
-		defer tty.Close()
 		fd = int(tty.Fd())
 	}
 	defer fmt.Fprintf(os.Stderr, "\n")
-	p, err := term.ReadPassword(fd)
+
+	state, err := term.GetState(fd)
 	if err != nil {
+		if tty != nil {
+			tty.Close()
+		}
 		return nil, err
 	}
-	return p, nil
+
+	type result struct {
+		p   []byte
+		err error
+	}
+	// The channel is buffered so that the goroutine can always complete.
+	done := make(chan result, 1)
+	go func() {
+		p, err := term.ReadPassword(fd)
+		// Close the tty only once the read returned, so its file descriptor
+		// can't be reused while it's still being read from.
+		if tty != nil {
+			tty.Close()
+		}
+		done <- result{p, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.p, r.err
+	case <-ctx.Done():
+		term.Restore(fd, state)
+		return nil, ctx.Err()
+	}
 }
@@ -25,6 +25,13 @@ import (
 // stdinInUse is set in main. It's a singleton like os.Stdin.
 var stdinInUse bool
 
+// strictMode is set by the --strict flag, and turns warnings into errors.
+var strictMode bool
+
+// utf8BOM is ignored at the start of recipients and identity files, since some
+// editors add it to text files.
+const utf8BOM = "\ufeff"
+
 func parseRecipient(arg string) (age.Recipient, error) {
 	switch {
 	case strings.HasPrefix(arg, "age1"):
@@ -65,6 +72,9 @@ func parseRecipientsFile(name string) ([]age.Recipient, error) {
 	for scanner.Scan() {
 		n++
 		line := scanner.Text()
+		if n == 1 {
+			line = strings.TrimPrefix(line, utf8BOM)
+		}
 		if strings.HasPrefix(line, "#") || line == "" {
 			continue
 		}
@@ -74,6 +84,9 @@ func parseRecipientsFile(name string) ([]age.Recipient, error) {
 		r, err := parseRecipient(line)
 		if err != nil {
 			if t, ok := sshKeyType(line); ok {
+				if strictMode {
+					return nil, fmt.Errorf("%q: unsupported SSH key of type %q at line %d (not skipped because of --strict)", name, t, n)
+				}
 				// Skip unsupported but valid SSH public keys with a warning.
 				log.Printf("Warning: recipients file %q: ignoring unsupported SSH key of type %q at line %d", name, t, n)
 				continue
@@ -134,9 +147,15 @@ func parseIdentitiesFile(name string) ([]age.Identity, error) {
 			return nil, fmt.Errorf("failed to open file: %v", err)
 		}
 		defer f.Close()
+		if err := age.CheckIdentityFile(f); err != nil {
+			return nil, fmt.Errorf("%q: %v (not ignored because of --strict)", name, err)
+		}
 	}
 
 	b := bufio.NewReader(f)
+	if peeked, _ := b.Peek(len(utf8BOM)); string(peeked) == utf8BOM {
+		b.Discard(len(utf8BOM))
+	}
 	const pemHeader = "-----BEGIN"
 	if peeked, _ := b.Peek(len(pemHeader)); string(peeked) == pemHeader {
 		const privateKeySizeLimit = 1 << 14 // 16 KiB
@@ -0,0 +1,80 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package age
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"filippo.io/age/internal/format"
+)
+
+// standardStanzaTypes are the stanza types specified by age-encryption.org/v1,
+// which all upstream age versions since v1.0.0 can decrypt.
+var standardStanzaTypes = map[string]bool{
+	"X25519":      true,
+	"scrypt":      true,
+	"ssh-rsa":     true,
+	"ssh-ed25519": true,
+}
+
+// ignoredStanzaTypes are the extension stanza types that other
+// implementations can ignore without changing the result of decryption.
+var ignoredStanzaTypes = map[string]bool{
+	hintStanzaType:      true,
+	groupStanzaType:     true,
+	chainStanzaType:     true,
+	metadataStanzaType:  true,
+	timestampStanzaType: true,
+}
+
+// compatFeatures names the settings that produce extension stanzas, for the
+// errors of checkCompat.
+var compatFeatures = map[string]string{
+	paddingStanzaType:     "Encryptor.Padding",
+	notBeforeStanzaType:   "Encryptor.NotBefore",
+	multiScryptStanzaType: "MultiPassphraseRecipient",
+}
+
+// checkCompatVersion checks that version is an upstream age version like
+// "v1.0.0" or "1.1", as used by Encryptor.Compat.
+func checkCompatVersion(version string) error {
+	parts := strings.Split(strings.TrimPrefix(version, "v"), ".")
+	if len(parts) > 3 {
+		return fmt.Errorf("malformed age version %q", version)
+	}
+	for _, p := range parts {
+		if v, err := strconv.Atoi(p); err != nil || v < 0 {
+			return fmt.Errorf("malformed age version %q", version)
+		}
+	}
+	if parts[0] != "1" {
+		return fmt.Errorf("unsupported age version %q: only v1 is supported", version)
+	}
+	return nil
+}
+
+// checkCompat returns an error if the header stanzas would not be decrypted
+// correctly by the upstream age version, as documented by Encryptor.Compat.
+func checkCompat(version string, stanzas []*format.Stanza) error {
+	if err := checkCompatVersion(version); err != nil {
+		return err
+	}
+	// All v1 versions decrypt the same stanzas, but the version is still
+	// required, so that the rules can be refined if that changes.
+	for _, s := range stanzas {
+		if standardStanzaTypes[s.Type] || ignoredStanzaTypes[s.Type] {
+			continue
+		}
+		if f, ok := compatFeatures[s.Type]; ok {
+			return fmt.Errorf("%s is not supported by age %s", f, version)
+		}
+		return fmt.Errorf("stanza type %q is not supported by age %s", s.Type, version)
+	}
+	return nil
+}
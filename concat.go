@@ -0,0 +1,68 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package age
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+
+	"filippo.io/age/internal/format"
+	"filippo.io/age/internal/stream"
+)
+
+// A ConcatenatedDecryptor decrypts a sequence of binary age files concatenated
+// in a single stream, for example the records of an encrypted log.
+type ConcatenatedDecryptor struct {
+	src        *bufio.Reader
+	identities []Identity
+	current    io.Reader
+	err        error
+}
+
+// DecryptConcatenated returns a ConcatenatedDecryptor that decrypts the age
+// files concatenated in src with identities. Each file can be encrypted to
+// different recipients, as long as one of identities matches it.
+//
+// The end of each payload is detected by its last chunk, which is found by
+// trial decryption before each occurrence of the start of an age header, so
+// reading the last chunk of each file is slightly more expensive than usual.
+func DecryptConcatenated(src io.Reader, identities ...Identity) *ConcatenatedDecryptor {
+	const size = stream.ChunkSize + 16 + len(format.Intro)
+	return &ConcatenatedDecryptor{
+		src:        bufio.NewReaderSize(src, size),
+		identities: identities,
+	}
+}
+
+// Next returns a Reader for the plaintext of the next file. If the Reader
+// returned by the previous call was not read until io.EOF, its remaining
+// plaintext is read and discarded first, still verifying it. After the last
+// file, Next returns io.EOF.
+func (c *ConcatenatedDecryptor) Next() (io.Reader, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	if c.current != nil {
+		if _, err := io.Copy(ioutil.Discard, c.current); err != nil {
+			c.err = err
+			return nil, err
+		}
+		c.current = nil
+	}
+	if _, err := c.src.Peek(1); err == io.EOF {
+		c.err = io.EOF
+		return nil, io.EOF
+	}
+	r, _, err := (&Decryptor{}).decrypt(c.src, c.identities, true)
+	if err != nil {
+		c.err = err
+		return nil, err
+	}
+	c.current = r
+	return r, nil
+}
@@ -0,0 +1,126 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package age
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Config collects the settings of a typical age command line, so that
+// front-ends can share the rules for which combinations are valid, instead of
+// each reimplementing them slightly differently.
+type Config struct {
+	// Recipients, RecipientFiles, and IdentityFiles are the sources of
+	// recipients when encrypting, as in RecipientSpec. When decrypting, only
+	// IdentityFiles can be used, and they are parsed with ParseIdentities.
+	Recipients     []string
+	RecipientFiles []string
+	IdentityFiles  []string
+
+	// Armor makes the encrypted output ASCII armored. It can't be used when
+	// decrypting.
+	Armor bool
+
+	// Passphrase, if not empty, is used instead of recipients or identities,
+	// with ScryptRecipient or ScryptIdentity. It can't be combined with them.
+	Passphrase string
+
+	// ScryptWorkFactor, if not zero, is the scrypt work factor used when
+	// encrypting with Passphrase, see ScryptRecipient.SetWorkFactor.
+	ScryptWorkFactor int
+}
+
+// BuildEncryptor checks that the settings of c are valid for encryption, and
+// returns a PreparedEncryptor for the recipients or passphrase they specify.
+//
+// Errors name the settings at fault. If some recipient sources can't be used,
+// the error is the one for the first of them, as returned by
+// ResolveRecipients.
+func (c *Config) BuildEncryptor() (*PreparedEncryptor, error) {
+	hasRecipients := len(c.Recipients) > 0 || len(c.RecipientFiles) > 0 || len(c.IdentityFiles) > 0
+	switch {
+	case c.Passphrase != "" && hasRecipients:
+		return nil, errors.New("a passphrase can't be combined with recipients or identity files")
+	case c.Passphrase == "" && !hasRecipients:
+		return nil, errors.New("missing recipients or passphrase")
+	case c.ScryptWorkFactor != 0 && c.Passphrase == "":
+		return nil, errors.New("a scrypt work factor can only be used with a passphrase")
+	case c.ScryptWorkFactor < 0 || c.ScryptWorkFactor > 30:
+		return nil, fmt.Errorf("invalid scrypt work factor %d: must be between 1 and 30", c.ScryptWorkFactor)
+	}
+
+	e := &Encryptor{Armor: c.Armor}
+	if c.Passphrase != "" {
+		r, err := NewScryptRecipient(c.Passphrase)
+		if err != nil {
+			return nil, err
+		}
+		if c.ScryptWorkFactor != 0 {
+			r.SetWorkFactor(c.ScryptWorkFactor)
+		}
+		return e.Prepare(r)
+	}
+
+	recipients, errs := ResolveRecipients(RecipientSpec{
+		Recipients:     c.Recipients,
+		RecipientFiles: c.RecipientFiles,
+		IdentityFiles:  c.IdentityFiles,
+	})
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+	return e.Prepare(recipients...)
+}
+
+// BuildDecryptor checks that the settings of c are valid for decryption, and
+// returns a Decryptor and the identities to pass to its Decrypt method, read
+// from the identity files or derived from the passphrase. Identity files that
+// other users can read cause a warning, see SetLogger, or an error in strict
+// mode, see SetStrict.
+func (c *Config) BuildDecryptor() (*Decryptor, []Identity, error) {
+	switch {
+	case len(c.Recipients) > 0 || len(c.RecipientFiles) > 0:
+		return nil, nil, errors.New("recipients can't be used when decrypting")
+	case c.Armor:
+		return nil, nil, errors.New("armor can't be used when decrypting")
+	case c.ScryptWorkFactor != 0:
+		return nil, nil, errors.New("a scrypt work factor can't be used when decrypting")
+	case c.Passphrase != "" && len(c.IdentityFiles) > 0:
+		return nil, nil, errors.New("a passphrase can't be combined with identity files")
+	case c.Passphrase == "" && len(c.IdentityFiles) == 0:
+		return nil, nil, errors.New("missing identity files or passphrase")
+	}
+
+	if c.Passphrase != "" {
+		i, err := NewScryptIdentity(c.Passphrase)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &Decryptor{}, []Identity{i}, nil
+	}
+
+	var identities []Identity
+	for _, path := range c.IdentityFiles {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open %q: %v", path, err)
+		}
+		if err := warnIfWorldReadable(f, path); err != nil {
+			f.Close()
+			return nil, nil, fmt.Errorf("failed to read %q: %v", path, err)
+		}
+		ids, err := ParseIdentities(f)
+		f.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read %q: %v", path, err)
+		}
+		identities = append(identities, ids...)
+	}
+	return &Decryptor{}, identities, nil
+}
@@ -0,0 +1,61 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package age
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// DirectoryAttribute is the attribute of directory entries that holds age
+// recipients, one per value, for RecipientsFromDirectory.
+const DirectoryAttribute = "ageRecipient"
+
+// A Directory is a minimal interface to a directory service, such as an LDAP
+// server, so that RecipientsFromDirectory can be used with any client.
+type Directory interface {
+	// Search returns the values of attribute of the entries matching filter
+	// in the subtree at baseDN, for example "(uid=alice)". If filter is empty,
+	// only the entry at baseDN is returned, like in an LDAP base scope search.
+	Search(ctx context.Context, baseDN, filter, attribute string) ([]string, error)
+}
+
+// RecipientsFromDirectory returns the recipients published in the
+// DirectoryAttribute attribute of the entries of dir matching filter under
+// baseDN, or of the entry at baseDN if filter is empty.
+//
+// Values can be of any type supported by ParseRecipients, including those
+// registered with RegisterRecipientParser. Identical values are returned once.
+// An error is returned if no entry holds a recipient.
+//
+// The recipients are only as trustworthy as dir: whoever can modify the entries
+// or tamper with the connection can substitute their own recipients.
+func RecipientsFromDirectory(ctx context.Context, dir Directory, baseDN, filter string) ([]Recipient, error) {
+	values, err := dir.Search(ctx, baseDN, filter, DirectoryAttribute)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search %q: %v", baseDN, err)
+	}
+	var list []string
+	seen := make(map[string]bool)
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if v == "" || seen[v] {
+			continue
+		}
+		seen[v] = true
+		list = append(list, v)
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf("no age recipients in the entries at %q", baseDN)
+	}
+	recs, err := parseRecipientsList(list)
+	if err != nil {
+		return nil, fmt.Errorf("%s attribute: %v", DirectoryAttribute, err)
+	}
+	return recs, nil
+}
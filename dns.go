@@ -0,0 +1,62 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package age
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ParseRecipientFromDNS looks up the TXT records of domain, like
+// "_age.example.com", and returns the X25519 recipient published in them.
+//
+// Records that don't start with "age1" are ignored, so the name can be shared
+// with other TXT records. An error is returned if no record holds a recipient,
+// or if records hold different ones. If resolver is nil, net.DefaultResolver
+// is used.
+//
+// Plain DNS is not authenticated, so whoever can tamper with the lookup can
+// substitute their own recipient, unless the resolver validates DNSSEC.
+func ParseRecipientFromDNS(ctx context.Context, domain string, resolver *net.Resolver) (*X25519Recipient, error) {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	records, err := resolver.LookupTXT(ctx, domain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up %q: %v", domain, err)
+	}
+	r, err := recipientFromTXT(records)
+	if err != nil {
+		return nil, fmt.Errorf("%q: %v", domain, err)
+	}
+	return r, nil
+}
+
+func recipientFromTXT(records []string) (*X25519Recipient, error) {
+	var found string
+	for _, txt := range records {
+		txt = strings.TrimSpace(txt)
+		if !strings.HasPrefix(txt, "age1") {
+			continue
+		}
+		if found != "" && txt != found {
+			return nil, errors.New("multiple conflicting age recipients in TXT records")
+		}
+		found = txt
+	}
+	if found == "" {
+		return nil, errors.New("no age recipient in TXT records")
+	}
+	r, err := ParseX25519Recipient(found)
+	if err != nil {
+		return nil, fmt.Errorf("malformed recipient in TXT record: %v", err)
+	}
+	return r, nil
+}
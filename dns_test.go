@@ -0,0 +1,44 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package age
+
+import "testing"
+
+func TestRecipientFromTXT(t *testing.T) {
+	const a = "age1zvkyg2lqzraa2lnjvqej32nkuu0ues2s82hzrye869xeexvn73equnujwj"
+	const b = "age1lggyhqrw2nlhcxprm67z43rta597azn8gknawjehu9d9dl0jq3yqqvfafg"
+	tests := []struct {
+		name    string
+		records []string
+		want    string
+	}{
+		{"single", []string{a}, a},
+		{"other records", []string{"v=spf1 -all", a, "hello"}, a},
+		{"duplicate", []string{a, " " + a}, a},
+		{"none", []string{"v=spf1 -all"}, ""},
+		{"empty", nil, ""},
+		{"conflicting", []string{a, b}, ""},
+		{"malformed", []string{"age1nope"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := recipientFromTXT(tt.records)
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("expected error, got %v", r)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.String() != tt.want {
+				t.Errorf("got %v, want %v", r, tt.want)
+			}
+		})
+	}
+}
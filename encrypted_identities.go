@@ -0,0 +1,59 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package age
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+
+	"filippo.io/age/internal/format"
+)
+
+// maxIdentityFileNesting is the maximum number of layers of encryption
+// ParseEncryptedIdentities removes from an identity file.
+const maxIdentityFileNesting = 4
+
+// ParseEncryptedIdentities is like ParseIdentities, but f can also be an age
+// file, binary or armored, that encrypts an identity file, for example with a
+// passphrase, to protect it at rest. In that case, unlock is called to obtain
+// the identities that decrypt it, like a ScryptIdentity for a passphrase read
+// from the user, and the plaintext is parsed the same way.
+//
+// Identity files can be encrypted up to four times, and unlock is called once
+// for each layer. If unlock is nil, encrypted identity files are rejected.
+func ParseEncryptedIdentities(f io.Reader, unlock func() ([]Identity, error)) ([]Identity, error) {
+	return parseEncryptedIdentities(f, unlock, 0)
+}
+
+func parseEncryptedIdentities(f io.Reader, unlock func() ([]Identity, error), depth int) ([]Identity, error) {
+	in, _, err := detectArmor(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identity file: %v", err)
+	}
+	b := bufio.NewReader(in)
+	if peeked, _ := b.Peek(len(format.Intro)); string(peeked) != format.Intro {
+		return ParseIdentities(b)
+	}
+
+	if unlock == nil {
+		return nil, errors.New("identity file is encrypted")
+	}
+	if depth >= maxIdentityFileNesting {
+		return nil, errors.New("identity file is encrypted too many times")
+	}
+	ids, err := unlock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to unlock identity file: %v", err)
+	}
+	r, err := Decrypt(b, ids...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt identity file: %v", err)
+	}
+	return parseEncryptedIdentities(r, unlock, depth+1)
+}
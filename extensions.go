@@ -0,0 +1,218 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package age
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"filippo.io/age/internal/format"
+)
+
+// Non-standard extension stanzas have types starting with extensionPrefix.
+// Identities ignore stanzas of types they don't recognize, so files with
+// extension stanzas can still be decrypted by other age implementations, unless
+// the extension says otherwise. Extension stanzas are authenticated by the
+// header MAC like all other stanzas.
+const extensionPrefix = "ext-"
+
+func isExtensionStanza(s *format.Stanza) bool {
+	return strings.HasPrefix(s.Type, extensionPrefix)
+}
+
+// metadataStanzaTypes are the extension stanza types that carry information
+// about the file rather than wrapping the file key, so no identity tries them.
+var metadataStanzaTypes = map[string]bool{
+	hintStanzaType:      true,
+	paddingStanzaType:   true,
+	notBeforeStanzaType: true,
+	groupStanzaType:     true,
+	timestampStanzaType: true,
+	metadataStanzaType:  true,
+	chainStanzaType:     true,
+}
+
+// isRecipientStanza reports whether s might wrap the file key. Some extension
+// stanzas do, like those of MultiPassphraseRecipient.
+func isRecipientStanza(s *format.Stanza) bool {
+	return !metadataStanzaTypes[s.Type]
+}
+
+const hintStanzaType = extensionPrefix + "hint"
+const hintLabel = "age-encryption.org/ext/hint"
+
+// hintTag returns the short tag identifying a recipient string encoding.
+func hintTag(recipient string) string {
+	h := sha256.Sum256([]byte(hintLabel + "\x00" + recipient))
+	return format.EncodeToString(h[:4])
+}
+
+type hintedRecipient struct {
+	r   Recipient
+	tag string
+}
+
+// NewHintedRecipient returns a Recipient that wraps file keys like r, but also
+// adds a non-standard "ext-hint" stanza before r's stanzas, carrying a short
+// tag derived from r's string encoding. When decrypting, an identity for which
+// a matching hint is found is tried against the hinted stanza first, turning
+// the trial of every stanza in files with many recipients into a single one.
+//
+// Hints are opt-in because they remove the anonymity of recipients like
+// X25519Recipient: anyone who knows a recipient's public key can check whether
+// a file is encrypted to it by comparing tags. Only use hints when the set of
+// recipients of a file is not confidential, for example in internal systems.
+//
+// r must implement fmt.Stringer, and the identity must have a Recipient method
+// returning an equivalent recipient, like X25519Identity does. Other age
+// implementations ignore hint stanzas. Hinted recipients can't be used with
+// ScryptRecipient.
+func NewHintedRecipient(r Recipient) (Recipient, error) {
+	s, ok := r.(fmt.Stringer)
+	if !ok {
+		return nil, fmt.Errorf("recipient of type %T has no string encoding", r)
+	}
+	return &hintedRecipient{r: r, tag: hintTag(s.String())}, nil
+}
+
+func (r *hintedRecipient) Wrap(fileKey []byte) ([]*Stanza, error) {
+	stanzas, _, err := r.WrapWithLabels(fileKey)
+	return stanzas, err
+}
+
+// WrapWithLabels implements RecipientWithLabels, returning the labels of the
+// underlying recipient, if any.
+func (r *hintedRecipient) WrapWithLabels(fileKey []byte) ([]*Stanza, []string, error) {
+	stanzas, labels, err := wrapWithLabels(r.r, fileKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(stanzas) != 1 {
+		return nil, nil, errors.New("hinted recipients must produce exactly one stanza")
+	}
+	hint := &Stanza{Type: hintStanzaType, Args: []string{r.tag}}
+	return []*Stanza{hint, stanzas[0]}, labels, nil
+}
+
+// hintedStanzas returns the stanzas that are preceded by a hint matching the
+// recipient of i, if any.
+func hintedStanzas(i Identity, stanzas []*Stanza) []*Stanza {
+	for n, s := range stanzas {
+		if s.Type == hintStanzaType && len(s.Args) == 1 && n+1 < len(stanzas) {
+			// Deriving the recipient might be expensive, so only do it if
+			// there are any hints.
+			return stanzasWithHint(identityHintTag(i), stanzas)
+		}
+	}
+	return nil
+}
+
+// identityHintTag returns the hint tag of the recipient of i, or an empty
+// string if i doesn't have one.
+func identityHintTag(i Identity) string {
+	r, err := identityToRecipient(i)
+	if err != nil {
+		return ""
+	}
+	str, ok := r.(fmt.Stringer)
+	if !ok {
+		return ""
+	}
+	return hintTag(str.String())
+}
+
+// stanzasWithHint returns the stanzas that are preceded by a hint with the
+// given tag. An empty tag matches nothing.
+func stanzasWithHint(tag string, stanzas []*Stanza) []*Stanza {
+	if tag == "" {
+		return nil
+	}
+	var hinted []*Stanza
+	for n, s := range stanzas {
+		if s.Type != hintStanzaType || len(s.Args) != 1 || n+1 >= len(stanzas) {
+			continue
+		}
+		if s.Args[0] == tag {
+			hinted = append(hinted, stanzas[n+1])
+		}
+	}
+	return hinted
+}
+
+const notBeforeStanzaType = extensionPrefix + "not-before"
+
+// NotYetValidError is returned by Decrypt when the file was encrypted with
+// Encryptor.NotBefore set to a time that has not yet come.
+type NotYetValidError struct {
+	NotBefore time.Time
+}
+
+func (e *NotYetValidError) Error() string {
+	return fmt.Sprintf("file can't be decrypted before %s", e.NotBefore.Format(time.RFC3339))
+}
+
+func notBeforeStanza(t time.Time) *format.Stanza {
+	return &format.Stanza{
+		Type: notBeforeStanzaType,
+		Args: []string{strconv.FormatInt(t.Unix(), 10)},
+	}
+}
+
+// checkNotBefore returns a NotYetValidError if hdr has an ext-not-before
+// stanza with a time after now. hdr must have been already authenticated.
+func checkNotBefore(hdr *format.Header, now time.Time) error {
+	for _, s := range hdr.Recipients {
+		if s.Type != notBeforeStanzaType {
+			continue
+		}
+		if len(s.Args) != 1 || len(s.Body) != 0 {
+			return errors.New("invalid ext-not-before stanza")
+		}
+		sec, err := strconv.ParseInt(s.Args[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid ext-not-before stanza: %v", err)
+		}
+		if t := time.Unix(sec, 0); now.Before(t) {
+			return &NotYetValidError{NotBefore: t}
+		}
+	}
+	return nil
+}
+
+const timestampStanzaType = extensionPrefix + "timestamp"
+
+func timestampStanza(t time.Time) *format.Stanza {
+	return &format.Stanza{
+		Type: timestampStanzaType,
+		Args: []string{t.UTC().Format(time.RFC3339)},
+	}
+}
+
+const groupStanzaType = extensionPrefix + "group"
+const maxGroupNameSize = 256
+
+func groupStanza(name string) (*format.Stanza, error) {
+	if len(name) > maxGroupNameSize || !utf8.ValidString(name) {
+		return nil, errors.New("invalid group name: must be valid UTF-8 and at most 256 bytes")
+	}
+	return &format.Stanza{Type: groupStanzaType, Body: []byte(name)}, nil
+}
+
+const metadataStanzaType = extensionPrefix + "metadata"
+const maxMetadataSize = 4096
+
+func metadataStanza(metadata []byte) (*format.Stanza, error) {
+	if len(metadata) > maxMetadataSize {
+		return nil, errors.New("invalid metadata: must be at most 4096 bytes")
+	}
+	return &format.Stanza{Type: metadataStanzaType, Body: metadata}, nil
+}
@@ -0,0 +1,48 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+//go:build !windows
+// +build !windows
+
+package age_test
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"testing"
+
+	"filippo.io/age"
+)
+
+func TestParseIdentitiesFD(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	go func() {
+		io.WriteString(w, "# test key\n"+privateKey+"\n")
+		w.Close()
+	}()
+
+	// ParseIdentitiesFD takes ownership of the descriptor, so hand it a
+	// duplicate rather than the one owned by r.
+	fd, err := syscall.Dup(int(r.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := age.ParseIdentitiesFD(uintptr(fd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 {
+		t.Fatalf("got %d identities, want 1", len(ids))
+	}
+	if got := ids[0].(*age.X25519Identity).String(); got != privateKey {
+		t.Errorf("got %q, want %q", got, privateKey)
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package age
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+)
+
+// A FingerprintedRecipient is a Recipient with its own fingerprint format,
+// like the SSH recipients of the agessh package, whose fingerprints match
+// those printed by ssh-keygen -l.
+type FingerprintedRecipient interface {
+	Recipient
+	Fingerprint() string
+}
+
+// RecipientFingerprint returns a short, stable identifier of r, for example
+// to index which keys can open which files.
+//
+// If r implements FingerprintedRecipient, that's its Fingerprint. Otherwise, r
+// must implement fmt.Stringer, like X25519Recipient, and the fingerprint is
+// "SHA256:" followed by the unpadded base64 of the SHA-256 hash of its string
+// encoding. Recipients returned by NewHintedRecipient have the fingerprint of
+// the recipient they wrap.
+func RecipientFingerprint(r Recipient) (string, error) {
+	if h, ok := r.(*hintedRecipient); ok {
+		r = h.r
+	}
+	if f, ok := r.(FingerprintedRecipient); ok {
+		return f.Fingerprint(), nil
+	}
+	s, ok := r.(fmt.Stringer)
+	if !ok {
+		return "", fmt.Errorf("recipient of type %T has no string encoding", r)
+	}
+	h := sha256.Sum256([]byte(s.String()))
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(h[:]), nil
+}
+
+// recipientFingerprints returns the RecipientFingerprint of each recipient.
+func recipientFingerprints(recipients []Recipient) ([]string, error) {
+	fingerprints := make([]string, 0, len(recipients))
+	for i, r := range recipients {
+		f, err := RecipientFingerprint(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fingerprint recipient #%d: %v", i, err)
+		}
+		fingerprints = append(fingerprints, f)
+	}
+	return fingerprints, nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+//go:build go1.18
+// +build go1.18
+
+package age_test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"filippo.io/age"
+)
+
+func FuzzParseRecipients(f *testing.F) {
+	f.Add([]byte("age1cy0su9fwf3gf9mw868g5yut09p6nytfmmnktexz2ya5uqg9vl9sss4euqm"))
+	f.Add([]byte("# comment\n\nage1cy0su9fwf3gf9mw868g5yut09p6nytfmmnktexz2ya5uqg9vl9sss4euqm\n"))
+	f.Add([]byte("AGE1CY0SU9FWF3GF9MW868G5YUT09P6NYTFMMNKTEXZ2YA5UQG9VL9SSS4EUQM"))
+	f.Add([]byte("age1"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		recs, err := age.ParseRecipients(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		for _, r := range recs {
+			r, ok := r.(*age.X25519Recipient)
+			if !ok {
+				continue
+			}
+			// Successfully parsed recipients must round-trip.
+			r1, err := age.ParseX25519Recipient(r.String())
+			if err != nil {
+				t.Fatalf("recipient %q failed to re-parse: %v", r, err)
+			}
+			if r1.String() != r.String() {
+				t.Errorf("recipient did not round-trip: %q != %q", r1, r)
+			}
+			if !bytes.Contains(data, []byte(r.String())) {
+				t.Errorf("recipient %q is not in the input", r)
+			}
+		}
+	})
+}
+
+func FuzzParseIdentities(f *testing.F) {
+	f.Add([]byte("AGE-SECRET-KEY-184JMZMVQH3E6U0PSL869004Y3U2NYV7R30EU99CSEDNPH02YUVFSZW44VU"))
+	f.Add([]byte("age-secret-key-184jmzmvqh3e6u0psl869004y3u2nyv7r30eu99csednph02yuvfszw44vu"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ids, err := age.ParseIdentities(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		for _, i := range ids {
+			if s := fmt.Sprint(i); !bytes.Contains(data, []byte(s)) {
+				t.Errorf("identity %q is not in the input", s)
+			}
+		}
+	})
+}
@@ -0,0 +1,590 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package age
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"filippo.io/age/armor"
+	"filippo.io/age/internal/format"
+)
+
+// CountRecipients returns the number of recipient stanzas in the header of the
+// age file read from src. It doesn't require any identity, and it doesn't read
+// the payload, so its cost is independent of the file size.
+//
+// Extension stanzas that don't wrap the file key, like those of hints or of
+// Encryptor.Padding, are not counted. Note that a single Recipient might
+// produce more than one stanza.
+func CountRecipients(src io.Reader) (int, error) {
+	hdr, _, err := format.Parse(src)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read header: %v", err)
+	}
+	return countRecipientStanzas(hdr), nil
+}
+
+func countRecipientStanzas(hdr *format.Header) int {
+	var n int
+	for _, s := range hdr.Recipients {
+		if isRecipientStanza(s) {
+			n++
+		}
+	}
+	return n
+}
+
+// HeaderInfo is the information about an age file that can be learned from its
+// header without decrypting it.
+type HeaderInfo struct {
+	// StanzaTypes lists the type of each stanza in the header, in order.
+	StanzaTypes []string
+
+	// GroupName is the name set with Encryptor.GroupName, if any.
+	GroupName string
+
+	// Metadata is the blob set with Encryptor.Metadata, if any.
+	Metadata []byte
+
+	// Timestamp is the time set with Encryptor.Timestamp, if any.
+	Timestamp time.Time
+}
+
+// Inspect parses the header of the age file read from src, without reading the
+// payload.
+//
+// The header can only be authenticated with the file key, so the returned
+// information could have been tampered with. Decrypt rejects files with a
+// modified header.
+func Inspect(src io.Reader) (*HeaderInfo, error) {
+	hdr, _, err := format.Parse(src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header: %v", err)
+	}
+	return headerInfo(hdr), nil
+}
+
+// ErrRecipientsNotComparable is returned by SameRecipients when a file has a
+// recipient stanza that doesn't identify its recipient.
+var ErrRecipientsNotComparable = errors.New("recipient stanza does not identify its recipient")
+
+// SameRecipients reports whether the age files read from a and b, binary or
+// ASCII armored, are encrypted to the same set of recipients, by comparing
+// their headers, without decrypting them or reading their payloads.
+//
+// The stanzas of a recipient are different in each file, so recipients are
+// identified by the short public key tags that some stanzas carry: the
+// ssh-rsa, ssh-ed25519, and piv-p256 stanzas, which start with a tag of the
+// public key, and any stanza preceded by a hint, see NewHintedRecipient. Two
+// files have the same recipients if they have the same set of stanza types
+// and tags, regardless of their order and of the extension stanzas that don't
+// wrap the file key, like those of Encryptor.GroupName or Encryptor.Padding.
+// If any other stanza is present, for example an X25519 stanza without a hint
+// or an scrypt stanza, SameRecipients returns ErrRecipientsNotComparable. To
+// audit files encrypted to X25519 recipients, encrypt them with
+// NewHintedRecipient.
+//
+// Tags are only 32 bits, so different recipients might be reported as the
+// same, but not by accident. Also, like with Inspect, the header can only be
+// authenticated with the file key, so anyone who can modify the files can
+// make SameRecipients return true for files with different recipients.
+func SameRecipients(a, b io.Reader) (bool, error) {
+	ra, err := headerRecipients(a)
+	if err != nil {
+		return false, err
+	}
+	rb, err := headerRecipients(b)
+	if err != nil {
+		return false, err
+	}
+	if len(ra) != len(rb) {
+		return false, nil
+	}
+	for r := range ra {
+		if !rb[r] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// keyTaggedStanzaTypes are the stanza types whose first argument is a tag of
+// the recipient's public key.
+var keyTaggedStanzaTypes = map[string]bool{
+	"ssh-rsa":     true,
+	"ssh-ed25519": true,
+	"piv-p256":    true,
+}
+
+// headerRecipients returns the set of recipients of the file read from src, as
+// described by SameRecipients, each as a stanza type and tag.
+func headerRecipients(src io.Reader) (map[string]bool, error) {
+	src, _, err := detectArmor(src)
+	if err != nil {
+		return nil, err
+	}
+	hdr, _, err := format.Parse(src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header: %v", err)
+	}
+	recipients := make(map[string]bool)
+	var hint string
+	for _, s := range hdr.Recipients {
+		switch {
+		case s.Type == hintStanzaType:
+			if len(s.Args) != 1 {
+				return nil, errors.New("invalid ext-hint stanza")
+			}
+			hint = s.Args[0]
+			continue
+		case !isRecipientStanza(s):
+		case keyTaggedStanzaTypes[s.Type]:
+			if len(s.Args) < 1 {
+				return nil, fmt.Errorf("invalid %s stanza", s.Type)
+			}
+			recipients[s.Type+" "+s.Args[0]] = true
+		case hint != "":
+			recipients[s.Type+" hint "+hint] = true
+		default:
+			return nil, ErrRecipientsNotComparable
+		}
+		hint = ""
+	}
+	return recipients, nil
+}
+
+func headerInfo(hdr *format.Header) *HeaderInfo {
+	info := &HeaderInfo{}
+	for _, s := range hdr.Recipients {
+		info.StanzaTypes = append(info.StanzaTypes, s.Type)
+		switch s.Type {
+		case groupStanzaType:
+			info.GroupName = string(s.Body)
+		case metadataStanzaType:
+			info.Metadata = s.Body
+		case timestampStanzaType:
+			if len(s.Args) == 1 {
+				info.Timestamp, _ = time.Parse(time.RFC3339, s.Args[0])
+			}
+		}
+	}
+	return info
+}
+
+// VerifyHeader checks that one of identities can decrypt the age file read from
+// src, by unwrapping the file key and verifying the header MAC, without reading
+// the payload. It returns the identity that matched.
+//
+// This is useful to check a passphrase with an ScryptIdentity before streaming
+// a large file, for example to unlock a vault. The scrypt work is the same
+// that Decrypt would do, and is still bounded by SetMaxWorkFactor. Note that a
+// valid header doesn't guarantee the payload is not corrupted or truncated,
+// which is only detected by reading it.
+func VerifyHeader(src io.Reader, identities ...Identity) (Identity, error) {
+	if len(identities) == 0 {
+		return nil, errors.New("no identities specified")
+	}
+	hdr, _, err := format.Parse(src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header: %v", err)
+	}
+	_, matched, err := unwrapHeader(hdr, identities)
+	if err != nil {
+		return nil, err
+	}
+	return matched, nil
+}
+
+// CanDecrypt reports whether id can decrypt the age file of the given size read
+// from src, binary or ASCII armored, by unwrapping the file key and verifying
+// the header MAC like VerifyHeader. Only the header is read, through ReadAt,
+// and no plaintext is returned.
+//
+// The Unwrap method of id does run, with all its costs and side effects: an
+// ScryptIdentity runs scrypt if the file is encrypted with a passphrase, and
+// identities that prompt the user, like those asking for a passphrase or a
+// one-time code, or plugin identities, might do so. Since identities ignore
+// stanzas of types they don't recognize, a file that id doesn't match returns
+// false and a nil error.
+func CanDecrypt(src io.ReaderAt, size int64, id Identity) (bool, error) {
+	r, _, err := detectArmor(io.NewSectionReader(src, 0, size))
+	if err != nil {
+		return false, err
+	}
+	_, err = VerifyHeader(r, id)
+	var noMatch *NoIdentityMatchError
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.As(err, &noMatch):
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// Cost is the estimated work of decrypting an age file, as returned by
+// DecryptionCost.
+type Cost struct {
+	// ScryptWorkFactor is the largest scrypt work factor, as a base-2
+	// logarithm, of the passphrase stanzas, or zero if there are none. Each
+	// passphrase stanza costs an ScryptIdentity 2^logN scrypt iterations,
+	// and all of them might be tried.
+	ScryptWorkFactor int
+
+	// ScryptStanzas is the number of passphrase stanzas.
+	ScryptStanzas int
+
+	// Stanzas is the number of recipient stanzas in the header, which
+	// identities might each have to try, as counted by CountRecipients.
+	Stanzas int
+
+	// PayloadSize is the size of the payload, including its nonce, which
+	// follows the header.
+	PayloadSize int64
+}
+
+// DecryptionCost estimates the work of decrypting the binary age file of the
+// given size read from src, without any identities and without reading the
+// payload, so that services can reject or defer expensive decryptions of
+// untrusted files.
+//
+// The header is not authenticated, and the work factors are reported as
+// declared, without any cap: a header might declare a work factor of 40. An
+// ScryptIdentity rejects stanzas above its SetMaxWorkFactor without running
+// scrypt, so callers should compare ScryptWorkFactor against that limit.
+func DecryptionCost(src io.ReaderAt, size int64) (*Cost, error) {
+	hdr, _, err := format.Parse(io.NewSectionReader(src, 0, size))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header: %v", err)
+	}
+	c := &Cost{Stanzas: countRecipientStanzas(hdr)}
+	for _, s := range hdr.Recipients {
+		if s.Type != "scrypt" && s.Type != multiScryptStanzaType {
+			continue
+		}
+		if len(s.Args) != 2 {
+			return nil, errors.New("invalid scrypt recipient block")
+		}
+		logN, err := strconv.Atoi(s.Args[1])
+		if err != nil || logN <= 0 {
+			return nil, fmt.Errorf("invalid scrypt work factor: %q", s.Args[1])
+		}
+		c.ScryptStanzas++
+		if logN > c.ScryptWorkFactor {
+			c.ScryptWorkFactor = logN
+		}
+	}
+
+	hdrSize, err := headerSize(hdr)
+	if err != nil {
+		return nil, err
+	}
+	c.PayloadSize = size - hdrSize
+	return c, nil
+}
+
+// headerSize returns the length of the header as read from the file. It's the
+// length of its encoding, since the parser only accepts canonical headers.
+func headerSize(hdr *format.Header) (int64, error) {
+	buf := &bytes.Buffer{}
+	if err := hdr.Marshal(buf); err != nil {
+		return 0, fmt.Errorf("failed to encode header: %v", err)
+	}
+	return int64(buf.Len()), nil
+}
+
+// AddRecipient copies the age file read from src to dst, adding the stanzas of
+// newRecipient to its header, so that newRecipient can decrypt it too. One of
+// ids must be able to decrypt the file, to recover the file key.
+//
+// The payload is copied unmodified, so the cost doesn't depend on decrypting
+// it, but it's also not verified: a corrupted payload is only detected when
+// decrypting the result. Recipients can't be added to files encrypted with a
+// ScryptRecipient or a MultiPassphraseRecipient.
+//
+// The labels of the existing recipients, see RecipientWithLabels, can't be
+// recovered from the file, so newRecipient must not return any labels: that
+// rules out recipients that must not be mixed with others, like
+// ScryptRecipient and HybridPQRecipient.
+//
+// Note that anyone who could decrypt the original file can still decrypt the
+// new one, as they share the file key.
+func AddRecipient(src io.Reader, ids []Identity, newRecipient Recipient, dst io.Writer) error {
+	if len(ids) == 0 {
+		return errors.New("no identities specified")
+	}
+	hdr, payload, err := format.Parse(src)
+	if err != nil {
+		return fmt.Errorf("failed to read header: %v", err)
+	}
+	fileKey, matched, err := unwrapHeader(hdr, ids)
+	if err != nil {
+		return err
+	}
+	if err := audit(matched, hdr); err != nil {
+		return err
+	}
+
+	stanzas, labels, err := wrapWithLabels(newRecipient, fileKey)
+	if err != nil {
+		return fmt.Errorf("failed to wrap key for new recipient: %v", err)
+	}
+	if len(labels) != 0 {
+		return errors.New("incompatible recipients: the new recipient has labels, and can't be mixed with the existing ones")
+	}
+	if len(stanzas) == 0 {
+		return &NoRecipientsError{EmptyStanzas: true}
+	}
+	for _, s := range stanzas {
+		hdr.Recipients = append(hdr.Recipients, (*format.Stanza)(s))
+	}
+	if err := checkScryptStanzas(hdr.Recipients); err != nil {
+		return err
+	}
+	if hdr.MAC, err = headerMAC(fileKey, hdr); err != nil {
+		return fmt.Errorf("failed to compute header MAC: %v", err)
+	}
+
+	if err := hdr.Marshal(dst); err != nil {
+		return fmt.Errorf("failed to write header: %v", err)
+	}
+	if _, err := io.Copy(dst, payload); err != nil {
+		return fmt.Errorf("failed to copy payload: %v", err)
+	}
+	return nil
+}
+
+// RemoveRecipient revokes access to the age file read from src for everyone
+// but recipients, by decrypting it with one of ids and encrypting it again to
+// recipients, with a new file key, into dst. The plaintext is streamed, and
+// never held in memory in full.
+//
+// Removing only the revoked party's stanza from the header would not be
+// enough, because the file key would not change, and they could have kept it
+// from when they had access. Moreover, stanzas can't in general be linked to
+// the recipients that produced them, which is why the remaining recipients
+// must be specified instead of the removed one. See UnsafeRemoveStanzas for a
+// header-only variant, for the rare cases where that is acceptable.
+//
+// Non-standard settings of the original file, like those of Encryptor, are not
+// preserved.
+func RemoveRecipient(src io.Reader, ids []Identity, recipients []Recipient, dst io.Writer) error {
+	// Check the recipients first, so that identities that might prompt the
+	// user, like encrypted SSH keys, are not used in vain.
+	if len(recipients) == 0 {
+		return &NoRecipientsError{}
+	}
+	r, err := Decrypt(src, ids...)
+	if err != nil {
+		return err
+	}
+	w, err := Encrypt(dst, recipients...)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return fmt.Errorf("failed to re-encrypt payload: %v", err)
+	}
+	return w.Close()
+}
+
+// UnsafeRemoveStanzas copies the age file read from src to dst, dropping from
+// its header the stanzas for which remove returns true, and recomputing the
+// header MAC with the file key recovered by one of ids.
+//
+// This is NOT a safe way to revoke access: the file key and the payload don't
+// change, so anyone who decrypted the file before, or who kept a copy of it,
+// can still decrypt the new one. Use RemoveRecipient instead, unless the goal
+// is only to shrink the header, and the removed parties are trusted not to
+// have retained the file key.
+func UnsafeRemoveStanzas(src io.Reader, ids []Identity, remove func(*Stanza) bool, dst io.Writer) error {
+	if len(ids) == 0 {
+		return errors.New("no identities specified")
+	}
+	hdr, payload, err := format.Parse(src)
+	if err != nil {
+		return fmt.Errorf("failed to read header: %v", err)
+	}
+	fileKey, matched, err := unwrapHeader(hdr, ids)
+	if err != nil {
+		return err
+	}
+	if err := audit(matched, hdr); err != nil {
+		return err
+	}
+
+	var kept []*format.Stanza
+	for _, s := range hdr.Recipients {
+		if !remove((*Stanza)(s)) {
+			kept = append(kept, s)
+		}
+	}
+	hdr.Recipients = kept
+	if len(hdr.Recipients) == 0 {
+		return errors.New("all stanzas would be removed")
+	}
+	if hdr.MAC, err = headerMAC(fileKey, hdr); err != nil {
+		return fmt.Errorf("failed to compute header MAC: %v", err)
+	}
+
+	if err := hdr.Marshal(dst); err != nil {
+		return fmt.Errorf("failed to write header: %v", err)
+	}
+	if _, err := io.Copy(dst, payload); err != nil {
+		return fmt.Errorf("failed to copy payload: %v", err)
+	}
+	return nil
+}
+
+// IsEncrypted reports whether the data read from src looks like an age file,
+// binary or ASCII armored, by peeking at its first bytes. It's meant to warn
+// users before they encrypt a file that is already encrypted.
+//
+// Since src might not be seekable, the peeked bytes are buffered, and src
+// must not be used afterwards. Instead, the returned Reader yields the whole
+// original content, including the peeked bytes, even if an error is returned.
+func IsEncrypted(src io.Reader) (bool, io.Reader, error) {
+	b := bufio.NewReader(src)
+	peeked, err := b.Peek(len(format.Intro))
+	if err != nil && err != io.EOF {
+		return false, b, err
+	}
+	if string(peeked) == format.Intro {
+		return true, b, nil
+	}
+	// Use the same rules as detectArmor, so that every armored file that
+	// DecryptStreamAuto or a Decryptor with RequireArmor would accept is
+	// recognized. Note that Decrypt itself only accepts binary files.
+	armored, err := armor.IsArmored(b)
+	return armored, b, err
+}
+
+// ConvertArmor copies the age file read from src to dst in the opposite
+// representation: an ASCII armored file is written in binary, and a binary file
+// is written ASCII armored. It reports whether the output is armored.
+//
+// The header is parsed and the armor, if any, is strictly decoded, but no
+// identities are needed, since neither the header MAC nor the payload can be
+// verified without the file key. The header and payload are copied unmodified,
+// so converting a file back and forth produces the same binary file. If an
+// error is returned, what was written to dst so far must be discarded.
+func ConvertArmor(src io.Reader, dst io.Writer) (armored bool, err error) {
+	in, fromArmor, err := detectArmor(src)
+	if err != nil {
+		return false, err
+	}
+
+	hdr, payload, err := format.Parse(in)
+	if err != nil {
+		return false, fmt.Errorf("failed to read header: %v", err)
+	}
+
+	out := dst
+	var aw io.WriteCloser
+	if !fromArmor {
+		aw = armor.NewWriter(dst)
+		out = aw
+	}
+	if err := hdr.Marshal(out); err != nil {
+		return false, fmt.Errorf("failed to write header: %v", err)
+	}
+	if _, err := io.Copy(out, payload); err != nil {
+		return false, fmt.Errorf("failed to copy payload: %v", err)
+	}
+	if aw != nil {
+		if err := aw.Close(); err != nil {
+			return false, fmt.Errorf("failed to write armor: %v", err)
+		}
+	}
+	return !fromArmor, nil
+}
+
+// SplitHeaderBody parses the header of the binary age file read from src, and
+// returns its encoding, including the MAC line and its trailing newline, and a
+// Reader positioned at the first byte of the payload.
+//
+// The payload is not read in advance, so it can be streamed to a different
+// storage than the header, and the file can be reassembled with
+// JoinHeaderBody. The header MAC can't be verified without the file key, so the
+// header is only checked to be well-formed.
+func SplitHeaderBody(src io.Reader) (header []byte, body io.Reader, err error) {
+	hdr, payload, err := format.Parse(src)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read header: %v", err)
+	}
+	buf := &bytes.Buffer{}
+	if err := hdr.Marshal(buf); err != nil {
+		return nil, nil, fmt.Errorf("failed to encode header: %v", err)
+	}
+	return buf.Bytes(), payload, nil
+}
+
+// JoinHeaderBody writes to dst the age file made of header, as returned by
+// SplitHeaderBody, followed by the payload read from body.
+//
+// header is checked to be the complete and canonical encoding of a well-formed
+// header, with a MAC of the right size and a valid set of stanzas, before
+// anything is written. Without the file key the MAC itself can't be checked,
+// so a header that doesn't belong to body is only detected when decrypting.
+func JoinHeaderBody(header []byte, body io.Reader, dst io.Writer) error {
+	hdr, rest, err := format.Parse(bytes.NewReader(header))
+	if err != nil {
+		return fmt.Errorf("failed to read header: %v", err)
+	}
+	if n, _ := rest.Read(make([]byte, 1)); n != 0 {
+		return errors.New("unexpected data after the header")
+	}
+	if len(hdr.MAC) != 32 {
+		return errors.New("malformed header MAC")
+	}
+	if len(hdr.Recipients) == 0 {
+		return errors.New("header has no recipient stanzas")
+	}
+	if err := checkScryptStanzas(hdr.Recipients); err != nil {
+		return err
+	}
+	buf := &bytes.Buffer{}
+	if err := hdr.Marshal(buf); err != nil {
+		return fmt.Errorf("failed to encode header: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), header) {
+		return errors.New("header is not canonically encoded")
+	}
+
+	if _, err := dst.Write(header); err != nil {
+		return fmt.Errorf("failed to write header: %v", err)
+	}
+	if _, err := io.Copy(dst, body); err != nil {
+		return fmt.Errorf("failed to copy payload: %v", err)
+	}
+	return nil
+}
+
+// detectArmor returns a reader for the binary age file read from src, which is
+// decoded with armor.NewReader if it starts with the armor header, possibly
+// after whitespace, see armor.IsArmored. It reports whether src is armored.
+//
+// All functions that accept both binary and armored files must use it, so
+// that they agree on which files are armored.
+func detectArmor(src io.Reader) (r io.Reader, armored bool, err error) {
+	b := bufio.NewReader(src)
+	armored, err = armor.IsArmored(b)
+	if err != nil {
+		return nil, false, err
+	}
+	if armored {
+		return armor.NewReader(b), true, nil
+	}
+	return b, false, nil
+}
@@ -0,0 +1,68 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package age
+
+import "sync"
+
+// The IdentityFunc type is an adapter to allow the use of ordinary functions as
+// identities. If f is a function with the appropriate signature,
+// IdentityFunc(f) is an Identity that calls f.
+type IdentityFunc func(stanzas []*Stanza) (fileKey []byte, err error)
+
+var _ Identity = IdentityFunc(nil)
+
+// Unwrap calls f(stanzas).
+func (f IdentityFunc) Unwrap(stanzas []*Stanza) ([]byte, error) {
+	return f(stanzas)
+}
+
+type lazyIdentity struct {
+	stanzaType  string
+	newIdentity func() (Identity, error)
+
+	mu sync.Mutex
+	id Identity
+}
+
+// NewLazyIdentity returns an Identity that calls newIdentity only the first
+// time it is asked to unwrap a set of stanzas that includes one of type
+// stanzaType, and then uses the returned Identity. Otherwise, it returns
+// ErrIncorrectIdentity without calling newIdentity.
+//
+// This is useful to avoid prompting for a passphrase or accessing hardware
+// tokens when a file is not encrypted to the identity. If newIdentity returns
+// an error, it is returned by Unwrap, and newIdentity will be called again by
+// the next Unwrap with a matching stanza.
+func NewLazyIdentity(stanzaType string, newIdentity func() (Identity, error)) Identity {
+	return &lazyIdentity{stanzaType: stanzaType, newIdentity: newIdentity}
+}
+
+func (i *lazyIdentity) Unwrap(stanzas []*Stanza) ([]byte, error) {
+	var match bool
+	for _, s := range stanzas {
+		if s.Type == i.stanzaType {
+			match = true
+			break
+		}
+	}
+	if !match {
+		return nil, ErrIncorrectIdentity
+	}
+
+	i.mu.Lock()
+	if i.id == nil {
+		id, err := i.newIdentity()
+		if err != nil {
+			i.mu.Unlock()
+			return nil, err
+		}
+		i.id = id
+	}
+	id := i.id
+	i.mu.Unlock()
+	return id.Unwrap(stanzas)
+}
@@ -107,11 +107,23 @@ func convertBits(data []byte, frombits, tobits byte, pad bool) ([]byte, error) {
 // Encode encodes the HRP and a bytes slice to Bech32. If the HRP is uppercase,
 // the output will be uppercase.
 func Encode(hrp string, data []byte) (string, error) {
+	return encode(hrp, data, 90)
+}
+
+// EncodeLong is like Encode, but without the 90 characters limit of BIP 173,
+// for keys that don't fit in it. The checksum still detects any error, but its
+// guarantees for errors affecting up to four characters are lost.
+func EncodeLong(hrp string, data []byte) (string, error) {
+	return encode(hrp, data, 0)
+}
+
+// encode implements Encode, rejecting outputs longer than limit, if not zero.
+func encode(hrp string, data []byte, limit int) (string, error) {
 	values, err := convertBits(data, 8, 5, true)
 	if err != nil {
 		return "", err
 	}
-	if len(hrp)+len(values)+7 > 90 {
+	if limit != 0 && len(hrp)+len(values)+7 > limit {
 		return "", fmt.Errorf("too long: hrp length=%d, data length=%d", len(hrp), len(values))
 	}
 	if len(hrp) < 1 {
@@ -144,7 +156,18 @@ func Encode(hrp string, data []byte) (string, error) {
 
 // Decode decodes a Bech32 string. If the string is uppercase, the HRP will be uppercase.
 func Decode(s string) (hrp string, data []byte, err error) {
-	if len(s) > 90 {
+	return decode(s, 90)
+}
+
+// DecodeLong is like Decode, but it accepts strings longer than 90 characters,
+// as produced by EncodeLong.
+func DecodeLong(s string) (hrp string, data []byte, err error) {
+	return decode(s, 0)
+}
+
+// decode implements Decode, rejecting inputs longer than limit, if not zero.
+func decode(s string, limit int) (hrp string, data []byte, err error) {
+	if limit != 0 && len(s) > limit {
 		return "", nil, fmt.Errorf("too long: len=%d", len(s))
 	}
 	if strings.ToLower(s) != s && strings.ToUpper(s) != s {
@@ -0,0 +1,89 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+// Package bip39 implements the BIP-39 encoding of entropy as a mnemonic
+// sentence of english words, with a checksum.
+//
+// Only the entropy encoding is implemented, not the derivation of a seed from
+// the mnemonic, which is not needed to store and recover raw keys.
+package bip39
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Encode returns the mnemonic encoding of entropy, which must be 16 to 32 bytes
+// long, in multiples of 4.
+func Encode(entropy []byte) (string, error) {
+	if len(entropy) < 16 || len(entropy) > 32 || len(entropy)%4 != 0 {
+		return "", fmt.Errorf("invalid entropy length %d", len(entropy))
+	}
+	checksumBits := len(entropy) / 4
+	h := sha256.Sum256(entropy)
+	// The checksum is at most 8 bits, so it fits in the first byte of the hash.
+	data := append(append([]byte{}, entropy...), h[0])
+
+	totalBits := len(entropy)*8 + checksumBits
+	words := make([]string, 0, totalBits/11)
+	for i := 0; i < totalBits; i += 11 {
+		var idx int
+		for b := i; b < i+11; b++ {
+			idx = idx<<1 | int(data[b/8]>>(7-uint(b%8))&1)
+		}
+		words = append(words, Wordlist[idx])
+	}
+	return strings.Join(words, " "), nil
+}
+
+var (
+	wordIndexOnce sync.Once
+	wordIndex     map[string]int
+)
+
+// Decode returns the entropy encoded by mnemonic, after verifying its
+// checksum. Words are case-insensitive and separated by any whitespace.
+func Decode(mnemonic string) ([]byte, error) {
+	wordIndexOnce.Do(func() {
+		wordIndex = make(map[string]int, len(Wordlist))
+		for i, w := range Wordlist {
+			wordIndex[w] = i
+		}
+	})
+
+	words := strings.Fields(strings.ToLower(mnemonic))
+	switch len(words) {
+	case 12, 15, 18, 21, 24:
+	default:
+		return nil, fmt.Errorf("invalid mnemonic length: %d words", len(words))
+	}
+	totalBits := len(words) * 11
+	checksumBits := totalBits / 33
+	data := make([]byte, (totalBits+7)/8)
+	for i, w := range words {
+		idx, ok := wordIndex[w]
+		if !ok {
+			return nil, fmt.Errorf("invalid mnemonic: unknown word %q", w)
+		}
+		for b := 0; b < 11; b++ {
+			if idx>>(10-uint(b))&1 == 1 {
+				bit := i*11 + b
+				data[bit/8] |= 1 << (7 - uint(bit%8))
+			}
+		}
+	}
+
+	entropy := data[:(totalBits-checksumBits)/8]
+	h := sha256.Sum256(entropy)
+	mask := byte(0xff) << (8 - uint(checksumBits))
+	if data[len(entropy)]&mask != h[0]&mask {
+		return nil, errors.New("invalid mnemonic: checksum mismatch")
+	}
+	return entropy, nil
+}
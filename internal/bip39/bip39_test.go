@@ -0,0 +1,61 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package bip39_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"filippo.io/age/internal/bip39"
+)
+
+// Test vectors from the reference implementation,
+// https://github.com/trezor/python-mnemonic/blob/master/vectors.json.
+var vectors = []struct {
+	entropy, mnemonic string
+}{
+	{"00000000000000000000000000000000", "abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about"},
+	{"7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f", "legal winner thank year wave sausage worth useful legal winner thank yellow"},
+	{"80808080808080808080808080808080", "letter advice cage absurd amount doctor acoustic avoid letter advice cage above"},
+	{"0000000000000000000000000000000000000000000000000000000000000000", strings.Repeat("abandon ", 23) + "art"},
+	{"ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff", strings.Repeat("zoo ", 23) + "vote"},
+}
+
+func TestVectors(t *testing.T) {
+	for _, v := range vectors {
+		entropy, _ := hex.DecodeString(v.entropy)
+		m, err := bip39.Encode(entropy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m != v.mnemonic {
+			t.Errorf("Encode(%s) = %q, want %q", v.entropy, m, v.mnemonic)
+		}
+		e, err := bip39.Decode(strings.ToUpper(v.mnemonic) + "\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(e, entropy) {
+			t.Errorf("Decode(%q) = %x, want %s", v.mnemonic, e, v.entropy)
+		}
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	for _, m := range []string{
+		"",
+		strings.Repeat("abandon ", 12),         // bad checksum
+		strings.Repeat("abandon ", 11) + "zzz", // unknown word
+		strings.Repeat("abandon ", 11),         // bad length
+	} {
+		if _, err := bip39.Decode(m); err == nil {
+			t.Errorf("Decode(%q) succeeded", m)
+		}
+	}
+}
@@ -20,6 +20,10 @@ import (
 type Header struct {
 	Recipients []*Stanza
 	MAC        []byte
+
+	// Intro, if not empty, is the version line the header was parsed from,
+	// if it's different from the package-level Intro. See ParseCompat.
+	Intro string
 }
 
 // Stanza is assignable to age.Stanza, and if this package is made public,
@@ -84,7 +88,10 @@ func (w *newlineWriter) Write(p []byte) (int, error) {
 	return len(p), nil
 }
 
-const intro = "age-encryption.org/v1\n"
+// Intro is the first line of every age file.
+const Intro = "age-encryption.org/v1\n"
+
+const intro = Intro
 
 var recipientPrefix = []byte("->")
 var footerPrefix = []byte("---")
@@ -101,18 +108,25 @@ func (r *Stanza) Marshal(w io.Writer) error {
 	if _, err := io.WriteString(w, "\n"); err != nil {
 		return err
 	}
-	ww := base64.NewEncoder(b64, NewlineWriter(w))
-	if _, err := ww.Write(r.Body); err != nil {
-		return err
-	}
-	if err := ww.Close(); err != nil {
-		return err
+	// Encode the body in one go rather than through base64.NewEncoder and
+	// NewlineWriter, since bodies are small and this is on the hot path of
+	// computing the header MAC, which happens for every file.
+	body := b64.EncodeToString(r.Body)
+	for len(body) >= ColumnsPerLine {
+		if _, err := io.WriteString(w, body[:ColumnsPerLine]+"\n"); err != nil {
+			return err
+		}
+		body = body[ColumnsPerLine:]
 	}
-	_, err := io.WriteString(w, "\n")
+	_, err := io.WriteString(w, body+"\n")
 	return err
 }
 
 func (h *Header) MarshalWithoutMAC(w io.Writer) error {
+	intro := intro
+	if h.Intro != "" {
+		intro = h.Intro
+	}
 	if _, err := io.WriteString(w, intro); err != nil {
 		return err
 	}
@@ -147,6 +161,53 @@ func errorf(format string, a ...interface{}) error {
 // Parse returns the header and a Reader that begins at the start of the
 // payload.
 func Parse(input io.Reader) (*Header, io.Reader, error) {
+	return parse(input, false)
+}
+
+// ParseCompat is like Parse, but it also accepts a version line with a newer
+// minor version of the same major version, like "age-encryption.org/v1.2",
+// which is then preserved in Header.Intro. Files of a different major
+// version are still rejected.
+func ParseCompat(input io.Reader) (*Header, io.Reader, error) {
+	return parse(input, true)
+}
+
+const introPrefix = "age-encryption.org/v"
+
+// checkIntroVersion returns nil if line is an intro with the same major
+// version as Intro, and any minor version.
+func checkIntroVersion(line string) error {
+	if !strings.HasPrefix(line, introPrefix) || !strings.HasSuffix(line, "\n") {
+		return errorf("unexpected intro: %q", line)
+	}
+	version := strings.TrimSuffix(strings.TrimPrefix(line, introPrefix), "\n")
+	major, minor := version, "0"
+	if i := strings.IndexByte(version, '.'); i >= 0 {
+		major, minor = version[:i], version[i+1:]
+	}
+	if !isVersionNumber(major) || !isVersionNumber(minor) {
+		return errorf("unexpected intro: %q", line)
+	}
+	if want := strings.TrimSuffix(strings.TrimPrefix(intro, introPrefix), "\n"); major != want {
+		return errorf("unsupported major version in intro: %q", line)
+	}
+	return nil
+}
+
+// isVersionNumber reports whether s is a decimal number without leading zeroes.
+func isVersionNumber(s string) bool {
+	if s == "" || len(s) > 1 && s[0] == '0' {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func parse(input io.Reader, compat bool) (*Header, io.Reader, error) {
 	h := &Header{}
 	rr := bufio.NewReader(input)
 
@@ -155,7 +216,13 @@ func Parse(input io.Reader) (*Header, io.Reader, error) {
 		return nil, nil, errorf("failed to read intro: %v", err)
 	}
 	if line != intro {
-		return nil, nil, errorf("unexpected intro: %q", line)
+		if !compat {
+			return nil, nil, errorf("unexpected intro: %q", line)
+		}
+		if err := checkIntroVersion(line); err != nil {
+			return nil, nil, err
+		}
+		h.Intro = line
 	}
 
 	var r *Stanza
@@ -231,6 +298,89 @@ func Parse(input io.Reader) (*Header, io.Reader, error) {
 	return h, payload, nil
 }
 
+// MaxStanzaLineLength is the limit on the length of each line read by a
+// StanzaReader, including the newline. Body lines are much shorter, but
+// arguments can be long, like the encoding of a post-quantum recipient.
+const MaxStanzaLineLength = 16 << 10
+
+// StanzaReader reads a sequence of stanzas from a stream, such as the messages
+// of a protocol built on the age stanza encoding. Lines longer than
+// MaxStanzaLineLength cause an error, so memory use is bounded.
+type StanzaReader struct {
+	r   *bufio.Reader
+	err error
+}
+
+func NewStanzaReader(r *bufio.Reader) *StanzaReader {
+	return &StanzaReader{r: r}
+}
+
+// ReadStanza reads the next stanza. Errors are not recoverable, and every call
+// after the first failure returns the same error.
+func (r *StanzaReader) ReadStanza() (s *Stanza, err error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	defer func() { r.err = err }()
+
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(line, recipientPrefix) {
+		return nil, fmt.Errorf("malformed stanza opening line: %q", line)
+	}
+	prefix, args := splitArgs(line)
+	if prefix != string(recipientPrefix) || len(args) < 1 {
+		return nil, fmt.Errorf("malformed stanza: %q", line)
+	}
+	for _, a := range args {
+		if !isValidString(a) {
+			return nil, fmt.Errorf("malformed stanza: %q", line)
+		}
+	}
+	s = &Stanza{Type: args[0], Args: args[1:]}
+
+	for {
+		line, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+		b, err := DecodeString(strings.TrimSuffix(string(line), "\n"))
+		if err != nil {
+			return nil, fmt.Errorf("malformed body line %q: %v", line, err)
+		}
+		if len(b) > BytesPerLine {
+			return nil, fmt.Errorf("malformed body line %q: too long", line)
+		}
+		s.Body = append(s.Body, b...)
+		if len(b) < BytesPerLine {
+			// Only the last line of a body can be short.
+			return s, nil
+		}
+	}
+}
+
+// readLine reads a line, including the newline, of at most
+// MaxStanzaLineLength bytes.
+func (r *StanzaReader) readLine() ([]byte, error) {
+	var line []byte
+	for {
+		frag, err := r.r.ReadSlice('\n')
+		if len(line)+len(frag) > MaxStanzaLineLength {
+			return nil, errors.New("failed to read line: line too long")
+		}
+		line = append(line, frag...)
+		switch {
+		case err == bufio.ErrBufferFull:
+		case err != nil:
+			return nil, fmt.Errorf("failed to read line: %w", err)
+		default:
+			return line, nil
+		}
+	}
+}
+
 func splitArgs(line []byte) (string, []string) {
 	l := strings.TrimSuffix(string(line), "\n")
 	parts := strings.Split(l, " ")
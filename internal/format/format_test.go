@@ -7,7 +7,10 @@
 package format_test
 
 import (
+	"bufio"
 	"bytes"
+	"io"
+	"strings"
 	"testing"
 
 	"filippo.io/age/internal/format"
@@ -39,3 +42,78 @@ func TestStanzaMarshal(t *testing.T) {
 		t.Errorf("wrong 64 columns stanza encoding: expected %q, got %q", exp, buf.String())
 	}
 }
+
+func TestParseCompat(t *testing.T) {
+	const rest = "-> test\nQUFB\n--- " + "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA" + "\n"
+	for _, tt := range []struct {
+		intro          string
+		strict, compat bool
+	}{
+		{"age-encryption.org/v1\n", true, true},
+		{"age-encryption.org/v1.0\n", false, true},
+		{"age-encryption.org/v1.7\n", false, true},
+		{"age-encryption.org/v2\n", false, false},
+		{"age-encryption.org/v2.0\n", false, false},
+		{"age-encryption.org/v01\n", false, false},
+		{"age-encryption.org/v1.-1\n", false, false},
+		{"age-encryption.org/v1.1.1\n", false, false},
+		{"age-encryption.org/v1.1\r\n", false, false},
+	} {
+		_, _, err := format.Parse(strings.NewReader(tt.intro + rest))
+		if (err == nil) != tt.strict {
+			t.Errorf("Parse(%q): got error %v", tt.intro, err)
+		}
+		h, _, err := format.ParseCompat(strings.NewReader(tt.intro + rest))
+		if (err == nil) != tt.compat {
+			t.Errorf("ParseCompat(%q): got error %v", tt.intro, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		buf := &bytes.Buffer{}
+		if err := h.Marshal(buf); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tt.intro+rest {
+			t.Errorf("ParseCompat(%q): header did not round-trip: %q", tt.intro, buf)
+		}
+	}
+}
+
+type infiniteReader byte
+
+func (r infiniteReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(r)
+	}
+	return len(p), nil
+}
+
+func TestStanzaReaderLineLimit(t *testing.T) {
+	// The longest allowed opening line, with the "-> " prefix and newline.
+	arg := strings.Repeat("A", format.MaxStanzaLineLength-len("-> test \n"))
+	in := "-> test " + arg + "\nQUFB\n"
+	s, err := format.NewStanzaReader(bufio.NewReader(strings.NewReader(in))).ReadStanza()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Type != "test" || len(s.Args) != 1 || s.Args[0] != arg || string(s.Body) != "AAA" {
+		t.Errorf("unexpected stanza: %v %v %q", s.Type, len(s.Args), s.Body)
+	}
+
+	in = "-> test A" + arg + "\nQUFB\n"
+	if _, err := format.NewStanzaReader(bufio.NewReader(strings.NewReader(in))).ReadStanza(); err == nil {
+		t.Error("expected an error for an opening line over the limit")
+	}
+
+	// Endless lines must be rejected without reading all of them.
+	r := io.MultiReader(strings.NewReader("-> test\n"), infiniteReader('A'))
+	if _, err := format.NewStanzaReader(bufio.NewReader(r)).ReadStanza(); err == nil {
+		t.Error("expected an error for an endless body line")
+	}
+	r = io.MultiReader(strings.NewReader("-> "), infiniteReader('A'))
+	if _, err := format.NewStanzaReader(bufio.NewReader(r)).ReadStanza(); err == nil {
+		t.Error("expected an error for an endless opening line")
+	}
+}
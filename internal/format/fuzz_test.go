@@ -0,0 +1,50 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+//go:build go1.18
+// +build go1.18
+
+package format_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"filippo.io/age/internal/format"
+)
+
+func FuzzParseHeader(f *testing.F) {
+	if example, err := ioutil.ReadFile("../../testdata/example.age"); err == nil {
+		f.Add(example)
+	}
+	f.Add([]byte("age-encryption.org/v1\n-> X25519 abc\n\n--- 1234\n"))
+	f.Add([]byte("age-encryption.org/v1\n-> a b c\nQUFB\n-> d\n\n--- AAAA\npayload"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		h, payload, err := format.Parse(bytes.NewReader(data))
+		if err != nil {
+			if h != nil || payload != nil {
+				t.Error("Parse returned non-nil values with an error")
+			}
+			return
+		}
+		// A successfully parsed header must re-encode to a prefix of the input.
+		buf := &bytes.Buffer{}
+		if err := h.Marshal(buf); err != nil {
+			t.Fatalf("failed to marshal parsed header: %v", err)
+		}
+		if !bytes.HasPrefix(data, buf.Bytes()) {
+			t.Errorf("header did not round-trip:\n%q\n%q", data, buf.Bytes())
+		}
+		rest, err := ioutil.ReadAll(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.Len()+len(rest) != len(data) {
+			t.Errorf("header and payload are %d+%d bytes, input is %d", buf.Len(), len(rest), len(data))
+		}
+	})
+}
@@ -0,0 +1,108 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+// Package shamir implements Shamir's secret sharing over GF(2^8).
+//
+// Field operations are implemented without lookup tables or secret-dependent
+// branches, to avoid leaking the secret through timing side channels.
+package shamir
+
+import (
+	"crypto/rand"
+	"errors"
+)
+
+// mul multiplies two elements of GF(2^8) modulo the AES polynomial
+// x^8 + x^4 + x^3 + x + 1.
+func mul(a, b byte) byte {
+	var p byte
+	for i := 0; i < 8; i++ {
+		p ^= -(b & 1) & a
+		carry := -(a >> 7)
+		a = a<<1 ^ 0x1b&carry
+		b >>= 1
+	}
+	return p
+}
+
+// inv returns the multiplicative inverse of a non-zero element, as a^254.
+func inv(a byte) byte {
+	r := a
+	for i := 0; i < 6; i++ {
+		r = mul(r, r)
+		r = mul(r, a)
+	}
+	return mul(r, r)
+}
+
+// Split splits secret into n shares, any k of which can reconstruct it. The
+// share for x coordinate i+1 is returned at index i.
+func Split(secret []byte, k, n int) ([][]byte, error) {
+	if k < 2 || n < k || n > 255 {
+		return nil, errors.New("invalid threshold: must have 2 <= k <= n <= 255")
+	}
+	coeffs := make([]byte, k-1)
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret))
+	}
+	for j, s := range secret {
+		if _, err := rand.Read(coeffs); err != nil {
+			return nil, err
+		}
+		for i := range shares {
+			x := byte(i + 1)
+			// Horner's method, from the highest degree coefficient down.
+			var y byte
+			for c := len(coeffs) - 1; c >= 0; c-- {
+				y = mul(y, x) ^ coeffs[c]
+			}
+			shares[i][j] = mul(y, x) ^ s
+		}
+	}
+	for i := range coeffs {
+		coeffs[i] = 0
+	}
+	return shares, nil
+}
+
+// Combine reconstructs the secret from shares, with the corresponding non-zero
+// and distinct x coordinates in xs, by interpolating the polynomial at zero.
+// If fewer shares than the threshold are provided, the result is unrelated to
+// the secret.
+func Combine(xs []byte, shares [][]byte) ([]byte, error) {
+	if len(xs) != len(shares) || len(xs) == 0 {
+		return nil, errors.New("mismatched shares and coordinates")
+	}
+	for i, x := range xs {
+		if x == 0 {
+			return nil, errors.New("invalid share coordinate")
+		}
+		if len(shares[i]) != len(shares[0]) {
+			return nil, errors.New("shares have different lengths")
+		}
+		for _, x1 := range xs[:i] {
+			if x == x1 {
+				return nil, errors.New("duplicate share")
+			}
+		}
+	}
+
+	secret := make([]byte, len(shares[0]))
+	for i, xi := range xs {
+		// Lagrange basis polynomial for xi, evaluated at zero.
+		l := byte(1)
+		for j, xj := range xs {
+			if i != j {
+				l = mul(l, mul(xj, inv(xj^xi)))
+			}
+		}
+		for b := range secret {
+			secret[b] ^= mul(l, shares[i][b])
+		}
+	}
+	return secret, nil
+}
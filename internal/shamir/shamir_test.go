@@ -0,0 +1,51 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package shamir
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestInv(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if mul(byte(a), inv(byte(a))) != 1 {
+			t.Errorf("%d * inv(%d) != 1", a, a)
+		}
+	}
+}
+
+func TestSplitCombine(t *testing.T) {
+	secret := []byte("YELLOW SUBMARINE, BLACK WIZARDRY")
+	shares, err := Split(secret, 3, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, idx := range [][]int{{0, 1, 2}, {4, 2, 0}, {1, 3, 4, 0}} {
+		var xs []byte
+		var ys [][]byte
+		for _, i := range idx {
+			xs = append(xs, byte(i+1))
+			ys = append(ys, shares[i])
+		}
+		got, err := Combine(xs, ys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, secret) {
+			t.Errorf("shares %v: got %q", idx, got)
+		}
+	}
+
+	got, err := Combine([]byte{1, 2}, shares[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(got, secret) {
+		t.Error("two shares reconstructed a 3-of-5 secret")
+	}
+}
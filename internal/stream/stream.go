@@ -8,8 +8,11 @@
 package stream
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/cipher"
 	"errors"
+	"fmt"
 	"io"
 
 	"golang.org/x/crypto/chacha20poly1305"
@@ -18,12 +21,36 @@ import (
 
 const ChunkSize = 64 * 1024
 
+// Overhead is the size difference between a chunk and its encryption.
+const Overhead = poly1305.TagSize
+
+// EncryptedSize returns the number of bytes a Writer writes for a plaintext of
+// plaintextSize bytes. Every chunk but the last is full, and the last chunk
+// can be empty only if it's the only one.
+func EncryptedSize(plaintextSize int64) int64 {
+	chunks := (plaintextSize + ChunkSize - 1) / ChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return plaintextSize + chunks*Overhead
+}
+
 type Reader struct {
 	a   cipher.AEAD
 	src io.Reader
 
-	unread []byte // decrypted but unread data, backed by buf
+	// If br is not nil, the message might be followed by more data starting
+	// with next, and the last chunk is found by trial decryption. See
+	// NewDelimitedReader.
+	br   *bufio.Reader
+	next []byte
+
+	skipCorrupted bool
+	chunk         uint64 // index of the next chunk
+
+	unread []byte // decrypted but unread data, backed by plain
 	buf    [encChunkSize]byte
+	plain  [ChunkSize]byte // decrypted chunk, kept apart from buf to retry Open
 
 	err   error
 	nonce [chacha20poly1305.NonceSize]byte
@@ -45,6 +72,47 @@ func NewReader(key []byte, src io.Reader) (*Reader, error) {
 	}, nil
 }
 
+// NewDelimitedReader returns a Reader that decrypts a message from src which
+// might be followed by other data starting with next, without reading past
+// the end of the message. This allows reading concatenated messages. The
+// buffer of src must be at least ChunkSize + 16 + len(next) bytes.
+//
+// Since the last chunk can be short, and its length is not encoded, it is
+// found by trying to decrypt the data before each occurrence of next.
+func NewDelimitedReader(key []byte, src *bufio.Reader, next []byte) (*Reader, error) {
+	if src.Size() < encChunkSize+len(next) {
+		return nil, errors.New("stream: buffer too small")
+	}
+	r, err := NewReader(key, src)
+	if err != nil {
+		return nil, err
+	}
+	r.br, r.next = src, next
+	return r, nil
+}
+
+// CorruptedChunkError is returned by a Reader in the mode enabled by
+// SkipCorruptedChunks when a chunk fails to decrypt.
+type CorruptedChunkError struct {
+	// Chunk is the index of the corrupted chunk, starting at zero.
+	Chunk uint64
+}
+
+func (e *CorruptedChunkError) Error() string {
+	return fmt.Sprintf("failed to decrypt and authenticate payload chunk #%d", e.Chunk)
+}
+
+// SkipCorruptedChunks makes r return a *CorruptedChunkError for chunks that
+// fail to decrypt, and then continue with the following chunk on the next
+// Read, instead of failing permanently. It doesn't work with
+// NewDelimitedReader.
+//
+// This is only meant for data recovery, and only helps if the corruption
+// didn't change the length of the ciphertext.
+func (r *Reader) SkipCorruptedChunks() {
+	r.skipCorrupted = true
+}
+
 func (r *Reader) Read(p []byte) (int, error) {
 	if len(r.unread) > 0 {
 		n := copy(p, r.unread)
@@ -59,6 +127,10 @@ func (r *Reader) Read(p []byte) (int, error) {
 	}
 
 	last, err := r.readChunk()
+	if _, ok := err.(*CorruptedChunkError); ok && !last {
+		// Let the next Read continue from the next chunk.
+		return 0, err
+	}
 	if err != nil {
 		r.err = err
 		return 0, err
@@ -69,6 +141,11 @@ func (r *Reader) Read(p []byte) (int, error) {
 
 	if last {
 		r.err = io.EOF
+		// Only the last chunk can be empty, as for an empty plaintext. Return
+		// EOF right away instead of a zero-length read with a nil error.
+		if n == 0 {
+			return 0, io.EOF
+		}
 	}
 
 	return n, nil
@@ -81,6 +158,9 @@ func (r *Reader) readChunk() (last bool, err error) {
 	if len(r.unread) != 0 {
 		panic("stream: internal error: readChunk called with dirty buffer")
 	}
+	if r.br != nil {
+		return r.readDelimitedChunk()
+	}
 
 	in := r.buf[:]
 	n, err := io.ReadFull(r.src, in)
@@ -97,7 +177,7 @@ func (r *Reader) readChunk() (last bool, err error) {
 		return false, err
 	}
 
-	outBuf := make([]byte, 0, ChunkSize)
+	outBuf := r.plain[:0]
 	out, err := r.a.Open(outBuf, r.nonce[:], in, nil)
 	if err != nil && !last {
 		// Check if this was a full-length final chunk.
@@ -105,15 +185,168 @@ func (r *Reader) readChunk() (last bool, err error) {
 		setLastChunkFlag(&r.nonce)
 		out, err = r.a.Open(outBuf, r.nonce[:], in, nil)
 	}
+	if err != nil && r.skipCorrupted {
+		// We can't tell if a full chunk was the last one, so assume it wasn't,
+		// and let the next read find out.
+		r.nonce[len(r.nonce)-1] = 0
+		incNonce(&r.nonce)
+		r.chunk++
+		return len(in) < encChunkSize, &CorruptedChunkError{Chunk: r.chunk - 1}
+	}
 	if err != nil {
 		return false, errors.New("failed to decrypt and authenticate payload chunk")
 	}
 
 	incNonce(&r.nonce)
-	r.unread = r.buf[:copy(r.buf[:], out)]
+	r.chunk++
+	r.unread = out
 	return last, nil
 }
 
+func (r *Reader) readDelimitedChunk() (last bool, err error) {
+	in, err := r.br.Peek(encChunkSize + len(r.next))
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	atEOF := err == io.EOF
+	if len(in) == 0 {
+		return false, io.ErrUnexpectedEOF
+	}
+
+	outBuf := r.plain[:0]
+	open := func(n int, last bool) bool {
+		nonce := r.nonce
+		if last {
+			setLastChunkFlag(&nonce)
+		}
+		out, err := r.a.Open(outBuf, nonce[:], in[:n], nil)
+		if err != nil {
+			return false
+		}
+		r.br.Discard(n)
+		incNonce(&r.nonce)
+		r.unread = out
+		return true
+	}
+
+	if len(in) >= encChunkSize {
+		if open(encChunkSize, false) {
+			return false, nil
+		}
+		if (len(in) == encChunkSize || bytes.HasPrefix(in[encChunkSize:], r.next)) &&
+			open(encChunkSize, true) {
+			return true, nil
+		}
+	}
+	for i := 0; i < len(in) && i < encChunkSize; {
+		j := bytes.Index(in[i:], r.next)
+		if j < 0 {
+			break
+		}
+		i += j
+		if i >= poly1305.TagSize && open(i, true) {
+			return true, nil
+		}
+		i++
+	}
+	if atEOF && len(in) < encChunkSize && open(len(in), true) {
+		return true, nil
+	}
+	return false, errors.New("failed to decrypt and authenticate payload chunk")
+}
+
+// ReaderAt decrypts arbitrary ranges of a message of known size, decrypting
+// only the chunks that overlap each range. It is safe for concurrent use.
+type ReaderAt struct {
+	a      cipher.AEAD
+	src    io.ReaderAt
+	size   int64 // size of the encrypted message
+	chunks int64
+}
+
+// NewReaderAt returns a ReaderAt that decrypts the message of the given size
+// read from src. The last chunk is decrypted right away, which authenticates
+// size, since only the last chunk is marked as such.
+func NewReaderAt(key []byte, src io.ReaderAt, size int64) (*ReaderAt, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	if size < Overhead {
+		return nil, errors.New("stream: message is too short")
+	}
+	chunks := (size + encChunkSize - 1) / encChunkSize
+	if last := size - (chunks-1)*encChunkSize; last < Overhead || last == Overhead && chunks > 1 {
+		return nil, errors.New("stream: message is truncated")
+	}
+	r := &ReaderAt{a: aead, src: src, size: size, chunks: chunks}
+	if _, err := r.chunkAt(chunks - 1); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Size returns the size of the decrypted message.
+func (r *ReaderAt) Size() int64 {
+	return r.size - r.chunks*Overhead
+}
+
+// ReadAt reads the plaintext starting at off, which must be between zero and
+// Size. Like for any io.ReaderAt, reading past the end returns io.EOF.
+func (r *ReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	size := r.Size()
+	if off < 0 {
+		return 0, fmt.Errorf("stream: negative offset %d", off)
+	}
+	if off > size {
+		return 0, fmt.Errorf("stream: offset %d is past the end of the %d bytes plaintext", off, size)
+	}
+	n := 0
+	for n < len(p) && off < size {
+		i := off / ChunkSize
+		chunk, err := r.chunkAt(i)
+		if err != nil {
+			return n, err
+		}
+		nn := copy(p[n:], chunk[off-i*ChunkSize:])
+		n += nn
+		off += int64(nn)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// chunkAt reads and decrypts the chunk with index i.
+func (r *ReaderAt) chunkAt(i int64) ([]byte, error) {
+	off := i * encChunkSize
+	n := int64(encChunkSize)
+	if i == r.chunks-1 {
+		n = r.size - off
+	}
+	in := make([]byte, n)
+	if nn, err := r.src.ReadAt(in, off); nn != len(in) {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	var nonce [chacha20poly1305.NonceSize]byte
+	for j, c := len(nonce)-2, uint64(i); j >= 0 && c > 0; j, c = j-1, c>>8 {
+		nonce[j] = byte(c)
+	}
+	if i == r.chunks-1 {
+		setLastChunkFlag(&nonce)
+	}
+	out, err := r.a.Open(in[:0], nonce[:], in, nil)
+	if err != nil {
+		return nil, &CorruptedChunkError{Chunk: uint64(i)}
+	}
+	return out, nil
+}
+
 func incNonce(nonce *[chacha20poly1305.NonceSize]byte) {
 	for i := len(nonce) - 2; i >= 0; i-- {
 		nonce[i]++
@@ -130,6 +363,12 @@ func setLastChunkFlag(nonce *[chacha20poly1305.NonceSize]byte) {
 	nonce[len(nonce)-1] = lastChunkFlag
 }
 
+// Writer encrypts a stream of plaintext into STREAM chunks.
+//
+// Writer intentionally has no Flush method. The format requires every chunk
+// but the last to be exactly ChunkSize long, since Reader relies on the fixed
+// size to find chunk boundaries, so a partial chunk can only be emitted as the
+// last one, by Close. Writes are buffered until a full chunk is available.
 type Writer struct {
 	a         cipher.AEAD
 	dst       io.Writer
@@ -193,6 +432,22 @@ func (w *Writer) Close() error {
 	return nil
 }
 
+// SealSingleChunk encrypts plaintext, which must be at most ChunkSize long, as
+// a whole message made of a single last chunk, and appends it to dst. The
+// result is the same that Writer would produce, without its buffering.
+func SealSingleChunk(key, dst, plaintext []byte) ([]byte, error) {
+	if len(plaintext) > ChunkSize {
+		return nil, errors.New("stream: plaintext too long for a single chunk")
+	}
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	var nonce [chacha20poly1305.NonceSize]byte
+	setLastChunkFlag(&nonce)
+	return aead.Seal(dst, nonce[:], plaintext, nil), nil
+}
+
 const (
 	lastChunk    = true
 	notLastChunk = false
@@ -10,6 +10,7 @@ import (
 	"bytes"
 	"crypto/rand"
 	"fmt"
+	"io"
 	"testing"
 
 	"filippo.io/age/internal/stream"
@@ -97,3 +98,78 @@ func testRoundTrip(t *testing.T, stepSize, length int) {
 		n += nn
 	}
 }
+
+func TestSealSingleChunk(t *testing.T) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	for _, length := range []int{0, 32, 1000, cs} {
+		src := make([]byte, length)
+		if _, err := rand.Read(src); err != nil {
+			t.Fatal(err)
+		}
+
+		buf := &bytes.Buffer{}
+		w, err := stream.NewWriter(key, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(src); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		out, err := stream.SealSingleChunk(key, []byte("prefix"), src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, append([]byte("prefix"), buf.Bytes()...)) {
+			t.Errorf("len=%d: output differs from Writer", length)
+		}
+	}
+	if _, err := stream.SealSingleChunk(key, nil, make([]byte, cs+1)); err == nil {
+		t.Error("expected error for plaintext longer than a chunk")
+	}
+}
+
+func BenchmarkReader(b *testing.B) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(key); err != nil {
+		b.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	w, err := stream.NewWriter(key, buf)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if _, err := w.Write(make([]byte, 16*cs)); err != nil {
+		b.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		b.Fatal(err)
+	}
+	ciphertext := buf.Bytes()
+
+	out := make([]byte, 16*1024)
+	b.SetBytes(16 * cs)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		r, err := stream.NewReader(key, bytes.NewReader(ciphertext))
+		if err != nil {
+			b.Fatal(err)
+		}
+		for {
+			_, err := r.Read(out)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
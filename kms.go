@@ -0,0 +1,114 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package age
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"filippo.io/age/internal/format"
+)
+
+const kmsStanzaType = extensionPrefix + "kms"
+const kmsLabel = "age-encryption.org/ext/kms"
+
+// A KMSClient encrypts and decrypts small messages with a key held by a key
+// management service, which never exports it.
+//
+// This package only defines the interface. Implementations for specific
+// services are expected to live in other packages.
+type KMSClient interface {
+	// KeyID returns an identifier of the key, such as its name or ARN. It must
+	// be the same for the client used to encrypt and the one used to decrypt.
+	KeyID() string
+
+	// Encrypt encrypts plaintext with the key.
+	Encrypt(plaintext []byte) ([]byte, error)
+
+	// Decrypt decrypts a ciphertext produced by Encrypt.
+	Decrypt(ciphertext []byte) ([]byte, error)
+}
+
+// kmsTag returns a short tag of keyID, so that an identity can recognize its
+// stanzas without the header revealing the key identifier.
+func kmsTag(keyID string) string {
+	h := sha256.Sum256([]byte(kmsLabel + "\x00" + keyID))
+	return format.EncodeToString(h[:4])
+}
+
+// KMSRecipient is a non-standard age recipient that wraps the file key with a
+// key held by a key management service.
+//
+// The file key is encrypted by the service, and stored in an "ext-kms" stanza
+// along with a short tag of the key identifier. Only a KMSIdentity for the same
+// key and with access to the service can decrypt the file, and other age
+// implementations can't.
+type KMSRecipient struct {
+	c KMSClient
+}
+
+var _ Recipient = &KMSRecipient{}
+
+// NewKMSRecipient returns a KMSRecipient that uses c to encrypt file keys.
+func NewKMSRecipient(c KMSClient) *KMSRecipient {
+	return &KMSRecipient{c: c}
+}
+
+func (r *KMSRecipient) Wrap(fileKey []byte) ([]*Stanza, error) {
+	ct, err := r.c.Encrypt(fileKey)
+	if err != nil {
+		return nil, fmt.Errorf("KMS encryption failed: %v", err)
+	}
+	l := &Stanza{
+		Type: kmsStanzaType,
+		Args: []string{kmsTag(r.c.KeyID())},
+		Body: ct,
+	}
+	return []*Stanza{l}, nil
+}
+
+// KMSIdentity is the identity corresponding to a KMSRecipient. It sends the
+// encrypted file key to the key management service to decrypt it, so the key
+// never leaves the service.
+type KMSIdentity struct {
+	c KMSClient
+}
+
+var _ Identity = &KMSIdentity{}
+
+// NewKMSIdentity returns a KMSIdentity that uses c to decrypt file keys.
+func NewKMSIdentity(c KMSClient) *KMSIdentity {
+	return &KMSIdentity{c: c}
+}
+
+// Unwrap implements Identity.Unwrap. Only stanzas tagged with the key
+// identifier of the client are sent to the service, and errors from the
+// service are returned rather than treated as a mismatch.
+func (i *KMSIdentity) Unwrap(stanzas []*Stanza) ([]byte, error) {
+	return multiUnwrap(i.unwrap, stanzas)
+}
+
+func (i *KMSIdentity) unwrap(block *Stanza) ([]byte, error) {
+	if block.Type != kmsStanzaType {
+		return nil, ErrIncorrectIdentity
+	}
+	if len(block.Args) != 1 {
+		return nil, errors.New("invalid ext-kms recipient block")
+	}
+	if block.Args[0] != kmsTag(i.c.KeyID()) {
+		return nil, ErrIncorrectIdentity
+	}
+	fileKey, err := i.c.Decrypt(block.Body)
+	if err != nil {
+		return nil, fmt.Errorf("KMS decryption failed: %v", err)
+	}
+	if len(fileKey) != fileKeySize {
+		return nil, errors.New("invalid ext-kms recipient block: incorrect file key size")
+	}
+	return fileKey, nil
+}
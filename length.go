@@ -0,0 +1,157 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package age
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"filippo.io/age/armor"
+	"filippo.io/age/internal/format"
+	"filippo.io/age/internal/stream"
+)
+
+// ErrLengthMismatch is returned by the Writer returned by EncryptWithLength
+// when the plaintext written to it is not exactly as long as declared.
+var ErrLengthMismatch = errors.New("plaintext length does not match the declared length")
+
+// EncryptWithLength is like Encrypt, but it also returns the exact length of
+// the encrypted file, for a plaintext of plaintextSize bytes. It's meant for
+// serving age files over HTTP with a Content-Length header.
+//
+// Nothing is written to dst until the first Write or Close, so the length can
+// be used before any output, for example to set the header of an
+// http.ResponseWriter. The Writer returns ErrLengthMismatch instead of writing
+// more than plaintextSize bytes of plaintext, and from Close if fewer were
+// written, in which case the output is incomplete. Close also checks that
+// exactly length bytes were written to dst.
+func EncryptWithLength(dst io.Writer, plaintextSize int64, recipients ...Recipient) (length int64, w io.WriteCloser, err error) {
+	return (&Encryptor{}).EncryptWithLength(dst, plaintextSize, recipients...)
+}
+
+// EncryptWithLength is like Encrypt, but it also returns the exact length of
+// the encrypted file. See the package-level EncryptWithLength function for
+// details. Armor and Padding are taken into account.
+func (e *Encryptor) EncryptWithLength(dst io.Writer, plaintextSize int64, recipients ...Recipient) (length int64, w io.WriteCloser, err error) {
+	if plaintextSize < 0 {
+		return 0, nil, errors.New("negative plaintext size")
+	}
+	payloadSize := plaintextSize
+	if e.Padding != nil {
+		payloadSize = e.Padding(plaintextSize)
+		if payloadSize <= plaintextSize {
+			return 0, nil, errors.New("padding function returned a length not greater than the plaintext")
+		}
+	}
+	extensions, err := e.extensionStanzas()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	hdr := &bytes.Buffer{}
+	key, err := e.writeHeader(hdr, recipients, extensions)
+	if err != nil {
+		return 0, nil, err
+	}
+	length = int64(hdr.Len()) + stream.EncryptedSize(payloadSize)
+
+	lw := &lengthWriter{
+		header: hdr.Bytes(),
+		out:    &countingWriter{w: dst},
+		left:   plaintextSize,
+		length: length,
+	}
+	lw.bin = lw.out
+	if e.Armor {
+		lw.armor = armor.NewWriter(lw.out)
+		lw.bin = lw.armor
+		lw.length = armoredSize(length)
+	}
+	sw, err := stream.NewWriter(key, lw.bin)
+	if err != nil {
+		return 0, nil, err
+	}
+	lw.w = sw
+	if e.Padding != nil {
+		lw.w = &padWriter{w: sw, padding: e.Padding}
+	}
+	return lw.length, lw, nil
+}
+
+// armoredSize returns the size of the output of armor.NewWriter for an input
+// of n bytes, without headers.
+func armoredSize(n int64) int64 {
+	encoded := (n + 2) / 3 * 4
+	lines := encoded / format.ColumnsPerLine
+	return int64(len(armor.Header)+1) + encoded + lines + int64(1+len(armor.Footer)+1)
+}
+
+// lengthWriter implements the Writer returned by EncryptWithLength.
+type lengthWriter struct {
+	w      io.WriteCloser // the payload writer, writing to bin
+	bin    io.Writer      // the binary file, either out or armor
+	armor  io.WriteCloser
+	out    *countingWriter
+	header []byte // not yet written to bin
+	left   int64  // plaintext bytes still expected
+	length int64
+}
+
+func (w *lengthWriter) flushHeader() error {
+	if w.header == nil {
+		return nil
+	}
+	_, err := w.bin.Write(w.header)
+	w.header = nil
+	return err
+}
+
+func (w *lengthWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > w.left {
+		return 0, ErrLengthMismatch
+	}
+	if err := w.flushHeader(); err != nil {
+		return 0, err
+	}
+	n, err := w.w.Write(p)
+	w.left -= int64(n)
+	return n, err
+}
+
+func (w *lengthWriter) Close() error {
+	if w.left != 0 {
+		return ErrLengthMismatch
+	}
+	if err := w.flushHeader(); err != nil {
+		return err
+	}
+	if err := w.w.Close(); err != nil {
+		return err
+	}
+	if w.armor != nil {
+		if err := w.armor.Close(); err != nil {
+			return err
+		}
+	}
+	if w.out.n != w.length {
+		return fmt.Errorf("wrote %d bytes instead of the declared length %d", w.out.n, w.length)
+	}
+	return nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,338 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+// Package mdns discovers age recipients advertised by peers on the local
+// network with multicast DNS service discovery (mDNS/DNS-SD, RFC 6762 and RFC
+// 6763), for ad-hoc transfers between nearby machines.
+//
+// A peer advertises a service instance of type "_age._tcp" whose TXT record
+// holds a "recipient=..." entry, for example with
+//
+//	avahi-publish -s "Alice's laptop" _age._tcp 1 recipient=age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p
+//
+// The port of the service is not used.
+//
+// mDNS is not authenticated, so anyone on the local network can advertise
+// their own recipient under any name. Recipients discovered this way should be
+// confirmed out of band, for example by comparing them on both screens.
+package mdns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+)
+
+// ServiceType is the DNS-SD service type browsed by Browse.
+const ServiceType = "_age._tcp"
+
+// A Peer is a service instance advertising an age recipient.
+type Peer struct {
+	// Name is the advertised instance name, like "Alice's laptop".
+	Name string
+
+	// Recipient is the advertised recipient, parsed like in
+	// age.ParseRecipients, so recipient types registered with
+	// age.RegisterRecipientParser are supported.
+	Recipient age.Recipient
+}
+
+var mdnsAddr = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// Browse queries the local network for ServiceType instances until ctx is
+// done, and returns the peers that answered by then, in the order their
+// recipients were received. Use context.WithTimeout to bound it; one or two
+// seconds are usually enough.
+//
+// An error is returned only if the query can't be sent. Responses that are
+// malformed or that don't hold a valid recipient are ignored, and if an
+// instance advertises different recipients, the first one received is kept.
+func Browse(ctx context.Context) ([]Peer, error) {
+	// Queries from a port other than 5353 are "one-shot" queries, answered
+	// with unicast responses to the source port, so there's no need to join
+	// the multicast group, which might be forbidden or already bound.
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open mDNS socket: %v", err)
+	}
+	defer conn.Close()
+	return browse(ctx, conn, mdnsAddr)
+}
+
+// queryInterval is how often Browse repeats its query, in case the first one
+// or its responses were lost.
+const queryInterval = time.Second
+
+func browse(ctx context.Context, conn *net.UDPConn, dst *net.UDPAddr) ([]Peer, error) {
+	service := append(strings.Split(ServiceType, "."), "local")
+	query := buildQuery(service, typePTR)
+	if _, err := conn.WriteToUDP(query, dst); err != nil {
+		return nil, fmt.Errorf("failed to send mDNS query: %v", err)
+	}
+	lastQuery := time.Now()
+
+	var peers []Peer
+	// Instances move from pending, once their PTR record is seen, to done,
+	// once their TXT record is.
+	pending := make(map[string][]string)
+	var order []string
+	done := make(map[string]bool)
+	queried := make(map[string]bool)
+	buf := make([]byte, 9000) // the maximum mDNS message size
+	for {
+		deadline := time.Now().Add(100 * time.Millisecond)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		conn.SetReadDeadline(deadline)
+		n, _, err := conn.ReadFromUDP(buf)
+		if ctx.Err() != nil {
+			return peers, nil
+		}
+		if err != nil {
+			if err, ok := err.(net.Error); ok && err.Timeout() {
+				if time.Since(lastQuery) >= queryInterval {
+					conn.WriteToUDP(query, dst)
+					lastQuery = time.Now()
+				}
+				continue
+			}
+			return peers, nil
+		}
+
+		msg, err := parseMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+		for _, instance := range msg.instances(service) {
+			key := strings.ToLower(strings.Join(instance, "."))
+			if _, ok := pending[key]; ok || done[key] {
+				continue
+			}
+			pending[key] = instance
+			order = append(order, key)
+		}
+		for _, key := range order {
+			instance, ok := pending[key]
+			if !ok {
+				continue
+			}
+			txt, ok := msg.txt[key]
+			if !ok {
+				// Ask for the TXT record, if it wasn't included.
+				if !queried[key] {
+					queried[key] = true
+					conn.WriteToUDP(buildQuery(instance, typeTXT), dst)
+				}
+				continue
+			}
+			delete(pending, key)
+			done[key] = true
+			r, err := recipientFromTXT(txt)
+			if err != nil {
+				continue
+			}
+			peers = append(peers, Peer{Name: instance[0], Recipient: r})
+		}
+	}
+}
+
+func recipientFromTXT(txt []string) (age.Recipient, error) {
+	for _, s := range txt {
+		if !strings.HasPrefix(s, "recipient=") {
+			continue
+		}
+		rr, err := age.ParseRecipients(strings.NewReader(strings.TrimPrefix(s, "recipient=")))
+		if err != nil {
+			return nil, err
+		}
+		if len(rr) != 1 {
+			return nil, errors.New("multiple recipients in TXT entry")
+		}
+		return rr[0], nil
+	}
+	return nil, errors.New("no recipient in TXT record")
+}
+
+const (
+	typePTR = 12
+	typeTXT = 16
+	classIN = 1
+
+	// unicastResponse is the top bit of the question class, asking for a
+	// unicast response. See RFC 6762, Section 5.4.
+	unicastResponse = 1 << 15
+	// cacheFlush is the top bit of the record class. See RFC 6762,
+	// Section 10.2.
+	cacheFlush = 1 << 15
+)
+
+// buildQuery returns a DNS query message for name and qtype.
+func buildQuery(name []string, qtype uint16) []byte {
+	msg := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(msg[4:], 1) // QDCOUNT
+	msg = appendName(msg, name)
+	msg = appendUint16(msg, qtype)
+	msg = appendUint16(msg, classIN|unicastResponse)
+	return msg
+}
+
+func appendName(b []byte, name []string) []byte {
+	for _, label := range name {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+// message holds the PTR and TXT records of a DNS response, from any section.
+// Names are lowercased and joined with dots, without escaping, so they are
+// only suitable as map keys.
+type message struct {
+	ptr map[string][][]string
+	txt map[string][]string
+}
+
+// instances returns the targets of the PTR records for service that are
+// instances of service, that is, have a single label followed by service.
+func (m *message) instances(service []string) [][]string {
+	var out [][]string
+	for _, target := range m.ptr[strings.ToLower(strings.Join(service, "."))] {
+		if len(target) != len(service)+1 {
+			continue
+		}
+		if !strings.EqualFold(strings.Join(target[1:], "."), strings.Join(service, ".")) {
+			continue
+		}
+		out = append(out, target)
+	}
+	return out
+}
+
+var errMalformed = errors.New("malformed DNS message")
+
+func parseMessage(b []byte) (*message, error) {
+	if len(b) < 12 {
+		return nil, errMalformed
+	}
+	if b[2]&0x80 == 0 {
+		return nil, errors.New("not a DNS response")
+	}
+	qdcount := int(binary.BigEndian.Uint16(b[4:]))
+	rrcount := int(binary.BigEndian.Uint16(b[6:])) +
+		int(binary.BigEndian.Uint16(b[8:])) + int(binary.BigEndian.Uint16(b[10:]))
+	off := 12
+	for i := 0; i < qdcount; i++ {
+		_, next, err := readName(b, off)
+		if err != nil {
+			return nil, err
+		}
+		off = next + 4
+		if off > len(b) {
+			return nil, errMalformed
+		}
+	}
+
+	m := &message{ptr: make(map[string][][]string), txt: make(map[string][]string)}
+	for i := 0; i < rrcount; i++ {
+		name, next, err := readName(b, off)
+		if err != nil {
+			return nil, err
+		}
+		off = next
+		if off+10 > len(b) {
+			return nil, errMalformed
+		}
+		rrtype := binary.BigEndian.Uint16(b[off:])
+		class := binary.BigEndian.Uint16(b[off+2:]) &^ cacheFlush
+		rdlength := int(binary.BigEndian.Uint16(b[off+8:]))
+		off += 10
+		if off+rdlength > len(b) {
+			return nil, errMalformed
+		}
+		rdata := b[off : off+rdlength]
+		key := strings.ToLower(strings.Join(name, "."))
+		switch {
+		case class != classIN:
+		case rrtype == typePTR:
+			target, end, err := readName(b, off)
+			if err != nil || end != off+rdlength {
+				return nil, errMalformed
+			}
+			m.ptr[key] = append(m.ptr[key], target)
+		case rrtype == typeTXT:
+			txt, err := readTXT(rdata)
+			if err != nil {
+				return nil, err
+			}
+			m.txt[key] = txt
+		}
+		off += rdlength
+	}
+	return m, nil
+}
+
+// readName reads the possibly compressed name at b[off:], and returns its
+// labels and the offset after it.
+func readName(b []byte, off int) ([]string, int, error) {
+	var labels []string
+	end := -1
+	for hops := 0; ; {
+		if off >= len(b) {
+			return nil, 0, errMalformed
+		}
+		l := int(b[off])
+		switch {
+		case l == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return labels, end, nil
+		case l&0xC0 == 0xC0:
+			if off+1 >= len(b) {
+				return nil, 0, errMalformed
+			}
+			if hops++; hops > 32 {
+				return nil, 0, errMalformed
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(b[off:]) & 0x3FFF)
+		case l&0xC0 != 0:
+			return nil, 0, errMalformed
+		default:
+			if off+1+l > len(b) {
+				return nil, 0, errMalformed
+			}
+			labels = append(labels, string(b[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
+
+func readTXT(rdata []byte) ([]string, error) {
+	var txt []string
+	for len(rdata) > 0 {
+		l := int(rdata[0])
+		if 1+l > len(rdata) {
+			return nil, errMalformed
+		}
+		txt = append(txt, string(rdata[1:1+l]))
+		rdata = rdata[1+l:]
+	}
+	return txt, nil
+}
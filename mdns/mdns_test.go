@@ -0,0 +1,162 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package mdns
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+)
+
+// record is a resource record for buildResponse. If ptr is not nil, it's a
+// PTR record, otherwise a TXT one.
+type record struct {
+	name []string
+	ptr  []string
+	txt  []string
+}
+
+// buildResponse encodes records in the answer section of a response, with
+// names after the first one compressed against the service name.
+func buildResponse(records ...record) []byte {
+	msg := make([]byte, 12)
+	msg[2] = 0x84 // QR and AA
+	binary.BigEndian.PutUint16(msg[6:], uint16(len(records)))
+	service := append(strings.Split(ServiceType, "."), "local")
+	serviceOff := -1
+	appendCompressed := func(b []byte, name []string) []byte {
+		if serviceOff < 0 || len(name) < len(service) ||
+			strings.Join(name[len(name)-len(service):], ".") != strings.Join(service, ".") {
+			if strings.Join(name, ".") == strings.Join(service, ".") {
+				serviceOff = len(b)
+			}
+			return appendName(b, name)
+		}
+		for _, label := range name[:len(name)-len(service)] {
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+		return appendUint16(b, 0xC000|uint16(serviceOff))
+	}
+	for _, r := range records {
+		msg = appendCompressed(msg, r.name)
+		var rdata []byte
+		rrtype := uint16(typeTXT)
+		if r.ptr != nil {
+			rrtype = typePTR
+			rdata = appendName(nil, r.ptr)
+		}
+		for _, s := range r.txt {
+			rdata = append(rdata, byte(len(s)))
+			rdata = append(rdata, s...)
+		}
+		msg = appendUint16(msg, rrtype)
+		msg = appendUint16(msg, classIN|cacheFlush)
+		msg = append(msg, 0, 0, 0x11, 0x94) // TTL
+		msg = appendUint16(msg, uint16(len(rdata)))
+		msg = append(msg, rdata...)
+	}
+	return msg
+}
+
+func TestBrowse(t *testing.T) {
+	alice, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := []string{"_age", "_tcp", "local"}
+	instance := func(name string) []string { return append([]string{name}, service...) }
+
+	responder, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer responder.Close()
+	go func() {
+		buf := make([]byte, 9000)
+		for {
+			n, addr, err := responder.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			q := string(buf[12:n])
+			switch {
+			case strings.Contains(q, "\x03Bob"):
+				// Bob's TXT record is only sent when asked for.
+				responder.WriteToUDP(buildResponse(
+					record{name: instance("Bob"), txt: []string{"txtvers=1", "recipient=" + bob.Recipient().String()}},
+				), addr)
+			default:
+				responder.WriteToUDP([]byte("garbage"), addr)
+				responder.WriteToUDP(buildResponse(
+					record{name: service, ptr: instance("Alice's laptop")},
+					record{name: service, ptr: instance("Bob")},
+					record{name: service, ptr: instance("Mallory")},
+					record{name: service, ptr: []string{"Eve", "_other", "_tcp", "local"}},
+					record{name: instance("Alice's laptop"), txt: []string{"recipient=" + alice.Recipient().String()}},
+					record{name: instance("Mallory"), txt: []string{"recipient=age1nope"}},
+				), addr)
+			}
+		}
+	}()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	peers, err := browse(ctx, conn, responder.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Errorf("browse didn't respect the context deadline")
+	}
+
+	var got []string
+	for _, p := range peers {
+		got = append(got, fmt.Sprintf("%s=%v", p.Name, p.Recipient))
+	}
+	want := []string{
+		"Alice's laptop=" + alice.Recipient().String(),
+		"Bob=" + bob.Recipient().String(),
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got peers %q, want %q", got, want)
+	}
+}
+
+func TestParseMessageMalformed(t *testing.T) {
+	valid := buildResponse(record{name: []string{"_age", "_tcp", "local"}, ptr: []string{"a", "_age", "_tcp", "local"}})
+	for i := 0; i < len(valid); i++ {
+		if _, err := parseMessage(valid[:i]); err == nil {
+			t.Errorf("truncated message of %d bytes was accepted", i)
+		}
+	}
+
+	// A compression pointer to itself must not loop forever.
+	loop := make([]byte, 12)
+	loop[2] = 0x80
+	binary.BigEndian.PutUint16(loop[6:], 1)
+	loop = append(loop, 0xC0, 12)
+	if _, err := parseMessage(loop); err == nil {
+		t.Error("compression loop was accepted")
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+//go:build go1.20
+// +build go1.20
+
+package age
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	"filippo.io/age/internal/bech32"
+	"filippo.io/age/internal/format"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// The P-256 recipient uses the "piv-p256" stanza of age-plugin-yubikey, so
+// files encrypted to it can be decrypted with that plugin, or with any other
+// implementation of the stanza. The stanza is
+//
+//	-> piv-p256 <4-byte SHA-256 tag of the public key> <ephemeral share>
+//	<wrapped file key>
+//
+// where the public key and the ephemeral share are compressed P-256 points,
+// and the file key is wrapped with ChaCha20-Poly1305 and a key derived with
+// HKDF-SHA-256 from the ECDH shared secret, with the ephemeral share and the
+// public key as salt.
+const (
+	p256Label        = "piv-p256"
+	p256StanzaType   = "piv-p256"
+	p256RecipientHRP = "age1yubikey"
+	p256TagSize      = 4
+)
+
+func init() {
+	RegisterRecipientParser(p256RecipientHRP+"1", func(s string) (Recipient, error) {
+		return ParseP256Recipient(s)
+	})
+}
+
+// P256Recipient is a P-256 public key, typically held in a PIV slot of a
+// smartcard like a YubiKey, that can't be extracted. This package can only
+// encrypt to it: decrypting requires the smartcard, usually through
+// age-plugin-yubikey, or a custom Identity that performs the ECDH on it.
+type P256Recipient struct {
+	key *ecdh.PublicKey
+	// compressed is the compressed encoding of key.
+	compressed []byte
+}
+
+var _ Recipient = &P256Recipient{}
+
+// RecipientFromP256PublicKey returns a P256Recipient for pub, which must be a
+// P-256 public key, for example one read from a PIV slot.
+func RecipientFromP256PublicKey(pub *ecdsa.PublicKey) (*P256Recipient, error) {
+	if pub == nil || pub.Curve != elliptic.P256() {
+		return nil, errors.New("not a P-256 public key")
+	}
+	k, err := pub.ECDH()
+	if err != nil {
+		return nil, fmt.Errorf("invalid P-256 public key: %v", err)
+	}
+	return &P256Recipient{
+		key:        k,
+		compressed: elliptic.MarshalCompressed(pub.Curve, pub.X, pub.Y),
+	}, nil
+}
+
+// ParseP256Recipient returns a new P256Recipient from a Bech32 public key
+// encoding with the "age1yubikey1" prefix, as printed by age-plugin-yubikey.
+func ParseP256Recipient(s string) (*P256Recipient, error) {
+	t, k, err := bech32.Decode(s)
+	if err != nil {
+		return nil, fmt.Errorf("malformed recipient %q: %v", s, err)
+	}
+	if t != p256RecipientHRP {
+		return nil, fmt.Errorf("malformed recipient %q: invalid type %q", s, t)
+	}
+	x, y := elliptic.UnmarshalCompressed(elliptic.P256(), k)
+	if x == nil {
+		return nil, fmt.Errorf("malformed recipient %q: invalid P-256 point", s)
+	}
+	return RecipientFromP256PublicKey(&ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y})
+}
+
+func (r *P256Recipient) Wrap(fileKey []byte) ([]*Stanza, error) {
+	ephemeral, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	sharedSecret, err := ephemeral.ECDH(r.key)
+	if err != nil {
+		return nil, err
+	}
+	share := p256Compress(ephemeral.PublicKey())
+
+	salt := make([]byte, 0, len(share)+len(r.compressed))
+	salt = append(salt, share...)
+	salt = append(salt, r.compressed...)
+	h := hkdf.New(sha256.New, sharedSecret, salt, []byte(p256Label))
+	wrappingKey := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(h, wrappingKey); err != nil {
+		return nil, err
+	}
+	wrappedKey, err := aeadEncrypt(wrappingKey, fileKey)
+	if err != nil {
+		return nil, err
+	}
+
+	tag := sha256.Sum256(r.compressed)
+	l := &Stanza{
+		Type: p256StanzaType,
+		Args: []string{format.EncodeToString(tag[:p256TagSize]), format.EncodeToString(share)},
+		Body: wrappedKey,
+	}
+	return []*Stanza{l}, nil
+}
+
+// String returns the Bech32 public key encoding of r.
+func (r *P256Recipient) String() string {
+	s, _ := bech32.Encode(p256RecipientHRP, r.compressed)
+	return s
+}
+
+// p256Compress returns the compressed encoding of k.
+func p256Compress(k *ecdh.PublicKey) []byte {
+	b := k.Bytes() // uncompressed: 0x04 || X || Y
+	out := make([]byte, 1, 33)
+	out[0] = 0x02 | b[len(b)-1]&1
+	return append(out, b[1:33]...)
+}
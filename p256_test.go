@@ -0,0 +1,117 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+//go:build go1.20
+// +build go1.20
+
+package age_test
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// pivIdentity implements the piv-p256 stanza with a software key, standing in
+// for a smartcard.
+type pivIdentity struct {
+	key *ecdsa.PrivateKey
+}
+
+func (i *pivIdentity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	pub := elliptic.MarshalCompressed(elliptic.P256(), i.key.X, i.key.Y)
+	tag := sha256.Sum256(pub)
+	for _, s := range stanzas {
+		if s.Type != "piv-p256" || len(s.Args) != 2 || s.Args[0] != base64.RawStdEncoding.EncodeToString(tag[:4]) {
+			continue
+		}
+		share, err := base64.RawStdEncoding.DecodeString(s.Args[1])
+		if err != nil {
+			return nil, err
+		}
+		x, y := elliptic.UnmarshalCompressed(elliptic.P256(), share)
+		if x == nil {
+			return nil, errors.New("invalid share")
+		}
+		k, err := i.key.ECDH()
+		if err != nil {
+			return nil, err
+		}
+		sharePub, err := ecdh.P256().NewPublicKey(elliptic.Marshal(elliptic.P256(), x, y))
+		if err != nil {
+			return nil, err
+		}
+		secret, err := k.ECDH(sharePub)
+		if err != nil {
+			return nil, err
+		}
+		h := hkdf.New(sha256.New, secret, append(share, pub...), []byte("piv-p256"))
+		key := make([]byte, chacha20poly1305.KeySize)
+		if _, err := io.ReadFull(h, key); err != nil {
+			return nil, err
+		}
+		aead, err := chacha20poly1305.New(key)
+		if err != nil {
+			return nil, err
+		}
+		return aead.Open(nil, make([]byte, aead.NonceSize()), s.Body, nil)
+	}
+	return nil, age.ErrIncorrectIdentity
+}
+
+func TestP256Recipient(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := age.RecipientFromP256PublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(r.String(), "age1yubikey1") {
+		t.Errorf("unexpected encoding %q", r)
+	}
+	rr, err := age.ParseRecipients(strings.NewReader(r.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rr) != 1 || rr[0].(*age.P256Recipient).String() != r.String() {
+		t.Errorf("recipient did not round-trip through parsing")
+	}
+
+	file, err := age.EncryptBytes([]byte(helloWorld), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := age.Decrypt(bytes.NewReader(file), &pivIdentity{key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadAll(out); err != nil || string(got) != helloWorld {
+		t.Errorf("got %q, %v", got, err)
+	}
+
+	other, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := age.RecipientFromP256PublicKey(&other.PublicKey); err == nil {
+		t.Error("expected an error for a P-384 key")
+	}
+}
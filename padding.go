@@ -0,0 +1,164 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package age
+
+import (
+	"errors"
+	"io"
+
+	"filippo.io/age/internal/format"
+)
+
+// Padded files carry an empty "ext-padding" stanza. Their plaintext is
+// followed, inside the encrypted and authenticated payload, by a 0x80 byte and
+// as many zero bytes as needed to reach the padded length, like in ISO/IEC
+// 7816-4. Other age implementations will decrypt padded files, but will not
+// strip the padding.
+const paddingStanzaType = extensionPrefix + "padding"
+
+func hasPaddingStanza(hdr *format.Header) bool {
+	for _, s := range hdr.Recipients {
+		if s.Type == paddingStanzaType {
+			return true
+		}
+	}
+	return false
+}
+
+// PadToPowerOfTwo is a padding function for Encryptor.Padding that pads the
+// plaintext to the next power of two. It hides all but the order of magnitude
+// of the plaintext length, at the cost of up to doubling it.
+func PadToPowerOfTwo(length int64) int64 {
+	padded := int64(1)
+	for padded <= length {
+		padded <<= 1
+	}
+	return padded
+}
+
+// PadToMultipleOf returns a padding function for Encryptor.Padding that pads
+// the plaintext to the next multiple of n, which must be positive.
+func PadToMultipleOf(n int64) func(length int64) int64 {
+	if n <= 0 {
+		panic("age: PadToMultipleOf called with non-positive value")
+	}
+	return func(length int64) int64 {
+		return (length/n + 1) * n
+	}
+}
+
+type padWriter struct {
+	w       io.WriteCloser
+	padding func(int64) int64
+	n       int64
+}
+
+func (p *padWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.n += int64(n)
+	return n, err
+}
+
+func (p *padWriter) Close() error {
+	padded := p.padding(p.n)
+	if padded <= p.n {
+		return errors.New("padding function returned a length not greater than the plaintext")
+	}
+	if _, err := p.w.Write([]byte{0x80}); err != nil {
+		return err
+	}
+	zeroes := make([]byte, 4096)
+	for left := padded - p.n - 1; left > 0; {
+		b := zeroes
+		if left < int64(len(b)) {
+			b = b[:left]
+		}
+		if _, err := p.w.Write(b); err != nil {
+			return err
+		}
+		left -= int64(len(b))
+	}
+	return p.w.Close()
+}
+
+// unpadReader strips the padding from a padded plaintext. It holds back a
+// 0x80 byte and the run of zeroes following it until either another byte shows
+// they were part of the plaintext, or EOF shows they were the padding. It only
+// counts the held back zeroes, so it uses constant memory.
+type unpadReader struct {
+	r      io.Reader
+	buf    [4096]byte
+	unread []byte // read from r but not processed yet, backed by buf
+	err    error
+
+	// marker is true if a 0x80 byte followed by zeroes bytes is held back.
+	marker bool
+	zeroes int64
+
+	// flushMarker and flushZeroes are held back bytes that turned out to be
+	// plaintext, and must be returned before processing unread.
+	flushMarker bool
+	flushZeroes int64
+}
+
+func (u *unpadReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if u.flushMarker {
+			p[n] = 0x80
+			n++
+			u.flushMarker = false
+			continue
+		}
+		if u.flushZeroes > 0 {
+			for u.flushZeroes > 0 && n < len(p) {
+				p[n] = 0
+				n++
+				u.flushZeroes--
+			}
+			continue
+		}
+
+		if len(u.unread) == 0 {
+			if u.err != nil || n > 0 {
+				// Don't block on a read if there is something to return.
+				break
+			}
+			m, err := u.r.Read(u.buf[:])
+			u.unread = u.buf[:m]
+			u.err = err
+			continue
+		}
+
+		c := u.unread[0]
+		switch {
+		case u.marker && c == 0:
+			u.zeroes++
+		case c == 0x80:
+			u.flushMarker, u.flushZeroes = u.marker, u.zeroes
+			u.marker, u.zeroes = true, 0
+		case u.marker:
+			// Return the held back bytes first, and then c, which is left
+			// unconsumed for now.
+			u.flushMarker, u.flushZeroes = true, u.zeroes
+			u.marker, u.zeroes = false, 0
+			continue
+		default:
+			p[n] = c
+			n++
+		}
+		u.unread = u.unread[1:]
+	}
+	if n > 0 {
+		return n, nil
+	}
+	if u.err == io.EOF && !u.marker {
+		u.err = errors.New("invalid padding")
+	}
+	// If a marker is held back at EOF, it and the zeroes are the padding.
+	return 0, u.err
+}
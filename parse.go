@@ -8,72 +8,263 @@ package age
 
 import (
 	"bufio"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"os"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
+var (
+	parsersMu        sync.RWMutex
+	recipientParsers = map[string]func(string) (Recipient, error){
+		"age1": func(s string) (Recipient, error) { return ParseX25519Recipient(s) },
+	}
+	identityParsers = map[string]func(string) (Identity, error){
+		"AGE-SECRET-KEY-1": func(s string) (Identity, error) { return ParseX25519Identity(s) },
+	}
+)
+
+// RegisterRecipientParser makes a recipient encoding available to
+// ParseRecipients. Lines starting with prefix will be passed to parse. If more
+// than one registered prefix matches a line, the longest one is used.
+//
+// It is meant to be called from the init function of packages implementing a
+// Recipient type. It panics if a parser is already registered for prefix.
+func RegisterRecipientParser(prefix string, parse func(string) (Recipient, error)) {
+	parsersMu.Lock()
+	defer parsersMu.Unlock()
+	if prefix == "" || parse == nil {
+		panic("age: RegisterRecipientParser called with empty prefix or nil function")
+	}
+	if _, dup := recipientParsers[prefix]; dup {
+		panic("age: RegisterRecipientParser called twice for prefix " + prefix)
+	}
+	recipientParsers[prefix] = parse
+}
+
+// RegisterIdentityParser makes an identity encoding available to
+// ParseIdentities. Lines starting with prefix will be passed to parse. If more
+// than one registered prefix matches a line, the longest one is used.
+//
+// It is meant to be called from the init function of packages implementing an
+// Identity type. It panics if a parser is already registered for prefix.
+func RegisterIdentityParser(prefix string, parse func(string) (Identity, error)) {
+	parsersMu.Lock()
+	defer parsersMu.Unlock()
+	if prefix == "" || parse == nil {
+		panic("age: RegisterIdentityParser called with empty prefix or nil function")
+	}
+	if _, dup := identityParsers[prefix]; dup {
+		panic("age: RegisterIdentityParser called twice for prefix " + prefix)
+	}
+	identityParsers[prefix] = parse
+}
+
+func lookupRecipientParser(line string) func(string) (Recipient, error) {
+	parsersMu.RLock()
+	defer parsersMu.RUnlock()
+	var match string
+	for prefix := range recipientParsers {
+		if strings.HasPrefix(line, prefix) && len(prefix) > len(match) {
+			match = prefix
+		}
+	}
+	return recipientParsers[match]
+}
+
+func lookupIdentityParser(line string) func(string) (Identity, error) {
+	parsersMu.RLock()
+	defer parsersMu.RUnlock()
+	var match string
+	for prefix := range identityParsers {
+		if strings.HasPrefix(line, prefix) && len(prefix) > len(match) {
+			match = prefix
+		}
+	}
+	return identityParsers[match]
+}
+
 // ParseIdentities parses a file with one or more private key encodings, one per
-// line. Empty lines and lines starting with "#" are ignored.
+// line. Empty lines and lines starting with "#" are ignored. Lines can end in
+// LF or CRLF.
 //
 // This is the same syntax as the private key files accepted by the CLI, except
 // the CLI also accepts SSH private keys, which are not recommended for the
 // average application.
 //
-// Currently, all returned values are of type *X25519Identity, but different
-// types might be returned in the future.
+// By default only X25519 identities are recognized, returned as values of type
+// *X25519Identity. Other encodings can be added with RegisterIdentityParser.
 func ParseIdentities(f io.Reader) ([]Identity, error) {
+	return parseIdentities(f, false)
+}
+
+// ParseIdentitiesFD parses an identities file, in the format of
+// ParseIdentities, from the already open file descriptor fd, and then closes
+// it.
+//
+// This allows receiving identities on an inherited file descriptor other than
+// standard input, for example when invoked as "tool 3<key.txt", so that
+// standard input remains available for the ciphertext and the identities never
+// need to be written to disk. On most Unix systems, the CLI equivalent is
+// "age -d -i /dev/fd/3".
+//
+// If fd is a regular file that other users can read, a warning is sent to the
+// Logger, see SetLogger, or an error is returned in strict mode, see SetStrict.
+func ParseIdentitiesFD(fd uintptr) ([]Identity, error) {
+	f := os.NewFile(fd, fmt.Sprintf("/dev/fd/%d", fd))
+	if f == nil {
+		return nil, fmt.Errorf("invalid file descriptor %d", fd)
+	}
+	defer f.Close()
+	if err := warnIfWorldReadable(f, f.Name()); err != nil {
+		return nil, err
+	}
+	return ParseIdentities(f)
+}
+
+// ParseIdentitiesStrict is like ParseIdentities, but it rejects any identity
+// that is not in its canonical encoding, as returned by its String method.
+// Identities that don't implement fmt.Stringer are rejected.
+//
+// The X25519 parser already only accepts the canonical uppercase encoding,
+// so this mostly matters for types added with RegisterIdentityParser.
+func ParseIdentitiesStrict(f io.Reader) ([]Identity, error) {
+	return parseIdentities(f, true)
+}
+
+func parseIdentities(f io.Reader, strict bool) ([]Identity, error) {
+	ids, errs := parseIdentitiesAll(f, strict, nil)
+	if len(errs) > 0 {
+		return nil, &errs[0]
+	}
+	return ids, nil
+}
+
+// A LineError is an error in a specific line of an identities file, returned
+// by ParseIdentitiesAll.
+type LineError struct {
+	// Line is the 1-based number of the offending line, or zero if the error
+	// is about the file as a whole.
+	Line int
+	// Content is the offending line. It is likely to contain secret key
+	// material, so it's not included in the output of Error.
+	Content string
+	Err     error
+}
+
+func (e *LineError) Error() string {
+	if e.Line == 0 {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("error at line %d: %v", e.Line, e.Err)
+}
+
+func (e *LineError) Unwrap() error { return e.Err }
+
+// ParseIdentitiesAll is like ParseIdentities, but instead of stopping at the
+// first malformed line, it returns all the identities that could be parsed
+// along with an error for every line that couldn't. This is useful to report
+// all the problems with a file at once.
+//
+// The returned identities should not be used if there are any errors.
+func ParseIdentitiesAll(f io.Reader) ([]Identity, []LineError) {
+	return parseIdentitiesAll(f, false, nil)
+}
+
+// parseIdentitiesAll implements ParseIdentitiesAll. If resolver is not nil,
+// lines that look like secret references are resolved with it.
+func parseIdentitiesAll(f io.Reader, strict bool, resolver SecretRefResolver) ([]Identity, []LineError) {
 	const privateKeySizeLimit = 1 << 24 // 16 MiB
 	var ids []Identity
-	scanner := bufio.NewScanner(io.LimitReader(f, privateKeySizeLimit))
-	var n int
+	var errs []LineError
+	scanner := newKeyFileScanner(f, privateKeySizeLimit)
 	for scanner.Scan() {
-		n++
-		line := scanner.Text()
-		if strings.HasPrefix(line, "#") || line == "" {
+		n, line := scanner.Line()
+		parse := lookupIdentityParser(line)
+		if parse == nil && resolver != nil && isSecretRef(line) {
+			rr, err := resolveSecretRef(resolver, line, strict)
+			if err != nil {
+				errs = append(errs, LineError{n, line, err})
+				continue
+			}
+			ids = append(ids, rr...)
 			continue
 		}
-		i, err := ParseX25519Identity(line)
+		if parse == nil {
+			errs = append(errs, LineError{n, line, errors.New("unknown identity type")})
+			continue
+		}
+		i, err := parse(line)
 		if err != nil {
-			return nil, fmt.Errorf("error at line %d: %v", n, err)
+			errs = append(errs, LineError{n, line, err})
+			continue
+		}
+		if strict && !isCanonical(i, line) {
+			errs = append(errs, LineError{n, line, errors.New("non-canonical encoding")})
+			continue
 		}
 		ids = append(ids, i)
 	}
 	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("failed to read secret keys file: %v", err)
+		errs = append(errs, LineError{Err: fmt.Errorf("failed to read secret keys file: %v", err)})
 	}
-	if len(ids) == 0 {
-		return nil, fmt.Errorf("no secret keys found")
+	if len(ids) == 0 && len(errs) == 0 {
+		errs = append(errs, LineError{Err: errors.New("no secret keys found")})
 	}
-	return ids, nil
+	return ids, errs
 }
 
 // ParseRecipients parses a file with one or more public key encodings, one per
-// line. Empty lines and lines starting with "#" are ignored.
+// line. Empty lines and lines starting with "#" are ignored. Lines can end in
+// LF or CRLF.
 //
 // This is the same syntax as the recipients files accepted by the CLI, except
 // the CLI also accepts SSH recipients, which are not recommended for the
 // average application.
 //
-// Currently, all returned values are of type *X25519Recipient, but different
-// types might be returned in the future.
+// By default only X25519 recipients are recognized, returned as values of type
+// *X25519Recipient. Other encodings can be added with RegisterRecipientParser.
+// For example, importing filippo.io/age/agessh registers SSH public keys.
 func ParseRecipients(f io.Reader) ([]Recipient, error) {
+	return parseRecipients(f, false)
+}
+
+// ParseRecipientsStrict is like ParseRecipients, but it rejects any recipient
+// that is not in its canonical encoding, as returned by its String method.
+// Recipients that don't implement fmt.Stringer are rejected.
+//
+// Use it when the string form of a recipient is used as an identifier, and
+// must have a single representation. The X25519 parser already only accepts
+// the canonical lowercase encoding, so this mostly matters for types added with
+// RegisterRecipientParser.
+func ParseRecipientsStrict(f io.Reader) ([]Recipient, error) {
+	return parseRecipients(f, true)
+}
+
+func parseRecipients(f io.Reader, strict bool) ([]Recipient, error) {
 	const recipientFileSizeLimit = 1 << 24 // 16 MiB
 	var recs []Recipient
-	scanner := bufio.NewScanner(io.LimitReader(f, recipientFileSizeLimit))
-	var n int
+	scanner := newKeyFileScanner(f, recipientFileSizeLimit)
 	for scanner.Scan() {
-		n++
-		line := scanner.Text()
-		if strings.HasPrefix(line, "#") || line == "" {
-			continue
+		n, line := scanner.Line()
+		parse := lookupRecipientParser(line)
+		if parse == nil {
+			return nil, fmt.Errorf("unknown recipient type at line %d", n)
 		}
-		r, err := ParseX25519Recipient(line)
+		r, err := parse(line)
 		if err != nil {
 			// Hide the error since it might unintentionally leak the contents
 			// of confidential files.
 			return nil, fmt.Errorf("malformed recipient at line %d", n)
 		}
+		if strict && !isCanonical(r, line) {
+			return nil, fmt.Errorf("non-canonical recipient at line %d", n)
+		}
 		recs = append(recs, r)
 	}
 	if err := scanner.Err(); err != nil {
@@ -84,3 +275,469 @@ func ParseRecipients(f io.Reader) ([]Recipient, error) {
 	}
 	return recs, nil
 }
+
+// ParseKeyFile parses a file that mixes identities and recipients, one per
+// line, in the formats of ParseIdentities and ParseRecipients, and returns
+// them separately. Empty lines and lines starting with "#" are ignored. Lines
+// can end in LF or CRLF.
+//
+// Each line is classified by its prefix, trying the recipient parsers first
+// like RecipientsFrom does, so that a file can hold one's own secret keys
+// together with the public keys of others. Errors are *LineError values, which don't include the contents
+// of the line in their message. An error is returned if the file contains
+// neither identities nor recipients.
+func ParseKeyFile(f io.Reader) (identities []Identity, recipients []Recipient, err error) {
+	const keyFileSizeLimit = 1 << 24 // 16 MiB
+	scanner := newKeyFileScanner(f, keyFileSizeLimit)
+	for scanner.Scan() {
+		n, line := scanner.Line()
+		parseRecipient, parseIdentity := lookupKeyParser(line)
+		if parseRecipient != nil {
+			r, err := parseRecipient(line)
+			if err != nil {
+				return nil, nil, &LineError{n, line, errors.New("malformed recipient")}
+			}
+			recipients = append(recipients, r)
+			continue
+		}
+		if parseIdentity != nil {
+			i, err := parseIdentity(line)
+			if err != nil {
+				return nil, nil, &LineError{n, line, err}
+			}
+			identities = append(identities, i)
+			continue
+		}
+		return nil, nil, &LineError{n, line, errors.New("unknown identity or recipient type")}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("failed to read keys file: %v", err)
+	}
+	if len(identities) == 0 && len(recipients) == 0 {
+		return nil, nil, errors.New("no identities or recipients found")
+	}
+	return identities, recipients, nil
+}
+
+// ParseRecipientsJSON parses a JSON array of recipient strings, in any of the
+// encodings accepted by ParseRecipients, such as
+//
+//	["age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p"]
+//
+// so that recipients lists can be kept in structured configuration files. If
+// an entry is invalid, the error includes its index.
+func ParseRecipientsJSON(f io.Reader) ([]Recipient, error) {
+	var list []string
+	if err := json.NewDecoder(f).Decode(&list); err != nil {
+		return nil, fmt.Errorf("failed to parse JSON recipients list: %v", err)
+	}
+	recs, err := parseRecipientsList(list)
+	if err != nil {
+		return nil, err
+	}
+	if len(recs) == 0 {
+		return nil, fmt.Errorf("no recipients found")
+	}
+	return recs, nil
+}
+
+// ParseRecipientGroupsJSON parses a JSON object mapping group names to arrays
+// of recipient strings, as accepted by ParseRecipientsJSON, such as
+//
+//	{"ops": ["age1...", "age1..."], "backup": ["age1..."]}
+//
+// and returns the recipients of each group. If an entry is invalid, the error
+// includes its group name and index. Groups can be empty.
+func ParseRecipientGroupsJSON(f io.Reader) (map[string][]Recipient, error) {
+	var groups map[string][]string
+	if err := json.NewDecoder(f).Decode(&groups); err != nil {
+		return nil, fmt.Errorf("failed to parse JSON recipient groups: %v", err)
+	}
+	res := make(map[string][]Recipient, len(groups))
+	for name, list := range groups {
+		recs, err := parseRecipientsList(list)
+		if err != nil {
+			return nil, fmt.Errorf("group %q: %v", name, err)
+		}
+		res[name] = recs
+	}
+	return res, nil
+}
+
+func parseRecipientsList(list []string) ([]Recipient, error) {
+	var recs []Recipient
+	for i, s := range list {
+		parse := lookupRecipientParser(s)
+		if parse == nil {
+			return nil, fmt.Errorf("unknown recipient type at index %d", i)
+		}
+		r, err := parse(s)
+		if err != nil {
+			return nil, fmt.Errorf("malformed recipient at index %d", i)
+		}
+		recs = append(recs, r)
+	}
+	return recs, nil
+}
+
+// utf8BOM is the UTF-8 encoding of U+FEFF, which some editors add at the start
+// of text files. It is ignored at the start of key and recipients files.
+const utf8BOM = "\ufeff"
+
+// keyFileScanner reads the lines of a key, recipients, or aliases file, up to
+// a size limit. It drops a leading BOM and the trailing CR of CRLF-terminated
+// lines, and skips empty lines and lines starting with "#".
+type keyFileScanner struct {
+	s    *bufio.Scanner
+	n    int
+	line string
+}
+
+func newKeyFileScanner(f io.Reader, limit int64) *keyFileScanner {
+	// bufio.ScanLines drops the trailing CR of CRLF-terminated lines, which
+	// are common in files edited on Windows.
+	return &keyFileScanner{s: bufio.NewScanner(io.LimitReader(f, limit))}
+}
+
+// Scan advances to the next line that is not empty or a comment.
+func (s *keyFileScanner) Scan() bool {
+	for s.s.Scan() {
+		s.n++
+		line := s.s.Text()
+		if s.n == 1 {
+			line = strings.TrimPrefix(line, utf8BOM)
+		}
+		if strings.HasPrefix(line, "#") || line == "" {
+			continue
+		}
+		s.line = line
+		return true
+	}
+	return false
+}
+
+// Line returns the current line and its 1-based number in the file.
+func (s *keyFileScanner) Line() (int, string) {
+	return s.n, s.line
+}
+
+func (s *keyFileScanner) Err() error {
+	return s.s.Err()
+}
+
+// lookupKeyParser classifies a line of a file that can mix recipients and
+// identities. Recipient parsers take precedence, so at most one of the
+// returned functions is not nil.
+func lookupKeyParser(line string) (func(string) (Recipient, error), func(string) (Identity, error)) {
+	if parse := lookupRecipientParser(line); parse != nil {
+		return parse, nil
+	}
+	return nil, lookupIdentityParser(line)
+}
+
+func isCanonical(v interface{}, s string) bool {
+	str, ok := v.(fmt.Stringer)
+	return ok && str.String() == s
+}
+
+// RecipientsFrom reads the files at paths, each listing recipients and/or
+// identities one per line, in the formats accepted by ParseRecipients and
+// ParseIdentities, and returns all the recipients they contain.
+//
+// Identities are replaced by their corresponding recipient, so that a file can
+// be encrypted to the holders of identity files without converting them first.
+// Only identities with a Recipient method, like X25519Identity, are supported.
+// Duplicate recipients are removed, keeping the first occurrence.
+func RecipientsFrom(paths ...string) ([]Recipient, error) {
+	var recs []Recipient
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		rr, err := recipientsFromFile(path, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range rr {
+			if s, ok := r.(fmt.Stringer); ok {
+				if seen[s.String()] {
+					continue
+				}
+				seen[s.String()] = true
+			}
+			recs = append(recs, r)
+		}
+	}
+	if len(recs) == 0 {
+		return nil, fmt.Errorf("no recipients found")
+	}
+	return recs, nil
+}
+
+// RecipientSpec lists the sources of recipients for ResolveRecipients.
+//
+// SSH public keys are accepted wherever recipients are, if the
+// filippo.io/age/agessh package is imported.
+type RecipientSpec struct {
+	// Recipients are recipient strings, like "age1...".
+	Recipients []string
+
+	// RecipientFiles are paths of files in the format of RecipientsFrom,
+	// which can also list identities.
+	RecipientFiles []string
+
+	// IdentityFiles are paths of files in the format of ParseIdentities,
+	// whose identities are replaced by their corresponding recipient. Files
+	// that other users can read cause a warning, see SetLogger, or an error
+	// in strict mode, see SetStrict.
+	IdentityFiles []string
+
+	// Resolver, if not nil, resolves entries of Recipients and lines of
+	// RecipientFiles of the form "@name", like "@alice", for example with
+	// the aliases returned by ParseRecipientAliases. Without a Resolver,
+	// those entries are errors.
+	Resolver RecipientResolver
+}
+
+// ResolveRecipients parses all the sources in spec, and returns the recipients
+// they contain, with duplicates removed, as well as an error for each source
+// that couldn't be used. Each error mentions the source it's about.
+//
+// The recipients are returned even if some sources failed, so the caller can
+// choose whether to proceed. If no source fails but no recipients are found,
+// a single error is returned.
+func ResolveRecipients(spec RecipientSpec) ([]Recipient, []error) {
+	var recs []Recipient
+	var errs []error
+	seen := make(map[string]bool)
+	add := func(rr ...Recipient) {
+		for _, r := range rr {
+			if s, ok := r.(fmt.Stringer); ok {
+				if seen[s.String()] {
+					continue
+				}
+				seen[s.String()] = true
+			}
+			recs = append(recs, r)
+		}
+	}
+
+	for _, arg := range spec.Recipients {
+		if strings.HasPrefix(arg, "@") {
+			r, err := resolveAlias(spec.Resolver, arg)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			add(r)
+			continue
+		}
+		parse := lookupRecipientParser(arg)
+		if parse == nil {
+			errs = append(errs, fmt.Errorf("unknown recipient type: %q", arg))
+			continue
+		}
+		r, err := parse(arg)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("malformed recipient %q: %v", arg, err))
+			continue
+		}
+		add(r)
+	}
+	for _, path := range spec.RecipientFiles {
+		rr, err := recipientsFromFile(path, spec.Resolver)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if len(rr) == 0 {
+			errs = append(errs, fmt.Errorf("%q: no recipients found", path))
+			continue
+		}
+		add(rr...)
+	}
+	for _, path := range spec.IdentityFiles {
+		rr, err := recipientsFromIdentityFile(path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		add(rr...)
+	}
+
+	if len(recs) == 0 && len(errs) == 0 {
+		errs = append(errs, errors.New("no recipients found"))
+	}
+	return recs, errs
+}
+
+// ValidateRecipientCount returns an error if recipients has fewer than min
+// distinct recipients, for example to make sure critical backups are not
+// encrypted to a single key by mistake.
+//
+// Like in ResolveRecipients, recipients are compared by their String method,
+// and those that don't implement fmt.Stringer are all counted as distinct.
+func ValidateRecipientCount(recipients []Recipient, min int) error {
+	n := 0
+	seen := make(map[string]bool)
+	for _, r := range recipients {
+		if s, ok := r.(fmt.Stringer); ok {
+			if seen[s.String()] {
+				continue
+			}
+			seen[s.String()] = true
+		}
+		n++
+	}
+	if n < min {
+		return fmt.Errorf("not enough recipients: got %d distinct, need at least %d", n, min)
+	}
+	return nil
+}
+
+func recipientsFromIdentityFile(path string) ([]Recipient, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %q: %v", path, err)
+	}
+	defer f.Close()
+	if err := warnIfWorldReadable(f, path); err != nil {
+		return nil, fmt.Errorf("failed to read %q: %v", path, err)
+	}
+	ids, err := ParseIdentities(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %q: %v", path, err)
+	}
+	var recs []Recipient
+	for _, i := range ids {
+		r, err := identityToRecipient(i)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v", path, err)
+		}
+		recs = append(recs, r)
+	}
+	return recs, nil
+}
+
+// recipientsFromFile reads the file at path in the format of RecipientsFrom.
+// If resolver is not nil, lines of the form "@name" are resolved with it.
+func recipientsFromFile(path string, resolver RecipientResolver) ([]Recipient, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %q: %v", path, err)
+	}
+	defer f.Close()
+
+	const fileSizeLimit = 1 << 24 // 16 MiB
+	var recs []Recipient
+	scanner := newKeyFileScanner(f, fileSizeLimit)
+	for scanner.Scan() {
+		n, line := scanner.Line()
+		if strings.HasPrefix(line, "@") && resolver != nil {
+			r, err := resolver.ResolveRecipient(line[1:])
+			if err != nil {
+				return nil, fmt.Errorf("%q: line %d: %v", path, n, err)
+			}
+			recs = append(recs, r)
+			continue
+		}
+		parseRecipient, parseIdentity := lookupKeyParser(line)
+		if parseRecipient != nil {
+			r, err := parseRecipient(line)
+			if err != nil {
+				return nil, fmt.Errorf("%q: malformed recipient at line %d", path, n)
+			}
+			recs = append(recs, r)
+			continue
+		}
+		if parseIdentity != nil {
+			i, err := parseIdentity(line)
+			if err != nil {
+				// Hide the error since it is about a secret key.
+				return nil, fmt.Errorf("%q: malformed identity at line %d", path, n)
+			}
+			r, err := identityToRecipient(i)
+			if err != nil {
+				return nil, fmt.Errorf("%q: line %d: %v", path, n, err)
+			}
+			recs = append(recs, r)
+			continue
+		}
+		return nil, fmt.Errorf("%q: unknown recipient or identity type at line %d", path, n)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %q: %v", path, err)
+	}
+	return recs, nil
+}
+
+// ConvertIdentitiesToRecipients parses an identities file from r, in the format
+// of ParseIdentities, and writes the corresponding recipients to w, one per
+// line, with no comments. It returns the number of recipients written.
+//
+// This is the library equivalent of "age-keygen -y". Only X25519 identities
+// are supported.
+func ConvertIdentitiesToRecipients(r io.Reader, w io.Writer) (int, error) {
+	ids, err := ParseIdentities(r)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse input: %v", err)
+	}
+	for n, id := range ids {
+		x, ok := id.(*X25519Identity)
+		if !ok {
+			return n, fmt.Errorf("unexpected identity type: %T", id)
+		}
+		if _, err := fmt.Fprintf(w, "%s\n", x.Recipient()); err != nil {
+			return n, err
+		}
+	}
+	return len(ids), nil
+}
+
+// WriteIdentityFile writes id to w in the format of the identity files
+// generated by age-keygen: a "# created:" comment, a "# public key:" comment,
+// the extra comments sorted by key, and finally the secret key.
+//
+// The creation time is the current local time in RFC 3339 format, unless
+// comments has a "created" entry. Comment keys can't be empty or contain colons,
+// and neither keys nor values can contain newlines.
+func WriteIdentityFile(w io.Writer, id *X25519Identity, comments map[string]string) error {
+	created := time.Now().Format(time.RFC3339)
+	var keys []string
+	for k, v := range comments {
+		if k == "" || strings.ContainsAny(k, ":\r\n") || strings.ContainsAny(v, "\r\n") {
+			return fmt.Errorf("invalid comment %q: %q", k, v)
+		}
+		switch k {
+		case "created":
+			created = v
+		case "public key":
+			return errors.New(`the "public key" comment can't be overridden`)
+		default:
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "# created: %s\n", created)
+	fmt.Fprintf(b, "# public key: %s\n", id.Recipient())
+	for _, k := range keys {
+		fmt.Fprintf(b, "# %s: %s\n", k, comments[k])
+	}
+	fmt.Fprintf(b, "%s\n", id)
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// identityToRecipient returns the Recipient corresponding to i, if i has a
+// Recipient method.
+func identityToRecipient(i Identity) (Recipient, error) {
+	switch i := i.(type) {
+	case *X25519Identity:
+		return i.Recipient(), nil
+	case interface{ Recipient() Recipient }:
+		return i.Recipient(), nil
+	case interface{ Recipient() (Recipient, error) }:
+		return i.Recipient()
+	}
+	return nil, fmt.Errorf("can't derive a recipient from identity of type %T", i)
+}
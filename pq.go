@@ -0,0 +1,282 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+//go:build go1.24
+// +build go1.24
+
+package age
+
+import (
+	"crypto/mlkem"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	"filippo.io/age/internal/bech32"
+	"filippo.io/age/internal/format"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// The hybrid post-quantum recipient is EXPERIMENTAL. Its stanza type, key
+// encodings, and key derivation are specific to this module, and might change
+// incompatibly. Other age implementations can't decrypt files encrypted to it.
+//
+// The file key is wrapped with a key derived with HKDF-SHA-256 from both an
+// ML-KEM-768 shared secret and an X25519 shared secret, so it stays secure as
+// long as either of the two holds. The stanza is
+//
+//	-> mlkem768x25519-exp <X25519 ephemeral share>
+//	<ML-KEM-768 ciphertext || wrapped file key>
+const (
+	hybridPQLabel        = "age-encryption.org/experimental/mlkem768x25519"
+	hybridPQStanzaType   = "mlkem768x25519-exp"
+	hybridPQRecipientHRP = "agepq"
+	hybridPQIdentityHRP  = "AGE-SECRET-KEY-PQ-"
+)
+
+func init() {
+	experimentalStanzaTypes = append(experimentalStanzaTypes, hybridPQStanzaType)
+	RegisterRecipientParser(hybridPQRecipientHRP+"1", func(s string) (Recipient, error) {
+		return ParseHybridPQRecipient(s)
+	})
+	RegisterIdentityParser(hybridPQIdentityHRP+"1", func(s string) (Identity, error) {
+		return ParseHybridPQIdentity(s)
+	})
+}
+
+// HybridPQRecipient is an EXPERIMENTAL post-quantum public key, combining
+// ML-KEM-768 and X25519. Messages encrypted to this recipient can be decrypted
+// with the corresponding HybridPQIdentity.
+//
+// It returns the "postquantum" label from WrapWithLabels, so it can't be mixed
+// in the same file with classical recipients like X25519Recipient, which would
+// defeat its purpose.
+type HybridPQRecipient struct {
+	mlkemKey  *mlkem.EncapsulationKey768
+	x25519Key []byte
+}
+
+var _ RecipientWithLabels = &HybridPQRecipient{}
+
+// NewHybridPQRecipient returns a new HybridPQRecipient from an encoded
+// ML-KEM-768 encapsulation key and a raw Curve25519 point.
+func NewHybridPQRecipient(mlkemKey, x25519Key []byte) (*HybridPQRecipient, error) {
+	ek, err := mlkem.NewEncapsulationKey768(mlkemKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ML-KEM-768 public key: %v", err)
+	}
+	if len(x25519Key) != curve25519.PointSize {
+		return nil, errors.New("invalid X25519 public key")
+	}
+	r := &HybridPQRecipient{
+		mlkemKey:  ek,
+		x25519Key: make([]byte, curve25519.PointSize),
+	}
+	copy(r.x25519Key, x25519Key)
+	return r, nil
+}
+
+// ParseHybridPQRecipient returns a new HybridPQRecipient from a Bech32 public
+// key encoding with the "agepq1" prefix. The encoding is longer than the
+// 90 characters allowed by BIP 173.
+func ParseHybridPQRecipient(s string) (*HybridPQRecipient, error) {
+	t, k, err := bech32.DecodeLong(s)
+	if err != nil {
+		return nil, fmt.Errorf("malformed recipient %q: %v", s, err)
+	}
+	if t != hybridPQRecipientHRP {
+		return nil, fmt.Errorf("malformed recipient %q: invalid type %q", s, t)
+	}
+	if len(k) != mlkem.EncapsulationKeySize768+curve25519.PointSize {
+		return nil, fmt.Errorf("malformed recipient %q: invalid length", s)
+	}
+	r, err := NewHybridPQRecipient(k[:mlkem.EncapsulationKeySize768], k[mlkem.EncapsulationKeySize768:])
+	if err != nil {
+		return nil, fmt.Errorf("malformed recipient %q: %v", s, err)
+	}
+	return r, nil
+}
+
+func (r *HybridPQRecipient) Wrap(fileKey []byte) ([]*Stanza, error) {
+	ephemeral := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(ephemeral); err != nil {
+		return nil, err
+	}
+	ourPublicKey, err := curve25519.X25519(ephemeral, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	x25519Secret, err := curve25519.X25519(ephemeral, r.x25519Key)
+	if err != nil {
+		return nil, err
+	}
+	mlkemSecret, ciphertext := r.mlkemKey.Encapsulate()
+
+	wrappingKey, err := hybridPQWrappingKey(mlkemSecret, x25519Secret, ciphertext, ourPublicKey, r.x25519Key)
+	if err != nil {
+		return nil, err
+	}
+	wrappedKey, err := aeadEncrypt(wrappingKey, fileKey)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Stanza{
+		Type: hybridPQStanzaType,
+		Args: []string{format.EncodeToString(ourPublicKey)},
+		Body: append(ciphertext, wrappedKey...),
+	}
+	return []*Stanza{l}, nil
+}
+
+// WrapWithLabels implements RecipientWithLabels, returning the "postquantum"
+// label.
+func (r *HybridPQRecipient) WrapWithLabels(fileKey []byte) ([]*Stanza, []string, error) {
+	s, err := r.Wrap(fileKey)
+	return s, []string{"postquantum"}, err
+}
+
+// String returns the Bech32 public key encoding of r.
+func (r *HybridPQRecipient) String() string {
+	k := append(r.mlkemKey.Bytes(), r.x25519Key...)
+	s, _ := bech32.EncodeLong(hybridPQRecipientHRP, k)
+	return s
+}
+
+// hybridPQWrappingKey derives the key that wraps the file key from both shared
+// secrets, binding the ML-KEM ciphertext and both X25519 public keys.
+func hybridPQWrappingKey(mlkemSecret, x25519Secret, ciphertext, share, theirPublicKey []byte) ([]byte, error) {
+	ikm := make([]byte, 0, len(mlkemSecret)+len(x25519Secret))
+	ikm = append(ikm, mlkemSecret...)
+	ikm = append(ikm, x25519Secret...)
+	salt := make([]byte, 0, len(ciphertext)+len(share)+len(theirPublicKey))
+	salt = append(salt, ciphertext...)
+	salt = append(salt, share...)
+	salt = append(salt, theirPublicKey...)
+	h := hkdf.New(sha256.New, ikm, salt, []byte(hybridPQLabel))
+	wrappingKey := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(h, wrappingKey); err != nil {
+		return nil, err
+	}
+	return wrappingKey, nil
+}
+
+// HybridPQIdentity is the EXPERIMENTAL secret key corresponding to a
+// HybridPQRecipient.
+type HybridPQIdentity struct {
+	mlkemKey     *mlkem.DecapsulationKey768
+	x25519Key    []byte
+	ourPublicKey []byte
+}
+
+var _ Identity = &HybridPQIdentity{}
+
+// GenerateHybridPQIdentity randomly generates a new HybridPQIdentity.
+func GenerateHybridPQIdentity() (*HybridPQIdentity, error) {
+	seed := make([]byte, mlkem.SeedSize+curve25519.ScalarSize)
+	if _, err := rand.Read(seed); err != nil {
+		return nil, fmt.Errorf("internal error: %v", err)
+	}
+	return newHybridPQIdentity(seed)
+}
+
+func newHybridPQIdentity(seed []byte) (*HybridPQIdentity, error) {
+	if len(seed) != mlkem.SeedSize+curve25519.ScalarSize {
+		return nil, errors.New("invalid hybrid post-quantum secret key")
+	}
+	dk, err := mlkem.NewDecapsulationKey768(seed[:mlkem.SeedSize])
+	if err != nil {
+		return nil, err
+	}
+	i := &HybridPQIdentity{
+		mlkemKey:  dk,
+		x25519Key: make([]byte, curve25519.ScalarSize),
+	}
+	copy(i.x25519Key, seed[mlkem.SeedSize:])
+	i.ourPublicKey, err = curve25519.X25519(i.x25519Key, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+// ParseHybridPQIdentity returns a new HybridPQIdentity from a Bech32 secret key
+// encoding with the "AGE-SECRET-KEY-PQ-1" prefix.
+func ParseHybridPQIdentity(s string) (*HybridPQIdentity, error) {
+	t, k, err := bech32.DecodeLong(s)
+	if err != nil {
+		return nil, fmt.Errorf("malformed secret key: %v", err)
+	}
+	if t != hybridPQIdentityHRP {
+		return nil, fmt.Errorf("malformed secret key: unknown type %q", t)
+	}
+	i, err := newHybridPQIdentity(k)
+	if err != nil {
+		return nil, fmt.Errorf("malformed secret key: %v", err)
+	}
+	return i, nil
+}
+
+func (i *HybridPQIdentity) Unwrap(stanzas []*Stanza) ([]byte, error) {
+	return multiUnwrap(i.unwrap, stanzas)
+}
+
+func (i *HybridPQIdentity) unwrap(block *Stanza) ([]byte, error) {
+	if block.Type != hybridPQStanzaType {
+		return nil, ErrIncorrectIdentity
+	}
+	if len(block.Args) != 1 {
+		return nil, errors.New("invalid hybrid post-quantum recipient block")
+	}
+	share, err := format.DecodeString(block.Args[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse hybrid post-quantum recipient: %v", err)
+	}
+	if len(share) != curve25519.PointSize || len(block.Body) < mlkem.CiphertextSize768 {
+		return nil, errors.New("invalid hybrid post-quantum recipient block")
+	}
+	ciphertext, wrappedKey := block.Body[:mlkem.CiphertextSize768], block.Body[mlkem.CiphertextSize768:]
+
+	x25519Secret, err := curve25519.X25519(i.x25519Key, share)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hybrid post-quantum recipient: %v", err)
+	}
+	mlkemSecret, err := i.mlkemKey.Decapsulate(ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hybrid post-quantum recipient: %v", err)
+	}
+
+	wrappingKey, err := hybridPQWrappingKey(mlkemSecret, x25519Secret, ciphertext, share, i.ourPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	fileKey, err := aeadDecrypt(wrappingKey, fileKeySize, wrappedKey)
+	if err == errIncorrectCiphertextSize {
+		return nil, errors.New("invalid hybrid post-quantum recipient block: incorrect file key size")
+	} else if err != nil {
+		return nil, ErrIncorrectIdentity
+	}
+	return fileKey, nil
+}
+
+// Recipient returns the public HybridPQRecipient value corresponding to i.
+func (i *HybridPQIdentity) Recipient() *HybridPQRecipient {
+	return &HybridPQRecipient{
+		mlkemKey:  i.mlkemKey.EncapsulationKey(),
+		x25519Key: i.ourPublicKey,
+	}
+}
+
+// String returns the Bech32 secret key encoding of i.
+func (i *HybridPQIdentity) String() string {
+	k := append(i.mlkemKey.Bytes(), i.x25519Key...)
+	s, _ := bech32.EncodeLong(hybridPQIdentityHRP, k)
+	return s
+}
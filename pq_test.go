@@ -0,0 +1,96 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+//go:build go1.24
+// +build go1.24
+
+package age_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+)
+
+func TestHybridPQ(t *testing.T) {
+	i, err := age.GenerateHybridPQIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := age.ParseIdentities(strings.NewReader(i.String() + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0].(*age.HybridPQIdentity).String() != i.String() {
+		t.Errorf("identity didn't round-trip")
+	}
+	recs, err := age.ParseRecipients(strings.NewReader(i.Recipient().String() + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 1 || recs[0].(*age.HybridPQRecipient).String() != i.Recipient().String() {
+		t.Errorf("recipient didn't round-trip")
+	}
+	if !strings.HasPrefix(i.String(), "AGE-SECRET-KEY-PQ-1") || !strings.HasPrefix(i.Recipient().String(), "agepq1") {
+		t.Errorf("unexpected encodings: %s, %s", i, i.Recipient())
+	}
+
+	file, err := age.EncryptBytes([]byte(helloWorld), recs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := age.Inspect(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(info.StanzaTypes, " "); got != "mlkem768x25519-exp" {
+		t.Errorf("got stanza types %q", got)
+	}
+	r, err := age.Decrypt(bytes.NewReader(file), ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := ioutil.ReadAll(r); err != nil {
+		t.Fatal(err)
+	} else if string(out) != helloWorld {
+		t.Errorf("wrong data: %q, excepted %q", out, helloWorld)
+	}
+
+	other, err := age.GenerateHybridPQIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := age.Decrypt(bytes.NewReader(file), other); err == nil {
+		t.Error("file was decrypted with the wrong identity")
+	}
+
+	x, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := age.EncryptBytes([]byte(helloWorld), i.Recipient(), x.Recipient()); err == nil {
+		t.Error("hybrid recipient was mixed with a classical one")
+	}
+}
+
+func TestConvertHybridPQIdentity(t *testing.T) {
+	pq, err := age.GenerateHybridPQIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := privateKey + "\n" + pq.String()
+	n, err := age.ConvertIdentitiesToRecipients(strings.NewReader(in), ioutil.Discard)
+	if err == nil {
+		t.Fatal("expected an error for a hybrid identity")
+	}
+	if n != 1 || !strings.Contains(err.Error(), "*age.HybridPQIdentity") {
+		t.Errorf("got %d recipients and unexpected error: %v", n, err)
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package age
+
+import (
+	"errors"
+	"io"
+
+	"filippo.io/age/internal/format"
+)
+
+// A PreparedEncryptor encrypts files to a fixed set of recipients, with the
+// settings of the Encryptor that created it. It's meant for services that
+// encrypt many files to the same recipients: they are parsed once, and checked
+// once by Prepare together with the settings, so that each file only pays for
+// generating and wrapping its own file key.
+//
+// A PreparedEncryptor is safe for concurrent use if its recipients are.
+type PreparedEncryptor struct {
+	e          Encryptor
+	recipients []Recipient
+	extensions []*format.Stanza
+}
+
+// Prepare returns a PreparedEncryptor that encrypts to recipients. Later
+// changes to e don't affect it.
+func (e *Encryptor) Prepare(recipients ...Recipient) (*PreparedEncryptor, error) {
+	if len(recipients) == 0 {
+		return nil, &NoRecipientsError{}
+	}
+	if err := checkWriteOnly(recipients, e.WriteOnlyIdentities); err != nil {
+		return nil, err
+	}
+	extensions, err := e.extensionStanzas()
+	if err != nil {
+		return nil, err
+	}
+	if e.Compat != "" {
+		if err := checkCompat(e.Compat, extensions); err != nil {
+			return nil, err
+		}
+	}
+	for _, r := range recipients {
+		switch r.(type) {
+		case *ScryptRecipient, *MultiPassphraseRecipient:
+			if len(recipients) != 1 || len(extensions) != 0 {
+				return nil, errors.New("an scrypt recipient must be the only one")
+			}
+		}
+	}
+	return &PreparedEncryptor{
+		e:          *e,
+		recipients: append([]Recipient{}, recipients...),
+		extensions: extensions,
+	}, nil
+}
+
+// Encrypt encrypts a file to the recipients of p. See Encryptor.Encrypt.
+func (p *PreparedEncryptor) Encrypt(dst io.Writer) (io.WriteCloser, error) {
+	return p.e.encrypt(dst, p.recipients, p.extensions)
+}
+
+// EncryptBytes encrypts plaintext to the recipients of p, and returns the
+// whole age file. See Encryptor.EncryptBytes.
+func (p *PreparedEncryptor) EncryptBytes(plaintext []byte) ([]byte, error) {
+	return p.e.encryptBytes(plaintext, p.recipients, p.extensions)
+}
@@ -7,6 +7,7 @@
 package age
 
 import (
+	"bytes"
 	"crypto/hmac"
 	"crypto/sha256"
 	"errors"
@@ -52,16 +53,32 @@ func aeadDecrypt(key []byte, size int, ciphertext []byte) ([]byte, error) {
 }
 
 func headerMAC(fileKey []byte, hdr *format.Header) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := hdr.MarshalWithoutMAC(buf); err != nil {
+		return nil, err
+	}
+	return HeaderMAC(fileKey, buf.Bytes()), nil
+}
+
+// HeaderMAC returns the MAC of an age header computed with fileKey, as
+// specified by the age format: HMAC-SHA-256 keyed with HKDF-SHA-256(ikm =
+// fileKey, salt = empty, info = "header").
+//
+// headerBytes must be the header up to and including the "---" of the last
+// line, excluding the space and the encoded MAC that follow it.
+//
+// This is a low-level function for building and checking custom headers in
+// tests and experiments. Applications should use Encrypt and Decrypt, which
+// compute and verify the MAC.
+func HeaderMAC(fileKey, headerBytes []byte) []byte {
 	h := hkdf.New(sha256.New, fileKey, nil, []byte("header"))
 	hmacKey := make([]byte, 32)
 	if _, err := io.ReadFull(h, hmacKey); err != nil {
-		return nil, err
+		panic("age: internal error: failed to read from HKDF: " + err.Error())
 	}
 	hh := hmac.New(sha256.New, hmacKey)
-	if err := hdr.MarshalWithoutMAC(hh); err != nil {
-		return nil, err
-	}
-	return hh.Sum(nil), nil
+	hh.Write(headerBytes)
+	return hh.Sum(nil)
 }
 
 func streamKey(fileKey, nonce []byte) []byte {
@@ -0,0 +1,89 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package age
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ProcessOptions are the options of Process.
+type ProcessOptions struct {
+	// Decrypt selects decryption instead of encryption.
+	Decrypt bool
+
+	// Recipients are the recipients to encrypt to. They must be empty when
+	// decrypting.
+	Recipients []Recipient
+
+	// Identities are the identities to decrypt with. They must be empty when
+	// encrypting.
+	Identities []Identity
+
+	// Armor makes the encrypted output ASCII armored. It can't be used when
+	// decrypting, since armored input is detected automatically.
+	Armor bool
+
+	// RequireArmor and RequireBinary restrict the accepted input when
+	// decrypting. At most one can be set, and neither can be used when
+	// encrypting.
+	RequireArmor, RequireBinary bool
+}
+
+// Process reads src and writes to dst its encryption, or its decryption if
+// opts.Decrypt is set, like the age CLI does. It's a high-level entry point
+// for tools that don't need the streaming API.
+//
+// When decrypting, ASCII armored input is detected automatically, unless
+// restricted by opts.RequireArmor or opts.RequireBinary. Options that don't
+// apply to the selected operation cause an error before anything is read.
+func Process(dst io.Writer, src io.Reader, opts ProcessOptions) error {
+	if !opts.Decrypt {
+		switch {
+		case len(opts.Identities) > 0:
+			return errors.New("identities can't be used when encrypting")
+		case opts.RequireArmor || opts.RequireBinary:
+			return errors.New("input restrictions can't be used when encrypting")
+		}
+		w, err := (&Encryptor{Armor: opts.Armor}).Encrypt(dst, opts.Recipients...)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, src); err != nil {
+			return err
+		}
+		return w.Close()
+	}
+
+	switch {
+	case len(opts.Recipients) > 0:
+		return errors.New("recipients can't be used when decrypting")
+	case opts.Armor:
+		return errors.New("armor can't be used when decrypting: armored input is detected automatically")
+	case opts.RequireArmor && opts.RequireBinary:
+		return errors.New("armored and binary input can't both be required")
+	}
+
+	in, armored, err := detectArmor(src)
+	switch {
+	case err != nil:
+		return err
+	case armored && opts.RequireBinary:
+		return errors.New("input is ASCII armored, but binary input is required")
+	case !armored && opts.RequireArmor:
+		return ErrNotArmored
+	}
+	r, err := Decrypt(in, opts.Identities...)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, r); err != nil {
+		return fmt.Errorf("failed to decrypt payload: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package age
+
+import (
+	"io"
+
+	"filippo.io/age/internal/stream"
+)
+
+// DefaultProgressInterval is the interval used by ProgressReader and
+// ProgressWriter if none is specified. It is the size of the chunks the
+// payload is encrypted in, so on the plaintext side progress is reported once
+// per chunk.
+const DefaultProgressInterval = stream.ChunkSize
+
+// progress calls report every time the total crosses a multiple of interval.
+type progress struct {
+	interval int64
+	report   func(total int64)
+	total    int64
+	reported int64
+}
+
+func newProgress(interval int64, report func(int64)) progress {
+	if interval <= 0 {
+		interval = DefaultProgressInterval
+	}
+	return progress{interval: interval, report: report}
+}
+
+func (p *progress) add(n int) {
+	p.total += int64(n)
+	if p.total/p.interval > p.reported/p.interval {
+		p.reported = p.total
+		p.report(p.total)
+	}
+}
+
+func (p *progress) done() {
+	if p.reported != p.total {
+		p.reported = p.total
+		p.report(p.total)
+	}
+}
+
+// A ProgressReader reports how many bytes were read through it, for example to
+// show a progress bar while decrypting a large file. It can wrap either the
+// ciphertext or the plaintext side of Decrypt.
+type ProgressReader struct {
+	r io.Reader
+	p progress
+}
+
+// NewProgressReader returns a ProgressReader that reads from r, and calls
+// report with the total number of bytes read so far every time it crosses a
+// multiple of interval, and once more when r returns io.EOF. If interval is
+// zero or negative, DefaultProgressInterval is used.
+//
+// report is called synchronously from Read, so it should be fast.
+func NewProgressReader(r io.Reader, interval int64, report func(total int64)) *ProgressReader {
+	return &ProgressReader{r: r, p: newProgress(interval, report)}
+}
+
+func (r *ProgressReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.p.add(n)
+	if err == io.EOF {
+		r.p.done()
+	}
+	return n, err
+}
+
+// A ProgressWriter reports how many bytes were written through it, for example
+// to show a progress bar while encrypting a large file. It can wrap either the
+// ciphertext or the plaintext side of Encrypt.
+type ProgressWriter struct {
+	w io.Writer
+	p progress
+}
+
+// NewProgressWriter returns a ProgressWriter that writes to w, and calls
+// report with the total number of bytes written so far every time it crosses a
+// multiple of interval, and once more on Close. If interval is zero or
+// negative, DefaultProgressInterval is used.
+//
+// report is called synchronously from Write, so it should be fast.
+func NewProgressWriter(w io.Writer, interval int64, report func(total int64)) *ProgressWriter {
+	return &ProgressWriter{w: w, p: newProgress(interval, report)}
+}
+
+func (w *ProgressWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.p.add(n)
+	return n, err
+}
+
+// Close reports the final total, and closes the underlying Writer if it is an
+// io.Closer, like the one returned by Encrypt.
+func (w *ProgressWriter) Close() error {
+	w.p.done()
+	if c, ok := w.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
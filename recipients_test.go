@@ -8,10 +8,15 @@ package age_test
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
 	"testing"
 
 	"filippo.io/age"
+	"filippo.io/age/internal/bech32"
 )
 
 func TestX25519RoundTrip(t *testing.T) {
@@ -82,3 +87,307 @@ func TestScryptRoundTrip(t *testing.T) {
 		t.Errorf("invalid output: %x, expected %x", out, fileKey)
 	}
 }
+
+func TestX25519RecipientFromWireGuard(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, k, err := bech32.Decode(i.Recipient().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := age.X25519RecipientFromWireGuard(base64.StdEncoding.EncodeToString(k))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.String() != i.Recipient().String() {
+		t.Errorf("got recipient %q, want %q", r, i.Recipient())
+	}
+
+	for name, key := range map[string]string{
+		"short":     base64.StdEncoding.EncodeToString(k[:31]),
+		"unpadded":  base64.RawStdEncoding.EncodeToString(k),
+		"zero":      base64.StdEncoding.EncodeToString(make([]byte, 32)),
+		"low order": "4Ot6fDtBuK4WVuP68Z/EatoJjeucMrH9hmIFFl9JuAA=",
+	} {
+		if _, err := age.X25519RecipientFromWireGuard(key); err == nil {
+			t.Errorf("%s: expected error for key %q", name, key)
+		}
+	}
+}
+
+type labeledRecipient struct {
+	r      age.Recipient
+	labels []string
+}
+
+func (r *labeledRecipient) Wrap(fileKey []byte) ([]*age.Stanza, error) {
+	panic("Wrap called on a RecipientWithLabels")
+}
+
+func (r *labeledRecipient) WrapWithLabels(fileKey []byte) ([]*age.Stanza, []string, error) {
+	s, err := r.r.Wrap(fileKey)
+	return s, r.labels, err
+}
+
+func TestLabels(t *testing.T) {
+	a, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pq := func(i *age.X25519Identity, labels ...string) age.Recipient {
+		return &labeledRecipient{i.Recipient(), labels}
+	}
+	scrypt, err := age.NewScryptRecipient("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	scrypt.SetWorkFactor(10)
+
+	tests := []struct {
+		name       string
+		recipients []age.Recipient
+		wantErr    bool
+	}{
+		{"no labels", []age.Recipient{a.Recipient(), b.Recipient()}, false},
+		{"same labels", []age.Recipient{pq(a, "postquantum"), pq(b, "postquantum")}, false},
+		{"same labels, different order", []age.Recipient{pq(a, "x", "y"), pq(b, "y", "x")}, false},
+		{"empty labels", []age.Recipient{pq(a), b.Recipient()}, false},
+		{"different labels", []age.Recipient{pq(a, "postquantum"), pq(b, "other")}, true},
+		{"labels and no labels", []age.Recipient{pq(a, "postquantum"), b.Recipient()}, true},
+		{"no labels and labels", []age.Recipient{a.Recipient(), b.Recipient(), pq(b, "postquantum")}, true},
+		{"scrypt alone", []age.Recipient{scrypt}, false},
+		{"scrypt with labels", []age.Recipient{scrypt, pq(a)}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			w, err := age.Encrypt(buf, tt.recipients...)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if tt.name == "scrypt alone" {
+				return
+			}
+			if _, err := age.Decrypt(buf, b, a); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestX25519Mnemonic(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := age.X25519IdentityToMnemonic(i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(strings.Fields(m)); n != 24 {
+		t.Errorf("got %d words, want 24", n)
+	}
+	i1, err := age.X25519IdentityFromMnemonic(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i1.String() != i.String() {
+		t.Errorf("round trip changed the identity: %v != %v", i1, i)
+	}
+
+	zero := strings.Repeat("abandon ", 23) + "art"
+	if _, err := age.X25519IdentityFromMnemonic(zero); err != nil {
+		t.Errorf("rejected a valid mnemonic: %v", err)
+	}
+	if _, err := age.X25519IdentityFromMnemonic(strings.Repeat("abandon ", 24)); err == nil {
+		t.Error("accepted a mnemonic with an invalid checksum")
+	}
+	short := "abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about"
+	if _, err := age.X25519IdentityFromMnemonic(short); err == nil {
+		t.Error("accepted a 12 words mnemonic")
+	}
+}
+
+func TestSplitIdentity(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	shares, err := age.SplitIdentity(i, 3, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shares) != 5 {
+		t.Fatalf("got %d shares, want 5", len(shares))
+	}
+
+	var parsed []age.Share
+	for _, s := range shares {
+		if !strings.HasPrefix(s.String(), "AGE-SHARE-1") {
+			t.Errorf("unexpected share encoding %q", s)
+		}
+		p, err := age.ParseShare(s.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed = append(parsed, p)
+	}
+
+	got, err := age.CombineIdentity([]age.Share{parsed[4], parsed[0], parsed[2]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != i.String() {
+		t.Errorf("reconstructed a different identity")
+	}
+
+	if _, err := age.CombineIdentity(parsed[:2]); err == nil {
+		t.Error("reconstructed with fewer shares than the threshold")
+	}
+	other, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherShares, err := age.SplitIdentity(other, 3, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := age.CombineIdentity([]age.Share{parsed[0], parsed[1], otherShares[2]}); err == nil {
+		t.Error("combined shares of different identities")
+	}
+}
+
+// fakeKMS "encrypts" by XORing with a fixed key, and can be made to fail.
+type fakeKMS struct {
+	id   string
+	key  [16]byte
+	fail bool
+}
+
+func (k *fakeKMS) KeyID() string { return k.id }
+
+func (k *fakeKMS) Encrypt(plaintext []byte) ([]byte, error) {
+	return k.Decrypt(plaintext)
+}
+
+func (k *fakeKMS) Decrypt(ciphertext []byte) ([]byte, error) {
+	if k.fail {
+		return nil, errors.New("service unavailable")
+	}
+	out := make([]byte, len(ciphertext))
+	for i := range out {
+		out[i] = ciphertext[i] ^ k.key[i%len(k.key)]
+	}
+	return out, nil
+}
+
+func TestKMSRoundTrip(t *testing.T) {
+	kms := &fakeKMS{id: "projects/p/keys/age"}
+	if _, err := rand.Read(kms.key[:]); err != nil {
+		t.Fatal(err)
+	}
+	r := age.NewKMSRecipient(kms)
+	i := age.NewKMSIdentity(kms)
+
+	fileKey := make([]byte, 16)
+	if _, err := rand.Read(fileKey); err != nil {
+		t.Fatal(err)
+	}
+	stanzas, err := r.Wrap(fileKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(stanzas[0].Args[0], "projects") {
+		t.Errorf("stanza reveals the key identifier: %v", stanzas[0].Args)
+	}
+
+	out, err := i.Unwrap(stanzas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fileKey, out) {
+		t.Errorf("invalid output: %x, expected %x", out, fileKey)
+	}
+
+	other := age.NewKMSIdentity(&fakeKMS{id: "projects/p/keys/other"})
+	if _, err := other.Unwrap(stanzas); !errors.Is(err, age.ErrIncorrectIdentity) {
+		t.Errorf("expected ErrIncorrectIdentity for a different key, got %v", err)
+	}
+
+	kms.fail = true
+	if _, err := i.Unwrap(stanzas); err == nil || errors.Is(err, age.ErrIncorrectIdentity) {
+		t.Errorf("expected the service error to be returned, got %v", err)
+	}
+}
+
+// fakeDirectory maps base DNs and filters to attribute values.
+type fakeDirectory map[string][]string
+
+func (d fakeDirectory) Search(ctx context.Context, baseDN, filter, attribute string) ([]string, error) {
+	if attribute != age.DirectoryAttribute {
+		return nil, errors.New("unexpected attribute")
+	}
+	values, ok := d[baseDN+filter]
+	if !ok {
+		return nil, errors.New("no such object")
+	}
+	return values, nil
+}
+
+func TestRecipientsFromDirectory(t *testing.T) {
+	a, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := fakeDirectory{
+		"uid=alice,ou=people,dc=example,dc=com": {a.Recipient().String(), " " + a.Recipient().String() + "\n"},
+		"ou=people,dc=example,dc=com(team=ops)": {a.Recipient().String(), b.Recipient().String()},
+		"uid=bob,ou=people,dc=example,dc=com":   {},
+		"uid=eve,ou=people,dc=example,dc=com":   {"age1invalid"},
+	}
+
+	recs, err := age.RecipientsFromDirectory(context.Background(), dir, "uid=alice,ou=people,dc=example,dc=com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 1 || recs[0].(*age.X25519Recipient).String() != a.Recipient().String() {
+		t.Errorf("got recipients %v, want only %v", recs, a.Recipient())
+	}
+	recs, err = age.RecipientsFromDirectory(context.Background(), dir, "ou=people,dc=example,dc=com", "(team=ops)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 2 {
+		t.Errorf("got %d recipients, want 2", len(recs))
+	}
+
+	for _, dn := range []string{
+		"uid=bob,ou=people,dc=example,dc=com",
+		"uid=eve,ou=people,dc=example,dc=com",
+		"uid=mallory,ou=people,dc=example,dc=com",
+	} {
+		if _, err := age.RecipientsFromDirectory(context.Background(), dir, dn, ""); err == nil {
+			t.Errorf("%s: expected error", dn)
+		}
+	}
+}
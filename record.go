@@ -0,0 +1,296 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package age
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+
+	"filippo.io/age/internal/format"
+)
+
+// A RecordWriter writes a sequence of independently encrypted records, for
+// example to an append-only log. Each record is a complete binary age file,
+// prefixed by its length as a 32-bit big-endian integer.
+//
+// In a chained log, written by a RecordWriter returned by
+// NewChainedRecordWriter, the header of each file also has a stanza
+//
+//	-> ext-chain <previous MAC>
+//
+// with an empty body, after the recipient stanzas, where the argument is the
+// unpadded base64 of the 32-byte header MAC of the previous record's file, or
+// of 32 zero bytes for the first record of the log. Since the header MAC of a
+// file covers its stanzas, each record authenticates the one before it, and a
+// RecordReader returned by NewChainedRecordReader detects records that were
+// removed, reordered, or copied from another log.
+//
+// Chaining can't detect records removed from the end of the log, since any
+// prefix of a chained log is a valid chained log: compare the ChainHead of the
+// reader with a copy of the writer's, kept elsewhere, for that. Moreover,
+// anyone who knows the recipients can append new records that link to the
+// end of the chain, or replace the log with a new one, so the integrity of
+// the log as a whole is only as good as the secrecy of the recipients.
+type RecordWriter struct {
+	dst        io.Writer
+	recipients []Recipient
+
+	chained bool
+	prev    []byte
+}
+
+const chainStanzaType = extensionPrefix + "chain"
+
+// chainMACSize is the size of the header MAC linked by an ext-chain stanza.
+const chainMACSize = 32
+
+func chainStanza(prev []byte) *format.Stanza {
+	return &format.Stanza{
+		Type: chainStanzaType,
+		Args: []string{format.EncodeToString(prev)},
+	}
+}
+
+// checkChainStanza checks that hdr has a single ext-chain stanza linking to
+// prev, and returns the MAC of hdr.
+func checkChainStanza(hdr *format.Header, prev []byte) ([]byte, error) {
+	var found bool
+	for _, s := range hdr.Recipients {
+		if s.Type != chainStanzaType {
+			continue
+		}
+		if found {
+			return nil, errors.New("malformed record: multiple ext-chain stanzas")
+		}
+		found = true
+		if len(s.Args) != 1 || len(s.Body) != 0 {
+			return nil, errors.New("malformed record: invalid ext-chain stanza")
+		}
+		mac, err := format.DecodeString(s.Args[0])
+		if err != nil || len(mac) != chainMACSize {
+			return nil, errors.New("malformed record: invalid ext-chain stanza")
+		}
+		if !hmac.Equal(mac, prev) {
+			return nil, ErrBrokenChain
+		}
+	}
+	if !found {
+		return nil, errors.New("malformed record: missing ext-chain stanza")
+	}
+	return hdr.MAC, nil
+}
+
+// ErrBrokenChain is returned by RecordReader.Next when a record of a chained
+// log doesn't link to the previous one, because records were removed,
+// reordered, or copied from another log.
+var ErrBrokenChain = errors.New("record does not follow the previous one in the chain")
+
+// NewRecordWriter returns a RecordWriter that writes records encrypted to
+// recipients to dst. dst can be a file opened with os.O_APPEND.
+func NewRecordWriter(dst io.Writer, recipients ...Recipient) (*RecordWriter, error) {
+	if len(recipients) == 0 {
+		return nil, &NoRecipientsError{}
+	}
+	return &RecordWriter{dst: dst, recipients: recipients}, nil
+}
+
+// NewChainedRecordWriter is like NewRecordWriter, but it writes a chained log,
+// as described in the RecordWriter documentation.
+//
+// prev is the ChainHead of the RecordWriter or RecordReader that last wrote or
+// read the log in dst, to append to it, or nil to start a new log, in which
+// case dst must be empty. ScryptRecipient can't be used for chained logs.
+func NewChainedRecordWriter(dst io.Writer, prev []byte, recipients ...Recipient) (*RecordWriter, error) {
+	if len(recipients) == 0 {
+		return nil, &NoRecipientsError{}
+	}
+	for _, r := range recipients {
+		switch r.(type) {
+		case *ScryptRecipient, *MultiPassphraseRecipient:
+			return nil, errors.New("scrypt recipients can't be used for chained logs")
+		}
+	}
+	if prev == nil {
+		prev = make([]byte, chainMACSize)
+	}
+	if len(prev) != chainMACSize {
+		return nil, fmt.Errorf("invalid chain head size %d, expected %d", len(prev), chainMACSize)
+	}
+	return &RecordWriter{
+		dst:        dst,
+		recipients: recipients,
+		chained:    true,
+		prev:       append([]byte{}, prev...),
+	}, nil
+}
+
+// ChainHead returns the header MAC of the last record written by w, or the
+// prev value passed to NewChainedRecordWriter if none was written. It returns
+// nil if w doesn't write a chained log.
+func (w *RecordWriter) ChainHead() []byte {
+	if !w.chained {
+		return nil
+	}
+	return append([]byte{}, w.prev...)
+}
+
+// WriteRecord encrypts p with a new file key and writes it as a record, with a
+// single call to Write.
+func (w *RecordWriter) WriteRecord(p []byte) error {
+	var extensions []*format.Stanza
+	if w.chained {
+		extensions = append(extensions, chainStanza(w.prev))
+	}
+	file, err := (&Encryptor{}).encryptBytes(p, w.recipients, extensions)
+	if err != nil {
+		return err
+	}
+	if uint64(len(file)) > math.MaxUint32 {
+		return errors.New("record too large")
+	}
+	record := make([]byte, 4, 4+len(file))
+	binary.BigEndian.PutUint32(record, uint32(len(file)))
+	record = append(record, file...)
+	if _, err := w.dst.Write(record); err != nil {
+		return fmt.Errorf("failed to write record: %v", err)
+	}
+	if w.chained {
+		hdr, _, err := format.Parse(bytes.NewReader(file))
+		if err != nil {
+			return fmt.Errorf("failed to read back record header: %v", err)
+		}
+		w.prev = hdr.MAC
+	}
+	return nil
+}
+
+// A RecordReader reads and decrypts the records written by a RecordWriter.
+type RecordReader struct {
+	src        io.Reader
+	identities []Identity
+	err        error
+
+	chained bool
+	prev    []byte
+}
+
+// NewRecordReader returns a RecordReader that reads records from src and
+// decrypts them with identities. Each record can be encrypted to different
+// recipients, as long as one of identities can decrypt it.
+func NewRecordReader(src io.Reader, identities ...Identity) *RecordReader {
+	return &RecordReader{src: src, identities: identities}
+}
+
+// NewChainedRecordReader is like NewRecordReader, but it reads a chained log,
+// as described in the RecordWriter documentation, and Next returns
+// ErrBrokenChain if a record doesn't link to the previous one.
+func NewChainedRecordReader(src io.Reader, identities ...Identity) *RecordReader {
+	return &RecordReader{
+		src:        src,
+		identities: identities,
+		chained:    true,
+		prev:       make([]byte, chainMACSize),
+	}
+}
+
+// ChainHead returns the header MAC of the last record returned by Next, or 32
+// zero bytes if none was. It can be passed to NewChainedRecordWriter to
+// append to the log. It returns nil if r doesn't read a chained log.
+func (r *RecordReader) ChainHead() []byte {
+	if !r.chained {
+		return nil
+	}
+	return append([]byte{}, r.prev...)
+}
+
+// Next returns the plaintext of the next record. After the last record, it
+// returns io.EOF. If src ends in the middle of a record, for example because it
+// is still being written, it returns io.ErrUnexpectedEOF.
+//
+// Any error other than io.EOF is permanent, since the framing can't be trusted
+// anymore.
+func (r *RecordReader) Next() ([]byte, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	p, err := r.next()
+	if err != nil {
+		r.err = err
+	}
+	return p, err
+}
+
+func (r *RecordReader) next() ([]byte, error) {
+	var prefix [4]byte
+	if _, err := io.ReadFull(r.src, prefix[:]); err != nil {
+		return nil, err
+	}
+	// Don't trust the length for allocations, only read up to it.
+	record := &recordReader{r: r.src, n: int64(binary.BigEndian.Uint32(prefix[:]))}
+	d := &Decryptor{}
+	var mac []byte
+	if r.chained {
+		d.checkHeader = func(hdr *format.Header) (err error) {
+			mac, err = checkChainStanza(hdr, r.prev)
+			return err
+		}
+	}
+	pr, err := d.Decrypt(record, r.identities...)
+	if err == ErrBrokenChain {
+		return nil, err
+	}
+	if err != nil {
+		if record.truncated {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("failed to decrypt record: %v", err)
+	}
+	p, err := ioutil.ReadAll(pr)
+	if err != nil {
+		if record.truncated {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("failed to decrypt record: %v", err)
+	}
+	if record.n != 0 {
+		return nil, errors.New("malformed record: trailing data")
+	}
+	if r.chained {
+		r.prev = mac
+	}
+	return p, nil
+}
+
+// recordReader is like io.LimitedReader, but it remembers if the underlying
+// Reader ended before the limit.
+type recordReader struct {
+	r         io.Reader
+	n         int64
+	truncated bool
+}
+
+func (r *recordReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.n {
+		p = p[:r.n]
+	}
+	n, err := r.r.Read(p)
+	r.n -= int64(n)
+	if err == io.EOF && r.n > 0 {
+		r.truncated = true
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
@@ -0,0 +1,137 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package age
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// RekeyOptions are the options of RekeyTree.
+type RekeyOptions struct {
+	// ContinueOnError makes RekeyTree go on with the other files after failing
+	// to re-encrypt one, instead of stopping.
+	ContinueOnError bool
+}
+
+// RekeyResult is the outcome of re-encrypting a file with RekeyTree.
+type RekeyResult struct {
+	// Path is the path of the file, including the root passed to RekeyTree.
+	Path string
+
+	// Skipped is true if none of the old identities could decrypt the file,
+	// which was left unchanged.
+	Skipped bool
+
+	// Err is the error that prevented re-encrypting the file, if any. The
+	// file is left unchanged if Err is not nil.
+	Err error
+}
+
+// RekeyTree walks the directory tree rooted at root, and re-encrypts to
+// newRecipients every regular file with the ".age" extension that can be
+// decrypted with oldIdentities, for example to rotate a master key. Symbolic
+// links are not followed.
+//
+// Each file is decrypted and encrypted again in a streaming fashion, with a
+// new file key, into a temporary file with mode 0600 in the same directory,
+// which then atomically replaces the original. Files that don't match any of
+// oldIdentities are skipped. Only binary files are supported.
+//
+// RekeyTree returns a result for each file it considered, in lexical order. If
+// a file fails and opts.ContinueOnError is not set, it stops and returns the
+// results so far along with that file's error.
+func RekeyTree(root string, oldIdentities []Identity, newRecipients []Recipient, opts RekeyOptions) ([]RekeyResult, error) {
+	if len(oldIdentities) == 0 {
+		return nil, errors.New("no identities specified")
+	}
+	if len(newRecipients) == 0 {
+		return nil, &NoRecipientsError{}
+	}
+
+	var results []RekeyResult
+	errStop := errors.New("stop")
+	var stopErr error
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || !strings.HasSuffix(path, ".age") {
+			return nil
+		}
+		res := RekeyResult{Path: path}
+		err = rekeyFile(path, oldIdentities, newRecipients)
+		if _, ok := err.(*NoIdentityMatchError); ok {
+			res.Skipped = true
+		} else if err != nil {
+			res.Err = err
+		}
+		results = append(results, res)
+		if res.Err != nil && !opts.ContinueOnError {
+			stopErr = fmt.Errorf("%q: %v", path, res.Err)
+			return errStop
+		}
+		return nil
+	})
+	if err == errStop {
+		return results, stopErr
+	}
+	if err != nil {
+		return results, fmt.Errorf("failed to walk %q: %v", root, err)
+	}
+	return results, nil
+}
+
+func rekeyFile(path string, oldIdentities []Identity, newRecipients []Recipient) (err error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	r, err := Decrypt(in, oldIdentities...)
+	if err != nil {
+		return err
+	}
+
+	out, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			out.Close()
+			os.Remove(out.Name())
+		}
+	}()
+	if err := out.Chmod(0600); err != nil {
+		return err
+	}
+	w, err := Encrypt(out, newRecipients...)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	// Some platforms don't allow replacing open files.
+	in.Close()
+	return os.Rename(out.Name(), path)
+}
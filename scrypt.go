@@ -7,10 +7,15 @@
 package age
 
 import (
+	"bytes"
 	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"strconv"
+	"sync/atomic"
+	"time"
 
 	"filippo.io/age/internal/format"
 	"golang.org/x/crypto/chacha20poly1305"
@@ -31,9 +36,15 @@ const scryptLabel = "age-encryption.org/v1/scrypt"
 type ScryptRecipient struct {
 	password   []byte
 	workFactor int
+
+	// salt, if not nil, is the fixed salt set by NewScryptRecipientWithSalt,
+	// and saltUsed is set to 1 by the first Wrap that uses it.
+	salt     []byte
+	saltUsed uint32
 }
 
 var _ Recipient = &ScryptRecipient{}
+var _ RecipientWithLabels = &ScryptRecipient{}
 
 // NewScryptRecipient returns a new ScryptRecipient with the provided password.
 func NewScryptRecipient(password string) (*ScryptRecipient, error) {
@@ -48,6 +59,26 @@ func NewScryptRecipient(password string) (*ScryptRecipient, error) {
 	return r, nil
 }
 
+// NewScryptRecipientWithSalt returns a new ScryptRecipient with the provided
+// password, work factor 2^logN, and a fixed salt instead of a random one, so
+// that the stanza it produces for a given file key is deterministic.
+//
+// It is meant ONLY for generating and checking test vectors. Reusing a salt
+// across files weakens them, so the returned recipient can wrap a single file
+// key, and further Wrap calls fail. Use NewScryptRecipient otherwise.
+func NewScryptRecipientWithSalt(password string, logN int, salt [16]byte) (*ScryptRecipient, error) {
+	if logN > 30 || logN < 1 {
+		return nil, fmt.Errorf("invalid scrypt work factor: %v", logN)
+	}
+	r, err := NewScryptRecipient(password)
+	if err != nil {
+		return nil, err
+	}
+	r.workFactor = logN
+	r.salt = append([]byte{}, salt[:]...)
+	return r, nil
+}
+
 // SetWorkFactor sets the scrypt work factor to 2^logN.
 // It must be called before Wrap.
 //
@@ -61,20 +92,96 @@ func (r *ScryptRecipient) SetWorkFactor(logN int) {
 
 const scryptSaltSize = 16
 
-func (r *ScryptRecipient) Wrap(fileKey []byte) ([]*Stanza, error) {
+// defaultMaxWorkFactor is the maximum scrypt work factor accepted by default by
+// ScryptIdentity, see SetMaxWorkFactor.
+const defaultMaxWorkFactor = 22 // 15s on a modern machine
+
+// CalibrateScryptWorkFactor measures the speed of scrypt on the local machine
+// and returns the largest work factor, suitable for SetWorkFactor, whose key
+// derivation is estimated to take less than target. It returns at least 1,
+// and at most 22, the largest work factor that ScryptIdentity accepts by
+// default.
+//
+// The estimate is extrapolated from derivations with a small work factor,
+// since the cost of scrypt grows linearly with 2^logN, to avoid spending more
+// than a few tens of milliseconds or allocating large amounts of memory. The
+// sample work factor is raised until a derivation takes a measurable time.
+func CalibrateScryptWorkFactor(target time.Duration) (logN int) {
+	const minSample = 10 * time.Millisecond
+	const maxSampleLogN = 16
 	salt := make([]byte, scryptSaltSize)
-	if _, err := rand.Read(salt[:]); err != nil {
+	sampleLogN := 12
+	var sample time.Duration
+	for {
+		start := time.Now()
+		if _, err := scrypt.Key([]byte("calibration"), salt, 1<<sampleLogN, 8, 1, chacha20poly1305.KeySize); err != nil {
+			panic("age: internal error: scrypt failed: " + err.Error())
+		}
+		sample = time.Since(start)
+		if sample >= minSample || sampleLogN == maxSampleLogN {
+			break
+		}
+		sampleLogN++
+	}
+
+	logN = 1
+	for logN < defaultMaxWorkFactor {
+		next := logN + 1
+		var estimate time.Duration
+		if next >= sampleLogN {
+			estimate = sample << uint(next-sampleLogN)
+		} else {
+			estimate = sample >> uint(sampleLogN-next)
+		}
+		if estimate >= target {
+			break
+		}
+		logN = next
+	}
+	return logN
+}
+
+// WrapWithLabels implements RecipientWithLabels, returning a random label to
+// ensure the recipient is not mixed with other recipients, since that would
+// defeat the authentication properties of a passphrase-encrypted file.
+func (r *ScryptRecipient) WrapWithLabels(fileKey []byte) (stanzas []*Stanza, labels []string, err error) {
+	stanzas, err = r.Wrap(fileKey)
+
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return nil, nil, err
+	}
+	return stanzas, []string{hex.EncodeToString(random)}, err
+}
+
+func (r *ScryptRecipient) Wrap(fileKey []byte) ([]*Stanza, error) {
+	if r.salt != nil && !atomic.CompareAndSwapUint32(&r.saltUsed, 0, 1) {
+		return nil, errors.New("recipient with a fixed salt was already used")
+	}
+	l, err := scryptWrap(fileKey, r.password, r.workFactor, r.salt, "scrypt", scryptLabel)
+	if err != nil {
 		return nil, err
 	}
+	return []*Stanza{l}, nil
+}
+
+// scryptWrap wraps fileKey with password in a stanza of type stanzaType. If
+// salt is nil, a random one is generated.
+func scryptWrap(fileKey, password []byte, logN int, salt []byte, stanzaType, label string) (*Stanza, error) {
+	if salt == nil {
+		salt = make([]byte, scryptSaltSize)
+		if _, err := rand.Read(salt[:]); err != nil {
+			return nil, err
+		}
+	}
 
-	logN := r.workFactor
 	l := &Stanza{
-		Type: "scrypt",
+		Type: stanzaType,
 		Args: []string{format.EncodeToString(salt), strconv.Itoa(logN)},
 	}
 
-	salt = append([]byte(scryptLabel), salt...)
-	k, err := scrypt.Key(r.password, salt, 1<<logN, 8, 1, chacha20poly1305.KeySize)
+	salt = append([]byte(label), salt...)
+	k, err := scrypt.Key(password, salt, 1<<logN, 8, 1, chacha20poly1305.KeySize)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate scrypt hash: %v", err)
 	}
@@ -85,13 +192,133 @@ func (r *ScryptRecipient) Wrap(fileKey []byte) ([]*Stanza, error) {
 	}
 	l.Body = wrappedKey
 
-	return []*Stanza{l}, nil
+	return l, nil
+}
+
+// Multi-passphrase files carry one "ext-scrypt" stanza per passphrase, with
+// the same arguments and body as a "scrypt" stanza, but a different label.
+const multiScryptStanzaType = extensionPrefix + "scrypt"
+const multiScryptLabel = "age-encryption.org/ext/scrypt"
+
+// MaxPassphrases is the maximum number of passwords of a
+// MultiPassphraseRecipient. Since each "ext-scrypt" stanza might cost a full
+// scrypt run for each password tried, files with more stanzas are rejected
+// before running scrypt.
+const MaxPassphrases = 8
+
+// MultiPassphraseRecipient is a password-based recipient like ScryptRecipient,
+// but anyone with any of several passwords can decrypt the message. A
+// ScryptIdentity with any of the passwords decrypts the file.
+//
+// This is a non-standard extension: since the age format allows a single
+// scrypt stanza, each password wraps the file key in a separate "ext-scrypt"
+// stanza, and other age implementations can't decrypt the resulting files.
+//
+// Like ScryptRecipient, a MultiPassphraseRecipient must be the only recipient
+// for the file. Note that decryption might run scrypt once for each password
+// being tried and each stanza, so the number of passwords is limited to
+// MaxPassphrases.
+type MultiPassphraseRecipient struct {
+	passwords  [][]byte
+	workFactor int
+}
+
+var _ Recipient = &MultiPassphraseRecipient{}
+var _ RecipientWithLabels = &MultiPassphraseRecipient{}
+
+// NewMultiPassphraseRecipient returns a new MultiPassphraseRecipient with the
+// provided passwords.
+func NewMultiPassphraseRecipient(passwords ...string) (*MultiPassphraseRecipient, error) {
+	if len(passwords) == 0 {
+		return nil, errors.New("no passphrases provided")
+	}
+	if len(passwords) > MaxPassphrases {
+		return nil, fmt.Errorf("too many passphrases: got %d, at most %d are allowed", len(passwords), MaxPassphrases)
+	}
+	r := &MultiPassphraseRecipient{workFactor: 18}
+	for _, p := range passwords {
+		if len(p) == 0 {
+			return nil, errors.New("passphrase can't be empty")
+		}
+		r.passwords = append(r.passwords, []byte(p))
+	}
+	return r, nil
+}
+
+// SetWorkFactor sets the scrypt work factor to 2^logN, like
+// ScryptRecipient.SetWorkFactor.
+func (r *MultiPassphraseRecipient) SetWorkFactor(logN int) {
+	if logN > 30 || logN < 1 {
+		panic("age: SetWorkFactor called with illegal value")
+	}
+	r.workFactor = logN
+}
+
+// WrapWithLabels implements RecipientWithLabels, returning a random label like
+// ScryptRecipient.WrapWithLabels.
+func (r *MultiPassphraseRecipient) WrapWithLabels(fileKey []byte) (stanzas []*Stanza, labels []string, err error) {
+	stanzas, err = r.Wrap(fileKey)
+
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return nil, nil, err
+	}
+	return stanzas, []string{hex.EncodeToString(random)}, err
+}
+
+func (r *MultiPassphraseRecipient) Wrap(fileKey []byte) ([]*Stanza, error) {
+	var stanzas []*Stanza
+	for _, p := range r.passwords {
+		l, err := scryptWrap(fileKey, p, r.workFactor, nil, multiScryptStanzaType, multiScryptLabel)
+		if err != nil {
+			return nil, err
+		}
+		stanzas = append(stanzas, l)
+	}
+	return stanzas, nil
+}
+
+// checkScryptStanzas enforces that passphrase-encrypted files are not mixed
+// with other recipients, which would defeat their authentication properties:
+// a "scrypt" stanza must be the only one, and "ext-scrypt" stanzas can only be
+// accompanied by other "ext-scrypt" stanzas. It also rejects more than
+// MaxPassphrases "ext-scrypt" stanzas, each of which might cost a scrypt run.
+func checkScryptStanzas(stanzas []*format.Stanza) error {
+	var multi int
+	for _, s := range stanzas {
+		switch s.Type {
+		case "scrypt":
+			if len(stanzas) != 1 {
+				return errors.New("an scrypt recipient must be the only one")
+			}
+		case multiScryptStanzaType:
+			multi++
+		}
+	}
+	if multi != 0 && multi != len(stanzas) {
+		return errors.New("a multi-passphrase recipient must be the only one")
+	}
+	if multi > MaxPassphrases {
+		return fmt.Errorf("too many ext-scrypt stanzas: got %d, at most %d are allowed", multi, MaxPassphrases)
+	}
+	return nil
 }
 
 // ScryptIdentity is a password-based identity.
 type ScryptIdentity struct {
 	password      []byte
 	maxWorkFactor int
+	limiter       ScryptLimiter
+}
+
+// A ScryptLimiter decides whether an ScryptIdentity may run the scrypt key
+// derivation, for example to rate-limit the passphrase attempts of each client
+// of a service, so that it can't be used as a brute-force oracle. See
+// ScryptIdentity.SetLimiter.
+type ScryptLimiter interface {
+	// AllowScrypt is called before each key derivation with its work factor,
+	// and must return an error to reject the attempt.
+	AllowScrypt(logN int) error
 }
 
 var _ Identity = &ScryptIdentity{}
@@ -103,11 +330,45 @@ func NewScryptIdentity(password string) (*ScryptIdentity, error) {
 	}
 	i := &ScryptIdentity{
 		password:      []byte(password),
-		maxWorkFactor: 22, // 15s on a modern machine
+		maxWorkFactor: defaultMaxWorkFactor,
 	}
 	return i, nil
 }
 
+// NewScryptIdentityFromReader returns a new ScryptIdentity with the password
+// read from the first line of r, without the line ending. It's meant for
+// reading a passphrase from a file descriptor, for example one passed to a
+// CLI, which unlike an environment variable or a flag is not visible to other
+// processes.
+//
+// r is read one byte at a time, and nothing is read past the first newline, so
+// the rest of r can be used for something else.
+func NewScryptIdentityFromReader(r io.Reader) (*ScryptIdentity, error) {
+	const maxPassphraseSize = 64 * 1024
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := r.Read(b)
+		if n > 0 {
+			if b[0] == '\n' {
+				break
+			}
+			line = append(line, b[0])
+			if len(line) > maxPassphraseSize {
+				return nil, errors.New("passphrase is too long")
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read passphrase: %v", err)
+		}
+	}
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	return NewScryptIdentity(string(line))
+}
+
 // SetMaxWorkFactor sets the maximum accepted scrypt work factor to 2^logN.
 // It must be called before Unwrap.
 //
@@ -121,12 +382,46 @@ func (i *ScryptIdentity) SetMaxWorkFactor(logN int) {
 	i.maxWorkFactor = logN
 }
 
+// ScryptLimitError is returned by ScryptIdentity.Unwrap when its ScryptLimiter
+// rejects an attempt.
+type ScryptLimitError struct {
+	Err error
+}
+
+func (e *ScryptLimitError) Error() string {
+	return fmt.Sprintf("scrypt attempt rejected: %v", e.Err)
+}
+
+func (e *ScryptLimitError) Unwrap() error { return e.Err }
+
+// SetLimiter makes i consult l before each scrypt key derivation. If l rejects
+// the attempt, Unwrap returns an error wrapping the one returned by
+// l.AllowScrypt, and decryption fails. It must be called before Unwrap.
+func (i *ScryptIdentity) SetLimiter(l ScryptLimiter) {
+	i.limiter = l
+}
+
 func (i *ScryptIdentity) Unwrap(stanzas []*Stanza) ([]byte, error) {
+	var multi int
+	for _, s := range stanzas {
+		if s.Type == multiScryptStanzaType {
+			multi++
+		}
+	}
+	if multi > MaxPassphrases {
+		return nil, fmt.Errorf("too many ext-scrypt stanzas: got %d, at most %d are allowed", multi, MaxPassphrases)
+	}
 	return multiUnwrap(i.unwrap, stanzas)
 }
 
 func (i *ScryptIdentity) unwrap(block *Stanza) ([]byte, error) {
-	if block.Type != "scrypt" {
+	var label string
+	switch block.Type {
+	case "scrypt":
+		label = scryptLabel
+	case multiScryptStanzaType:
+		label = multiScryptLabel
+	default:
 		return nil, ErrIncorrectIdentity
 	}
 	if len(block.Args) != 2 {
@@ -150,7 +445,13 @@ func (i *ScryptIdentity) unwrap(block *Stanza) ([]byte, error) {
 		return nil, fmt.Errorf("invalid scrypt work factor: %v", logN)
 	}
 
-	salt = append([]byte(scryptLabel), salt...)
+	if i.limiter != nil {
+		if err := i.limiter.AllowScrypt(logN); err != nil {
+			return nil, &ScryptLimitError{Err: err}
+		}
+	}
+
+	salt = append([]byte(label), salt...)
 	k, err := scrypt.Key(i.password, salt, 1<<logN, 8, 1, chacha20poly1305.KeySize)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate scrypt hash: %v", err)
@@ -171,3 +472,55 @@ func (i *ScryptIdentity) unwrap(block *Stanza) ([]byte, error) {
 	}
 	return fileKey, nil
 }
+
+// ErrIncorrectPassphrase is returned by OpenWithPassphrase when the file is
+// encrypted with a passphrase, but not with the supplied one.
+var ErrIncorrectPassphrase = errors.New("incorrect passphrase")
+
+// OpenWithPassphrase decrypts a binary file encrypted with a passphrase, like
+// Decrypt with an ScryptIdentity. It's meant for services that receive a
+// passphrase, for example in an API request, and need to reject a wrong one
+// cleanly before streaming a possibly large plaintext.
+//
+// The passphrase is checked by unwrapping the file key and verifying the
+// header MAC, before anything is read past the header. A wrong passphrase
+// makes OpenWithPassphrase return ErrIncorrectPassphrase, while the errors
+// returned later by Read can only be caused by a corrupted or truncated
+// payload. The scrypt work factor is bounded like for NewScryptIdentity;
+// use ScryptIdentity directly with SetMaxWorkFactor or SetLimiter for
+// untrusted files.
+func OpenWithPassphrase(src io.Reader, passphrase string) (io.Reader, error) {
+	i, err := NewScryptIdentity(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	p := &passphraseIdentity{i: i}
+	r, err := Decrypt(src, p)
+	if _, ok := err.(*NoIdentityMatchError); ok {
+		if p.sawScrypt {
+			return nil, ErrIncorrectPassphrase
+		}
+		return nil, errors.New("file is not encrypted with a passphrase")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// passphraseIdentity wraps an ScryptIdentity and records whether it was asked
+// to unwrap any scrypt stanza, to tell a wrong passphrase apart from a file
+// that isn't encrypted with one.
+type passphraseIdentity struct {
+	i         *ScryptIdentity
+	sawScrypt bool
+}
+
+func (p *passphraseIdentity) Unwrap(stanzas []*Stanza) ([]byte, error) {
+	for _, s := range stanzas {
+		if s.Type == "scrypt" || s.Type == multiScryptStanzaType {
+			p.sawScrypt = true
+		}
+	}
+	return p.i.Unwrap(stanzas)
+}
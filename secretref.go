@@ -0,0 +1,68 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package age
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// A SecretRefResolver fetches secrets from a secret manager, so that
+// identity files can refer to secret keys instead of holding them. See
+// ParseIdentitiesWithResolver.
+type SecretRefResolver interface {
+	// ResolveSecretRef returns the secret referenced by ref, for example
+	// "op://vault/item/field" or "vault:secret/data/path#key". The secret
+	// must hold one or more identities in the format of ParseIdentities.
+	ResolveSecretRef(ref string) (string, error)
+}
+
+// ParseIdentitiesWithResolver is like ParseIdentities, but lines that start
+// with a URI scheme, like "op:" or "vault:", and don't match any registered
+// identity type, are secret references resolved with resolver. The identities
+// in the resolved secrets are returned in place of the reference.
+//
+// Resolved secrets can't hold further references. Errors mention the line of
+// the reference but, like those of ParseIdentities, never the secret itself.
+func ParseIdentitiesWithResolver(f io.Reader, resolver SecretRefResolver) ([]Identity, error) {
+	ids, errs := parseIdentitiesAll(f, false, resolver)
+	if len(errs) > 0 {
+		return nil, &errs[0]
+	}
+	return ids, nil
+}
+
+// isSecretRef reports whether line starts with a URI scheme as defined by RFC
+// 3986, Section 3.1, followed by a non-empty reference without spaces.
+func isSecretRef(line string) bool {
+	i := strings.IndexByte(line, ':')
+	if i < 1 || i == len(line)-1 || strings.ContainsAny(line, " \t") {
+		return false
+	}
+	for j, c := range line[:i] {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z':
+		case j > 0 && ('0' <= c && c <= '9' || c == '+' || c == '-' || c == '.'):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func resolveSecretRef(resolver SecretRefResolver, ref string, strict bool) ([]Identity, error) {
+	secret, err := resolver.ResolveSecretRef(ref)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve secret reference: %v", err)
+	}
+	ids, errs := parseIdentitiesAll(strings.NewReader(secret), strict, nil)
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("referenced secret: %v", &errs[0])
+	}
+	return ids, nil
+}
@@ -0,0 +1,131 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package age
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+
+	"filippo.io/age/internal/bech32"
+	"filippo.io/age/internal/shamir"
+	"golang.org/x/crypto/curve25519"
+)
+
+const shareHRP = "AGE-SHARE-"
+const shareTagSize = 4
+
+// A Share is one of the pieces of an X25519Identity split by SplitIdentity.
+//
+// Shares are secret: anyone who collects enough of them can reconstruct the
+// identity. A single share, or any set of fewer shares than the threshold,
+// reveals nothing about the identity, except for a short tag that identifies
+// the recipient it belongs to.
+type Share struct {
+	threshold byte
+	index     byte
+	tag       [shareTagSize]byte
+	value     []byte
+}
+
+// shareTag returns a short tag of the recipient of a split identity, which
+// lets CombineIdentity detect mismatched or insufficient shares.
+func shareTag(r *X25519Recipient) (tag [shareTagSize]byte) {
+	h := sha256.Sum256([]byte(shareHRP + r.String()))
+	copy(tag[:], h[:])
+	return tag
+}
+
+// SplitIdentity splits id into n shares, any k of which can reconstruct it with
+// CombineIdentity, using Shamir's secret sharing. k must be at least 2, and n
+// at most 255.
+//
+// This is meant for social recovery of a long-term key, by giving each share
+// to a different trusted party.
+func SplitIdentity(id *X25519Identity, k, n int) ([]Share, error) {
+	values, err := shamir.Split(id.secretKey, k, n)
+	if err != nil {
+		return nil, err
+	}
+	tag := shareTag(id.Recipient())
+	shares := make([]Share, 0, n)
+	for i, v := range values {
+		shares = append(shares, Share{
+			threshold: byte(k),
+			index:     byte(i + 1),
+			tag:       tag,
+			value:     v,
+		})
+	}
+	return shares, nil
+}
+
+// CombineIdentity reconstructs the identity split by SplitIdentity from at
+// least as many distinct shares as the threshold it was split with.
+//
+// The result is checked against the tag carried by the shares, so an error is
+// returned if the shares come from different identities, or are corrupted.
+func CombineIdentity(shares []Share) (*X25519Identity, error) {
+	if len(shares) == 0 {
+		return nil, errors.New("no shares provided")
+	}
+	first := shares[0]
+	if len(shares) < int(first.threshold) {
+		return nil, fmt.Errorf("not enough shares: got %d, need %d", len(shares), first.threshold)
+	}
+	var xs []byte
+	var ys [][]byte
+	for _, s := range shares[:first.threshold] {
+		if s.threshold != first.threshold || s.tag != first.tag {
+			return nil, errors.New("shares belong to different identities")
+		}
+		xs = append(xs, s.index)
+		ys = append(ys, s.value)
+	}
+	secretKey, err := shamir.Combine(xs, ys)
+	if err != nil {
+		return nil, err
+	}
+	id, err := newX25519IdentityFromScalar(secretKey)
+	if err != nil {
+		return nil, err
+	}
+	if tag := shareTag(id.Recipient()); subtle.ConstantTimeCompare(tag[:], first.tag[:]) != 1 {
+		return nil, errors.New("shares don't reconstruct the original identity")
+	}
+	return id, nil
+}
+
+// String returns the Bech32 encoding of s, with the "AGE-SHARE-1" prefix.
+func (s Share) String() string {
+	data := append([]byte{s.threshold, s.index}, s.tag[:]...)
+	data = append(data, s.value...)
+	str, _ := bech32.Encode(shareHRP, data)
+	return str
+}
+
+// ParseShare parses a share encoded by Share.String.
+func ParseShare(s string) (Share, error) {
+	t, data, err := bech32.Decode(s)
+	if err != nil {
+		return Share{}, fmt.Errorf("malformed share: %v", err)
+	}
+	if t != shareHRP {
+		return Share{}, fmt.Errorf("malformed share: unknown type %q", t)
+	}
+	if len(data) != 2+shareTagSize+curve25519.ScalarSize {
+		return Share{}, errors.New("malformed share: invalid length")
+	}
+	share := Share{threshold: data[0], index: data[1]}
+	if share.threshold < 2 || share.index == 0 {
+		return Share{}, errors.New("malformed share: invalid parameters")
+	}
+	copy(share.tag[:], data[2:])
+	share.value = data[2+shareTagSize:]
+	return share, nil
+}
@@ -0,0 +1,54 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package age
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ShredFile overwrites the contents of the regular file at path with random
+// bytes, syncs it to disk, and then removes it, for example to dispose of an
+// identity file after rotating keys. Symbolic links and other non-regular
+// files are rejected.
+//
+// This is only a best effort. On SSDs, and on copy-on-write, journaling, or
+// snapshotting file systems, the old contents might survive elsewhere on the
+// device. Backups and swap might also hold copies. Full-disk encryption is the
+// only reliable protection for secrets at rest.
+func ShredFile(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("%q is not a regular file", path)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	fi, err = f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := io.CopyN(f, rand.Reader, fi.Size()); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to overwrite %q: %v", path, err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to sync %q: %v", path, err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,162 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package age
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"filippo.io/age/internal/format"
+	"filippo.io/age/internal/stream"
+)
+
+// EncryptStream encrypts the plaintext read from src until EOF to one or more
+// recipients, writing the age file to dst. It takes care of closing the
+// encrypting writer, and returns the number of plaintext bytes encrypted.
+//
+// If an error is returned, the output written to dst is incomplete, and must
+// be discarded.
+func EncryptStream(dst io.Writer, src io.Reader, recipients ...Recipient) (int64, error) {
+	w, err := Encrypt(dst, recipients...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(w, src)
+	if err != nil {
+		return n, err
+	}
+	if err := w.Close(); err != nil {
+		return n, fmt.Errorf("failed to flush the last chunk: %v", err)
+	}
+	return n, nil
+}
+
+// DecryptStream decrypts the age file read from src with one of the
+// identities, writing the plaintext to dst. It returns the number of plaintext
+// bytes written.
+//
+// If an error is returned, for example because the file is truncated or was
+// tampered with, the plaintext written to dst so far must be discarded.
+func DecryptStream(dst io.Writer, src io.Reader, identities ...Identity) (int64, error) {
+	r, err := Decrypt(src, identities...)
+	if err != nil {
+		return 0, err
+	}
+	return io.Copy(dst, r)
+}
+
+// DecryptChunks decrypts the age file read from src with one of the
+// identities, and calls fn with the plaintext of each 64 KiB chunk, in order,
+// as soon as it's decrypted and authenticated. If fn returns an error,
+// DecryptChunks stops and returns it. The chunk slice is reused, so fn must
+// not retain it after returning.
+//
+// Every chunk passed to fn is authenticated, but the file might turn out to
+// be truncated or corrupted only later, in which case DecryptChunks returns an
+// error after fn processed the preceding chunks, whose results must then be
+// discarded. For files encrypted with Encryptor.Padding, the plaintext might
+// be split at different boundaries, but still in pieces of at most 64 KiB.
+func DecryptChunks(src io.Reader, identities []Identity, fn func(chunk []byte) error) error {
+	r, err := Decrypt(src, identities...)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, stream.ChunkSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if err := fn(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// DecryptStreamAuto is like DecryptStream, but it also accepts ASCII armored
+// files, detected by their armor header, possibly preceded by whitespace.
+//
+// A truncated or tampered file, including one whose armor is malformed, makes
+// DecryptStreamAuto return an error, possibly after writing some plaintext to
+// dst, which must then be discarded.
+func DecryptStreamAuto(dst io.Writer, src io.Reader, identities ...Identity) (int64, error) {
+	in, _, err := detectArmor(src)
+	if err != nil {
+		return 0, err
+	}
+	return DecryptStream(dst, in, identities...)
+}
+
+// DecryptReaderAt decrypts the binary age file of the given size read from src
+// with one of the identities, and returns an io.ReaderAt for its plaintext,
+// and the plaintext size. It's meant for browsing into large files, for
+// example memory-mapped ones, without reading the whole file.
+//
+// Each ReadAt decrypts and authenticates only the 64 KiB chunks overlapping
+// the requested range, so no unauthenticated plaintext is ever returned.
+// Offsets past the plaintext size cause an error. The size of the file is
+// authenticated by DecryptReaderAt, which decrypts the last chunk.
+//
+// ASCII armored files and files encrypted with Encryptor.Padding are not
+// supported.
+func DecryptReaderAt(src io.ReaderAt, size int64, identities ...Identity) (io.ReaderAt, int64, error) {
+	return (&Decryptor{}).DecryptReaderAt(src, size, identities...)
+}
+
+// DecryptReaderAt is like the package-level DecryptReaderAt function, but
+// with the settings of d. RequireArmor and UnsafeIgnoreErrors are not
+// supported, and if MaxPayloadBytes is set, larger plaintexts are rejected
+// with ErrPayloadTooLarge.
+func (d *Decryptor) DecryptReaderAt(src io.ReaderAt, size int64, identities ...Identity) (io.ReaderAt, int64, error) {
+	if d.RequireArmor || d.UnsafeIgnoreErrors {
+		return nil, 0, errors.New("DecryptReaderAt can't be used with RequireArmor or UnsafeIgnoreErrors")
+	}
+	identities, err := d.selectIdentities(identities)
+	if err != nil {
+		return nil, 0, err
+	}
+	parse := format.Parse
+	if d.AcceptNewerMinorVersion {
+		parse = format.ParseCompat
+	}
+	hdr, _, err := parse(io.NewSectionReader(src, 0, size))
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read header: %v", err)
+	}
+	fileKey, _, err := d.openHeader(hdr, identities, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if hasPaddingStanza(hdr) {
+		return nil, 0, errors.New("padded files can't be decrypted at random offsets")
+	}
+
+	offset, err := headerSize(hdr)
+	if err != nil {
+		return nil, 0, err
+	}
+	nonce := make([]byte, streamNonceSize)
+	if n, err := src.ReadAt(nonce, offset); n != len(nonce) {
+		return nil, 0, fmt.Errorf("failed to read nonce: %v", err)
+	}
+	offset += streamNonceSize
+
+	r, err := stream.NewReaderAt(streamKey(fileKey, nonce), io.NewSectionReader(src, offset, size-offset), size-offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	if d.MaxPayloadBytes > 0 && r.Size() > d.MaxPayloadBytes {
+		return nil, 0, ErrPayloadTooLarge
+	}
+	return r, r.Size(), nil
+}
@@ -0,0 +1,135 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package age
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	"filippo.io/age/internal/format"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const symmetricStanzaType = extensionPrefix + "symmetric"
+const symmetricLabel = "age-encryption.org/ext/symmetric"
+const symmetricSaltSize = 16
+
+// EncryptSymmetric encrypts a file with a pre-shared 32-byte symmetric key,
+// for example one agreed upon through a separate key exchange.
+//
+// The output is a regular age file whose only stanza, of the non-standard type
+// "ext-symmetric", wraps a random file key with a key derived from key and a
+// random salt. The payload is encrypted like any other age file, and Close must
+// be called on the returned WriteCloser as with Encrypt.
+//
+// Files produced by EncryptSymmetric can only be decrypted with
+// DecryptSymmetric and the same key.
+func EncryptSymmetric(dst io.Writer, key [32]byte) (io.WriteCloser, error) {
+	return Encrypt(dst, &symmetricRecipient{key: key})
+}
+
+// DecryptSymmetric decrypts a file produced by EncryptSymmetric with key.
+//
+// Like for passphrase-encrypted files, the "ext-symmetric" stanza must be the
+// only one in the file, otherwise the file is rejected.
+func DecryptSymmetric(src io.Reader, key [32]byte) (io.Reader, error) {
+	return Decrypt(src, &symmetricIdentity{key: key})
+}
+
+func symmetricWrappingKey(key [32]byte, salt []byte) ([]byte, error) {
+	h := hkdf.New(sha256.New, key[:], salt, []byte(symmetricLabel))
+	wrappingKey := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(h, wrappingKey); err != nil {
+		return nil, err
+	}
+	return wrappingKey, nil
+}
+
+type symmetricRecipient struct {
+	key [32]byte
+}
+
+var _ RecipientWithLabels = &symmetricRecipient{}
+
+// WrapWithLabels returns a random label, like ScryptRecipient does, to ensure
+// the recipient is not mixed with others.
+func (r *symmetricRecipient) WrapWithLabels(fileKey []byte) ([]*Stanza, []string, error) {
+	stanzas, err := r.Wrap(fileKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return nil, nil, err
+	}
+	return stanzas, []string{hex.EncodeToString(random)}, nil
+}
+
+func (r *symmetricRecipient) Wrap(fileKey []byte) ([]*Stanza, error) {
+	salt := make([]byte, symmetricSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	wrappingKey, err := symmetricWrappingKey(r.key, salt)
+	if err != nil {
+		return nil, err
+	}
+	wrappedKey, err := aeadEncrypt(wrappingKey, fileKey)
+	if err != nil {
+		return nil, err
+	}
+	return []*Stanza{{
+		Type: symmetricStanzaType,
+		Args: []string{format.EncodeToString(salt)},
+		Body: wrappedKey,
+	}}, nil
+}
+
+type symmetricIdentity struct {
+	key [32]byte
+}
+
+func (i *symmetricIdentity) Unwrap(stanzas []*Stanza) ([]byte, error) {
+	for _, s := range stanzas {
+		if s.Type == symmetricStanzaType && len(stanzas) != 1 {
+			return nil, errors.New("an ext-symmetric recipient must be the only one")
+		}
+	}
+	return multiUnwrap(i.unwrap, stanzas)
+}
+
+func (i *symmetricIdentity) unwrap(block *Stanza) ([]byte, error) {
+	if block.Type != symmetricStanzaType {
+		return nil, ErrIncorrectIdentity
+	}
+	if len(block.Args) != 1 {
+		return nil, errors.New("invalid ext-symmetric recipient block")
+	}
+	salt, err := format.DecodeString(block.Args[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse ext-symmetric salt: %v", err)
+	}
+	if len(salt) != symmetricSaltSize {
+		return nil, errors.New("invalid ext-symmetric recipient block")
+	}
+	wrappingKey, err := symmetricWrappingKey(i.key, salt)
+	if err != nil {
+		return nil, err
+	}
+	fileKey, err := aeadDecrypt(wrappingKey, fileKeySize, block.Body)
+	if err == errIncorrectCiphertextSize {
+		return nil, errors.New("invalid ext-symmetric recipient block: incorrect file key size")
+	} else if err != nil {
+		return nil, ErrIncorrectIdentity
+	}
+	return fileKey, nil
+}
@@ -0,0 +1,100 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package age
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+type teeEncryptor struct {
+	ws []io.WriteCloser
+}
+
+// NewTeeEncryptor returns a WriteCloser that encrypts the plaintext written to
+// it to len(dsts) age files at once, so that the plaintext needs to be read
+// only once. The file written to dsts[i] is encrypted to recipientSets[i], as
+// if by Encrypt(dsts[i], recipientSets[i]...).
+//
+// Each file has its own independent file key, so they can't be decrypted with
+// each other's identities.
+//
+// The headers are written to dsts only once all of them could be generated,
+// so if NewTeeEncryptor fails because of a recipient set, nothing is written
+// to any destination. If writing to any of the destinations fails, either
+// while writing the headers or later, the whole operation fails, and all the
+// destinations must be discarded: the files written so far are truncated,
+// and Decrypt rejects them. The caller must call Close when done, like for
+// the WriteCloser returned by Encrypt.
+func NewTeeEncryptor(dsts []io.Writer, recipientSets [][]Recipient) (io.WriteCloser, error) {
+	if len(dsts) != len(recipientSets) {
+		return nil, errors.New("mismatched number of destinations and recipient sets")
+	}
+	if len(dsts) == 0 {
+		return nil, errors.New("no destinations specified")
+	}
+	t := &teeEncryptor{}
+	var pending []*pendingWriter
+	for i, dst := range dsts {
+		p := &pendingWriter{dst: dst, buf: &bytes.Buffer{}}
+		w, err := Encrypt(p, recipientSets[i]...)
+		if err != nil {
+			return nil, fmt.Errorf("destination #%d: %v", i, err)
+		}
+		t.ws = append(t.ws, w)
+		pending = append(pending, p)
+	}
+	for i, p := range pending {
+		if err := p.flush(); err != nil {
+			return nil, fmt.Errorf("destination #%d: %v", i, err)
+		}
+	}
+	return t, nil
+}
+
+// pendingWriter buffers what is written to it until flush is called, and
+// then writes directly to dst.
+type pendingWriter struct {
+	dst io.Writer
+	buf *bytes.Buffer
+}
+
+func (p *pendingWriter) Write(b []byte) (int, error) {
+	if p.buf != nil {
+		return p.buf.Write(b)
+	}
+	return p.dst.Write(b)
+}
+
+func (p *pendingWriter) flush() error {
+	_, err := p.dst.Write(p.buf.Bytes())
+	p.buf = nil
+	return err
+}
+
+func (t *teeEncryptor) Write(p []byte) (int, error) {
+	for i, w := range t.ws {
+		if _, err := w.Write(p); err != nil {
+			return 0, fmt.Errorf("destination #%d: %v", i, err)
+		}
+	}
+	return len(p), nil
+}
+
+// Close closes all the encrypting writers, even if some of them fail, and
+// returns the first error.
+func (t *teeEncryptor) Close() error {
+	var first error
+	for i, w := range t.ws {
+		if err := w.Close(); err != nil && first == nil {
+			first = fmt.Errorf("destination #%d: %v", i, err)
+		}
+	}
+	return first
+}
@@ -0,0 +1,200 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package age
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const totpStanzaType = extensionPrefix + "totp"
+const totpWrapStanzaType = extensionPrefix + "totp-wrap"
+const totpLabel = "age-encryption.org/ext/totp"
+
+// The TOTP parameters are the RFC 6238 defaults, which are the only ones
+// supported by most authenticator apps.
+const (
+	totpPeriod = 30 * time.Second
+	totpDigits = 6
+	// totpSkew is the number of time steps of clock skew tolerated in either
+	// direction when decrypting.
+	totpSkew = 1
+	// totpMaxValidity bounds the number of ext-totp stanzas in a header.
+	totpMaxValidity = 24 * time.Hour
+)
+
+func totpCounter(t time.Time) uint64 {
+	return uint64(t.Unix() / int64(totpPeriod/time.Second))
+}
+
+// totpCode computes the RFC 4226 HOTP value for secret and counter.
+func totpCode(secret []byte, counter uint64) string {
+	h := hmac.New(sha1.New, secret)
+	binary.Write(h, binary.BigEndian, counter)
+	sum := h.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	v := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, v%1000000)
+}
+
+func totpWrappingKey(innerKey []byte, code string, counter uint64) []byte {
+	info := totpLabel + "\x00" + code + "\x00" + strconv.FormatUint(counter, 10)
+	h := hkdf.New(sha256.New, innerKey, nil, []byte(info))
+	k := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(h, k); err != nil {
+		panic("age: internal error: failed to read from HKDF: " + err.Error())
+	}
+	return k
+}
+
+type totpRecipient struct {
+	r        Recipient
+	secret   []byte
+	validFor time.Duration
+}
+
+// NewExperimentalTOTPRecipient returns a Recipient that binds the file key to
+// both r and a TOTP second factor. The file can be decrypted with an identity
+// for r and the TOTP code for secret (the raw key, not its base32 encoding)
+// current at decryption time, as long as that happens within validFor of
+// encryption. Codes follow the RFC 6238 defaults (SHA-1, six digits, 30 second
+// steps) so that common authenticator apps can produce them.
+//
+// The file key is wrapped to r indirectly, through an intermediate key that is
+// then combined with the code of each time step in the validity window, so the
+// header carries a non-standard "ext-totp" stanza for each step. validFor can
+// be at most 24 hours.
+//
+// This is an experiment, and provides weak guarantees. Anyone holding an
+// identity for r can try all one million possible codes offline, anyone who
+// knows secret can compute the codes of any time step, and decryption depends
+// on the clock of the decrypting machine being accurate. The format of the
+// stanzas might change in the future.
+func NewExperimentalTOTPRecipient(r Recipient, secret []byte, validFor time.Duration) (Recipient, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("TOTP secret can't be empty")
+	}
+	if validFor < 0 || validFor > totpMaxValidity {
+		return nil, fmt.Errorf("invalid TOTP validity period %v", validFor)
+	}
+	return &totpRecipient{r: r, secret: secret, validFor: validFor}, nil
+}
+
+func (t *totpRecipient) Wrap(fileKey []byte) ([]*Stanza, error) {
+	s, _, err := t.WrapWithLabels(fileKey)
+	return s, err
+}
+
+// WrapWithLabels implements RecipientWithLabels, forwarding the labels of the
+// underlying recipient.
+func (t *totpRecipient) WrapWithLabels(fileKey []byte) ([]*Stanza, []string, error) {
+	innerKey := make([]byte, fileKeySize)
+	if _, err := rand.Read(innerKey); err != nil {
+		return nil, nil, err
+	}
+	inner, labels, err := wrapWithLabels(t.r, innerKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var stanzas []*Stanza
+	for _, s := range inner {
+		stanzas = append(stanzas, &Stanza{
+			Type: totpWrapStanzaType,
+			Args: append([]string{s.Type}, s.Args...),
+			Body: s.Body,
+		})
+	}
+	now := time.Now()
+	for c := totpCounter(now); c <= totpCounter(now.Add(t.validFor)); c++ {
+		k := totpWrappingKey(innerKey, totpCode(t.secret, c), c)
+		wrappedKey, err := aeadEncrypt(k, fileKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		stanzas = append(stanzas, &Stanza{
+			Type: totpStanzaType,
+			Args: []string{strconv.FormatUint(c, 10)},
+			Body: wrappedKey,
+		})
+	}
+	return stanzas, labels, nil
+}
+
+type totpIdentity struct {
+	i    Identity
+	code func() (string, error)
+}
+
+// NewExperimentalTOTPIdentity returns an Identity that decrypts files
+// encrypted to a recipient returned by NewExperimentalTOTPRecipient, using i
+// and the current TOTP code returned by code. code is called only if i
+// matches the file, so it can prompt the user lazily.
+//
+// See NewExperimentalTOTPRecipient for the limitations of this scheme.
+func NewExperimentalTOTPIdentity(i Identity, code func() (string, error)) Identity {
+	return &totpIdentity{i: i, code: code}
+}
+
+func (t *totpIdentity) Unwrap(stanzas []*Stanza) ([]byte, error) {
+	var inner []*Stanza
+	for _, s := range stanzas {
+		if s.Type != totpWrapStanzaType {
+			continue
+		}
+		if len(s.Args) < 1 {
+			return nil, errors.New("invalid ext-totp-wrap recipient block")
+		}
+		inner = append(inner, &Stanza{Type: s.Args[0], Args: s.Args[1:], Body: s.Body})
+	}
+	if len(inner) == 0 {
+		return nil, ErrIncorrectIdentity
+	}
+	innerKey, err := t.i.Unwrap(inner)
+	if err != nil {
+		return nil, err
+	}
+
+	code, err := t.code()
+	if err != nil {
+		return nil, fmt.Errorf("failed to obtain TOTP code: %v", err)
+	}
+	now := totpCounter(time.Now())
+	for _, s := range stanzas {
+		if s.Type != totpStanzaType {
+			continue
+		}
+		if len(s.Args) != 1 {
+			return nil, errors.New("invalid ext-totp recipient block")
+		}
+		c, err := strconv.ParseUint(s.Args[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse ext-totp time step: %v", err)
+		}
+		if c+totpSkew < now || c > now+totpSkew {
+			continue
+		}
+		fileKey, err := aeadDecrypt(totpWrappingKey(innerKey, code, c), fileKeySize, s.Body)
+		if err == errIncorrectCiphertextSize {
+			return nil, errors.New("invalid ext-totp recipient block: incorrect file key size")
+		} else if err == nil {
+			return fileKey, nil
+		}
+	}
+	return nil, errors.New("incorrect TOTP code, or the file is not valid at this time")
+}
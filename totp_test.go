@@ -0,0 +1,80 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package age
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// Test vectors from RFC 6238, Appendix B, truncated to six digits.
+	secret := []byte("12345678901234567890")
+	for _, tt := range []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{20000000000, "353130"},
+	} {
+		if got := totpCode(secret, totpCounter(time.Unix(tt.unix, 0))); got != tt.code {
+			t.Errorf("TOTP at %d: got %s, want %s", tt.unix, got, tt.code)
+		}
+	}
+}
+
+func TestTOTPRoundTrip(t *testing.T) {
+	i, err := GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte("12345678901234567890")
+	r, err := NewExperimentalTOTPRecipient(i.Recipient(), secret, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	w, err := Encrypt(buf, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, "Hello, Twitch!"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Decrypt(bytes.NewReader(buf.Bytes()), i); err == nil {
+		t.Error("decrypted without the TOTP code")
+	}
+	wrong := NewExperimentalTOTPIdentity(i, func() (string, error) {
+		return "000000", nil
+	})
+	if _, err := Decrypt(bytes.NewReader(buf.Bytes()), wrong); err == nil {
+		t.Error("decrypted with the wrong TOTP code")
+	}
+
+	id := NewExperimentalTOTPIdentity(i, func() (string, error) {
+		return totpCode(secret, totpCounter(time.Now())), nil
+	})
+	out, err := Decrypt(buf, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outBytes, err := ioutil.ReadAll(out); err != nil {
+		t.Fatal(err)
+	} else if string(outBytes) != "Hello, Twitch!" {
+		t.Errorf("wrong data: %q", outBytes)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+//go:build linux
+// +build linux
+
+// Package tpm provides an age.Identity whose secret keys are sealed by a TPM
+// 2.0 chip, for example to the PCR state of a trusted boot, and are unsealed
+// only for the duration of each decryption.
+//
+// This package does not implement the TPM command protocol itself. Sealing and
+// unsealing are delegated to an Unsealer, which can be implemented with any TPM
+// library, such as github.com/google/go-tpm, over the transport returned by
+// OpenDevice. This keeps the age module free of TPM dependencies, while the
+// TPM policy (PCR selection, authorization values, parent key) stays under the
+// control of the application.
+package tpm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+
+	"filippo.io/age"
+)
+
+// DefaultDevice is the path of the Linux in-kernel TPM resource manager, which
+// allows multiple processes to share the TPM.
+const DefaultDevice = "/dev/tpmrm0"
+
+// OpenDevice opens the TPM character device at path, or at DefaultDevice if
+// path is empty, to be used as the transport of a TPM library.
+func OpenDevice(path string) (*os.File, error) {
+	if path == "" {
+		path = DefaultDevice
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open TPM device: %v", err)
+	}
+	return f, nil
+}
+
+// An Unsealer unseals a secret previously sealed by the TPM.
+//
+// Unseal must return the contents of an identities file, in the format
+// accepted by age.ParseIdentities, for example a single "AGE-SECRET-KEY-1..."
+// line. It should fail if the TPM policy the secret was sealed to is not
+// satisfied, which makes decryption fail.
+type Unsealer interface {
+	Unseal() ([]byte, error)
+}
+
+// Identity is an age.Identity backed by secret keys sealed by a TPM.
+type Identity struct {
+	u Unsealer
+}
+
+var _ age.Identity = &Identity{}
+
+// NewIdentity returns an Identity that calls u.Unseal on every Unwrap call,
+// so the TPM policy is checked for every decryption, and that doesn't retain
+// the unsealed keys afterwards.
+//
+// The unsealed bytes are zeroed after parsing, but the parsed keys are left
+// for the garbage collector to reclaim, as Go doesn't allow reliably erasing
+// secrets from memory.
+func NewIdentity(u Unsealer) *Identity {
+	return &Identity{u: u}
+}
+
+func (i *Identity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	secret, err := i.u.Unseal()
+	if err != nil {
+		return nil, fmt.Errorf("failed to unseal TPM key: %v", err)
+	}
+	ids, err := age.ParseIdentities(bytes.NewReader(secret))
+	for j := range secret {
+		secret[j] = 0
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse unsealed TPM key: %v", err)
+	}
+
+	for _, id := range ids {
+		fileKey, err := id.Unwrap(stanzas)
+		if errors.Is(err, age.ErrIncorrectIdentity) {
+			continue
+		}
+		return fileKey, err
+	}
+	return nil, age.ErrIncorrectIdentity
+}
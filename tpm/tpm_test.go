@@ -0,0 +1,72 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+//go:build linux
+// +build linux
+
+package tpm_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/tpm"
+)
+
+type fakeUnsealer struct {
+	secret []byte
+	err    error
+	calls  int
+}
+
+func (u *fakeUnsealer) Unseal() ([]byte, error) {
+	u.calls++
+	if u.err != nil {
+		return nil, u.err
+	}
+	return append([]byte{}, u.secret...), nil
+}
+
+func TestIdentity(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, "Hello, Twitch!"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	u := &fakeUnsealer{secret: []byte(i.String() + "\n")}
+	out, err := age.Decrypt(bytes.NewReader(buf.Bytes()), tpm.NewIdentity(u))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outBytes, err := ioutil.ReadAll(out); err != nil {
+		t.Fatal(err)
+	} else if string(outBytes) != "Hello, Twitch!" {
+		t.Errorf("wrong data: %q", outBytes)
+	}
+	if u.calls != 1 {
+		t.Errorf("Unseal called %d times, want 1", u.calls)
+	}
+
+	u.err = errors.New("PCR policy check failed")
+	if _, err := age.Decrypt(bytes.NewReader(buf.Bytes()), tpm.NewIdentity(u)); err == nil {
+		t.Error("decrypted with a failing Unsealer")
+	}
+}
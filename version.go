@@ -0,0 +1,53 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package age
+
+import (
+	"reflect"
+	"runtime/debug"
+)
+
+// version can be set at link time, with -ldflags "-X filippo.io/age.version=…",
+// to override the version read from the build info.
+var version string
+
+// LibraryVersion returns the version of this package's module, like "v1.0.0",
+// for embedders to log which version they are linked against. It's unrelated
+// to the version of the file format, which is always "age-encryption.org/v1".
+//
+// The version is read from the build info of the binary, so it's "(devel)"
+// when building from within the module, and "(unknown)" if the binary has no
+// build info for the module. If the module is replaced, for example with a
+// fork, the version of the replacement is returned.
+func LibraryVersion() string {
+	if version != "" {
+		return version
+	}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "(unknown)"
+	}
+	// Use the path of this package rather than a constant, so that forks with
+	// a different module path report their own version.
+	path := reflect.TypeOf(X25519Recipient{}).PkgPath()
+	if bi.Main.Path == path {
+		return bi.Main.Version
+	}
+	for _, m := range bi.Deps {
+		if m.Path != path {
+			continue
+		}
+		if m.Replace != nil {
+			m = m.Replace
+		}
+		if m.Version == "" {
+			return "(devel)"
+		}
+		return m.Version
+	}
+	return "(unknown)"
+}
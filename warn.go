@@ -0,0 +1,116 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package age
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// A Logger receives the advisory warnings of this package, such as about an
+// identity file that other users can read. These never affect the result of
+// an operation, unless strict mode is enabled with SetStrict. level is
+// currently always "warning", and kv holds alternating keys and values, like
+// "path", "key.txt", which describe the event.
+type Logger func(level, msg string, kv ...interface{})
+
+var (
+	loggerMu sync.RWMutex
+	logger   Logger = defaultLogger
+	strict   bool
+)
+
+// SetLogger makes warnings be sent to l, for example to route them through a
+// structured logging package, and returns the previous Logger. If l is nil,
+// warnings are discarded. By default, they are printed with the standard log
+// package, which writes to standard error unless configured otherwise.
+func SetLogger(l Logger) (previous Logger) {
+	loggerMu.Lock()
+	defer loggerMu.Unlock()
+	previous, logger = logger, l
+	return previous
+}
+
+// SetStrict sets whether strict mode is enabled, and returns the previous
+// setting. In strict mode, every condition that would send a warning to the
+// Logger makes the operation fail instead, with a *WarningError, and nothing
+// is logged. It is disabled by default.
+//
+// Strict mode currently covers identity files that other users can read, as
+// opened by ParseIdentitiesFD, Config.BuildDecryptor, the IdentityFiles of
+// ResolveRecipients, and CheckIdentityFile. It is the library equivalent of
+// the --strict flag of the age and age-keygen commands.
+func SetStrict(enabled bool) (previous bool) {
+	loggerMu.Lock()
+	defer loggerMu.Unlock()
+	previous, strict = strict, enabled
+	return previous
+}
+
+// A WarningError is returned in strict mode, see SetStrict, by operations that
+// would otherwise have sent a warning to the Logger. Msg and KV are what the
+// Logger would have received.
+type WarningError struct {
+	Msg string
+	KV  []interface{}
+}
+
+func (e *WarningError) Error() string {
+	b := &strings.Builder{}
+	b.WriteString(e.Msg)
+	for i := 0; i+1 < len(e.KV); i += 2 {
+		fmt.Fprintf(b, " %v=%q", e.KV[i], fmt.Sprint(e.KV[i+1]))
+	}
+	return b.String()
+}
+
+func defaultLogger(level, msg string, kv ...interface{}) {
+	log.Print("age: " + level + ": " + (&WarningError{msg, kv}).Error())
+}
+
+// warn sends a warning to the Logger, or returns it as an error in strict mode.
+func warn(msg string, kv ...interface{}) error {
+	loggerMu.RLock()
+	l, s := logger, strict
+	loggerMu.RUnlock()
+	if s {
+		return &WarningError{Msg: msg, KV: kv}
+	}
+	if l != nil {
+		l("warning", msg, kv...)
+	}
+	return nil
+}
+
+// CheckIdentityFile sends a warning to the Logger if f, holding secret keys, is
+// a regular file that other users can read. In strict mode, see SetStrict, it
+// returns a *WarningError instead. It's meant for programs that open identity
+// files themselves, rather than with ParseIdentitiesFD or Config.
+//
+// Permission bits are not meaningful on Windows, so there it always returns
+// nil.
+func CheckIdentityFile(f *os.File) error {
+	return warnIfWorldReadable(f, f.Name())
+}
+
+func warnIfWorldReadable(f *os.File, name string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return nil
+	}
+	if fi.Mode().IsRegular() && fi.Mode().Perm()&0004 != 0 {
+		return warn("identity file is readable by other users", "path", name)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package age
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// MaxWrappedSecretSize is the maximum size of a secret protected with
+// WrapBytes. It's the size of a single payload chunk.
+const MaxWrappedSecretSize = 64 * 1024
+
+// WrapBytes protects secret, such as a data encryption key from another
+// system, for one or more recipients, and returns it as a binary age file.
+// Any of the corresponding identities can recover it with UnwrapBytes, which
+// makes this multi-recipient envelope encryption for existing keys.
+//
+// The secret must be at least one byte and at most MaxWrappedSecretSize bytes.
+// Since the result is a regular age file, it can also be decrypted with
+// Decrypt or the age CLI.
+func WrapBytes(secret []byte, recipients ...Recipient) ([]byte, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("secret is empty")
+	}
+	if len(secret) > MaxWrappedSecretSize {
+		return nil, fmt.Errorf("secret is %d bytes, more than the maximum of %d", len(secret), MaxWrappedSecretSize)
+	}
+	return EncryptBytes(secret, recipients...)
+}
+
+// UnwrapBytes recovers a secret protected by WrapBytes with one of the
+// identities. Files with a payload larger than MaxWrappedSecretSize are
+// rejected without decrypting more than that.
+func UnwrapBytes(blob []byte, identities ...Identity) ([]byte, error) {
+	d := &Decryptor{MaxPayloadBytes: MaxWrappedSecretSize}
+	r, err := d.Decrypt(bytes.NewReader(blob), identities...)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap secret: %v", err)
+	}
+	if len(secret) == 0 {
+		return nil, errors.New("failed to unwrap secret: secret is empty")
+	}
+	return secret, nil
+}
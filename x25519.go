@@ -9,12 +9,14 @@ package age
 import (
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
 	"strings"
 
 	"filippo.io/age/internal/bech32"
+	"filippo.io/age/internal/bip39"
 	"filippo.io/age/internal/format"
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/curve25519"
@@ -63,9 +65,46 @@ func ParseX25519Recipient(s string) (*X25519Recipient, error) {
 	return r, nil
 }
 
+// X25519RecipientFromWireGuard returns a new X25519Recipient from a WireGuard
+// public key, which is a standard padded base64 encoding of a Curve25519 point.
+//
+// This allows encrypting to WireGuard peers without issuing age keys. The
+// corresponding X25519Identity can be obtained from the raw WireGuard private
+// key, which is a Curve25519 scalar in the same encoding.
+func X25519RecipientFromWireGuard(b64 string) (*X25519Recipient, error) {
+	k, err := base64.StdEncoding.Strict().DecodeString(b64)
+	if err != nil {
+		return nil, fmt.Errorf("malformed WireGuard public key: %v", err)
+	}
+	r, err := newX25519RecipientFromPoint(k)
+	if err != nil {
+		return nil, fmt.Errorf("malformed WireGuard public key: %v", err)
+	}
+	if isLowOrderPoint(r.theirPublicKey) {
+		return nil, errors.New("invalid WireGuard public key: low-order point")
+	}
+	return r, nil
+}
+
+// ErrLowOrderKey is returned when parsing an X25519 key whose public key is a
+// low-order point, with which every shared secret would be all zeroes.
+var ErrLowOrderKey = errors.New("X25519 public key is a low-order point")
+
+// isLowOrderPoint reports whether p is a low-order point. Multiplying a
+// low-order point by a clamped scalar produces the all-zero value, which X25519
+// rejects. Any valid scalar works for this check.
+func isLowOrderPoint(p []byte) bool {
+	_, err := curve25519.X25519(curve25519.Basepoint, p)
+	return err != nil
+}
+
 func (r *X25519Recipient) Wrap(fileKey []byte) ([]*Stanza, error) {
+	return r.wrapWithRand(fileKey, rand.Reader)
+}
+
+func (r *X25519Recipient) wrapWithRand(fileKey []byte, rand io.Reader) ([]*Stanza, error) {
 	ephemeral := make([]byte, curve25519.ScalarSize)
-	if _, err := rand.Read(ephemeral); err != nil {
+	if _, err := io.ReadFull(rand, ephemeral); err != nil {
 		return nil, err
 	}
 	ourPublicKey, err := curve25519.X25519(ephemeral, curve25519.Basepoint)
@@ -124,7 +163,17 @@ func newX25519IdentityFromScalar(secretKey []byte) (*X25519Identity, error) {
 		secretKey: make([]byte, curve25519.ScalarSize),
 	}
 	copy(i.secretKey, secretKey)
-	i.ourPublicKey, _ = curve25519.X25519(i.secretKey, curve25519.Basepoint)
+	ourPublicKey, err := curve25519.X25519(i.secretKey, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	// Clamping makes the public key of any scalar a point of prime order, so
+	// this can only fail due to a bug, but a low-order public key would
+	// silently make the identity insecure, so check anyway.
+	if isLowOrderPoint(ourPublicKey) {
+		return nil, ErrLowOrderKey
+	}
+	i.ourPublicKey = ourPublicKey
 	return i, nil
 }
 
@@ -196,6 +245,30 @@ func (i *X25519Identity) unwrap(block *Stanza) ([]byte, error) {
 	return fileKey, nil
 }
 
+// X25519IdentityToMnemonic returns a BIP-39 mnemonic of 24 english words that
+// encodes the secret key of id, for example to write it down as a backup. It
+// can be reversed with X25519IdentityFromMnemonic.
+//
+// The secret key is used directly as the BIP-39 entropy. The mnemonic is not
+// compatible with wallets that derive keys from the BIP-39 seed.
+func X25519IdentityToMnemonic(id *X25519Identity) (string, error) {
+	return bip39.Encode(id.secretKey)
+}
+
+// X25519IdentityFromMnemonic returns the X25519Identity encoded by a mnemonic
+// returned by X25519IdentityToMnemonic. It rejects phrases with unknown words
+// or an invalid checksum.
+func X25519IdentityFromMnemonic(phrase string) (*X25519Identity, error) {
+	k, err := bip39.Decode(phrase)
+	if err != nil {
+		return nil, err
+	}
+	if len(k) != curve25519.ScalarSize {
+		return nil, fmt.Errorf("invalid mnemonic: %d words, expected 24", len(strings.Fields(phrase)))
+	}
+	return newX25519IdentityFromScalar(k)
+}
+
 // Recipient returns the public X25519Recipient value corresponding to i.
 func (i *X25519Identity) Recipient() *X25519Recipient {
 	r := &X25519Recipient{}
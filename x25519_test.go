@@ -0,0 +1,51 @@
+// Copyright 2021 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package age
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestIsLowOrderPoint(t *testing.T) {
+	// The points of order 1, 2, 4, and 8, and their non-canonical encodings.
+	for _, p := range []string{
+		"0000000000000000000000000000000000000000000000000000000000000000",
+		"0100000000000000000000000000000000000000000000000000000000000000",
+		"e0eb7a7c3b41b8ae1656e3faf19fc46ada098deb9c32b1fd866205165f49b800",
+		"5f9c95bca3508c24b1d0b1559c83ef5b04445cc4581c8e86d8224eddd09f1157",
+		"ecffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff7f",
+		"edffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff7f",
+		"eeffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff7f",
+	} {
+		b, err := hex.DecodeString(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !isLowOrderPoint(b) {
+			t.Errorf("%s is not detected as a low-order point", p)
+		}
+	}
+
+	// Crafted scalars are clamped, so they still produce valid public keys.
+	for _, k := range []string{
+		"0000000000000000000000000000000000000000000000000000000000000000",
+		"ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff",
+	} {
+		b, err := hex.DecodeString(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		i, err := newX25519IdentityFromScalar(b)
+		if err != nil {
+			t.Fatalf("%s: %v", k, err)
+		}
+		if isLowOrderPoint(i.ourPublicKey) {
+			t.Errorf("%s: public key is a low-order point", k)
+		}
+	}
+}